@@ -46,7 +46,8 @@ func corsMiddleware(next http.Handler) http.Handler {
             w.Header().Set("Access-Control-Allow-Origin", origin)
         }
         w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+        w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, If-Match")
+        w.Header().Set("Access-Control-Expose-Headers", "ETag, Content-Disposition")
         w.Header().Set("Access-Control-Allow-Credentials", "true")
 
         // Handle preflight requests
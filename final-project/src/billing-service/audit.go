@@ -0,0 +1,527 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audited changes of a billing.
+const (
+    auditCreated    = "created"
+    auditUpdated    = "updated"
+    auditRemoved    = "removed"
+    auditInvoiced   = "invoiced"
+    auditReleased   = "released"
+    auditAnonymized = "anonymized"
+)
+
+// auditGenesis is the previous hash of the first entry.
+var auditGenesis = strings.Repeat("0", 64)
+
+// auditActor is who changed a billing: a user from the JWT, or a service.
+type auditActor struct {
+    ID   string
+    Role string
+}
+
+var (
+    taskServiceActor = auditActor{ID: "task-service", Role: "service"}
+    userServiceActor = auditActor{ID: "user-service", Role: "service"}
+)
+
+// requestActor is the user whose token authorized req. Requests task-service
+// makes with its secret have no token.
+func requestActor(req *http.Request) auditActor {
+    id, _ := req.Context().Value("userID").(string)
+    role, _ := req.Context().Value("role").(string)
+    if id == "" && req.Header.Get("X-Task-Service") != "" {
+        return taskServiceActor
+    }
+    if id == "" {
+        id = "unknown"
+    }
+    return auditActor{ID: id, Role: role}
+}
+
+// billingChange describes a change for the audit log; InvoiceID is set when a
+// billing is put on or taken off an invoice.
+type billingChange struct {
+    Action    string
+    Actor     auditActor
+    Reason    string
+    InvoiceID *primitive.ObjectID
+}
+
+// AuditEntry records one change of a billing: who made it, why, and the
+// billing before and after, as stored. Entries form a hash chain: each one's
+// Hash covers its fields, the digests of its snapshots and the Hash of the
+// entry before it, so changing, removing or reordering entries breaks the
+// chain. The log is append-only, except that the IDs of deleted users are
+// redacted from snapshots; the digests keep vouching for the original values.
+// Each snapshot's user has its own salted digest, so a billing moved from one
+// user to another can lose either user and still vouch for the other.
+type AuditEntry struct {
+    Sequence         int64               `bson:"_id" json:"sequence"`
+    BillingID        primitive.ObjectID  `bson:"billing_id" json:"billing_id"`
+    Action           string              `bson:"action" json:"action"`
+    Actor            string              `bson:"actor" json:"actor"`
+    ActorRole        string              `bson:"actor_role,omitempty" json:"actor_role,omitempty"`
+    Reason           string              `bson:"reason,omitempty" json:"reason,omitempty"`
+    InvoiceID        *primitive.ObjectID `bson:"invoice_id,omitempty" json:"invoice_id,omitempty"`
+    Before           bson.Raw            `bson:"before,omitempty" json:"-"`
+    After            bson.Raw            `bson:"after,omitempty" json:"-"`
+    BeforeDigest     string              `bson:"before_digest,omitempty" json:"before_digest,omitempty"`
+    AfterDigest      string              `bson:"after_digest,omitempty" json:"after_digest,omitempty"`
+    BeforeUserDigest string              `bson:"before_user_digest,omitempty" json:"before_user_digest,omitempty"`
+    AfterUserDigest  string              `bson:"after_user_digest,omitempty" json:"after_user_digest,omitempty"`
+    BeforeUserSalt   string              `bson:"before_user_salt,omitempty" json:"-"`
+    AfterUserSalt    string              `bson:"after_user_salt,omitempty" json:"-"`
+    At               time.Time           `bson:"at" json:"at"`
+    PrevHash         string              `bson:"prev_hash" json:"prev_hash"`
+    Hash             string              `bson:"hash" json:"hash"`
+    RedactedAt       *time.Time          `bson:"redacted_at,omitempty" json:"redacted_at,omitempty"`
+}
+
+// MarshalJSON writes the snapshots as billings.
+func (e AuditEntry) MarshalJSON() ([]byte, error) {
+    type entry AuditEntry
+    snapshot := func(raw bson.Raw) (*Billing, error) {
+        if len(raw) == 0 {
+            return nil, nil
+        }
+        var billing Billing
+        return &billing, bson.Unmarshal(raw, &billing)
+    }
+    before, err := snapshot(e.Before)
+    if err != nil {
+        return nil, err
+    }
+    after, err := snapshot(e.After)
+    if err != nil {
+        return nil, err
+    }
+    return json.Marshal(struct {
+        entry
+        Before *Billing `json:"before,omitempty"`
+        After  *Billing `json:"after,omitempty"`
+    }{entry(e), before, after})
+}
+
+// auditHead is the last entry of the chain, kept so that entries removed from
+// the end of the log are noticed too.
+type auditHead struct {
+    Sequence int64  `bson:"sequence"`
+    Hash     string `bson:"hash"`
+}
+
+func auditLog() *mongo.Collection {
+    return client.Database("billing").Collection("audit_log")
+}
+
+func auditHeads() *mongo.Collection {
+    return client.Database("billing").Collection("audit_head")
+}
+
+// ensureAuditLog creates the head of the chain if there is none yet and
+// indexes entries by billing.
+func ensureAuditLog() error {
+    _, err := auditHeads().UpdateOne(context.Background(), bson.M{"_id": "billings"},
+        bson.M{"$setOnInsert": bson.M{"sequence": 0, "hash": auditGenesis}}, options.Update().SetUpsert(true))
+    if err != nil {
+        return err
+    }
+    _, err = auditLog().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+        Keys: bson.D{{Key: "billing_id", Value: 1}, {Key: "_id", Value: 1}},
+    })
+    return err
+}
+
+// snapshotDigest is the digest of a snapshot with its user ID cleared, so
+// that it still holds once the user is redacted.
+func snapshotDigest(raw bson.Raw) (string, error) {
+    if len(raw) == 0 {
+        return "", nil
+    }
+    var doc bson.D
+    if err := bson.Unmarshal(raw, &doc); err != nil {
+        return "", err
+    }
+    for i := range doc {
+        if doc[i].Key == "user_id" {
+            doc[i].Value = primitive.NilObjectID
+        }
+    }
+    canonical, err := bson.Marshal(doc)
+    if err != nil {
+        return "", err
+    }
+    sum := sha256.Sum256(canonical)
+    return hex.EncodeToString(sum[:]), nil
+}
+
+// userDigest is the digest of the user ID in a snapshot, salted so that it
+// can't be traced back to the user once the salt is gone.
+func userDigest(salt string, raw bson.Raw) string {
+    userID := ""
+    if id, ok := raw.Lookup("user_id").ObjectIDOK(); ok {
+        userID = id.Hex()
+    }
+    sum := sha256.Sum256([]byte(salt + "|" + userID))
+    return hex.EncodeToString(sum[:])
+}
+
+// sealUser salts and digests the user of a snapshot, if there is one.
+func sealUser(raw bson.Raw) (digest, salt string, err error) {
+    if len(raw) == 0 {
+        return "", "", nil
+    }
+    random := make([]byte, 16)
+    if _, err := rand.Read(random); err != nil {
+        return "", "", err
+    }
+    salt = hex.EncodeToString(random)
+    return userDigest(salt, raw), salt, nil
+}
+
+// auditHash is the hash of entry, chained to the one before it.
+func auditHash(entry AuditEntry) string {
+    invoiceID := ""
+    if entry.InvoiceID != nil {
+        invoiceID = entry.InvoiceID.Hex()
+    }
+    fields, _ := json.Marshal([]string{
+        strconv.FormatInt(entry.Sequence, 10),
+        entry.BillingID.Hex(),
+        entry.Action,
+        entry.Actor,
+        entry.ActorRole,
+        entry.Reason,
+        invoiceID,
+        entry.BeforeDigest,
+        entry.AfterDigest,
+        entry.BeforeUserDigest,
+        entry.AfterUserDigest,
+        entry.At.UTC().Format(time.RFC3339Nano),
+        entry.PrevHash,
+    })
+    sum := sha256.Sum256(fields)
+    return hex.EncodeToString(sum[:])
+}
+
+// sealAuditEntry makes entry the one after head and returns the new head. At
+// is cut to milliseconds, as MongoDB stores it.
+func sealAuditEntry(entry *AuditEntry, head auditHead) (auditHead, error) {
+    entry.Sequence = head.Sequence + 1
+    entry.PrevHash = head.Hash
+    entry.At = entry.At.UTC().Truncate(time.Millisecond)
+    var err error
+    if entry.BeforeDigest, err = snapshotDigest(entry.Before); err != nil {
+        return head, err
+    }
+    if entry.AfterDigest, err = snapshotDigest(entry.After); err != nil {
+        return head, err
+    }
+    if entry.BeforeUserDigest, entry.BeforeUserSalt, err = sealUser(entry.Before); err != nil {
+        return head, err
+    }
+    if entry.AfterUserDigest, entry.AfterUserSalt, err = sealUser(entry.After); err != nil {
+        return head, err
+    }
+    entry.Hash = auditHash(*entry)
+    return auditHead{Sequence: entry.Sequence, Hash: entry.Hash}, nil
+}
+
+// recordBillingChange appends change of a billing from before to after to the
+// audit log; before is nil for a new billing. It must run in the transaction
+// making the change, which also serializes concurrent appends: they all move
+// the head of the chain.
+func recordBillingChange(ctx mongo.SessionContext, change billingChange, before, after *Billing) error {
+    entry := AuditEntry{
+        Action:    change.Action,
+        Actor:     change.Actor.ID,
+        ActorRole: change.Actor.Role,
+        Reason:    change.Reason,
+        InvoiceID: change.InvoiceID,
+        At:        time.Now(),
+    }
+    for _, snapshot := range []struct {
+        billing *Billing
+        raw     *bson.Raw
+    }{{before, &entry.Before}, {after, &entry.After}} {
+        if snapshot.billing == nil {
+            continue
+        }
+        entry.BillingID = snapshot.billing.ID
+        raw, err := bson.Marshal(snapshot.billing)
+        if err != nil {
+            return err
+        }
+        *snapshot.raw = raw
+    }
+
+    var head auditHead
+    if err := auditHeads().FindOne(ctx, bson.M{"_id": "billings"}).Decode(&head); err != nil {
+        return fmt.Errorf("reading audit head: %w", err)
+    }
+    next, err := sealAuditEntry(&entry, head)
+    if err != nil {
+        return err
+    }
+    if _, err := auditLog().InsertOne(ctx, entry); err != nil {
+        return err
+    }
+    result, err := auditHeads().UpdateOne(ctx, bson.M{"_id": "billings", "sequence": head.Sequence},
+        bson.M{"$set": bson.M{"sequence": next.Sequence, "hash": next.Hash}})
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return fmt.Errorf("audit head moved past %d", head.Sequence)
+    }
+    return nil
+}
+
+// mutateBilling applies update to the billing matching filter and records the
+// change. It reports false, without error, when no billing matches.
+func mutateBilling(ctx mongo.SessionContext, filter, update bson.M, change billingChange) (Billing, bool, error) {
+    collection := client.Database("billing").Collection("billings")
+    var before, after Billing
+    err := collection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&before)
+    if err == mongo.ErrNoDocuments {
+        return after, false, nil
+    }
+    if err != nil {
+        return after, false, err
+    }
+    if err := collection.FindOne(ctx, bson.M{"_id": before.ID}).Decode(&after); err != nil {
+        return after, false, err
+    }
+    return after, true, recordBillingChange(ctx, change, &before, &after)
+}
+
+// redactAuditUser removes a deleted user's ID from the snapshots in the audit
+// log, as handleUserDeleted does from billings, and the salts that tie those
+// snapshots' user digests to it. Other users in the same entries keep theirs.
+func redactAuditUser(ctx mongo.SessionContext, userID primitive.ObjectID) (int64, error) {
+    redacted, err := auditLog().CountDocuments(ctx, bson.M{"$or": bson.A{bson.M{"before.user_id": userID}, bson.M{"after.user_id": userID}}})
+    if err != nil || redacted == 0 {
+        return 0, err
+    }
+    now := time.Now().UTC()
+    for _, snapshot := range []string{"before", "after"} {
+        _, err := auditLog().UpdateMany(ctx, bson.M{snapshot + ".user_id": userID},
+            bson.M{"$set": bson.M{snapshot + ".user_id": primitive.NilObjectID, "redacted_at": now}, "$unset": bson.M{snapshot + "_user_salt": ""}})
+        if err != nil {
+            return 0, err
+        }
+    }
+    return redacted, nil
+}
+
+// auditVerification is the result of checking the audit chain. BrokenAt is the
+// first entry that doesn't check out, with the Problem found.
+type auditVerification struct {
+    Valid    bool   `json:"valid"`
+    Entries  int64  `json:"entries"`
+    Redacted int64  `json:"redacted"`
+    Head     int64  `json:"head"`
+    BrokenAt int64  `json:"broken_at,omitempty"`
+    Problem  string `json:"problem,omitempty"`
+}
+
+// chainVerifier checks audit entries one by one, in order of sequence.
+type chainVerifier struct {
+    result auditVerification
+    last   auditHead
+}
+
+func newChainVerifier() *chainVerifier {
+    return &chainVerifier{result: auditVerification{Valid: true}, last: auditHead{Hash: auditGenesis}}
+}
+
+// check checks the next entry and reports whether the chain still holds.
+// Snapshots are checked on every entry; only redacted user IDs, which no
+// longer have a salt, can't be.
+func (v *chainVerifier) check(entry AuditEntry) bool {
+    beforeDigest, beforeErr := snapshotDigest(entry.Before)
+    afterDigest, afterErr := snapshotDigest(entry.After)
+    redacted := entry.RedactedAt != nil
+    userProblem := checkUser(entry.Before, entry.BeforeUserSalt, entry.BeforeUserDigest, redacted)
+    if userProblem == "" {
+        userProblem = checkUser(entry.After, entry.AfterUserSalt, entry.AfterUserDigest, redacted)
+    }
+    problem := ""
+    switch {
+    case entry.Sequence != v.last.Sequence+1:
+        problem = fmt.Sprintf("expected entry %d", v.last.Sequence+1)
+    case entry.PrevHash != v.last.Hash:
+        problem = fmt.Sprintf("does not follow entry %d", v.last.Sequence)
+    case beforeErr != nil || afterErr != nil || beforeDigest != entry.BeforeDigest || afterDigest != entry.AfterDigest:
+        problem = "before or after values were changed"
+    case userProblem != "":
+        problem = userProblem
+    case auditHash(entry) != entry.Hash:
+        problem = "entry was changed"
+    }
+    if problem != "" {
+        v.result.Valid, v.result.BrokenAt, v.result.Problem = false, entry.Sequence, problem
+        return false
+    }
+    v.result.Entries++
+    if entry.RedactedAt != nil {
+        v.result.Redacted++
+    }
+    v.last = auditHead{Sequence: entry.Sequence, Hash: entry.Hash}
+    return true
+}
+
+// checkUser checks the user of one snapshot against its digest and returns
+// the problem found, if any.
+func checkUser(raw bson.Raw, salt, digest string, redacted bool) string {
+    switch {
+    case len(raw) == 0:
+        return ""
+    case salt == "" && !redacted:
+        return "user was removed without redaction"
+    case salt == "" && hasUser(raw):
+        return "redacted entry names a user"
+    case salt != "" && userDigest(salt, raw) != digest:
+        return "user was changed"
+    }
+    return ""
+}
+
+// hasUser reports whether a snapshot still names a user.
+func hasUser(raw bson.Raw) bool {
+    if len(raw) == 0 {
+        return false
+    }
+    id, ok := raw.Lookup("user_id").ObjectIDOK()
+    return ok && !id.IsZero()
+}
+
+// finish compares the last entry checked with the head of the chain.
+func (v *chainVerifier) finish(head auditHead) auditVerification {
+    v.result.Head = head.Sequence
+    if v.result.Valid && v.last != head {
+        v.result.Valid, v.result.BrokenAt = false, v.last.Sequence+1
+        v.result.Problem = fmt.Sprintf("log ends at entry %d but its head is entry %d", v.last.Sequence, head.Sequence)
+    }
+    return v.result
+}
+
+// verifyAudit checks the whole audit chain, from the first entry to the head.
+func verifyAudit(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to verify audit log")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var head auditHead
+    if err := auditHeads().FindOne(context.TODO(), bson.M{"_id": "billings"}).Decode(&head); err != nil {
+        http.Error(w, "Failed to read audit head", http.StatusInternalServerError)
+        return
+    }
+    cursor, err := auditLog().Find(context.TODO(), bson.M{"_id": bson.M{"$lte": head.Sequence}}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+    if err != nil {
+        http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+        return
+    }
+    defer cursor.Close(context.TODO())
+
+    verifier := newChainVerifier()
+    for cursor.Next(context.TODO()) {
+        var entry AuditEntry
+        if err := cursor.Decode(&entry); err != nil {
+            http.Error(w, "Failed to decode audit entry", http.StatusInternalServerError)
+            return
+        }
+        if !verifier.check(entry) {
+            break
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+        return
+    }
+    result := verifier.finish(head)
+    if !result.Valid {
+        log.Printf("Audit log is broken at entry %d: %s", result.BrokenAt, result.Problem)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// listAudit lists audit entries in order, optionally of a billing_id, an actor
+// or an action. Pages hold limit entries (default 100, at most 1000); the next
+// page starts after the sequence of the last entry.
+func listAudit(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to list audit log")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := req.URL.Query()
+    filter := bson.M{}
+    if value := query.Get("billing_id"); value != "" {
+        id, err := primitive.ObjectIDFromHex(value)
+        if err != nil {
+            http.Error(w, "Invalid billing_id", http.StatusBadRequest)
+            return
+        }
+        filter["billing_id"] = id
+    }
+    for _, key := range []string{"actor", "action"} {
+        if value := query.Get(key); value != "" {
+            filter[key] = value
+        }
+    }
+    if value := query.Get("after"); value != "" {
+        after, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            http.Error(w, "Invalid after", http.StatusBadRequest)
+            return
+        }
+        filter["_id"] = bson.M{"$gt": after}
+    }
+    limit := int64(100)
+    if value := query.Get("limit"); value != "" {
+        n, err := strconv.ParseInt(value, 10, 64)
+        if err != nil || n < 1 || n > 1000 {
+            http.Error(w, "limit must be from 1 to 1000", http.StatusBadRequest)
+            return
+        }
+        limit = n
+    }
+
+    cursor, err := auditLog().Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit))
+    if err != nil {
+        http.Error(w, "Failed to list audit log", http.StatusInternalServerError)
+        return
+    }
+    entries := []AuditEntry{}
+    if err := cursor.All(context.TODO(), &entries); err != nil {
+        http.Error(w, "Failed to decode audit log", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(entries)
+}
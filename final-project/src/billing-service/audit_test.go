@@ -0,0 +1,238 @@
+package main
+
+import (
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func testAuditChain(t *testing.T) ([]AuditEntry, auditHead) {
+    billing := Billing{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID(), Hours: 2, Currency: "USD", Amount: 20000, Version: 1}
+    snapshot := func(b Billing) bson.Raw {
+        raw, err := bson.Marshal(b)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return raw
+    }
+
+    created := snapshot(billing)
+    billing.Hours, billing.Amount, billing.Version = 3, 30000, 2
+    updated := snapshot(billing)
+    billing.Version = 3
+    removed := snapshot(billing)
+
+    at := time.Date(2024, 3, 1, 9, 0, 0, 123456789, time.UTC)
+    entries := []AuditEntry{
+        {BillingID: billing.ID, Action: auditCreated, Actor: "admin", ActorRole: "admin", After: created, At: at},
+        {BillingID: billing.ID, Action: auditUpdated, Actor: "admin", ActorRole: "admin", Reason: "typo in hours", Before: created, After: updated, At: at.Add(time.Hour)},
+        {BillingID: billing.ID, Action: auditRemoved, Actor: "admin", ActorRole: "admin", Before: updated, After: removed, At: at.Add(2 * time.Hour)},
+    }
+    head := auditHead{Hash: auditGenesis}
+    for i := range entries {
+        var err error
+        if head, err = sealAuditEntry(&entries[i], head); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return entries, head
+}
+
+func verifyEntries(entries []AuditEntry, head auditHead) auditVerification {
+    v := newChainVerifier()
+    for _, entry := range entries {
+        if !v.check(entry) {
+            break
+        }
+    }
+    return v.finish(head)
+}
+
+func TestSealAuditEntry(t *testing.T) {
+    entries, head := testAuditChain(t)
+    if entries[0].Sequence != 1 || entries[0].PrevHash != auditGenesis || entries[0].BeforeDigest != "" {
+        t.Errorf("First entry: %+v", entries[0])
+    }
+    if entries[1].PrevHash != entries[0].Hash || entries[2].PrevHash != entries[1].Hash {
+        t.Errorf("Entries are not chained")
+    }
+    if head.Sequence != 3 || head.Hash != entries[2].Hash {
+        t.Errorf("Want head at entry 3, Got %+v", head)
+    }
+    if entries[0].At.Nanosecond() != 123000000 {
+        t.Errorf("Want the time in milliseconds, Got %v", entries[0].At)
+    }
+    if auditHash(entries[1]) != entries[1].Hash {
+        t.Errorf("Hash is not reproducible")
+    }
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+    entries, head := testAuditChain(t)
+    if result := verifyEntries(entries, head); !result.Valid || result.Entries != 3 {
+        t.Fatalf("Want a valid chain of 3, Got %+v", result)
+    }
+
+    tests := map[string]struct {
+        tamper   func(entries []AuditEntry, head auditHead) ([]AuditEntry, auditHead)
+        brokenAt int64
+        problem  string
+    }{
+        "changed reason": {func(e []AuditEntry, h auditHead) ([]AuditEntry, auditHead) {
+            e[1].Reason = "approved"
+            return e, h
+        }, 2, "entry was changed"},
+        "changed actor": {func(e []AuditEntry, h auditHead) ([]AuditEntry, auditHead) {
+            e[2].Actor = "someone"
+            return e, h
+        }, 3, "entry was changed"},
+        "changed values": {func(e []AuditEntry, h auditHead) ([]AuditEntry, auditHead) {
+            e[1].After = e[0].After
+            return e, h
+        }, 2, "before or after values were changed"},
+        "removed entry": {func(e []AuditEntry, h auditHead) ([]AuditEntry, auditHead) {
+            return append(e[:1:1], e[2]), h
+        }, 3, "expected entry 2"},
+        "rehashed entry": {func(e []AuditEntry, h auditHead) ([]AuditEntry, auditHead) {
+            e[1].Reason = "approved"
+            e[1].Hash = auditHash(e[1])
+            return e, h
+        }, 3, "does not follow entry 2"},
+        "truncated log": {func(e []AuditEntry, h auditHead) ([]AuditEntry, auditHead) {
+            return e[:2], h
+        }, 3, "log ends at entry 2 but its head is entry 3"},
+    }
+    for name, tc := range tests {
+        entries, head := testAuditChain(t)
+        result := verifyEntries(tc.tamper(entries, head))
+        if result.Valid || result.BrokenAt != tc.brokenAt || result.Problem != tc.problem {
+            t.Errorf("%s: Want broken at %d (%s), Got %+v", name, tc.brokenAt, tc.problem, result)
+        }
+    }
+}
+
+// redactUser clears userID from an entry's snapshots as redactAuditUser does,
+// after change has been applied to the after snapshot.
+func redactUser(t *testing.T, entry *AuditEntry, userID primitive.ObjectID, change func(*Billing)) {
+    snapshots := []struct {
+        raw  *bson.Raw
+        salt *string
+    }{{&entry.Before, &entry.BeforeUserSalt}, {&entry.After, &entry.AfterUserSalt}}
+    for _, snapshot := range snapshots {
+        if len(*snapshot.raw) == 0 {
+            continue
+        }
+        var billing Billing
+        if err := bson.Unmarshal(*snapshot.raw, &billing); err != nil {
+            t.Fatal(err)
+        }
+        if billing.UserID == userID {
+            billing.UserID = primitive.NilObjectID
+            *snapshot.salt = ""
+        }
+        if snapshot.raw == &entry.After && change != nil {
+            change(&billing)
+        }
+        var err error
+        if *snapshot.raw, err = bson.Marshal(billing); err != nil {
+            t.Fatal(err)
+        }
+    }
+    redactedAt := time.Now()
+    entry.RedactedAt = &redactedAt
+}
+
+// redact clears the user of an entry whose snapshots all name the same user.
+func redact(t *testing.T, entry *AuditEntry, change func(*Billing)) {
+    userID, _ := entry.Before.Lookup("user_id").ObjectIDOK()
+    redactUser(t, entry, userID, change)
+}
+
+func TestVerifyRedactedAuditEntry(t *testing.T) {
+    entries, head := testAuditChain(t)
+    redact(t, &entries[1], nil)
+    if result := verifyEntries(entries, head); !result.Valid || result.Redacted != 1 {
+        t.Errorf("Want a valid chain with a redacted entry, Got %+v", result)
+    }
+
+    tests := map[string]struct {
+        tamper  func(entry *AuditEntry)
+        problem string
+    }{
+        "changed user": {func(e *AuditEntry) {
+            var billing Billing
+            bson.Unmarshal(e.After, &billing)
+            billing.UserID = primitive.NewObjectID()
+            e.After, _ = bson.Marshal(billing)
+        }, "user was changed"},
+        "user cleared without redaction": {func(e *AuditEntry) {
+            redact(t, e, nil)
+            e.RedactedAt = nil
+        }, "user was removed without redaction"},
+        "changed values of a redacted entry": {func(e *AuditEntry) {
+            redact(t, e, func(b *Billing) { b.Amount = 1 })
+        }, "before or after values were changed"},
+        "redacted entry given another user": {func(e *AuditEntry) {
+            redact(t, e, func(b *Billing) { b.UserID = primitive.NewObjectID() })
+        }, "redacted entry names a user"},
+        "changed user digest of a redacted entry": {func(e *AuditEntry) {
+            redact(t, e, nil)
+            e.AfterUserDigest = userDigest("", e.After)
+        }, "entry was changed"},
+    }
+    for name, tc := range tests {
+        entries, head := testAuditChain(t)
+        tc.tamper(&entries[1])
+        result := verifyEntries(entries, head)
+        if result.Valid || result.BrokenAt != 2 || result.Problem != tc.problem {
+            t.Errorf("%s: Want broken at 2 (%s), Got %+v", name, tc.problem, result)
+        }
+    }
+}
+
+func TestVerifyReassignedAuditEntry(t *testing.T) {
+    first, second := primitive.NewObjectID(), primitive.NewObjectID()
+    billing := Billing{ID: primitive.NewObjectID(), UserID: first, Hours: 2, Currency: "USD", Amount: 20000, Version: 1}
+    created, _ := bson.Marshal(billing)
+    billing.UserID, billing.Version = second, 2
+    reassigned, _ := bson.Marshal(billing)
+
+    chain := func() ([]AuditEntry, auditHead) {
+        entries := []AuditEntry{
+            {BillingID: billing.ID, Action: auditCreated, Actor: "admin", After: created, At: time.Now()},
+            {BillingID: billing.ID, Action: auditUpdated, Actor: "admin", Before: created, After: reassigned, At: time.Now()},
+        }
+        head := auditHead{Hash: auditGenesis}
+        for i := range entries {
+            var err error
+            if head, err = sealAuditEntry(&entries[i], head); err != nil {
+                t.Fatal(err)
+            }
+        }
+        return entries, head
+    }
+
+    entries, head := chain()
+    for i := range entries {
+        redactUser(t, &entries[i], first, nil)
+    }
+    if result := verifyEntries(entries, head); !result.Valid || result.Redacted != 2 {
+        t.Errorf("Want a valid chain once the first user is deleted, Got %+v", result)
+    }
+    if entries[1].AfterUserSalt == "" || !hasUser(entries[1].After) {
+        t.Errorf("The second user should keep their salt, Got %+v", entries[1])
+    }
+
+    redactUser(t, &entries[1], second, nil)
+    if result := verifyEntries(entries, head); !result.Valid {
+        t.Errorf("Want a valid chain once both users are deleted, Got %+v", result)
+    }
+
+    entries, head = chain()
+    redactUser(t, &entries[1], first, func(b *Billing) { b.UserID = primitive.NewObjectID() })
+    if result := verifyEntries(entries, head); result.Valid || result.BrokenAt != 2 || result.Problem != "user was changed" {
+        t.Errorf("Want the remaining user checked, Got %+v", result)
+    }
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
     "go.mongodb.org/mongo-driver/bson"
@@ -18,7 +20,7 @@ var client *mongo.Client
 func main() {
     // Create a new MongoDB client
     var err error
-    client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://billing-mongodb:27017"))
+    client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://billing-mongodb:27017/?replicaSet=rs0"))
     if err != nil {
         log.Fatal(err)
     }
@@ -37,6 +39,59 @@ func main() {
     if err != nil {
         log.Fatal(err)
     }
+    err = ensureIdempotencyIndex()
+    if err != nil {
+        log.Fatal(err)
+    }
+    err = migrateMoney()
+    if err != nil {
+        log.Fatal(err)
+    }
+    err = ensureInvoiceIndexes()
+    if err != nil {
+        log.Fatal(err)
+    }
+    err = migrateInvoiceTaxes()
+    if err != nil {
+        log.Fatal(err)
+    }
+    err = ensurePaymentIndexes()
+    if err != nil {
+        log.Fatal(err)
+    }
+    err = ensureAuditLog()
+    if err != nil {
+        log.Fatal(err)
+    }
+    err = ensureBudgetIndexes()
+    if err != nil {
+        log.Fatal(err)
+    }
+    go runOverdueSweep()
+
+    users, tasks = newLookupClients()
+
+    provider, err = newPaymentProvider()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // Invoice tasks when task-service reports them completed or asks for an invoice
+    bus, err = newEventBus("billing-service")
+    if err != nil {
+        log.Fatal(err)
+    }
+    defer bus.Close()
+    for _, eventType := range []string{eventTaskCompleted, eventInvoiceRequested} {
+        err = bus.Subscribe(eventType, handleTaskInvoice)
+        if err != nil {
+            log.Fatal(err)
+        }
+    }
+    err = bus.Subscribe(eventUserDeleted, handleUserDeleted)
+    if err != nil {
+        log.Fatal(err)
+    }
 
     // Create a new HTTP server
     mux := http.NewServeMux()
@@ -50,7 +105,49 @@ mux.Handle("/billings/remove/", authMiddleware(adminMiddleware(http.HandlerFunc(
 mux.Handle("/billings/removeAllBillings", http.HandlerFunc(removeAllBillings))
 mux.Handle("/billings/listByUserID", authMiddleware(adminMiddleware(http.HandlerFunc(listBillingsUserID))))
 mux.Handle("/billings/createForTaskService", taskServiceAuthMiddleware(http.HandlerFunc(createBilling)))
-
+mux.Handle("/billings/rates/create", authMiddleware(adminMiddleware(http.HandlerFunc(createRateCard))))
+mux.Handle("/billings/rates/list", authMiddleware(adminMiddleware(http.HandlerFunc(listRateCards))))
+mux.Handle("/billings/rates/remove/", authMiddleware(adminMiddleware(http.HandlerFunc(removeRateCard))))
+mux.Handle("/billings/rates/resolve", authMiddleware(adminMiddleware(http.HandlerFunc(resolveRateCard))))
+mux.Handle("/billings/invoices/create", authMiddleware(adminMiddleware(http.HandlerFunc(createInvoice))))
+mux.Handle("/billings/invoices/list", authMiddleware(adminMiddleware(http.HandlerFunc(listInvoices))))
+mux.Handle("/billings/invoices/get/", authMiddleware(adminMiddleware(http.HandlerFunc(getInvoice))))
+mux.Handle("/billings/invoices/update/", authMiddleware(adminMiddleware(http.HandlerFunc(updateInvoice))))
+mux.Handle("/billings/invoices/status/", authMiddleware(adminMiddleware(http.HandlerFunc(setInvoiceStatus))))
+mux.Handle("/billings/invoices/credit/", authMiddleware(adminMiddleware(http.HandlerFunc(creditInvoice))))
+mux.Handle("/billings/invoices/remove/", authMiddleware(adminMiddleware(http.HandlerFunc(removeInvoice))))
+mux.Handle("/billings/invoices/paylink/", authMiddleware(adminMiddleware(http.HandlerFunc(createPaymentLink))))
+mux.Handle("/billings/taxes/rules/create", authMiddleware(adminMiddleware(http.HandlerFunc(createTaxRule))))
+mux.Handle("/billings/taxes/rules/list", authMiddleware(adminMiddleware(http.HandlerFunc(listTaxRules))))
+mux.Handle("/billings/taxes/rules/remove/", authMiddleware(adminMiddleware(http.HandlerFunc(removeTaxRule))))
+mux.Handle("/billings/taxes/customers/", authMiddleware(adminMiddleware(http.HandlerFunc(taxProfileHandler))))
+mux.Handle("/billings/taxes/report", authMiddleware(adminMiddleware(http.HandlerFunc(taxReport))))
+mux.Handle("/billings/payments/create", authMiddleware(adminMiddleware(http.HandlerFunc(createPayment))))
+mux.Handle("/billings/payments/list", authMiddleware(adminMiddleware(http.HandlerFunc(listPayments))))
+mux.Handle("/billings/payments/get/", authMiddleware(adminMiddleware(http.HandlerFunc(getPayment))))
+mux.Handle("/billings/payments/apply/", authMiddleware(adminMiddleware(http.HandlerFunc(applyPaymentCredit))))
+mux.Handle("/billings/payments/void/", authMiddleware(adminMiddleware(http.HandlerFunc(voidPayment))))
+mux.Handle("/billings/payments/outstanding", authMiddleware(adminMiddleware(http.HandlerFunc(outstandingBalances))))
+mux.Handle("/billings/payments/aging", authMiddleware(adminMiddleware(http.HandlerFunc(agingReport))))
+mux.Handle("/billings/payments/webhook", http.HandlerFunc(paymentWebhook))
+mux.Handle("/billings/reports/revenue", authMiddleware(adminMiddleware(http.HandlerFunc(revenueReport))))
+mux.Handle("/billings/reports/users", authMiddleware(adminMiddleware(http.HandlerFunc(userReport))))
+mux.Handle("/billings/reports/tasks", authMiddleware(adminMiddleware(http.HandlerFunc(taskReport))))
+mux.Handle("/billings/reports/hours", authMiddleware(adminMiddleware(http.HandlerFunc(hoursReport))))
+mux.Handle("/billings/reports/compare", authMiddleware(adminMiddleware(http.HandlerFunc(compareReport))))
+mux.Handle("/billings/audit/list", authMiddleware(adminMiddleware(http.HandlerFunc(listAudit))))
+mux.Handle("/billings/audit/verify", authMiddleware(adminMiddleware(http.HandlerFunc(verifyAudit))))
+mux.Handle("/billings/budgets/create", authMiddleware(adminMiddleware(http.HandlerFunc(createBudget))))
+mux.Handle("/billings/budgets/list", authMiddleware(adminMiddleware(http.HandlerFunc(listBudgets))))
+mux.Handle("/billings/budgets/get/", authMiddleware(adminMiddleware(http.HandlerFunc(getBudget))))
+mux.Handle("/billings/budgets/update/", authMiddleware(adminMiddleware(http.HandlerFunc(updateBudget))))
+mux.Handle("/billings/budgets/remove/", authMiddleware(adminMiddleware(http.HandlerFunc(removeBudget))))
+mux.Handle("/billings/budgets/check", taskServiceAuthMiddleware(http.HandlerFunc(checkBudgets)))
+mux.Handle("/billings/budgets/hard", taskServiceAuthMiddleware(http.HandlerFunc(listHardBudgetTasks)))
+mux.Handle("/billings/branding/", authMiddleware(adminMiddleware(http.HandlerFunc(brandingHandler))))
+mux.Handle("/billings/", authMiddleware(adminMiddleware(http.HandlerFunc(invoiceDocument))))
+
+    go runBudgetSweep()
 
     // Start the server
     log.Println("Billing Service listening on port 8003...")
@@ -115,8 +212,86 @@ type Billing struct {
 	UserID primitive.ObjectID `bson:"user_id" json:"user_id"`
 	TaskID primitive.ObjectID `bson:"task_id" json:"task_id"`
 	Hours  float64             `bson:"hours" json:"hours"`
-        HourlyRate *float64           `bson:"hourly_rate,omitempty" json:"hourly_rate,omitempty"`
-	Amount float64             `bson:"amount" json:"amount"`
+        // Currency is the ISO 4217 code of HourlyRate and Amount
+        Currency string            `bson:"currency" json:"currency"`
+        HourlyRate *Money          `bson:"hourly_rate_minor,omitempty" json:"-"`
+        // RateSource says where HourlyRate came from: a rate card (RateCardID), the
+        // default rate or the request
+        RateSource string          `bson:"rate_source,omitempty" json:"rate_source,omitempty"`
+        RateCardID *primitive.ObjectID `bson:"rate_card_id,omitempty" json:"rate_card_id,omitempty"`
+        // InvoiceID is the invoice the billing is on, if any
+        InvoiceID *primitive.ObjectID `bson:"invoice_id,omitempty" json:"invoice_id,omitempty"`
+	Amount Money               `bson:"amount_minor" json:"-"`
+        Version int64              `bson:"version" json:"version"`
+        IdempotencyKey string      `bson:"idempotency_key,omitempty" json:"idempotency_key,omitempty"`
+        // AnonymizedAt is when the billing's user was deleted and UserID cleared
+        AnonymizedAt *time.Time    `bson:"anonymized_at,omitempty" json:"anonymized_at,omitempty"`
+        // DeletedAt is when the billing was removed; removed billings are kept for the audit log
+        DeletedAt *time.Time       `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+        // OverBudget lists the hard budgets the billing was found to exceed once it was created
+        OverBudget []primitive.ObjectID `bson:"over_budget,omitempty" json:"over_budget,omitempty"`
+}
+
+// notDeleted matches the billings that haven't been removed.
+var notDeleted = bson.M{"$exists": false}
+
+// softDelete is the update removing a billing.
+func softDelete() bson.M {
+    return bson.M{"$set": bson.M{"deleted_at": time.Now().UTC()}, "$inc": bson.M{"version": 1}}
+}
+
+var errBillingModified = errors.New("billing has been modified")
+
+// MarshalJSON writes HourlyRate and Amount as decimals in the billing's currency,
+// e.g. "150.00", so clients never see them as floats.
+func (b Billing) MarshalJSON() ([]byte, error) {
+    type billing Billing
+    out := struct {
+        billing
+        HourlyRate string `json:"hourly_rate,omitempty"`
+        Amount     string `json:"amount"`
+    }{billing: billing(b), Amount: b.Amount.Format(b.Currency)}
+    if b.HourlyRate != nil {
+        out.HourlyRate = b.HourlyRate.Format(b.Currency)
+    }
+    return json.Marshal(out)
+}
+
+// billingInput is the body of a create or update request. The hourly rate and
+// amount are decimals in the billing's currency, sent as a JSON number or string.
+type billingInput struct {
+    UserID     *primitive.ObjectID `json:"user_id"`
+    TaskID     *primitive.ObjectID `json:"task_id"`
+    Hours      *float64            `json:"hours"`
+    Currency   *string             `json:"currency"`
+    HourlyRate *json.Number        `json:"hourly_rate"`
+    Amount     *json.Number        `json:"amount"`
+    // Reason says why the billing is created or changed, for the audit log
+    Reason     string              `json:"reason"`
+}
+
+// money validates the input's hours and parses its rate and amount in currency.
+func (input billingInput) money(currency string) (rate, amount *Money, errs ValidationError) {
+    if input.Hours != nil && *input.Hours < 0 {
+        errs = append(errs, FieldError{Field: "hours", Code: "invalid_value", Message: "must not be negative"})
+    }
+    parse := func(field string, value *json.Number) *Money {
+        if value == nil {
+            return nil
+        }
+        m, err := parseMoney(value.String(), currency)
+        if err == nil && m < 0 {
+            err = errors.New("must not be negative")
+        }
+        if err != nil {
+            errs = append(errs, FieldError{Field: field, Code: "invalid_value", Message: err.Error()})
+            return nil
+        }
+        return &m
+    }
+    rate = parse("hourly_rate", input.HourlyRate)
+    amount = parse("amount", input.Amount)
+    return rate, amount, errs
 }
 
 func createBilling(w http.ResponseWriter, req *http.Request) {
@@ -127,28 +302,84 @@ func createBilling(w http.ResponseWriter, req *http.Request) {
         return
     }
 
-    var billing Billing
-    err := json.NewDecoder(req.Body).Decode(&billing)
+    var input billingInput
+    err := json.NewDecoder(req.Body).Decode(&input)
     if err != nil {
         http.Error(w, "Invalid request body", http.StatusBadRequest)
         return
     }
 
-    defaultRate := 100.0
+    // Without a currency the billing takes its rate card's, or the default one
+    var billing Billing
+    currency := defaultCurrency()
+    if input.Currency != nil {
+        billing.Currency = strings.ToUpper(*input.Currency)
+        currency = billing.Currency
+    }
+    if input.Hours != nil {
+        billing.Hours = *input.Hours
+    }
+
+    // A billing is for an existing user and task
+    var validationErrs ValidationError
+    if input.UserID == nil || input.UserID.IsZero() {
+        validationErrs = append(validationErrs, FieldError{Field: "user_id", Code: "required", Message: "is required"})
+    } else {
+        billing.UserID = *input.UserID
+    }
+    if input.TaskID == nil || input.TaskID.IsZero() {
+        validationErrs = append(validationErrs, FieldError{Field: "task_id", Code: "required", Message: "is required"})
+    } else {
+        billing.TaskID = *input.TaskID
+    }
+    if !validCurrency(currency) {
+        validationErrs = append(validationErrs, FieldError{Field: "currency", Code: "invalid_value", Message: "must be a supported ISO 4217 currency code"})
+    } else {
+        // The amount is always computed from the hours and rate
+        input.Amount = nil
+        var moneyErrs ValidationError
+        billing.HourlyRate, _, moneyErrs = input.money(currency)
+        validationErrs = append(validationErrs, moneyErrs...)
+        if billing.HourlyRate != nil {
+            billing.Currency = currency
+        }
+    }
+    if len(validationErrs) == 0 {
+        validationErrs, err = checkReferences(req.Context(), &billing.UserID, &billing.TaskID)
+        if err != nil {
+            http.Error(w, "Failed to validate billing: "+err.Error(), http.StatusServiceUnavailable)
+            return
+        }
+    }
+    if len(validationErrs) > 0 {
+        writeValidationError(w, validationErrs)
+        return
+    }
+
+    // A billing without a rate gets the one of the rate card for its user and task
+    var rc rateContext
     if billing.HourlyRate == nil {
-        billing.HourlyRate = &defaultRate
+        if rc, err = taskRateContext(req.Context(), billing.UserID, billing.TaskID); err != nil {
+            http.Error(w, "Failed to resolve rate: "+err.Error(), http.StatusServiceUnavailable)
+            return
+        }
     }
-    billing.Amount = billing.Hours * *billing.HourlyRate
 
-    collection := client.Database("billing").Collection("billings")
-    billing.ID = primitive.NewObjectID()
-    _, err = collection.InsertOne(context.TODO(), billing)
+    // A retried request returns the billing created the first time
+    billing.IdempotencyKey = req.Header.Get("Idempotency-Key")
+    billing, err = insertBilling(req.Context(), billing, rc, billingChange{Action: auditCreated, Actor: requestActor(req), Reason: input.Reason})
+    if errors.Is(err, errAmountTooLarge) {
+        writeValidationError(w, ValidationError{{Field: "amount", Code: "invalid_value", Message: err.Error()}})
+        return
+    }
     if err != nil {
         http.Error(w, "Failed to create billing", http.StatusInternalServerError)
         return
     }
     log.Printf("Billing created successfully: %+v", billing)  // Confirm successful creation
+    budgetsChanged(billing.TaskID)
     w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("ETag", etag(billing.Version))
     json.NewEncoder(w).Encode(billing)
 }
 
@@ -167,7 +398,7 @@ func getBilling(w http.ResponseWriter, req *http.Request) {
     }
 
     collection := client.Database("billing").Collection("billings")
-    filter := bson.M{"_id": objectID}
+    filter := bson.M{"_id": objectID, "deleted_at": notDeleted}
 
     var billing Billing
     err = collection.FindOne(context.TODO(), filter).Decode(&billing)
@@ -179,6 +410,7 @@ func getBilling(w http.ResponseWriter, req *http.Request) {
 
     log.Printf("Billing retrieved successfully: %+v", billing)  // Confirm successful retrieval
     w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("ETag", etag(billing.Version))
     json.NewEncoder(w).Encode(billing)
 }
 
@@ -195,21 +427,26 @@ func updateBilling(w http.ResponseWriter, req *http.Request) {
         return
     }
 
-    var input struct {
-        UserID     *primitive.ObjectID `json:"user_id"`
-        TaskID     *primitive.ObjectID `json:"task_id"`
-        Hours      *float64            `json:"hours"`
-        HourlyRate *float64            `json:"hourly_rate"`
-        Amount     *float64            `json:"amount"`
-    }
+    var input billingInput
     err = json.NewDecoder(req.Body).Decode(&input)
     if err != nil {
         http.Error(w, "Invalid request body", http.StatusBadRequest)
         return
     }
 
+    // A changed user or task must exist
+    validationErrs, err := checkReferences(req.Context(), input.UserID, input.TaskID)
+    if err != nil {
+        http.Error(w, "Failed to validate billing: "+err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    if len(validationErrs) > 0 {
+        writeValidationError(w, validationErrs)
+        return
+    }
+
     collection := client.Database("billing").Collection("billings")
-    filter := bson.M{"_id": objectID}
+    filter := bson.M{"_id": objectID, "deleted_at": notDeleted}
 
     // Fetch the current data to handle calculations properly
     var current Billing
@@ -219,6 +456,34 @@ func updateBilling(w http.ResponseWriter, req *http.Request) {
         return
     }
 
+    // Reject the update if the client's copy is stale
+    if expected, ok, err := parseIfMatch(req); err != nil {
+        http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+        return
+    } else if ok && expected != current.Version {
+        http.Error(w, "Billing has been modified", http.StatusPreconditionFailed)
+        return
+    }
+
+    // Issued invoices keep their amounts; corrections go through credit notes
+    if inv, err := billingLockedBy(context.TODO(), current, false); err != nil {
+        http.Error(w, "Failed to update billing", http.StatusInternalServerError)
+        return
+    } else if inv != nil {
+        http.Error(w, "Billing is on "+inv.Status+" invoice "+inv.Number+"; issue a credit note instead", http.StatusConflict)
+        return
+    }
+
+    // Amounts are in the billing's currency, which can't change once they exist
+    rate, amount, validationErrs := input.money(current.Currency)
+    if input.Currency != nil && !strings.EqualFold(*input.Currency, current.Currency) {
+        validationErrs = append(validationErrs, FieldError{Field: "currency", Code: "immutable", Message: "cannot be changed"})
+    }
+    if len(validationErrs) > 0 {
+        writeValidationError(w, validationErrs)
+        return
+    }
+
     update := bson.M{}
     if input.UserID != nil {
         update["user_id"] = *input.UserID
@@ -229,8 +494,11 @@ func updateBilling(w http.ResponseWriter, req *http.Request) {
     if input.Hours != nil {
         update["hours"] = *input.Hours
     }
-    if input.HourlyRate != nil {
-        update["hourly_rate"] = *input.HourlyRate
+    unset := bson.M{}
+    if rate != nil {
+        update["hourly_rate_minor"] = *rate
+        update["rate_source"] = rateSourceManual
+        unset["rate_card_id"] = ""
     }
 
     // Determine amount calculation logic
@@ -239,28 +507,67 @@ func updateBilling(w http.ResponseWriter, req *http.Request) {
         finalHours = *input.Hours
     }
 
-    finalRate := current.HourlyRate
-    if input.HourlyRate != nil {
-        finalRate = input.HourlyRate
-    } else if finalRate == nil {
-        defaultRate := 100.0 // Default rate if no rate is recorded or provided
-        finalRate = &defaultRate
+    finalRate := fallbackHourlyRate(current.Currency) // Default rate if no rate is recorded or provided
+    if rate != nil {
+        finalRate = *rate
+    } else if current.HourlyRate != nil {
+        finalRate = *current.HourlyRate
     }
 
-    if input.HourlyRate != nil || input.Hours != nil {
-        update["amount"] = *finalRate * finalHours
+    if rate != nil || input.Hours != nil {
+        computed, err := billAmount(finalHours, finalRate)
+        if err != nil {
+            writeValidationError(w, ValidationError{{Field: "amount", Code: "invalid_value", Message: err.Error()}})
+            return
+        }
+        update["amount_minor"] = computed
     }
-    if input.Amount != nil {
-        update["amount"] = *input.Amount // Override calculated amount if direct amount is provided
+    if amount != nil {
+        update["amount_minor"] = *amount // Override calculated amount if direct amount is provided
     }
 
-    _, err = collection.UpdateOne(context.TODO(), filter, bson.M{"$set": update})
+    // The amount above was computed from the version we read, so only apply it to that version
+    conditional := bson.M{"_id": objectID, "version": versionFilter(current.Version), "invoice_id": bson.M{"$exists": false}}
+    if current.InvoiceID != nil {
+        conditional["invoice_id"] = *current.InvoiceID
+    }
+    updateDoc := bson.M{"$set": update, "$inc": bson.M{"version": 1}}
+    if len(unset) > 0 {
+        updateDoc["$unset"] = unset
+    }
+    var updated Billing
+    err = withTransaction(func(ctx mongo.SessionContext) error {
+        var matched bool
+        var err error
+        // The draft the billing is on is checked again as part of the change
+        if current.InvoiceID != nil {
+            if err := touchDraftInvoice(ctx, *current.InvoiceID); err != nil {
+                return err
+            }
+        }
+        updated, matched, err = mutateBilling(ctx, conditional, updateDoc, billingChange{Action: auditUpdated, Actor: requestActor(req), Reason: input.Reason})
+        if err == nil && !matched {
+            return errBillingModified
+        }
+        return err
+    })
+    var opErr *invoiceOpError
+    if errors.As(err, &opErr) {
+        http.Error(w, opErr.Message, opErr.Status)
+        return
+    }
+    if errors.Is(err, errBillingModified) {
+        http.Error(w, "Billing has been modified", http.StatusPreconditionFailed)
+        return
+    }
     if err != nil {
         http.Error(w, "Failed to update billing", http.StatusInternalServerError)
         return
     }
 
     log.Println("Billing updated successfully")
+    budgetsChanged(current.TaskID, updated.TaskID)
+    w.Header().Set("ETag", etag(updated.Version))
     w.WriteHeader(http.StatusNoContent)
 }
 
@@ -282,12 +589,42 @@ func removeBilling(w http.ResponseWriter, req *http.Request) {
     collection := client.Database("billing").Collection("billings")
     filter := bson.M{"_id": objectID}
 
-    _, err = collection.DeleteOne(context.TODO(), filter)
+    // Billings on an invoice stay until the invoice is removed or voided
+    var current Billing
+    err = collection.FindOne(context.TODO(), filter).Decode(&current)
+    if err != nil || current.DeletedAt != nil {
+        http.Error(w, "Billing not found", http.StatusNotFound)
+        return
+    }
+    if inv, err := billingLockedBy(context.TODO(), current, true); err != nil {
+        http.Error(w, "Failed to remove billing", http.StatusInternalServerError)
+        return
+    } else if inv != nil {
+        http.Error(w, "Billing is on invoice "+inv.ID.Hex()+"; remove it from the invoice first", http.StatusConflict)
+        return
+    }
+
+    // The billing is only marked deleted, so the audit log keeps referring to it
+    filter["invoice_id"] = bson.M{"$exists": false}
+    filter["deleted_at"] = notDeleted
+    change := billingChange{Action: auditRemoved, Actor: requestActor(req), Reason: req.URL.Query().Get("reason")}
+    err = withTransaction(func(ctx mongo.SessionContext) error {
+        _, matched, err := mutateBilling(ctx, filter, softDelete(), change)
+        if err == nil && !matched {
+            return errBillingModified
+        }
+        return err
+    })
+    if errors.Is(err, errBillingModified) {
+        http.Error(w, "Billing was changed while removing it", http.StatusConflict)
+        return
+    }
     if err != nil {
         http.Error(w, "Failed to remove billing", http.StatusInternalServerError)
         return
     }
     log.Println("Billing removed successfully")  // Confirm successful update
+    budgetsChanged(current.TaskID)
     w.WriteHeader(http.StatusNoContent)
 }
 
@@ -299,8 +636,14 @@ func listBillings(w http.ResponseWriter, req *http.Request) {
         return
     }
 
+    // Removed billings are only listed with include_deleted=true
+    filter := bson.M{"deleted_at": notDeleted}
+    if req.URL.Query().Get("include_deleted") == "true" {
+        filter = bson.M{}
+    }
+
     collection := client.Database("billing").Collection("billings")
-    cursor, err := collection.Find(context.TODO(), bson.M{})
+    cursor, err := collection.Find(context.TODO(), filter)
     if err != nil {
         http.Error(w, "Failed to list billings", http.StatusInternalServerError)
         return
@@ -329,13 +672,38 @@ func removeAllBillings(w http.ResponseWriter, req *http.Request) {
 
     collection := client.Database("billing").Collection("billings")
 
-    _, err := collection.DeleteMany(context.TODO(), bson.M{})
+    // Like removeBilling, this marks the billings deleted, one audited change each
+    cursor, err := collection.Find(context.TODO(), bson.M{"deleted_at": notDeleted}, options.Find().SetProjection(bson.M{"_id": 1}))
     if err != nil {
         http.Error(w, "Failed to remove all billings", http.StatusInternalServerError)
         return
     }
+    var live []struct {
+        ID primitive.ObjectID `bson:"_id"`
+    }
+    if err := cursor.All(context.TODO(), &live); err != nil {
+        http.Error(w, "Failed to remove all billings", http.StatusInternalServerError)
+        return
+    }
+    change := billingChange{Action: auditRemoved, Actor: requestActor(req), Reason: "all billings removed"}
+    removed := 0
+    for _, billing := range live {
+        var matched bool
+        err = withTransaction(func(ctx mongo.SessionContext) error {
+            var err error
+            _, matched, err = mutateBilling(ctx, bson.M{"_id": billing.ID, "deleted_at": notDeleted}, softDelete(), change)
+            return err
+        })
+        if err != nil {
+            http.Error(w, "Failed to remove all billings", http.StatusInternalServerError)
+            return
+        }
+        if matched {
+            removed++
+        }
+    }
 
-    log.Printf("All billings removed successfully, count: %d")  // Log the count of billings removed
+    log.Printf("All billings removed successfully, count: %d", removed)  // Log the count of billings removed
     w.WriteHeader(http.StatusNoContent)
 }
 func listBillingsUserID(w http.ResponseWriter, req *http.Request) {
@@ -345,7 +713,7 @@ func listBillingsUserID(w http.ResponseWriter, req *http.Request) {
         return
     }
 
-    var filter bson.M = bson.M{}
+    var filter bson.M = bson.M{"deleted_at": notDeleted}
     if userIDParam := req.URL.Query().Get("user_id"); userIDParam != "" {
         userID, err := primitive.ObjectIDFromHex(userIDParam)
         if err != nil {
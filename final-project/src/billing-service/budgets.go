@@ -0,0 +1,930 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// What a budget limits.
+const (
+    budgetHours  = "hours"
+    budgetAmount = "amount"
+)
+
+// defaultBudgetThresholds are the percentages of a budget alerts are sent at
+// unless it names its own.
+var defaultBudgetThresholds = []int{50, 80, 100}
+
+const maxBudgetThresholds = 10
+
+// Budget limits the hours or the amount billed for a task and all tasks below
+// it. Alerts go out once for each of the Thresholds, percentages of the limit,
+// that the billings reach; Alerted are those sent. A Hard budget also stops
+// task-service from completing tasks whose billing would exceed it.
+type Budget struct {
+    ID         primitive.ObjectID `bson:"_id" json:"id"`
+    TaskID     primitive.ObjectID `bson:"task_id" json:"task_id"`
+    Kind       string             `bson:"kind" json:"kind"`
+    Hours      float64            `bson:"hours,omitempty" json:"hours,omitempty"`
+    Currency   string             `bson:"currency,omitempty" json:"currency,omitempty"`
+    Amount     Money              `bson:"amount_minor,omitempty" json:"-"`
+    Thresholds []int              `bson:"thresholds" json:"thresholds"`
+    Hard       bool               `bson:"hard" json:"hard"`
+    WebhookURL string             `bson:"webhook_url,omitempty" json:"webhook_url,omitempty"`
+    Alerted    []int              `bson:"alerted" json:"alerted"`
+    Version    int64              `bson:"version" json:"version"`
+    CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// MarshalJSON writes the amount of an amount budget as a decimal in its currency.
+func (b Budget) MarshalJSON() ([]byte, error) {
+    type budget Budget
+    out := struct {
+        budget
+        Amount string `json:"amount,omitempty"`
+    }{budget: budget(b)}
+    if b.Kind == budgetAmount {
+        out.Amount = b.Amount.Format(b.Currency)
+    }
+    return json.Marshal(out)
+}
+
+// limit is the budget in its unit: hours, or minor units of its currency.
+func (b Budget) limit() float64 {
+    if b.Kind == budgetHours {
+        return b.Hours
+    }
+    return float64(b.Amount)
+}
+
+// measure is how much of the budget totals use.
+func (b Budget) measure(totals BillingTotals) float64 {
+    if b.Kind == budgetHours {
+        return totals.Hours
+    }
+    return float64(totals.Amount)
+}
+
+// format writes a value in the budget's unit, like its limit.
+func (b Budget) format(value float64) string {
+    if b.Kind == budgetHours {
+        return formatHours(value)
+    }
+    return Money(math.Round(value)).Format(b.Currency)
+}
+
+// budgetPercent is how much of limit used is, in percent with one decimal.
+func budgetPercent(used, limit float64) float64 {
+    if limit <= 0 {
+        return 0
+    }
+    return math.Round(used/limit*1000) / 10
+}
+
+// budgetThresholds returns the thresholds percent has reached that haven't
+// been alerted yet, and the alerted ones it is below again, which can be
+// alerted again once they are reached again.
+func budgetThresholds(b Budget, percent float64) (reached, rearmed []int) {
+    alerted := map[int]bool{}
+    for _, t := range b.Alerted {
+        alerted[t] = true
+    }
+    for _, t := range b.Thresholds {
+        switch {
+        case float64(t) <= percent && !alerted[t]:
+            reached = append(reached, t)
+        case float64(t) > percent && alerted[t]:
+            rearmed = append(rearmed, t)
+        }
+    }
+    return reached, rearmed
+}
+
+// normalizeThresholds sorts thresholds and drops duplicates, or explains what
+// is wrong with them.
+func normalizeThresholds(thresholds []int) ([]int, string) {
+    if len(thresholds) == 0 {
+        return nil, "must have at least one percentage"
+    }
+    seen := map[int]bool{}
+    var out []int
+    for _, t := range thresholds {
+        if t < 1 || t > 1000 {
+            return nil, "must be percentages from 1 to 1000"
+        }
+        if !seen[t] {
+            seen[t] = true
+            out = append(out, t)
+        }
+    }
+    if len(out) > maxBudgetThresholds {
+        return nil, fmt.Sprintf("must have at most %d percentages", maxBudgetThresholds)
+    }
+    sort.Ints(out)
+    return out, ""
+}
+
+func budgets() *mongo.Collection {
+    return client.Database("billing").Collection("budgets")
+}
+
+// ensureBudgetIndexes allows one budget of each kind, and currency, per task.
+func ensureBudgetIndexes() error {
+    _, err := budgets().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+        Keys:    bson.D{{Key: "task_id", Value: 1}, {Key: "kind", Value: 1}, {Key: "currency", Value: 1}},
+        Options: options.Index().SetUnique(true),
+    })
+    return err
+}
+
+// fetchSubtree returns the IDs of a task and of all tasks below it from
+// task-service. A task that no longer exists is its own subtree.
+func fetchSubtree(ctx context.Context, taskID primitive.ObjectID) ([]primitive.ObjectID, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, tasks.baseURL+"/tasks/subtree/"+taskID.Hex(), nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set(internalServiceHeader, internalServiceSecret)
+    resp, err := tasks.http.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", errLookupUnavailable, err)
+    }
+    defer resp.Body.Close()
+    switch resp.StatusCode {
+    case http.StatusOK:
+    case http.StatusNotFound:
+        return []primitive.ObjectID{taskID}, nil
+    default:
+        return nil, fmt.Errorf("%w: subtree of %s returned status %d", errLookupUnavailable, taskID.Hex(), resp.StatusCode)
+    }
+    var subtree struct {
+        TaskIDs []primitive.ObjectID `json:"task_ids"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&subtree); err != nil {
+        return nil, fmt.Errorf("%w: subtree of %s: %v", errLookupUnavailable, taskID.Hex(), err)
+    }
+    return subtree.TaskIDs, nil
+}
+
+// taskAncestors returns the task and the tasks above it, whose budgets its
+// billings count against.
+func taskAncestors(ctx context.Context, taskID primitive.ObjectID) ([]primitive.ObjectID, error) {
+    var ids []primitive.ObjectID
+    seen := map[primitive.ObjectID]bool{}
+    for id := &taskID; id != nil && !seen[*id]; {
+        seen[*id] = true
+        ids = append(ids, *id)
+        var info taskInfo
+        found, err := tasks.Get(ctx, *id, &info)
+        if err != nil {
+            return nil, err
+        }
+        if !found {
+            break
+        }
+        id = info.ParentTask
+    }
+    return ids, nil
+}
+
+// budgetsOver returns the budgets that billings of the tasks count against.
+func budgetsOver(ctx context.Context, taskIDs []primitive.ObjectID, filter bson.M) ([]Budget, error) {
+    var ancestors []primitive.ObjectID
+    seen := map[primitive.ObjectID]bool{}
+    for _, taskID := range taskIDs {
+        ids, err := taskAncestors(ctx, taskID)
+        if err != nil {
+            return nil, err
+        }
+        for _, id := range ids {
+            if !seen[id] {
+                seen[id] = true
+                ancestors = append(ancestors, id)
+            }
+        }
+    }
+    filter["task_id"] = bson.M{"$in": ancestors}
+    cursor, err := budgets().Find(ctx, filter)
+    if err != nil {
+        return nil, err
+    }
+    var found []Budget
+    return found, cursor.All(ctx, &found)
+}
+
+// budgetTotals adds up the billings of the budget's task tree; an amount budget
+// only counts billings in its currency.
+func budgetTotals(ctx context.Context, b Budget) (BillingTotals, error) {
+    var totals BillingTotals
+    ids, err := fetchSubtree(ctx, b.TaskID)
+    if err != nil {
+        return totals, err
+    }
+    match := bson.M{"task_id": bson.M{"$in": ids}, "deleted_at": notDeleted}
+    if b.Kind == budgetAmount {
+        match["currency"] = b.Currency
+    }
+    var results []BillingTotals
+    err = aggregateBillings(mongo.Pipeline{
+        {{Key: "$match", Value: match}},
+        {{Key: "$group", Value: totalsGroup(nil)}},
+    }, &results)
+    if err != nil || len(results) == 0 {
+        return totals, err
+    }
+    return results[0], nil
+}
+
+// BudgetStatus is how much of a budget its task tree's billings use.
+type BudgetStatus struct {
+    Budget    Budget  `json:"budget"`
+    Billings  int     `json:"billings"`
+    Used      string  `json:"used"`
+    Remaining string  `json:"remaining"`
+    Percent   float64 `json:"percent"`
+    Exceeded  bool    `json:"exceeded"`
+}
+
+func budgetStatus(b Budget, totals BillingTotals) BudgetStatus {
+    used := b.measure(totals)
+    return BudgetStatus{
+        Budget:    b,
+        Billings:  totals.Billings,
+        Used:      b.format(used),
+        Remaining: b.format(math.Max(b.limit()-used, 0)),
+        Percent:   budgetPercent(used, b.limit()),
+        Exceeded:  used > b.limit(),
+    }
+}
+
+// overrunBy reports whether billing counts against b and the budget's totals,
+// which include it, exceed b.
+func overrunBy(b Budget, billing Billing, totals BillingTotals) bool {
+    if b.Kind == budgetAmount && b.Currency != billing.Currency {
+        return false
+    }
+    return budgetStatus(b, totals).Exceeded
+}
+
+// flagBudgetOverruns checks the hard budgets a billing for a completed task
+// counts against once the billing exists. Task-service checks them before
+// completing the task, outside any transaction here, so completions racing
+// each other can go over together; a billing that did is flagged with the
+// budgets it exceeded.
+func flagBudgetOverruns(ctx context.Context, billing Billing) error {
+    if len(billing.OverBudget) > 0 {
+        return nil
+    }
+    found, err := budgetsOver(ctx, []primitive.ObjectID{billing.TaskID}, bson.M{"hard": true})
+    if err != nil {
+        return err
+    }
+    var exceeded []primitive.ObjectID
+    for _, b := range found {
+        totals, err := budgetTotals(ctx, b)
+        if err != nil {
+            return err
+        }
+        if overrunBy(b, billing, totals) {
+            log.Printf("Billing %s of task %s exceeds the hard %s budget %s of task %s", billing.ID.Hex(), billing.TaskID.Hex(), b.Kind, b.ID.Hex(), b.TaskID.Hex())
+            exceeded = append(exceeded, b.ID)
+        }
+    }
+    if len(exceeded) == 0 {
+        return nil
+    }
+    return withTransaction(func(sctx mongo.SessionContext) error {
+        _, _, err := mutateBilling(sctx, bson.M{"_id": billing.ID, "deleted_at": notDeleted},
+            bson.M{"$set": bson.M{"over_budget": exceeded}, "$inc": bson.M{"version": 1}},
+            billingChange{Action: auditUpdated, Actor: taskServiceActor, Reason: "exceeds a hard budget"})
+        return err
+    })
+}
+
+// evaluateBudget works out the budget's status and sends the alerts for the
+// thresholds it has newly reached. Claiming a threshold in Alerted first
+// keeps concurrent evaluations from alerting it twice; an alert that can't be
+// sent gives its claim back, so the next evaluation sends it again.
+func evaluateBudget(ctx context.Context, b Budget) (BudgetStatus, error) {
+    totals, err := budgetTotals(ctx, b)
+    if err != nil {
+        return BudgetStatus{}, err
+    }
+    status := budgetStatus(b, totals)
+    reached, rearmed := budgetThresholds(b, status.Percent)
+    if len(rearmed) > 0 {
+        if _, err := budgets().UpdateOne(ctx, bson.M{"_id": b.ID}, bson.M{"$pull": bson.M{"alerted": bson.M{"$in": rearmed}}}); err != nil {
+            return status, err
+        }
+    }
+    for _, threshold := range reached {
+        result, err := budgets().UpdateOne(ctx, bson.M{"_id": b.ID, "alerted": bson.M{"$ne": threshold}}, bson.M{"$addToSet": bson.M{"alerted": threshold}})
+        if err != nil {
+            return status, err
+        }
+        if result.ModifiedCount == 0 {
+            continue
+        }
+        alert := BudgetAlertEvent{
+            BudgetID:  b.ID,
+            TaskID:    b.TaskID,
+            Kind:      b.Kind,
+            Threshold: threshold,
+            Percent:   status.Percent,
+            Limit:     b.format(b.limit()),
+            Used:      status.Used,
+            Currency:  b.Currency,
+            Hard:      b.Hard,
+        }
+        if err := sendBudgetAlert(ctx, b, alert); err != nil {
+            log.Printf("Failed to send %d%% alert of budget %s, will retry: %v", threshold, b.ID.Hex(), err)
+            if _, err := budgets().UpdateOne(ctx, bson.M{"_id": b.ID}, bson.M{"$pull": bson.M{"alerted": threshold}}); err != nil {
+                return status, err
+            }
+        }
+    }
+    return status, nil
+}
+
+// sendBudgetAlert publishes the alert and posts it to the budget's webhook, or
+// BUDGET_WEBHOOK_URL when it has none.
+func sendBudgetAlert(ctx context.Context, b Budget, alert BudgetAlertEvent) error {
+    event, err := newEvent("", eventBudgetThresholdReached, alert)
+    if err != nil {
+        return err
+    }
+    log.Printf("Budget %s of task %s reached %d%%: %s of %s used", b.ID.Hex(), b.TaskID.Hex(), alert.Threshold, alert.Used, alert.Limit)
+    if err := bus.Publish(ctx, event); err != nil {
+        return err
+    }
+    webhookURL := b.WebhookURL
+    if webhookURL == "" {
+        webhookURL = os.Getenv("BUDGET_WEBHOOK_URL")
+    }
+    if webhookURL == "" {
+        return nil
+    }
+    return postBudgetWebhook(ctx, http.DefaultClient, webhookURL, os.Getenv("BUDGET_WEBHOOK_SECRET"), event, time.Now())
+}
+
+// postBudgetWebhook posts the event as JSON. With a secret, the request is
+// signed like payment providers sign theirs: X-Budget-Signature holds the
+// time and an HMAC-SHA256 of the time and the body, "t=<unix>,v1=<hex>".
+func postBudgetWebhook(ctx context.Context, httpClient *http.Client, webhookURL, secret string, event Event, now time.Time) error {
+    payload, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(payload))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if secret != "" {
+        mac := hmac.New(sha256.New, []byte(secret))
+        fmt.Fprintf(mac, "%d.", now.Unix())
+        mac.Write(payload)
+        req.Header.Set("X-Budget-Signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), hex.EncodeToString(mac.Sum(nil))))
+    }
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("webhook answered %s", resp.Status)
+    }
+    return nil
+}
+
+// budgetsChanged checks, in the background, the budgets that billings of the
+// tasks count against, once those billings have changed.
+func budgetsChanged(taskIDs ...primitive.ObjectID) {
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+        defer cancel()
+        if n, err := budgets().CountDocuments(ctx, bson.M{}, options.Count().SetLimit(1)); err != nil || n == 0 {
+            return
+        }
+        found, err := budgetsOver(ctx, taskIDs, bson.M{})
+        if err != nil {
+            log.Printf("Failed to check budgets: %v", err)
+            return
+        }
+        for _, b := range found {
+            if _, err := evaluateBudget(ctx, b); err != nil {
+                log.Printf("Failed to check budget %s: %v", b.ID.Hex(), err)
+            }
+        }
+    }()
+}
+
+// runBudgetSweep evaluates every budget each BUDGET_CHECK_INTERVAL (default
+// 15m), which sends the alerts that failed before without waiting for the
+// billings to change again.
+func runBudgetSweep() {
+    interval, err := time.ParseDuration(os.Getenv("BUDGET_CHECK_INTERVAL"))
+    if err != nil || interval <= 0 {
+        interval = 15 * time.Minute
+    }
+    for range time.Tick(interval) {
+        ctx, cancel := context.WithTimeout(context.Background(), interval)
+        cursor, err := budgets().Find(ctx, bson.M{})
+        var all []Budget
+        if err == nil {
+            err = cursor.All(ctx, &all)
+        }
+        if err != nil {
+            log.Printf("Failed to read budgets: %v", err)
+        }
+        for _, b := range all {
+            if _, err := evaluateBudget(ctx, b); err != nil {
+                log.Printf("Failed to check budget %s: %v", b.ID.Hex(), err)
+            }
+        }
+        cancel()
+    }
+}
+
+// budgetInput is the body of a create or update request. The amount is a
+// decimal in the budget's currency, sent as a JSON number or string.
+type budgetInput struct {
+    TaskID     *primitive.ObjectID `json:"task_id"`
+    Kind       string              `json:"kind"`
+    Hours      *float64            `json:"hours"`
+    Currency   *string             `json:"currency"`
+    Amount     *json.Number        `json:"amount"`
+    Thresholds []int               `json:"thresholds"`
+    Hard       *bool               `json:"hard"`
+    WebhookURL *string             `json:"webhook_url"`
+}
+
+// apply validates the input's limit, thresholds, hardness and webhook and sets
+// them on b.
+func (input budgetInput) apply(b *Budget) ValidationError {
+    var errs ValidationError
+    switch b.Kind {
+    case budgetHours:
+        if input.Amount != nil {
+            errs = append(errs, FieldError{Field: "amount", Code: "invalid_value", Message: "is for amount budgets"})
+        }
+        if input.Hours != nil {
+            if *input.Hours <= 0 {
+                errs = append(errs, FieldError{Field: "hours", Code: "invalid_value", Message: "must be positive"})
+            } else {
+                b.Hours = *input.Hours
+            }
+        }
+        if b.Hours <= 0 && input.Hours == nil {
+            errs = append(errs, FieldError{Field: "hours", Code: "required", Message: "is required"})
+        }
+    case budgetAmount:
+        if input.Hours != nil {
+            errs = append(errs, FieldError{Field: "hours", Code: "invalid_value", Message: "is for hours budgets"})
+        }
+        if input.Amount != nil {
+            amount, err := parseMoney(input.Amount.String(), b.Currency)
+            if err == nil && amount <= 0 {
+                err = errors.New("must be positive")
+            }
+            if err != nil {
+                errs = append(errs, FieldError{Field: "amount", Code: "invalid_value", Message: err.Error()})
+            } else {
+                b.Amount = amount
+            }
+        } else if b.Amount <= 0 {
+            errs = append(errs, FieldError{Field: "amount", Code: "required", Message: "is required"})
+        }
+    }
+    if input.Thresholds != nil {
+        thresholds, problem := normalizeThresholds(input.Thresholds)
+        if problem != "" {
+            errs = append(errs, FieldError{Field: "thresholds", Code: "invalid_value", Message: problem})
+        } else {
+            b.Thresholds = thresholds
+        }
+    }
+    if input.Hard != nil {
+        b.Hard = *input.Hard
+    }
+    if input.WebhookURL != nil {
+        u, err := url.Parse(*input.WebhookURL)
+        if *input.WebhookURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+            errs = append(errs, FieldError{Field: "webhook_url", Code: "invalid_value", Message: "must be an http or https URL"})
+        } else {
+            b.WebhookURL = *input.WebhookURL
+        }
+    }
+    return errs
+}
+
+func writeBudgetStatus(w http.ResponseWriter, status int, s BudgetStatus) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("ETag", etag(s.Budget.Version))
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(s)
+}
+
+// createBudget sets a budget on a task, usually a parent task.
+func createBudget(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to create budget")
+
+    if req.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var input budgetInput
+    if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    b := Budget{ID: primitive.NewObjectID(), Kind: input.Kind, Thresholds: defaultBudgetThresholds, Alerted: []int{}, Version: 1, CreatedAt: time.Now().UTC()}
+    var validationErrs ValidationError
+    if input.TaskID == nil || input.TaskID.IsZero() {
+        validationErrs = append(validationErrs, FieldError{Field: "task_id", Code: "required", Message: "is required"})
+    } else {
+        b.TaskID = *input.TaskID
+    }
+    switch b.Kind {
+    case budgetHours:
+        if input.Currency != nil {
+            validationErrs = append(validationErrs, FieldError{Field: "currency", Code: "invalid_value", Message: "is for amount budgets"})
+        }
+    case budgetAmount:
+        b.Currency = defaultCurrency()
+        if input.Currency != nil {
+            b.Currency = strings.ToUpper(*input.Currency)
+        }
+        if !validCurrency(b.Currency) {
+            validationErrs = append(validationErrs, FieldError{Field: "currency", Code: "invalid_value", Message: "must be a supported ISO 4217 currency code"})
+        }
+    default:
+        validationErrs = append(validationErrs, FieldError{Field: "kind", Code: "invalid_value", Message: "must be hours or amount"})
+    }
+    if len(validationErrs) == 0 {
+        validationErrs = input.apply(&b)
+    }
+    if len(validationErrs) == 0 {
+        refErrs, err := checkReferences(req.Context(), nil, &b.TaskID)
+        if err != nil {
+            http.Error(w, "Failed to validate budget: "+err.Error(), http.StatusServiceUnavailable)
+            return
+        }
+        validationErrs = refErrs
+    }
+    if len(validationErrs) > 0 {
+        writeValidationError(w, validationErrs)
+        return
+    }
+
+    _, err := budgets().InsertOne(context.TODO(), b)
+    if mongo.IsDuplicateKeyError(err) {
+        http.Error(w, "Task already has a "+b.Kind+" budget", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Failed to create budget", http.StatusInternalServerError)
+        return
+    }
+    log.Printf("Budget %s created for task %s: %s %s", b.ID.Hex(), b.TaskID.Hex(), b.format(b.limit()), b.Kind)
+
+    // Billings may already use up some of it
+    status, err := evaluateBudget(req.Context(), b)
+    if err != nil {
+        log.Printf("Failed to check budget %s: %v", b.ID.Hex(), err)
+        status = budgetStatus(b, BillingTotals{})
+    }
+    writeBudgetStatus(w, http.StatusCreated, status)
+}
+
+// listBudgets lists the budgets, optionally of a task_id.
+func listBudgets(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to list budgets")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    filter := bson.M{}
+    if value := req.URL.Query().Get("task_id"); value != "" {
+        taskID, err := primitive.ObjectIDFromHex(value)
+        if err != nil {
+            http.Error(w, "Invalid task_id", http.StatusBadRequest)
+            return
+        }
+        filter["task_id"] = taskID
+    }
+    cursor, err := budgets().Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+    if err != nil {
+        http.Error(w, "Failed to list budgets", http.StatusInternalServerError)
+        return
+    }
+    found := []Budget{}
+    if err := cursor.All(context.TODO(), &found); err != nil {
+        http.Error(w, "Failed to decode budgets", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(found)
+}
+
+func budgetFromPath(w http.ResponseWriter, req *http.Request, prefix string) (Budget, bool) {
+    var b Budget
+    id, err := primitive.ObjectIDFromHex(req.URL.Path[len(prefix):])
+    if err != nil {
+        http.Error(w, "Invalid budget ID", http.StatusBadRequest)
+        return b, false
+    }
+    if err := budgets().FindOne(context.TODO(), bson.M{"_id": id}).Decode(&b); err != nil {
+        http.Error(w, "Budget not found", http.StatusNotFound)
+        return b, false
+    }
+    return b, true
+}
+
+// getBudget returns a budget with how much of it is used.
+func getBudget(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to get budget")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    b, ok := budgetFromPath(w, req, "/billings/budgets/get/")
+    if !ok {
+        return
+    }
+    totals, err := budgetTotals(req.Context(), b)
+    if errors.Is(err, errLookupUnavailable) {
+        http.Error(w, "Failed to read task tree: "+err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Failed to add up billings", http.StatusInternalServerError)
+        return
+    }
+    writeBudgetStatus(w, http.StatusOK, budgetStatus(b, totals))
+}
+
+// updateBudget changes a budget's limit, thresholds, hardness or webhook. Its
+// task, kind and currency are fixed.
+func updateBudget(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to update budget")
+
+    if req.Method != http.MethodPut {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    b, ok := budgetFromPath(w, req, "/billings/budgets/update/")
+    if !ok {
+        return
+    }
+    var input budgetInput
+    if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if expected, ok, err := parseIfMatch(req); err != nil {
+        http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+        return
+    } else if ok && expected != b.Version {
+        http.Error(w, "Budget has been modified", http.StatusPreconditionFailed)
+        return
+    }
+
+    var validationErrs ValidationError
+    if input.TaskID != nil && *input.TaskID != b.TaskID {
+        validationErrs = append(validationErrs, FieldError{Field: "task_id", Code: "immutable", Message: "cannot be changed"})
+    }
+    if input.Kind != "" && input.Kind != b.Kind {
+        validationErrs = append(validationErrs, FieldError{Field: "kind", Code: "immutable", Message: "cannot be changed"})
+    }
+    if input.Currency != nil && !strings.EqualFold(*input.Currency, b.Currency) {
+        validationErrs = append(validationErrs, FieldError{Field: "currency", Code: "immutable", Message: "cannot be changed"})
+    }
+    version := b.Version
+    validationErrs = append(validationErrs, input.apply(&b)...)
+    if len(validationErrs) > 0 {
+        writeValidationError(w, validationErrs)
+        return
+    }
+
+    // Alerts sent for thresholds that were dropped are forgotten
+    alerted := []int{}
+    for _, t := range b.Alerted {
+        for _, kept := range b.Thresholds {
+            if t == kept {
+                alerted = append(alerted, t)
+            }
+        }
+    }
+    b.Alerted = alerted
+    b.Version++
+    set := bson.M{"thresholds": b.Thresholds, "alerted": b.Alerted, "hard": b.Hard, "webhook_url": b.WebhookURL, "version": b.Version}
+    if b.Kind == budgetHours {
+        set["hours"] = b.Hours
+    } else {
+        set["amount_minor"] = b.Amount
+    }
+    result, err := budgets().UpdateOne(context.TODO(), bson.M{"_id": b.ID, "version": version}, bson.M{"$set": set})
+    if err != nil {
+        http.Error(w, "Failed to update budget", http.StatusInternalServerError)
+        return
+    }
+    if result.MatchedCount == 0 {
+        http.Error(w, "Budget has been modified", http.StatusPreconditionFailed)
+        return
+    }
+    log.Printf("Budget %s updated", b.ID.Hex())
+
+    // A new limit or new thresholds may be reached, or no longer be
+    status, err := evaluateBudget(req.Context(), b)
+    if err != nil {
+        log.Printf("Failed to check budget %s: %v", b.ID.Hex(), err)
+        status = budgetStatus(b, BillingTotals{})
+    }
+    writeBudgetStatus(w, http.StatusOK, status)
+}
+
+func removeBudget(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to remove budget")
+
+    if req.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    id, err := primitive.ObjectIDFromHex(req.URL.Path[len("/billings/budgets/remove/"):])
+    if err != nil {
+        http.Error(w, "Invalid budget ID", http.StatusBadRequest)
+        return
+    }
+    result, err := budgets().DeleteOne(context.TODO(), bson.M{"_id": id})
+    if err != nil {
+        http.Error(w, "Failed to remove budget", http.StatusInternalServerError)
+        return
+    }
+    if result.DeletedCount == 0 {
+        http.Error(w, "Budget not found", http.StatusNotFound)
+        return
+    }
+    log.Printf("Budget %s removed", id.Hex())
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// budgetLine is work task-service is about to bill.
+type budgetLine struct {
+    TaskID       primitive.ObjectID `json:"task_id"`
+    UserID       primitive.ObjectID `json:"user_id"`
+    Organization string             `json:"organization,omitempty"`
+    ProjectID    primitive.ObjectID `json:"project_id"`
+    Hours        float64            `json:"hours"`
+}
+
+// ExceededBudget is a hard budget that billing some work would go over.
+type ExceededBudget struct {
+    BudgetID  primitive.ObjectID `json:"budget_id"`
+    TaskID    primitive.ObjectID `json:"task_id"`
+    Kind      string             `json:"kind"`
+    Limit     string             `json:"limit"`
+    Used      string             `json:"used"`
+    Projected string             `json:"projected"`
+}
+
+// listHardBudgetTasks answers task-service with the tasks that have a hard
+// budget, so it only checks completions in their trees.
+func listHardBudgetTasks(w http.ResponseWriter, req *http.Request) {
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    taskIDs, err := budgets().Distinct(req.Context(), "task_id", bson.M{"hard": true})
+    if err != nil {
+        http.Error(w, "Failed to list budgets", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(struct {
+        TaskIDs []interface{} `json:"task_ids"`
+    }{append([]interface{}{}, taskIDs...)})
+}
+
+// checkBudgets answers task-service, before it completes tasks, with the hard
+// budgets billing their work would exceed. Work is priced as its invoice would
+// be, from the rate cards in effect now.
+func checkBudgets(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to check budgets")
+
+    if req.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var input struct {
+        Lines []budgetLine `json:"lines"`
+    }
+    if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    ctx := req.Context()
+    added := map[primitive.ObjectID]float64{}
+    hard := map[primitive.ObjectID]Budget{}
+    var order []primitive.ObjectID
+    for _, line := range input.Lines {
+        if line.Hours <= 0 {
+            continue
+        }
+        over, err := budgetsOver(ctx, []primitive.ObjectID{line.TaskID}, bson.M{"hard": true})
+        if errors.Is(err, errLookupUnavailable) {
+            http.Error(w, "Failed to read task tree: "+err.Error(), http.StatusServiceUnavailable)
+            return
+        }
+        if err != nil {
+            http.Error(w, "Failed to check budgets", http.StatusInternalServerError)
+            return
+        }
+
+        var priced *Billing
+        for _, b := range over {
+            if _, ok := hard[b.ID]; !ok {
+                hard[b.ID] = b
+                order = append(order, b.ID)
+            }
+            if b.Kind == budgetHours {
+                added[b.ID] += line.Hours
+                continue
+            }
+            if priced == nil {
+                priced = &Billing{UserID: line.UserID, TaskID: line.TaskID, Hours: line.Hours}
+                rc := rateContext{UserID: line.UserID, ProjectID: line.ProjectID, Organization: line.Organization, At: time.Now().UTC()}
+                err := withUserRole(ctx, &rc)
+                if err == nil {
+                    err = resolveRate(ctx, priced, rc)
+                }
+                if err == nil {
+                    priced.Amount, err = billAmount(priced.Hours, *priced.HourlyRate)
+                }
+                if err != nil {
+                    http.Error(w, "Failed to price work: "+err.Error(), http.StatusServiceUnavailable)
+                    return
+                }
+            }
+            if priced.Currency == b.Currency {
+                added[b.ID] += float64(priced.Amount)
+            }
+        }
+    }
+
+    exceeded := []ExceededBudget{}
+    for _, id := range order {
+        b := hard[id]
+        totals, err := budgetTotals(ctx, b)
+        if err != nil {
+            http.Error(w, "Failed to check budgets", http.StatusServiceUnavailable)
+            return
+        }
+        used := b.measure(totals)
+        if projected := used + added[id]; projected > b.limit() {
+            exceeded = append(exceeded, ExceededBudget{
+                BudgetID:  b.ID,
+                TaskID:    b.TaskID,
+                Kind:      b.Kind,
+                Limit:     b.format(b.limit()),
+                Used:      b.format(used),
+                Projected: b.format(projected),
+            })
+        }
+    }
+    if len(exceeded) > 0 {
+        log.Printf("Work on %d tasks would exceed %d hard budgets", len(input.Lines), len(exceeded))
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(struct {
+        Allowed  bool             `json:"allowed"`
+        Exceeded []ExceededBudget `json:"exceeded"`
+    }{len(exceeded) == 0, exceeded})
+}
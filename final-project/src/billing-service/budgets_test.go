@@ -0,0 +1,157 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBudgetThresholds(t *testing.T) {
+    b := Budget{Thresholds: []int{50, 80, 100}, Alerted: []int{50, 100}}
+    tests := []struct {
+        percent          float64
+        reached, rearmed []int
+    }{
+        {40, nil, []int{50, 100}},
+        {85, []int{80}, []int{100}},
+        {120, []int{80}, nil},
+    }
+    for _, tc := range tests {
+        reached, rearmed := budgetThresholds(b, tc.percent)
+        if !reflect.DeepEqual(reached, tc.reached) || !reflect.DeepEqual(rearmed, tc.rearmed) {
+            t.Errorf("%g%%: Want reached %v and rearmed %v, Got %v and %v", tc.percent, tc.reached, tc.rearmed, reached, rearmed)
+        }
+    }
+}
+
+func TestNormalizeThresholds(t *testing.T) {
+    if thresholds, problem := normalizeThresholds([]int{100, 50, 80, 50}); problem != "" || !reflect.DeepEqual(thresholds, []int{50, 80, 100}) {
+        t.Errorf("Want sorted thresholds without duplicates, Got %v (%s)", thresholds, problem)
+    }
+    for _, thresholds := range [][]int{{}, {0, 50}, {50, 1001}, {1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}} {
+        if _, problem := normalizeThresholds(thresholds); problem == "" {
+            t.Errorf("%v: Want a problem", thresholds)
+        }
+    }
+}
+
+func TestBudgetStatus(t *testing.T) {
+    hours := Budget{Kind: budgetHours, Hours: 40}
+    status := budgetStatus(hours, BillingTotals{Billings: 3, Hours: 30.5})
+    if status.Used != "30.5" || status.Remaining != "9.5" || status.Percent != 76.3 || status.Exceeded {
+        t.Errorf("Hours budget: %+v", status)
+    }
+
+    amount := Budget{Kind: budgetAmount, Currency: "USD", Amount: 100000}
+    status = budgetStatus(amount, BillingTotals{Billings: 2, Amount: 125050})
+    if status.Used != "1250.50" || status.Remaining != "0.00" || status.Percent != 125.1 || !status.Exceeded {
+        t.Errorf("Amount budget: %+v", status)
+    }
+}
+
+func TestOverrunBy(t *testing.T) {
+    hours := Budget{Kind: budgetHours, Hours: 40, Hard: true}
+    amount := Budget{Kind: budgetAmount, Currency: "USD", Amount: 100000, Hard: true}
+    usd := Billing{Currency: "USD"}
+    eur := Billing{Currency: "EUR"}
+
+    tests := []struct {
+        name    string
+        budget  Budget
+        billing Billing
+        totals  BillingTotals
+        want    bool
+    }{
+        {"hours within", hours, usd, BillingTotals{Hours: 40}, false},
+        {"hours over", hours, usd, BillingTotals{Hours: 40.5}, true},
+        {"hours over in any currency", hours, eur, BillingTotals{Hours: 41}, true},
+        {"amount within", amount, usd, BillingTotals{Amount: 100000}, false},
+        {"amount over", amount, usd, BillingTotals{Amount: 100001}, true},
+        {"amount over in another currency", amount, eur, BillingTotals{Amount: 200000}, false},
+    }
+    for _, tc := range tests {
+        if got := overrunBy(tc.budget, tc.billing, tc.totals); got != tc.want {
+            t.Errorf("%s: Want %v, Got %v", tc.name, tc.want, got)
+        }
+    }
+}
+
+func TestBudgetInputApply(t *testing.T) {
+    hours, amount := 0.0, json.Number("1500.00")
+    b := Budget{Kind: budgetHours, Thresholds: defaultBudgetThresholds}
+    errs := budgetInput{Hours: &hours, Amount: &amount}.apply(&b)
+    if len(errs) != 2 || errs[0].Field != "amount" || errs[1].Field != "hours" {
+        t.Errorf("Want amount and hours errors, Got %v", errs)
+    }
+
+    webhook, hard := "https://hooks.example.com/budget", true
+    b = Budget{Kind: budgetAmount, Currency: "EUR", Thresholds: defaultBudgetThresholds}
+    if errs := (budgetInput{Amount: &amount, Thresholds: []int{90}, Hard: &hard, WebhookURL: &webhook}).apply(&b); len(errs) > 0 {
+        t.Fatal(errs)
+    }
+    if b.Amount != 150000 || !reflect.DeepEqual(b.Thresholds, []int{90}) || !b.Hard || b.WebhookURL != webhook {
+        t.Errorf("Want the input applied, Got %+v", b)
+    }
+
+    ftp := "ftp://example.com"
+    if errs := (budgetInput{WebhookURL: &ftp}).apply(&b); len(errs) != 1 || errs[0].Field != "webhook_url" {
+        t.Errorf("Want a webhook_url error, Got %v", errs)
+    }
+}
+
+func TestPostBudgetWebhook(t *testing.T) {
+    var body []byte
+    var signature string
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        body, _ = io.ReadAll(req.Body)
+        signature = req.Header.Get("X-Budget-Signature")
+        w.WriteHeader(http.StatusAccepted)
+    }))
+    defer server.Close()
+
+    event, err := newEvent("", eventBudgetThresholdReached, BudgetAlertEvent{BudgetID: primitive.NewObjectID(), Kind: budgetHours, Threshold: 80, Percent: 82.5})
+    if err != nil {
+        t.Fatal(err)
+    }
+    now := time.Unix(1700000000, 0)
+    if err := postBudgetWebhook(context.Background(), server.Client(), server.URL, "whsec_budget", event, now); err != nil {
+        t.Fatal(err)
+    }
+
+    var got Event
+    if err := json.Unmarshal(body, &got); err != nil || got.ID != event.ID || got.Type != eventBudgetThresholdReached {
+        t.Errorf("Want the event posted, Got %s (%v)", body, err)
+    }
+    mac := hmac.New(sha256.New, []byte("whsec_budget"))
+    fmt.Fprintf(mac, "%d.", now.Unix())
+    mac.Write(body)
+    if want := fmt.Sprintf("t=%d,v1=%s", now.Unix(), hex.EncodeToString(mac.Sum(nil))); signature != want {
+        t.Errorf("Want signature %s, Got %s", want, signature)
+    }
+}
+
+func TestPostBudgetWebhookFailure(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        if req.Header.Get("X-Budget-Signature") != "" {
+            t.Errorf("Want no signature without a secret")
+        }
+        http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+    }))
+    defer server.Close()
+
+    event, _ := newEvent("", eventBudgetThresholdReached, BudgetAlertEvent{})
+    if err := postBudgetWebhook(context.Background(), server.Client(), server.URL, "", event, time.Now()); err == nil {
+        t.Errorf("Want an error for a failed webhook")
+    }
+}
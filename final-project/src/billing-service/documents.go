@@ -0,0 +1,604 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "html/template"
+    "log"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultAccentColor is the accent color of invoices without branding.
+const defaultAccentColor = "#1f4e79"
+
+// Branding is what invoices of an organization show about the sender. Invoices
+// of organizations without branding use that of the organization "default".
+type Branding struct {
+    Organization string `bson:"_id" json:"organization"`
+    DisplayName  string `bson:"display_name" json:"display_name"`
+    // Address is printed as is, one line per line
+    Address string `bson:"address,omitempty" json:"address,omitempty"`
+    Email   string `bson:"email,omitempty" json:"email,omitempty"`
+    Website string `bson:"website,omitempty" json:"website,omitempty"`
+    TaxID   string `bson:"tax_id,omitempty" json:"tax_id,omitempty"`
+    // AccentColor is a #rrggbb color for the header and headings
+    AccentColor string `bson:"accent_color" json:"accent_color"`
+    // LogoURL is shown in the HTML invoice; PDFs show the display name instead
+    LogoURL   string    `bson:"logo_url,omitempty" json:"logo_url,omitempty"`
+    Footer    string    `bson:"footer,omitempty" json:"footer,omitempty"`
+    UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+func brandings() *mongo.Collection {
+    return client.Database("billing").Collection("branding")
+}
+
+// brandingFor returns the branding of organization, or the default one.
+func brandingFor(ctx context.Context, organization string) (Branding, error) {
+    for _, id := range []string{organization, "default"} {
+        var branding Branding
+        err := brandings().FindOne(ctx, bson.M{"_id": id}).Decode(&branding)
+        if err == nil {
+            return branding, nil
+        }
+        if err != mongo.ErrNoDocuments {
+            return branding, err
+        }
+    }
+    return Branding{Organization: organization, DisplayName: organization, AccentColor: defaultAccentColor}, nil
+}
+
+// brandingHandler gets (GET) or replaces (PUT) the branding of the organization
+// in the path.
+func brandingHandler(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request for invoice branding")
+
+    organization := req.URL.Path[len("/billings/branding/"):]
+    if organization == "" || strings.Contains(organization, "/") {
+        http.Error(w, "Invalid organization", http.StatusBadRequest)
+        return
+    }
+
+    switch req.Method {
+    case http.MethodGet:
+        var branding Branding
+        err := brandings().FindOne(context.TODO(), bson.M{"_id": organization}).Decode(&branding)
+        if err == mongo.ErrNoDocuments {
+            http.Error(w, "Branding not found", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            http.Error(w, "Failed to get branding", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(branding)
+    case http.MethodPut:
+        var branding Branding
+        if err := json.NewDecoder(req.Body).Decode(&branding); err != nil {
+            http.Error(w, "Invalid request body", http.StatusBadRequest)
+            return
+        }
+        branding.Organization = organization
+        if branding.AccentColor == "" {
+            branding.AccentColor = defaultAccentColor
+        }
+        var validationErrs ValidationError
+        if strings.TrimSpace(branding.DisplayName) == "" {
+            validationErrs = append(validationErrs, FieldError{Field: "display_name", Code: "required", Message: "is required"})
+        }
+        if !colorPattern.MatchString(branding.AccentColor) {
+            validationErrs = append(validationErrs, FieldError{Field: "accent_color", Code: "invalid_value", Message: "must be a color like #1f4e79"})
+        }
+        if branding.LogoURL != "" {
+            if logo, err := url.Parse(branding.LogoURL); err != nil || (logo.Scheme != "https" && logo.Scheme != "http") || logo.Host == "" {
+                validationErrs = append(validationErrs, FieldError{Field: "logo_url", Code: "invalid_value", Message: "must be an http or https URL"})
+            }
+        }
+        if len(validationErrs) > 0 {
+            writeValidationError(w, validationErrs)
+            return
+        }
+        branding.UpdatedAt = time.Now().UTC()
+        _, err := brandings().ReplaceOne(context.TODO(), bson.M{"_id": organization}, branding, options.Replace().SetUpsert(true))
+        if err != nil {
+            http.Error(w, "Failed to save branding", http.StatusInternalServerError)
+            return
+        }
+        log.Printf("Branding of %s saved", organization)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(branding)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// invoiceView is an invoice as the HTML and PDF documents show it, with every
+// amount formatted in its currency.
+type invoiceView struct {
+    Kind          string
+    Title         string
+    Number        string
+    Status        string
+    Organization  string
+    Currency      string
+    Brand         Branding
+    AddressLines  []string
+    IssuedAt      string
+    DueDate       string
+    CreditsNumber string
+    CustomerTaxID string
+    TaxNotes      []string
+    Reason        string
+    Notes         string
+    Lines         []invoiceLineView
+    Subtotal      string
+    Taxes         []invoiceTaxView
+    Total         string
+    Credited      string
+    Paid          string
+    Balance       string
+    PayURL        string
+}
+
+type invoiceLineView struct {
+    Description string
+    Hours       string
+    Rate        string
+    Amount      string
+}
+
+// invoiceTaxView is one tax on the invoice, e.g. "VAT 20% (FR)".
+type invoiceTaxView struct {
+    Name   string
+    Amount string
+}
+
+func formatDate(t *time.Time) string {
+    if t == nil {
+        return ""
+    }
+    return t.Format("2 January 2006")
+}
+
+// buildInvoiceView gathers what the documents of inv show: its branding, the
+// titles of its tasks and, for a credit note, the number of its invoice. Tasks
+// task-service doesn't know (any more) are shown by ID.
+func buildInvoiceView(ctx context.Context, inv Invoice) (invoiceView, error) {
+    brand, err := brandingFor(ctx, inv.Organization)
+    if err != nil {
+        return invoiceView{}, err
+    }
+    view := invoiceView{
+        Kind:          inv.Kind,
+        Title:         "Invoice",
+        Number:        inv.Number,
+        Status:        inv.Status,
+        Organization:  inv.Organization,
+        Currency:      inv.Currency,
+        Brand:         brand,
+        IssuedAt:      formatDate(inv.IssuedAt),
+        DueDate:       formatDate(inv.DueDate),
+        CustomerTaxID: inv.CustomerTaxID,
+        TaxNotes:      inv.TaxNotes,
+        Reason:        inv.Reason,
+        Notes:         inv.Notes,
+        Subtotal:      inv.Subtotal.Format(inv.Currency),
+        Total:         inv.Total.Format(inv.Currency),
+    }
+    for _, tax := range inv.Taxes {
+        name := fmt.Sprintf("%s (%s)", tax.Name, tax.Jurisdiction)
+        switch tax.Treatment {
+        case taxExempt:
+            name += ", exempt"
+        case taxReverseCharge:
+            name += ", reverse charge"
+        case taxCharged:
+            if tax.Inclusive {
+                name += ", included"
+            }
+        }
+        view.Taxes = append(view.Taxes, invoiceTaxView{Name: name, Amount: tax.Amount.Format(inv.Currency)})
+    }
+    if brand.Address != "" {
+        view.AddressLines = strings.Split(strings.ReplaceAll(brand.Address, "\r\n", "\n"), "\n")
+    }
+    if inv.Kind == kindCreditNote {
+        view.Title = "Credit Note"
+        if inv.CreditsInvoiceID != nil {
+            if credited, err := findInvoice(ctx, *inv.CreditsInvoiceID); err == nil {
+                view.CreditsNumber = credited.Number
+            }
+        }
+    }
+    if inv.Credited != 0 {
+        view.Credited = inv.Credited.Format(inv.Currency)
+    }
+    if inv.Paid != 0 {
+        view.Paid = inv.Paid.Format(inv.Currency)
+    }
+    if inv.Credited != 0 || inv.Paid != 0 {
+        view.Balance = inv.Balance().Format(inv.Currency)
+    }
+    if inv.PaymentLink.Usable(inv.Balance(), time.Now()) && (inv.Status == invoiceIssued || inv.Status == invoiceOverdue) {
+        view.PayURL = inv.PaymentLink.URL
+    }
+
+    // Lines describe their task as it was when they were copied; only invoices
+    // from before that look the title up
+    titles := map[primitive.ObjectID]string{}
+    for _, line := range inv.Lines {
+        if line.Description != "" {
+            titles[line.TaskID] = line.Description
+        }
+        if _, ok := titles[line.TaskID]; ok {
+            continue
+        }
+        titles[line.TaskID] = "Task " + line.TaskID.Hex()
+        var task struct {
+            Title string `json:"title"`
+        }
+        if found, err := tasks.Get(ctx, line.TaskID, &task); err != nil {
+            log.Printf("Failed to look up task %s for invoice %s: %v", line.TaskID.Hex(), inv.ID.Hex(), err)
+        } else if found && task.Title != "" {
+            titles[line.TaskID] = task.Title
+        }
+    }
+    for _, line := range inv.Lines {
+        description := line.Description
+        if description == "" {
+            description = titles[line.TaskID]
+        }
+        view.Lines = append(view.Lines, invoiceLineView{
+            Description: description,
+            Hours:       strconv.FormatFloat(line.Hours, 'f', 2, 64),
+            Rate:        line.HourlyRate.Format(inv.Currency),
+            Amount:      line.Net.Format(inv.Currency),
+        })
+    }
+    return view, nil
+}
+
+var invoiceTemplate = template.Must(template.New("invoice").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} {{if .Number}}{{.Number}}{{else}}(draft){{end}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; color: #222; margin: 0; }
+.page { max-width: 800px; margin: 0 auto; padding: 40px; border-top: 8px solid {{.Brand.AccentColor}}; }
+header { display: flex; justify-content: space-between; }
+h1 { color: {{.Brand.AccentColor}}; margin: 0 0 8px; }
+h2 { margin: 0 0 8px; text-transform: uppercase; }
+.muted { color: #666; font-size: 0.9em; }
+.draft { color: #b00; font-weight: bold; }
+table { width: 100%; border-collapse: collapse; margin-top: 32px; }
+th { background: #eee; text-align: left; }
+th, td { padding: 6px 8px; }
+td.num, th.num { text-align: right; }
+tbody tr { border-bottom: 1px solid #ddd; }
+.totals td { border: none; }
+.total td { font-weight: bold; border-top: 2px solid {{.Brand.AccentColor}}; }
+footer { margin-top: 48px; font-size: 0.8em; color: #666; }
+</style>
+</head>
+<body>
+<div class="page">
+<header>
+  <div>
+    {{if .Brand.LogoURL}}<img src="{{.Brand.LogoURL}}" alt="{{.Brand.DisplayName}}" style="max-height: 60px"><br>{{end}}
+    <h1>{{.Brand.DisplayName}}</h1>
+    <div class="muted">
+      {{range .AddressLines}}{{.}}<br>{{end}}
+      {{if .Brand.Email}}{{.Brand.Email}}<br>{{end}}
+      {{if .Brand.Website}}{{.Brand.Website}}<br>{{end}}
+      {{if .Brand.TaxID}}Tax ID: {{.Brand.TaxID}}{{end}}
+    </div>
+  </div>
+  <div>
+    <h2>{{.Title}}</h2>
+    {{if .Number}}<div>Number: <strong>{{.Number}}</strong></div>{{else}}<div class="draft">DRAFT</div>{{end}}
+    <div>Organization: {{.Organization}}</div>
+    {{if .IssuedAt}}<div>Issued: {{.IssuedAt}}</div>{{end}}
+    {{if .DueDate}}<div>Due: {{.DueDate}}</div>{{end}}
+    {{if .CreditsNumber}}<div>Credits invoice: {{.CreditsNumber}}</div>{{end}}
+    {{if .CustomerTaxID}}<div>Customer tax ID: {{.CustomerTaxID}}</div>{{end}}
+    <div>Status: {{.Status}}</div>
+  </div>
+</header>
+<table>
+  <thead>
+    <tr><th>Description</th><th class="num">Hours</th><th class="num">Rate</th><th class="num">Amount ({{.Currency}})</th></tr>
+  </thead>
+  <tbody>
+    {{range .Lines}}<tr><td>{{.Description}}</td><td class="num">{{.Hours}}</td><td class="num">{{.Rate}}</td><td class="num">{{.Amount}}</td></tr>
+    {{end}}
+  </tbody>
+  <tbody class="totals">
+    <tr><td colspan="3" class="num">Subtotal</td><td class="num">{{.Subtotal}}</td></tr>
+    {{range .Taxes}}<tr><td colspan="3" class="num">{{.Name}}</td><td class="num">{{.Amount}}</td></tr>
+    {{end}}
+    <tr class="total"><td colspan="3" class="num">Total</td><td class="num">{{.Total}} {{.Currency}}</td></tr>
+    {{if .Credited}}<tr><td colspan="3" class="num">Credited</td><td class="num">-{{.Credited}}</td></tr>{{end}}
+    {{if .Paid}}<tr><td colspan="3" class="num">Paid</td><td class="num">-{{.Paid}}</td></tr>{{end}}
+    {{if .Balance}}<tr class="total"><td colspan="3" class="num">Balance</td><td class="num">{{.Balance}} {{.Currency}}</td></tr>{{end}}
+  </tbody>
+</table>
+{{range .TaxNotes}}<p class="muted">{{.}}</p>{{end}}
+{{if .Reason}}<p><strong>Reason:</strong> {{.Reason}}</p>{{end}}
+{{if .Notes}}<p>{{.Notes}}</p>{{end}}
+{{if .PayURL}}<p><a href="{{.PayURL}}">Pay this invoice online</a></p>{{end}}
+{{if .Brand.Footer}}<footer>{{.Brand.Footer}}</footer>{{end}}
+</div>
+</body>
+</html>
+`))
+
+func renderInvoiceHTML(view invoiceView) ([]byte, error) {
+    var out bytes.Buffer
+    if err := invoiceTemplate.Execute(&out, view); err != nil {
+        return nil, err
+    }
+    return out.Bytes(), nil
+}
+
+func parseColor(hex string) rgb {
+    value, err := strconv.ParseUint(strings.TrimPrefix(hex, "#"), 16, 32)
+    if err != nil || !colorPattern.MatchString(hex) {
+        return parseColor(defaultAccentColor)
+    }
+    return rgb{uint8(value >> 16), uint8(value >> 8), uint8(value)}
+}
+
+// renderInvoicePDF lays the invoice out on A4 pages, repeating the table header
+// on every page the lines continue on.
+func renderInvoicePDF(view invoiceView) []byte {
+    const (
+        left      = 50.0
+        right     = pdfPageWidth - 50
+        bottom    = pdfPageHeight - 80
+        rowHeight = 16.0
+    )
+    var (
+        accent = parseColor(view.Brand.AccentColor)
+        text   = rgb{34, 34, 34}
+        muted  = rgb{102, 102, 102}
+        rule   = rgb{221, 221, 221}
+    )
+
+    title := view.Title
+    if view.Number != "" {
+        title += " " + view.Number
+    }
+    doc := newPDF(title)
+    doc.AddPage()
+    doc.Rect(0, 0, pdfPageWidth, 8, accent)
+
+    // Sender on the left, the invoice's details on the right
+    y := 60.0
+    doc.Text(left, y, 18, true, accent, truncateText(view.Brand.DisplayName, 280, 18, true))
+    var sender []string
+    sender = append(sender, view.AddressLines...)
+    for _, line := range []string{view.Brand.Email, view.Brand.Website} {
+        if line != "" {
+            sender = append(sender, line)
+        }
+    }
+    if view.Brand.TaxID != "" {
+        sender = append(sender, "Tax ID: "+view.Brand.TaxID)
+    }
+    for i, line := range sender {
+        doc.Text(left, y+18+float64(i)*12, 9, false, muted, truncateText(line, 280, 9, false))
+    }
+
+    doc.TextRight(right, y, 20, true, text, strings.ToUpper(view.Title))
+    details := []string{"Organization: " + view.Organization}
+    if view.Number != "" {
+        details = append([]string{"Number: " + view.Number}, details...)
+    }
+    if view.IssuedAt != "" {
+        details = append(details, "Issued: "+view.IssuedAt)
+    }
+    if view.DueDate != "" {
+        details = append(details, "Due: "+view.DueDate)
+    }
+    if view.CreditsNumber != "" {
+        details = append(details, "Credits invoice: "+view.CreditsNumber)
+    }
+    if view.CustomerTaxID != "" {
+        details = append(details, "Customer tax ID: "+view.CustomerTaxID)
+    }
+    details = append(details, "Status: "+view.Status)
+    detailsY := y + 18
+    if view.Number == "" {
+        doc.TextRight(right, detailsY, 11, true, rgb{187, 0, 0}, "DRAFT")
+        detailsY += 14
+    }
+    for i, line := range details {
+        doc.TextRight(right, detailsY+float64(i)*12, 9, false, text, line)
+    }
+
+    y += 18 + float64(max(len(sender), len(details)+1))*12 + 24
+    tableHeader := func() {
+        doc.Rect(left, y-12, right-left, rowHeight, rgb{238, 238, 238})
+        doc.Text(left+4, y, 9, true, text, "Description")
+        doc.TextRight(360, y, 9, true, text, "Hours")
+        doc.TextRight(450, y, 9, true, text, "Rate")
+        doc.TextRight(right-4, y, 9, true, text, "Amount ("+view.Currency+")")
+        y += rowHeight + 2
+    }
+    tableHeader()
+    for _, line := range view.Lines {
+        if y > bottom {
+            doc.AddPage()
+            y = 60
+            tableHeader()
+        }
+        doc.Text(left+4, y, 9, false, text, truncateText(line.Description, 240, 9, false))
+        doc.TextRight(360, y, 9, false, text, line.Hours)
+        doc.TextRight(450, y, 9, false, text, line.Rate)
+        doc.TextRight(right-4, y, 9, false, text, line.Amount)
+        doc.Line(left, y+5, right, y+5, 0.5, rule)
+        y += rowHeight
+    }
+
+    // Totals, kept together on one page
+    type total struct {
+        label, amount string
+        bold          bool
+    }
+    totals := []total{{"Subtotal", view.Subtotal, false}}
+    for _, tax := range view.Taxes {
+        totals = append(totals, total{tax.Name, tax.Amount, false})
+    }
+    totals = append(totals, total{"Total", view.Total + " " + view.Currency, true})
+    if view.Credited != "" {
+        totals = append(totals, total{"Credited", "-" + view.Credited, false})
+    }
+    if view.Paid != "" {
+        totals = append(totals, total{"Paid", "-" + view.Paid, false})
+    }
+    if view.Balance != "" {
+        totals = append(totals, total{"Balance", view.Balance + " " + view.Currency, true})
+    }
+    if y+float64(len(totals))*rowHeight > bottom {
+        doc.AddPage()
+        y = 60
+    }
+    y += 6
+    for _, t := range totals {
+        if t.bold {
+            doc.Line(360, y-12, right, y-12, 1, accent)
+        }
+        doc.TextRight(450, y, 9, t.bold, text, t.label)
+        doc.TextRight(right-4, y, 9, t.bold, text, t.amount)
+        y += rowHeight
+    }
+
+    paragraphs := append(append([]string{}, view.TaxNotes...), prefixed("Reason: ", view.Reason), view.Notes, prefixed("Pay online: ", view.PayURL))
+    for _, paragraph := range paragraphs {
+        if paragraph == "" {
+            continue
+        }
+        y += 8
+        for _, line := range wrapText(paragraph, right-left, 9) {
+            if y > bottom {
+                doc.AddPage()
+                y = 60
+            }
+            doc.Text(left, y, 9, false, text, line)
+            y += 12
+        }
+    }
+
+    // Footer and page numbers once the number of pages is known
+    for page := 0; page < doc.PageCount(); page++ {
+        doc.SetPage(page)
+        if view.Brand.Footer != "" {
+            doc.Text(left, pdfPageHeight-40, 8, false, muted, truncateText(view.Brand.Footer, right-left-80, 8, false))
+        }
+        doc.TextRight(right, pdfPageHeight-40, 8, false, muted, fmt.Sprintf("Page %d of %d", page+1, doc.PageCount()))
+    }
+    return doc.Bytes()
+}
+
+func prefixed(prefix, text string) string {
+    if text == "" {
+        return ""
+    }
+    return prefix + text
+}
+
+// wrapText breaks text into lines no wider than width, at spaces where it can.
+func wrapText(text string, width, size float64) []string {
+    var lines []string
+    for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+        line := ""
+        for _, word := range strings.Fields(paragraph) {
+            candidate := strings.TrimSpace(line + " " + word)
+            if line != "" && textWidth(candidate, size, false) > width {
+                lines = append(lines, line)
+                candidate = word
+            }
+            // Words too long for a line, such as URLs, are broken up
+            for len([]rune(candidate)) > 1 && textWidth(candidate, size, false) > width {
+                runes := []rune(candidate)
+                n := len(runes) - 1
+                for n > 1 && textWidth(string(runes[:n]), size, false) > width {
+                    n--
+                }
+                lines = append(lines, string(runes[:n]))
+                candidate = string(runes[n:])
+            }
+            line = candidate
+        }
+        lines = append(lines, line)
+    }
+    return lines
+}
+
+// invoiceDocument serves an invoice or credit note as a PDF (/billings/<id>/pdf)
+// or an HTML page (/billings/<id>/html).
+func invoiceDocument(w http.ResponseWriter, req *http.Request) {
+    invoiceID, format, ok := strings.Cut(req.URL.Path[len("/billings/"):], "/")
+    if !ok || (format != "pdf" && format != "html") {
+        http.NotFound(w, req)
+        return
+    }
+    log.Printf("Received request to render invoice as %s", format)
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    objectID, err := primitive.ObjectIDFromHex(invoiceID)
+    if err != nil {
+        http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+        return
+    }
+    inv, err := findInvoice(context.TODO(), objectID)
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to get invoice")
+        return
+    }
+    view, err := buildInvoiceView(req.Context(), inv)
+    if err != nil {
+        http.Error(w, "Failed to render invoice", http.StatusInternalServerError)
+        return
+    }
+
+    name := inv.Number
+    if name == "" {
+        name = "draft-" + inv.ID.Hex()
+    }
+    w.Header().Set("ETag", etag(inv.Version))
+    if format == "html" {
+        body, err := renderInvoiceHTML(view)
+        if err != nil {
+            log.Printf("Failed to render invoice %s: %v", inv.ID.Hex(), err)
+            http.Error(w, "Failed to render invoice", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        w.Write(body)
+        return
+    }
+    w.Header().Set("Content-Type", "application/pdf")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", name+".pdf"))
+    w.Write(renderInvoicePDF(view))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestPdfString(t *testing.T) {
+    tests := []struct {
+        text string
+        want string
+    }{
+        {"Invoice INV-000042", "(Invoice INV-000042)"},
+        {"Fix (urgent) C:\\temp", `(Fix \(urgent\) C:\\temp)`},
+        {"line\nbreak\ttab", "(line break tab)"},
+        {"Café 50 €", `(Caf\351 50 \200)`},
+        {"“quoted” – done", `(\223quoted\224 \226 done)`},
+        {"東京", "(??)"},
+        {"", "()"},
+    }
+    for _, tc := range tests {
+        if got := pdfString(tc.text); got != tc.want {
+            t.Errorf("%q: Want %s, Got %s", tc.text, tc.want, got)
+        }
+    }
+}
+
+func TestWrapText(t *testing.T) {
+    // At size 10, a digit is 5.56 wide
+    tests := []struct {
+        name  string
+        text  string
+        width float64
+        want  []string
+    }{
+        {"fits", "11 22", 30, []string{"11 22"}},
+        {"wraps between words", "11 22 33", 30, []string{"11 22", "33"}},
+        {"keeps paragraphs", "11\r\n\n22", 30, []string{"11", "", "22"}},
+        {"breaks long words", "1234567890", 30, []string{"12345", "67890"}},
+        {"breaks long words after others", "11 1234567", 30, []string{"11", "12345", "67"}},
+        {"collapses spaces", "  11   22  ", 30, []string{"11 22"}},
+        {"empty", "", 30, []string{""}},
+    }
+    for _, tc := range tests {
+        got := wrapText(tc.text, tc.width, 10)
+        if !reflect.DeepEqual(got, tc.want) {
+            t.Errorf("%s: Want %q, Got %q", tc.name, tc.want, got)
+        }
+        for _, line := range got {
+            if len([]rune(line)) > 1 && textWidth(line, 10, false) > tc.width {
+                t.Errorf("%s: Want %q to fit in %v, Got width %v", tc.name, line, tc.width, textWidth(line, 10, false))
+            }
+        }
+    }
+    if lines := wrapText(strings.Repeat("word ", 50), 100, 10); len(lines) < 2 {
+        t.Errorf("Want a long paragraph wrapped, Got %q", lines)
+    }
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Domain events exchanged between the services.
+const (
+    eventTaskCreated            = "TaskCreated"
+    eventTaskCompleted          = "TaskCompleted"
+    eventInvoiceRequested       = "InvoiceRequested"
+    eventInvoiceIssued          = "InvoiceIssued"
+    eventUserDeleted            = "UserDeleted"
+    eventUserDataPurged         = "UserDataPurged"
+    eventBudgetThresholdReached = "BudgetThresholdReached"
+)
+
+// Event is the envelope every domain event travels in. Data holds the event
+// type's payload as JSON.
+type Event struct {
+    ID         string          `json:"id"`
+    Type       string          `json:"type"`
+    Source     string          `json:"source"`
+    OccurredAt time.Time       `json:"occurred_at"`
+    Data       json.RawMessage `json:"data"`
+}
+
+// EventHandler processes one event. Returning an error asks the bus to deliver
+// the event again later, so handlers must be safe to repeat.
+type EventHandler func(ctx context.Context, event Event) error
+
+// EventBus publishes events and delivers them to subscribers.
+type EventBus interface {
+    Publish(ctx context.Context, event Event) error
+    Subscribe(eventType string, handler EventHandler) error
+    Close() error
+}
+
+// TaskInvoiceEvent is the payload of TaskCompleted and InvoiceRequested from
+// task-service. Hours is zero when a completed task has nothing left to bill.
+// Organization and ProjectID pick the task's rate card.
+type TaskInvoiceEvent struct {
+    IdempotencyKey string             `json:"idempotency_key"`
+    TaskID         primitive.ObjectID `json:"task_id"`
+    UserID         primitive.ObjectID `json:"user_id"`
+    Organization   string             `json:"organization,omitempty"`
+    ProjectID      primitive.ObjectID `json:"project_id"`
+    Hours          float64            `json:"hours"`
+}
+
+// InvoiceIssuedEvent is published once an invoice exists.
+type InvoiceIssuedEvent struct {
+    IdempotencyKey string             `json:"idempotency_key"`
+    TaskID         primitive.ObjectID `json:"task_id"`
+    InvoiceID      primitive.ObjectID `json:"invoice_id"`
+    Hours          float64            `json:"hours"`
+    Amount         string             `json:"amount"`
+    Currency       string             `json:"currency"`
+}
+
+// UserDeletedEvent is published when a deleted user's grace period is over and
+// their data is purged. TaskPolicy says what happens to their tasks: "reassign"
+// them to ReassignTo, "anonymize" them by unassigning, or "delete" them.
+type UserDeletedEvent struct {
+    UserID     primitive.ObjectID  `json:"user_id"`
+    DeletionID primitive.ObjectID  `json:"deletion_id"`
+    TaskPolicy string              `json:"task_policy"`
+    ReassignTo *primitive.ObjectID `json:"reassign_to,omitempty"`
+}
+
+// UserDataPurgedEvent reports what a service changed for a user deletion.
+type UserDataPurgedEvent struct {
+    DeletionID primitive.ObjectID `json:"deletion_id"`
+    UserID     primitive.ObjectID `json:"user_id"`
+    Service    string             `json:"service"`
+    Changes    map[string]int64   `json:"changes"`
+}
+
+// BudgetAlertEvent is published, and sent to the budget's webhook, when the
+// billings of a budget's task tree reach one of its thresholds.
+type BudgetAlertEvent struct {
+    BudgetID  primitive.ObjectID `json:"budget_id"`
+    TaskID    primitive.ObjectID `json:"task_id"`
+    Kind      string             `json:"kind"`
+    Threshold int                `json:"threshold"`
+    Percent   float64            `json:"percent"`
+    Limit     string             `json:"limit"`
+    Used      string             `json:"used"`
+    Currency  string             `json:"currency,omitempty"`
+    Hard      bool               `json:"hard"`
+}
+
+var bus EventBus
+
+// newEventBus returns the bus selected by EVENT_BUS: "nats" (default) at
+// NATS_URL, which fails when NATS can't be reached, or "memory", which only
+// reaches subscribers in this process and is meant for tests.
+func newEventBus(service string) (EventBus, error) {
+    switch os.Getenv("EVENT_BUS") {
+    case "memory":
+        return NewMemoryBus(), nil
+    case "", "nats":
+        url := os.Getenv("NATS_URL")
+        if url == "" {
+            url = "nats://nats:4222"
+        }
+        natsBus, err := NewNATSBus(url, service)
+        if err != nil {
+            return nil, fmt.Errorf("NATS at %s: %w", url, err)
+        }
+        return natsBus, nil
+    default:
+        return nil, fmt.Errorf("unknown EVENT_BUS %q", os.Getenv("EVENT_BUS"))
+    }
+}
+
+// newEvent wraps data in an envelope. An empty id gets a new one; pass a stable
+// id to let the bus drop duplicates of the same event.
+func newEvent(id, eventType string, data interface{}) (Event, error) {
+    payload, err := json.Marshal(data)
+    if err != nil {
+        return Event{}, err
+    }
+    if id == "" {
+        id = primitive.NewObjectID().Hex()
+    }
+    return Event{ID: id, Type: eventType, Source: "billing-service", OccurredAt: time.Now().UTC(), Data: payload}, nil
+}
+
+// MemoryBus delivers events synchronously to handlers in the same process.
+type MemoryBus struct {
+    mu       sync.RWMutex
+    handlers map[string][]EventHandler
+}
+
+func NewMemoryBus() *MemoryBus {
+    return &MemoryBus{handlers: map[string][]EventHandler{}}
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, event Event) error {
+    b.mu.RLock()
+    handlers := append([]EventHandler(nil), b.handlers[event.Type]...)
+    b.mu.RUnlock()
+
+    var errs []error
+    for _, handler := range handlers {
+        if err := handler(ctx, event); err != nil {
+            errs = append(errs, err)
+        }
+    }
+    return errors.Join(errs...)
+}
+
+func (b *MemoryBus) Subscribe(eventType string, handler EventHandler) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.handlers[eventType] = append(b.handlers[eventType], handler)
+    return nil
+}
+
+func (b *MemoryBus) Close() error {
+    return nil
+}
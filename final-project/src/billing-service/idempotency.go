@@ -0,0 +1,149 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ensureIdempotencyIndex makes an idempotency key usable only once, so concurrent
+// retries of the same request can't both create a billing.
+func ensureIdempotencyIndex() error {
+    _, err := client.Database("billing").Collection("billings").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+        Keys: bson.D{{Key: "idempotency_key", Value: 1}},
+        Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+            "idempotency_key": bson.M{"$type": "string"},
+        }),
+    })
+    return err
+}
+
+// billingStore is where insertBilling looks for and stores billings.
+type billingStore interface {
+    // FindByIdempotencyKey returns the billing created with key, if there is one.
+    // Requests without a key never match.
+    FindByIdempotencyKey(key string) (Billing, bool, error)
+    // Insert stores billing, recording change in the audit log. A billing whose
+    // idempotency key is taken gives a duplicate key error.
+    Insert(billing Billing, change billingChange) error
+}
+
+// billingRecords is the store of new billings.
+var billingRecords billingStore = mongoBillings{}
+
+// mongoBillings is the billingStore of the billings collection, whose unique
+// index on idempotency_key refuses a second billing with the same key.
+type mongoBillings struct{}
+
+func (mongoBillings) FindByIdempotencyKey(key string) (Billing, bool, error) {
+    var billing Billing
+    if key == "" {
+        return billing, false, nil
+    }
+    err := client.Database("billing").Collection("billings").FindOne(context.TODO(), bson.M{"idempotency_key": key}).Decode(&billing)
+    if err == mongo.ErrNoDocuments {
+        return billing, false, nil
+    }
+    return billing, err == nil, err
+}
+
+func (mongoBillings) Insert(billing Billing, change billingChange) error {
+    return withTransaction(func(ctx mongo.SessionContext) error {
+        if _, err := client.Database("billing").Collection("billings").InsertOne(ctx, billing); err != nil {
+            return err
+        }
+        return recordBillingChange(ctx, change, nil, &billing)
+    })
+}
+
+// insertBilling fills in the rate, from the rate card for rc unless the billing
+// has one, and the amount and stores the billing, recording change in the audit log.
+// If a billing with the same idempotency key exists, that one is returned instead.
+func insertBilling(ctx context.Context, billing Billing, rc rateContext, change billingChange) (Billing, error) {
+    if existing, found, err := billingRecords.FindByIdempotencyKey(billing.IdempotencyKey); err != nil || found {
+        if found {
+            log.Printf("Billing already created for idempotency key %s: %s", billing.IdempotencyKey, existing.ID.Hex())
+        }
+        return existing, err
+    }
+
+    if billing.HourlyRate == nil {
+        if err := resolveRate(ctx, &billing, rc); err != nil {
+            return billing, err
+        }
+    } else {
+        billing.RateSource = rateSourceManual
+    }
+    if billing.Currency == "" {
+        billing.Currency = defaultCurrency()
+    }
+    amount, err := billAmount(billing.Hours, *billing.HourlyRate)
+    if err != nil {
+        return billing, err
+    }
+    billing.Amount = amount
+    billing.ID = primitive.NewObjectID()
+    billing.Version = 1
+
+    err = billingRecords.Insert(billing, change)
+    if mongo.IsDuplicateKeyError(err) {
+        // Lost a race with a concurrent retry of the same request
+        if existing, found, findErr := billingRecords.FindByIdempotencyKey(billing.IdempotencyKey); findErr == nil && found {
+            return existing, nil
+        }
+    }
+    return billing, err
+}
+
+// handleTaskInvoice creates the invoice task-service asked for and answers with
+// InvoiceIssued. Redelivered requests find the invoice by idempotency key and
+// announce it again, so task-service gets its answer even if the first was lost.
+func handleTaskInvoice(ctx context.Context, event Event) error {
+    var request TaskInvoiceEvent
+    if err := json.Unmarshal(event.Data, &request); err != nil {
+        log.Printf("Ignoring malformed %s event %s: %v", event.Type, event.ID, err)
+        return nil
+    }
+    if request.Hours <= 0 || request.IdempotencyKey == "" {
+        return nil
+    }
+
+    // The rate is the one of the rate card in effect when the invoice is issued
+    rc := rateContext{UserID: request.UserID, ProjectID: request.ProjectID, Organization: request.Organization, At: time.Now().UTC()}
+    if err := withUserRole(ctx, &rc); err != nil {
+        return err
+    }
+    billing, err := insertBilling(ctx, Billing{
+        UserID:         request.UserID,
+        TaskID:         request.TaskID,
+        Hours:          request.Hours,
+        IdempotencyKey: request.IdempotencyKey,
+    }, rc, billingChange{Action: auditCreated, Actor: taskServiceActor, Reason: "invoice requested for task " + request.TaskID.Hex()})
+    if err != nil {
+        return err
+    }
+
+    issued, err := newEvent("", eventInvoiceIssued, InvoiceIssuedEvent{
+        IdempotencyKey: request.IdempotencyKey,
+        TaskID:         billing.TaskID,
+        InvoiceID:      billing.ID,
+        Hours:          billing.Hours,
+        Amount:         billing.Amount.Format(billing.Currency),
+        Currency:       billing.Currency,
+    })
+    if err != nil {
+        return err
+    }
+    if err := flagBudgetOverruns(ctx, billing); err != nil {
+        log.Printf("Failed to check the hard budgets of billing %s: %v", billing.ID.Hex(), err)
+    }
+    log.Printf("Invoice %s issued for task ID: %s", billing.ID.Hex(), billing.TaskID.Hex())
+    budgetsChanged(billing.TaskID)
+    return bus.Publish(ctx, issued)
+}
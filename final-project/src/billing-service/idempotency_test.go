@@ -0,0 +1,109 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// memoryBillings is a billingStore in memory that refuses a second billing with
+// the same idempotency key, like the unique index does. concurrent, if set, is
+// stored by a concurrent retry just before the next insert.
+type memoryBillings struct {
+    billings   []Billing
+    concurrent *Billing
+    failing    error
+}
+
+func (s *memoryBillings) FindByIdempotencyKey(key string) (Billing, bool, error) {
+    for _, billing := range s.billings {
+        if key != "" && billing.IdempotencyKey == key {
+            return billing, true, nil
+        }
+    }
+    return Billing{}, false, nil
+}
+
+func (s *memoryBillings) Insert(billing Billing, change billingChange) error {
+    if s.failing != nil {
+        return s.failing
+    }
+    if s.concurrent != nil {
+        s.billings = append(s.billings, *s.concurrent)
+        s.concurrent = nil
+    }
+    if _, taken, _ := s.FindByIdempotencyKey(billing.IdempotencyKey); taken {
+        return mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "duplicate key"}}}
+    }
+    s.billings = append(s.billings, billing)
+    return nil
+}
+
+func useMemoryBillings(t *testing.T) *memoryBillings {
+    store := &memoryBillings{}
+    previous := billingRecords
+    billingRecords = store
+    t.Cleanup(func() { billingRecords = previous })
+    return store
+}
+
+func newTestBilling(key string) Billing {
+    rate := Money(10000)
+    return Billing{UserID: primitive.NewObjectID(), TaskID: primitive.NewObjectID(), Hours: 2, HourlyRate: &rate, Currency: "USD", IdempotencyKey: key}
+}
+
+func TestInsertBillingIdempotencyKey(t *testing.T) {
+    store := useMemoryBillings(t)
+    change := billingChange{Action: auditCreated, Actor: taskServiceActor}
+
+    first, err := insertBilling(context.Background(), newTestBilling("task-1"), rateContext{}, change)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if first.Amount != 20000 || first.ID.IsZero() || first.Version != 1 {
+        t.Errorf("Want a new billing of 20000, Got %+v", first)
+    }
+
+    // task-service publishes an invoice again until it hears back
+    again, err := insertBilling(context.Background(), newTestBilling("task-1"), rateContext{}, change)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if again.ID != first.ID || len(store.billings) != 1 {
+        t.Errorf("Retry: Want billing %s returned and 1 stored, Got %s and %d stored", first.ID.Hex(), again.ID.Hex(), len(store.billings))
+    }
+
+    // Billings without a key are never taken for each other
+    for i := 0; i < 2; i++ {
+        if _, err := insertBilling(context.Background(), newTestBilling(""), rateContext{}, change); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if len(store.billings) != 3 {
+        t.Errorf("Want 3 billings stored, Got %d", len(store.billings))
+    }
+}
+
+func TestInsertBillingConcurrentRetry(t *testing.T) {
+    store := useMemoryBillings(t)
+    change := billingChange{Action: auditCreated, Actor: taskServiceActor}
+    winner := newTestBilling("task-1")
+    winner.ID = primitive.NewObjectID()
+    store.concurrent = &winner
+
+    got, err := insertBilling(context.Background(), newTestBilling("task-1"), rateContext{}, change)
+    if err != nil {
+        t.Fatalf("Want the concurrent retry's billing, Got %v", err)
+    }
+    if got.ID != winner.ID || len(store.billings) != 1 {
+        t.Errorf("Want billing %s and 1 stored, Got %s and %d stored", winner.ID.Hex(), got.ID.Hex(), len(store.billings))
+    }
+
+    store.failing = errors.New("database unavailable")
+    if _, err := insertBilling(context.Background(), newTestBilling("task-2"), rateContext{}, change); !errors.Is(err, store.failing) {
+        t.Errorf("Want the store's error, Got %v", err)
+    }
+}
@@ -0,0 +1,1148 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of invoice documents.
+const (
+    kindInvoice    = "invoice"
+    kindCreditNote = "credit_note"
+)
+
+// Invoice statuses.
+const (
+    invoiceDraft   = "draft"
+    invoiceIssued  = "issued"
+    invoicePaid    = "paid"
+    invoiceVoid    = "void"
+    invoiceOverdue = "overdue"
+)
+
+// maxInvoiceLines limits the number of billings on one invoice.
+const maxInvoiceLines = 500
+
+// invoiceTransitions lists the statuses an invoice can be moved to from each
+// status. Overdue is only set by the overdue sweep, and paid and void are final:
+// a paid invoice is corrected with a credit note.
+var invoiceTransitions = map[string][]string{
+    invoiceDraft:   {invoiceIssued},
+    invoiceIssued:  {invoicePaid, invoiceVoid},
+    invoiceOverdue: {invoicePaid, invoiceVoid},
+}
+
+// creditNoteTransitions is the same for credit notes, which are issued when
+// they are created.
+var creditNoteTransitions = map[string][]string{
+    invoiceIssued: {invoiceVoid},
+}
+
+// InvoiceLine is a billing on an invoice, copied when the invoice is issued so the
+// invoice never changes afterwards. Amount is the billed amount; Net and Tax are
+// what it comes to before and in taxes, and Total is what the customer pays.
+type InvoiceLine struct {
+    BillingID  primitive.ObjectID `bson:"billing_id" json:"billing_id"`
+    TaskID     primitive.ObjectID `bson:"task_id" json:"task_id"`
+    UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
+    Hours      float64            `bson:"hours" json:"hours"`
+    HourlyRate Money              `bson:"hourly_rate_minor" json:"-"`
+    Amount     Money              `bson:"amount_minor" json:"-"`
+    Net        Money              `bson:"net_minor" json:"-"`
+    Tax        Money              `bson:"tax_minor" json:"-"`
+    Total      Money              `bson:"total_minor" json:"-"`
+    Taxes      []LineTax          `bson:"taxes,omitempty" json:"-"`
+    // Credited is how much of Total credit notes have taken back
+    Credited Money `bson:"credited_minor,omitempty" json:"-"`
+    // Description is the task's title when the line was last copied from its
+    // billing, so an issued invoice keeps showing what it was issued with
+    Description string `bson:"description,omitempty" json:"description,omitempty"`
+}
+
+// Invoice groups billings of one organization and currency. Drafts have no number;
+// issuing one gives it the organization's next number and a due date
+// PaymentTermsDays later. A credit note is an Invoice of kind credit_note that
+// takes back (part of) the lines of the invoice CreditsInvoiceID.
+type Invoice struct {
+    ID               primitive.ObjectID  `bson:"_id" json:"id"`
+    Kind             string              `bson:"kind" json:"kind"`
+    Number           string              `bson:"number,omitempty" json:"number,omitempty"`
+    Organization     string              `bson:"organization" json:"organization"`
+    Status           string              `bson:"status" json:"status"`
+    Currency         string              `bson:"currency" json:"currency"`
+    Lines            []InvoiceLine       `bson:"lines" json:"-"`
+    Subtotal         Money               `bson:"subtotal_minor" json:"-"`
+    Tax              Money               `bson:"tax_minor" json:"-"`
+    Total            Money               `bson:"total_minor" json:"-"`
+    Taxes            []InvoiceTax        `bson:"taxes,omitempty" json:"-"`
+    // TaxJurisdiction and CustomerTaxID are the customer's when it was taxed, and
+    // TaxNotes explain taxes it was exempt from or has to account for itself
+    TaxJurisdiction  string              `bson:"tax_jurisdiction,omitempty" json:"tax_jurisdiction,omitempty"`
+    CustomerTaxID    string              `bson:"customer_tax_id,omitempty" json:"customer_tax_id,omitempty"`
+    TaxNotes         []string            `bson:"tax_notes,omitempty" json:"tax_notes,omitempty"`
+    Credited         Money               `bson:"credited_minor" json:"-"`
+    // Paid is what payments have paid off, each of them listed in Payments
+    Paid             Money               `bson:"paid_minor,omitempty" json:"-"`
+    Payments         []InvoicePayment    `bson:"payments,omitempty" json:"-"`
+    // Overpaid is what was paid beyond what credit notes left to pay; it was
+    // turned into customer credit, a payment of method credit_note
+    Overpaid         Money               `bson:"overpaid_minor,omitempty" json:"-"`
+    // CreditPaymentID is, on a credit note, the payment that holds the customer
+    // credit it gave
+    CreditPaymentID  *primitive.ObjectID `bson:"credit_payment_id,omitempty" json:"credit_payment_id,omitempty"`
+    PaymentLink      *PaymentLink        `bson:"payment_link,omitempty" json:"payment_link,omitempty"`
+    PaymentTermsDays int                 `bson:"payment_terms_days" json:"payment_terms_days"`
+    CreditsInvoiceID *primitive.ObjectID `bson:"credits_invoice_id,omitempty" json:"credits_invoice_id,omitempty"`
+    Reason           string              `bson:"reason,omitempty" json:"reason,omitempty"`
+    Notes            string              `bson:"notes,omitempty" json:"notes,omitempty"`
+    IssuedAt         *time.Time          `bson:"issued_at,omitempty" json:"issued_at,omitempty"`
+    DueDate          *time.Time          `bson:"due_date,omitempty" json:"due_date,omitempty"`
+    PaidAt           *time.Time          `bson:"paid_at,omitempty" json:"paid_at,omitempty"`
+    VoidedAt         *time.Time          `bson:"voided_at,omitempty" json:"voided_at,omitempty"`
+    Version          int64               `bson:"version" json:"version"`
+    CreatedAt        time.Time           `bson:"created_at" json:"created_at"`
+}
+
+// MarshalJSON writes amounts as decimals in the invoice's currency. Balance is
+// what is left of the total after credit notes and payments.
+func (inv Invoice) MarshalJSON() ([]byte, error) {
+    type invoice Invoice
+    type tax struct {
+        LineTax
+        Rate    string `json:"rate"`
+        Taxable string `json:"taxable,omitempty"`
+        Amount  string `json:"amount"`
+    }
+    type line struct {
+        InvoiceLine
+        HourlyRate string `json:"hourly_rate"`
+        Amount     string `json:"amount"`
+        Net        string `json:"net"`
+        Tax        string `json:"tax"`
+        Total      string `json:"total"`
+        Taxes      []tax  `json:"taxes,omitempty"`
+        Credited   string `json:"credited,omitempty"`
+    }
+    lines := make([]line, len(inv.Lines))
+    for i, l := range inv.Lines {
+        lines[i] = line{
+            InvoiceLine: l,
+            HourlyRate:  l.HourlyRate.Format(inv.Currency),
+            Amount:      l.Amount.Format(inv.Currency),
+            Net:         l.Net.Format(inv.Currency),
+            Tax:         l.Tax.Format(inv.Currency),
+            Total:       l.Total.Format(inv.Currency),
+        }
+        for _, t := range l.Taxes {
+            lines[i].Taxes = append(lines[i].Taxes, tax{LineTax: t, Rate: formatRate(t.Rate), Amount: t.Amount.Format(inv.Currency)})
+        }
+        if l.Credited != 0 {
+            lines[i].Credited = l.Credited.Format(inv.Currency)
+        }
+    }
+    taxes := []tax{}
+    for _, t := range inv.Taxes {
+        taxes = append(taxes, tax{LineTax: t.LineTax, Rate: formatRate(t.Rate), Taxable: t.Taxable.Format(inv.Currency), Amount: t.Amount.Format(inv.Currency)})
+    }
+    type payment struct {
+        InvoicePayment
+        Amount string `json:"amount"`
+    }
+    payments := []payment{}
+    for _, p := range inv.Payments {
+        payments = append(payments, payment{p, p.Amount.Format(inv.Currency)})
+    }
+    var overpaid string
+    if inv.Overpaid != 0 {
+        overpaid = inv.Overpaid.Format(inv.Currency)
+    }
+    return json.Marshal(struct {
+        invoice
+        Lines    []line    `json:"lines"`
+        Subtotal string    `json:"subtotal"`
+        Tax      string    `json:"tax"`
+        Taxes    []tax     `json:"taxes"`
+        Total    string    `json:"total"`
+        Credited string    `json:"credited"`
+        Paid     string    `json:"paid"`
+        Payments []payment `json:"payments"`
+        Overpaid string    `json:"overpaid,omitempty"`
+        Balance  string    `json:"balance"`
+    }{invoice(inv), lines, inv.Subtotal.Format(inv.Currency), inv.Tax.Format(inv.Currency), taxes,
+        inv.Total.Format(inv.Currency), inv.Credited.Format(inv.Currency), inv.Paid.Format(inv.Currency), payments,
+        overpaid, inv.Balance().Format(inv.Currency)})
+}
+
+// Balance is what the customer still owes. What they paid beyond what credit
+// notes left to pay is Overpaid and their credit, so it doesn't count here.
+func (inv Invoice) Balance() Money {
+    return inv.Total - inv.Credited - inv.Paid + inv.Overpaid
+}
+
+// creditExcess is how much of a credit of amount on inv goes beyond its
+// balance, and so was already paid and becomes customer credit.
+func creditExcess(inv Invoice, amount Money) Money {
+    return max(amount-max(inv.Balance(), 0), 0)
+}
+
+func invoices() *mongo.Collection {
+    return client.Database("billing").Collection("invoices")
+}
+
+// ensureInvoiceIndexes makes an invoice number unique within its organization and
+// kind, and keeps the overdue sweep cheap.
+func ensureInvoiceIndexes() error {
+    _, err := invoices().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+        {
+            Keys: bson.D{{Key: "organization", Value: 1}, {Key: "kind", Value: 1}, {Key: "number", Value: 1}},
+            Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+                "number": bson.M{"$type": "string"},
+            }),
+        },
+        {Keys: bson.D{{Key: "status", Value: 1}, {Key: "due_date", Value: 1}}},
+    })
+    return err
+}
+
+// withTransaction runs fn in a MongoDB transaction. fn may be called more than
+// once if the transaction has to be retried.
+func withTransaction(fn func(ctx mongo.SessionContext) error) error {
+    session, err := client.StartSession()
+    if err != nil {
+        return err
+    }
+    defer session.EndSession(context.Background())
+
+    _, err = session.WithTransaction(context.TODO(), func(ctx mongo.SessionContext) (interface{}, error) {
+        return nil, fn(ctx)
+    })
+    return err
+}
+
+// invoicePaymentTerms is the number of days until an invoice is due, unless it
+// says otherwise, from INVOICE_PAYMENT_TERMS_DAYS (default 30).
+func invoicePaymentTerms() int {
+    days, err := strconv.Atoi(os.Getenv("INVOICE_PAYMENT_TERMS_DAYS"))
+    if err != nil || days < 0 {
+        return 30
+    }
+    return days
+}
+
+// nextInvoiceNumber takes the next number of the organization's invoices or
+// credit notes. It must run in the transaction that issues the document: if that
+// is rolled back so is the number, which keeps the numbers free of gaps.
+func nextInvoiceNumber(ctx mongo.SessionContext, organization, kind string) (string, error) {
+    var counter struct {
+        Seq int64 `bson:"seq"`
+    }
+    err := client.Database("billing").Collection("invoice_counters").FindOneAndUpdate(ctx,
+        bson.M{"_id": invoiceCounterID(organization, kind)},
+        bson.M{"$inc": bson.M{"seq": 1}},
+        options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+    ).Decode(&counter)
+    if err != nil {
+        return "", err
+    }
+    return formatInvoiceNumber(kind, counter.Seq), nil
+}
+
+// invoiceCounterID names the counter of an organization's invoices or credit
+// notes; each has its own sequence.
+func invoiceCounterID(organization, kind string) string {
+    return kind + ":" + organization
+}
+
+// formatInvoiceNumber is the number of the seq-th invoice or credit note.
+func formatInvoiceNumber(kind string, seq int64) string {
+    prefix := "INV"
+    if kind == kindCreditNote {
+        prefix = "CN"
+    }
+    return fmt.Sprintf("%s-%06d", prefix, seq)
+}
+
+// canTransition reports whether inv can be moved to status.
+func canTransition(inv Invoice, status string) bool {
+    transitions := invoiceTransitions
+    if inv.Kind == kindCreditNote {
+        transitions = creditNoteTransitions
+    }
+    for _, allowed := range transitions[inv.Status] {
+        if allowed == status {
+            return true
+        }
+    }
+    return false
+}
+
+// invoiceOpError is an invoice change that was refused, with the response for it.
+type invoiceOpError struct {
+    Status  int
+    Message string
+    Errors  ValidationError
+}
+
+func (e *invoiceOpError) Error() string {
+    if len(e.Errors) > 0 {
+        return e.Errors.Error()
+    }
+    return e.Message
+}
+
+func invoiceRefused(status int, message string) *invoiceOpError {
+    return &invoiceOpError{Status: status, Message: message}
+}
+
+func invoiceInvalid(errs ValidationError) *invoiceOpError {
+    return &invoiceOpError{Status: http.StatusUnprocessableEntity, Errors: errs}
+}
+
+var errInvoiceModified = invoiceRefused(http.StatusPreconditionFailed, "Invoice has been modified")
+
+// writeInvoiceError answers a request whose invoice change failed with err.
+func writeInvoiceError(w http.ResponseWriter, err error, failure string) {
+    var opErr *invoiceOpError
+    switch {
+    case errors.As(err, &opErr) && len(opErr.Errors) > 0:
+        writeValidationError(w, opErr.Errors)
+    case errors.As(err, &opErr):
+        http.Error(w, opErr.Message, opErr.Status)
+    default:
+        log.Printf("%s: %v", failure, err)
+        http.Error(w, failure, http.StatusInternalServerError)
+    }
+}
+
+// billedTask is what an invoice takes from a billing's task.
+type billedTask struct {
+    Organization string `json:"organization"`
+    Title        string `json:"title"`
+}
+
+// billedTasks returns each of the tasks from task-service; tasks without an
+// organization belong to "default". Tasks that no longer exist are left out.
+func billedTasks(ctx context.Context, taskIDs []primitive.ObjectID) (map[primitive.ObjectID]billedTask, error) {
+    found := map[primitive.ObjectID]billedTask{}
+    for _, id := range taskIDs {
+        if _, ok := found[id]; ok {
+            continue
+        }
+        var task billedTask
+        ok, err := tasks.Get(ctx, id, &task)
+        if err != nil {
+            return nil, err
+        }
+        if !ok {
+            continue
+        }
+        if task.Organization == "" {
+            task.Organization = "default"
+        }
+        found[id] = task
+    }
+    return found, nil
+}
+
+// attachBillings makes the billings with ids the lines of a draft: billings no
+// longer listed are released, new ones are claimed so no other invoice can take
+// them, and every line is copied again from its billing and task and taxed. Billings
+// must be for tasks of the invoice's organization. actor is
+// recorded in the audit log for the billings released and claimed.
+func attachBillings(ctx mongo.SessionContext, inv *Invoice, ids []primitive.ObjectID, actor auditActor) error {
+    if len(ids) == 0 {
+        return invoiceInvalid(ValidationError{{Field: "billing_ids", Code: "required", Message: "is required"}})
+    }
+    if len(ids) > maxInvoiceLines {
+        return invoiceInvalid(ValidationError{{Field: "billing_ids", Code: "invalid_value", Message: fmt.Sprintf("must have at most %d billings", maxInvoiceLines)}})
+    }
+
+    cursor, err := client.Database("billing").Collection("billings").Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "deleted_at": notDeleted})
+    if err != nil {
+        return err
+    }
+    var found []Billing
+    if err := cursor.All(ctx, &found); err != nil {
+        return err
+    }
+    byID := map[primitive.ObjectID]Billing{}
+    taskIDs := make([]primitive.ObjectID, 0, len(found))
+    for _, billing := range found {
+        byID[billing.ID] = billing
+        taskIDs = append(taskIDs, billing.TaskID)
+    }
+    billed, err := billedTasks(ctx, taskIDs)
+    if errors.Is(err, errLookupUnavailable) {
+        return invoiceRefused(http.StatusServiceUnavailable, "Failed to look up the billings' tasks: "+err.Error())
+    }
+    if err != nil {
+        return err
+    }
+
+    // The first billing sets the invoice's currency
+    currency := ""
+    for _, id := range ids {
+        if billing, ok := byID[id]; ok && currency == "" {
+            currency = billing.Currency
+        }
+    }
+    var errs ValidationError
+    seen := map[primitive.ObjectID]bool{}
+    var lines []InvoiceLine
+    for _, id := range ids {
+        billing, ok := byID[id]
+        switch {
+        case seen[id]:
+            continue
+        case !ok:
+            errs = append(errs, FieldError{Field: "billing_ids", Code: "not_found", Message: "billing " + id.Hex() + " does not exist"})
+        case billing.InvoiceID != nil && *billing.InvoiceID != inv.ID:
+            errs = append(errs, FieldError{Field: "billing_ids", Code: "already_invoiced", Message: "billing " + id.Hex() + " is on invoice " + billing.InvoiceID.Hex()})
+        case billing.Currency != currency:
+            errs = append(errs, FieldError{Field: "billing_ids", Code: "invalid_value", Message: "billing " + id.Hex() + " is in " + billing.Currency + ", not " + currency})
+        case billed[billing.TaskID].Organization == "":
+            errs = append(errs, FieldError{Field: "billing_ids", Code: "not_found", Message: "task " + billing.TaskID.Hex() + " of billing " + id.Hex() + " does not exist"})
+        case billed[billing.TaskID].Organization != inv.Organization:
+            errs = append(errs, FieldError{Field: "billing_ids", Code: "invalid_value", Message: "billing " + id.Hex() + " is for organization " + billed[billing.TaskID].Organization + ", not " + inv.Organization})
+        }
+        seen[id] = true
+        if len(errs) > 0 {
+            continue
+        }
+        line := InvoiceLine{BillingID: id, TaskID: billing.TaskID, UserID: billing.UserID, Description: billed[billing.TaskID].Title, Hours: billing.Hours, Amount: billing.Amount}
+        if billing.HourlyRate != nil {
+            line.HourlyRate = *billing.HourlyRate
+        }
+        lines = append(lines, line)
+    }
+    if len(errs) > 0 {
+        return invoiceInvalid(errs)
+    }
+
+    var released []primitive.ObjectID
+    attached := map[primitive.ObjectID]bool{}
+    for _, line := range inv.Lines {
+        attached[line.BillingID] = true
+        if !seen[line.BillingID] {
+            released = append(released, line.BillingID)
+        }
+    }
+    if len(released) > 0 {
+        if err := releaseBillings(ctx, bson.M{"_id": bson.M{"$in": released}, "invoice_id": inv.ID}, inv.ID, actor); err != nil {
+            return err
+        }
+    }
+    change := billingChange{Action: auditInvoiced, Actor: actor, InvoiceID: &inv.ID}
+    for _, line := range lines {
+        if attached[line.BillingID] {
+            continue
+        }
+        filter := bson.M{"_id": line.BillingID, "invoice_id": bson.M{"$exists": false}, "deleted_at": notDeleted}
+        _, matched, err := mutateBilling(ctx, filter, bson.M{"$set": bson.M{"invoice_id": inv.ID}, "$inc": bson.M{"version": 1}}, change)
+        if err != nil {
+            return err
+        }
+        if !matched {
+            return invoiceRefused(http.StatusConflict, "Billing "+line.BillingID.Hex()+" was just put on another invoice")
+        }
+    }
+
+    inv.Currency, inv.Lines = currency, lines
+    return taxInvoice(ctx, inv, time.Now().UTC())
+}
+
+// invoiceAmounts returns the fields attachBillings sets, to save them.
+func invoiceAmounts(inv Invoice) bson.M {
+    return bson.M{
+        "currency":         inv.Currency,
+        "lines":            inv.Lines,
+        "subtotal_minor":   inv.Subtotal,
+        "tax_minor":        inv.Tax,
+        "total_minor":      inv.Total,
+        "taxes":            inv.Taxes,
+        "tax_jurisdiction": inv.TaxJurisdiction,
+        "customer_tax_id":  inv.CustomerTaxID,
+        "tax_notes":        inv.TaxNotes,
+    }
+}
+
+func lineBillingIDs(inv Invoice) []primitive.ObjectID {
+    ids := make([]primitive.ObjectID, len(inv.Lines))
+    for i, line := range inv.Lines {
+        ids[i] = line.BillingID
+    }
+    return ids
+}
+
+// findInvoice loads an invoice; a missing one is a 404 invoiceOpError.
+func findInvoice(ctx context.Context, id primitive.ObjectID) (Invoice, error) {
+    var inv Invoice
+    err := invoices().FindOne(ctx, bson.M{"_id": id}).Decode(&inv)
+    if err == mongo.ErrNoDocuments {
+        return inv, invoiceRefused(http.StatusNotFound, "Invoice not found")
+    }
+    return inv, err
+}
+
+// invoiceFromPath loads the invoice whose ID follows prefix in the request path
+// and checks the request's If-Match against it.
+func invoiceFromPath(req *http.Request, prefix string) (Invoice, error) {
+    invoiceID, err := primitive.ObjectIDFromHex(req.URL.Path[len(prefix):])
+    if err != nil {
+        return Invoice{}, invoiceRefused(http.StatusBadRequest, "Invalid invoice ID")
+    }
+    inv, err := findInvoice(context.TODO(), invoiceID)
+    if err != nil {
+        return inv, err
+    }
+    if expected, ok, err := parseIfMatch(req); err != nil {
+        return inv, invoiceRefused(http.StatusBadRequest, "Invalid If-Match header")
+    } else if ok && expected != inv.Version {
+        return inv, errInvoiceModified
+    }
+    return inv, nil
+}
+
+// saveInvoice writes set to the invoice only if it is still at the version and
+// status it was read with.
+func saveInvoice(ctx mongo.SessionContext, inv Invoice, set bson.M) error {
+    filter := bson.M{"_id": inv.ID, "version": inv.Version, "status": inv.Status}
+    result, err := invoices().UpdateOne(ctx, filter, bson.M{"$set": set, "$inc": bson.M{"version": 1}})
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return errInvoiceModified
+    }
+    return nil
+}
+
+func writeInvoice(w http.ResponseWriter, status int, inv Invoice) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("ETag", etag(inv.Version))
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(inv)
+}
+
+// createInvoice creates a draft invoice for billings that aren't on another one.
+func createInvoice(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to create invoice")
+
+    if req.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var input struct {
+        Organization     string               `json:"organization"`
+        BillingIDs       []primitive.ObjectID `json:"billing_ids"`
+        PaymentTermsDays *int                 `json:"payment_terms_days"`
+        Notes            string               `json:"notes"`
+    }
+    if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    now := time.Now().UTC()
+    inv := Invoice{
+        ID:               primitive.NewObjectID(),
+        Kind:             kindInvoice,
+        Organization:     input.Organization,
+        Status:           invoiceDraft,
+        PaymentTermsDays: invoicePaymentTerms(),
+        Notes:            input.Notes,
+        Version:          1,
+        CreatedAt:        now,
+    }
+    if inv.Organization == "" {
+        inv.Organization = "default"
+    }
+    if input.PaymentTermsDays != nil {
+        if *input.PaymentTermsDays < 0 || *input.PaymentTermsDays > 365 {
+            writeValidationError(w, ValidationError{{Field: "payment_terms_days", Code: "invalid_value", Message: "must be between 0 and 365"}})
+            return
+        }
+        inv.PaymentTermsDays = *input.PaymentTermsDays
+    }
+
+    err := withTransaction(func(ctx mongo.SessionContext) error {
+        inv.Lines = nil
+        if err := attachBillings(ctx, &inv, input.BillingIDs, requestActor(req)); err != nil {
+            return err
+        }
+        _, err := invoices().InsertOne(ctx, inv)
+        return err
+    })
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to create invoice")
+        return
+    }
+    log.Printf("Draft invoice %s created with %d lines", inv.ID.Hex(), len(inv.Lines))
+    writeInvoice(w, http.StatusCreated, inv)
+}
+
+// updateInvoice changes the billings, payment terms or notes of a draft.
+func updateInvoice(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to update invoice")
+
+    if req.Method != http.MethodPut {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var input struct {
+        BillingIDs       *[]primitive.ObjectID `json:"billing_ids"`
+        PaymentTermsDays *int                  `json:"payment_terms_days"`
+        Notes            *string               `json:"notes"`
+    }
+    if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    inv, err := invoiceFromPath(req, "/billings/invoices/update/")
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to update invoice")
+        return
+    }
+    if inv.Status != invoiceDraft {
+        http.Error(w, "Only draft invoices can be changed; issue a credit note instead", http.StatusConflict)
+        return
+    }
+
+    set := bson.M{}
+    if input.PaymentTermsDays != nil {
+        if *input.PaymentTermsDays < 0 || *input.PaymentTermsDays > 365 {
+            writeValidationError(w, ValidationError{{Field: "payment_terms_days", Code: "invalid_value", Message: "must be between 0 and 365"}})
+            return
+        }
+        set["payment_terms_days"] = *input.PaymentTermsDays
+    }
+    if input.Notes != nil {
+        set["notes"] = *input.Notes
+    }
+
+    current := inv
+    err = withTransaction(func(ctx mongo.SessionContext) error {
+        inv = current
+        if input.BillingIDs != nil {
+            if err := attachBillings(ctx, &inv, *input.BillingIDs, requestActor(req)); err != nil {
+                return err
+            }
+            for key, value := range invoiceAmounts(inv) {
+                set[key] = value
+            }
+        }
+        return saveInvoice(ctx, current, set)
+    })
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to update invoice")
+        return
+    }
+
+    inv, err = findInvoice(context.TODO(), inv.ID)
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to update invoice")
+        return
+    }
+    log.Printf("Draft invoice %s updated", inv.ID.Hex())
+    writeInvoice(w, http.StatusOK, inv)
+}
+
+// setInvoiceStatus moves an invoice along its lifecycle. Issuing copies the lines
+// from their billings once more, numbers the invoice and sets its due date;
+// voiding an invoice releases its billings so they can be invoiced again, and
+// voiding a credit note gives the credited amount back to its invoice.
+func setInvoiceStatus(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to change invoice status")
+
+    if req.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var input struct {
+        Status string `json:"status"`
+    }
+    if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    inv, err := invoiceFromPath(req, "/billings/invoices/status/")
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to change invoice status")
+        return
+    }
+
+    if !canTransition(inv, input.Status) {
+        http.Error(w, fmt.Sprintf("A %s %s can't become %s", inv.Status, strings.ReplaceAll(inv.Kind, "_", " "), input.Status), http.StatusConflict)
+        return
+    }
+    // Payments mark invoices paid; by hand only what is left after credit notes
+    if input.Status == invoicePaid && inv.Balance() > 0 {
+        http.Error(w, "Invoice has a balance of "+inv.Balance().Format(inv.Currency)+" "+inv.Currency+"; record a payment instead", http.StatusConflict)
+        return
+    }
+    if input.Status == invoiceVoid && inv.Paid != 0 {
+        http.Error(w, "Invoice has payments; void them first", http.StatusConflict)
+        return
+    }
+    // Its credit notes would stay live while its billings are invoiced again
+    if input.Status == invoiceVoid && inv.Credited != 0 {
+        http.Error(w, "Invoice has credit notes; void its credit notes first", http.StatusConflict)
+        return
+    }
+
+    current := inv
+    now := time.Now().UTC()
+    err = withTransaction(func(ctx mongo.SessionContext) error {
+        inv = current
+        set := bson.M{"status": input.Status}
+        switch input.Status {
+        case invoiceIssued:
+            if err := attachBillings(ctx, &inv, lineBillingIDs(inv), requestActor(req)); err != nil {
+                return err
+            }
+            number, err := nextInvoiceNumber(ctx, inv.Organization, inv.Kind)
+            if err != nil {
+                return err
+            }
+            due := now.AddDate(0, 0, inv.PaymentTermsDays)
+            for key, value := range invoiceAmounts(inv) {
+                set[key] = value
+            }
+            set["number"], set["issued_at"], set["due_date"] = number, now, due
+        case invoicePaid:
+            set["paid_at"] = now
+        case invoiceVoid:
+            set["voided_at"] = now
+            if err := voidInvoice(ctx, inv, requestActor(req)); err != nil {
+                return err
+            }
+        }
+        return saveInvoice(ctx, current, set)
+    })
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to change invoice status")
+        return
+    }
+
+    inv, err = findInvoice(context.TODO(), inv.ID)
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to change invoice status")
+        return
+    }
+    log.Printf("Invoice %s is now %s", inv.ID.Hex(), inv.Status)
+    writeInvoice(w, http.StatusOK, inv)
+}
+
+// releaseBillings takes the billings matching filter off invoice invoiceID,
+// recording each in the audit log.
+func releaseBillings(ctx mongo.SessionContext, filter bson.M, invoiceID primitive.ObjectID, actor auditActor) error {
+    cursor, err := client.Database("billing").Collection("billings").Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+    if err != nil {
+        return err
+    }
+    var billings []struct {
+        ID primitive.ObjectID `bson:"_id"`
+    }
+    if err := cursor.All(ctx, &billings); err != nil {
+        return err
+    }
+    change := billingChange{Action: auditReleased, Actor: actor, InvoiceID: &invoiceID}
+    for _, billing := range billings {
+        update := bson.M{"$unset": bson.M{"invoice_id": ""}, "$inc": bson.M{"version": 1}}
+        if _, _, err := mutateBilling(ctx, bson.M{"_id": billing.ID, "invoice_id": invoiceID}, update, change); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// voidInvoice undoes what an invoice did: an invoice's billings are released and
+// a credit note's amounts are no longer credited on its invoice, nor is the
+// customer credit it gave left to use.
+func voidInvoice(ctx mongo.SessionContext, inv Invoice, actor auditActor) error {
+    if inv.Kind == kindInvoice {
+        return releaseBillings(ctx, bson.M{"invoice_id": inv.ID}, inv.ID, actor)
+    }
+    if inv.CreditsInvoiceID == nil {
+        return nil
+    }
+    var overpaid Money
+    if inv.CreditPaymentID != nil {
+        var payment Payment
+        if err := payments().FindOne(ctx, bson.M{"_id": *inv.CreditPaymentID}).Decode(&payment); err != nil {
+            return err
+        }
+        if err := cancelPayment(ctx, payment, time.Now().UTC()); err != nil {
+            return err
+        }
+        overpaid = payment.Amount
+    }
+    return creditLines(ctx, bson.M{"_id": *inv.CreditsInvoiceID}, inv.Lines, overpaid, -1)
+}
+
+// creditLines adds the amounts of lines, times sign, to what is credited on the
+// matching lines of the invoice matching filter and to its total, and overpaid,
+// the part of them that became customer credit, to what it was overpaid.
+func creditLines(ctx mongo.SessionContext, filter bson.M, lines []InvoiceLine, overpaid Money, sign Money) error {
+    inc := bson.M{"version": 1}
+    if overpaid != 0 {
+        inc["overpaid_minor"] = sign * overpaid
+    }
+    var total Money
+    var filters []interface{}
+    for i, line := range lines {
+        name := "l" + strconv.Itoa(i)
+        inc["lines.$["+name+"].credited_minor"] = sign * line.Total
+        filters = append(filters, bson.M{name + ".billing_id": line.BillingID})
+        total += line.Total
+    }
+    inc["credited_minor"] = sign * total
+    opts := options.Update().SetArrayFilters(options.ArrayFilters{Filters: filters})
+    result, err := invoices().UpdateOne(ctx, filter, bson.M{"$inc": inc}, opts)
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return errInvoiceModified
+    }
+    return nil
+}
+
+// creditRequest asks to credit Amount, or all that is left, of a billing.
+type creditRequest struct {
+    BillingID primitive.ObjectID `json:"billing_id"`
+    Amount    *json.Number       `json:"amount"`
+}
+
+// planCredit returns the lines of a credit note of inv for requests, or of
+// all that is left of every line without any, and what is wrong with them.
+func planCredit(inv Invoice, requests []creditRequest) ([]InvoiceLine, ValidationError) {
+    byBilling := map[primitive.ObjectID]InvoiceLine{}
+    for _, line := range inv.Lines {
+        byBilling[line.BillingID] = line
+    }
+    var credited []InvoiceLine
+    var validationErrs ValidationError
+    credit := func(field string, line InvoiceLine, amount Money) {
+        note, err := creditLine(line, amount)
+        if err != nil {
+            validationErrs = append(validationErrs, FieldError{Field: field, Code: "invalid_value", Message: err.Error()})
+            return
+        }
+        credited = append(credited, note)
+    }
+    if len(requests) == 0 {
+        for _, line := range inv.Lines {
+            if left := line.Total - line.Credited; left > 0 {
+                credit("lines", line, left)
+            }
+        }
+    }
+    for i, requested := range requests {
+        field := fmt.Sprintf("lines[%d]", i)
+        line, ok := byBilling[requested.BillingID]
+        if !ok {
+            validationErrs = append(validationErrs, FieldError{Field: field + ".billing_id", Code: "not_found", Message: "billing " + requested.BillingID.Hex() + " is not on this invoice"})
+            continue
+        }
+        left := line.Total - line.Credited
+        amount := left
+        if requested.Amount != nil {
+            var err error
+            if amount, err = parseMoney(requested.Amount.String(), inv.Currency); err != nil {
+                validationErrs = append(validationErrs, FieldError{Field: field + ".amount", Code: "invalid_value", Message: err.Error()})
+                continue
+            }
+        }
+        switch {
+        case amount <= 0 && requested.Amount != nil:
+            validationErrs = append(validationErrs, FieldError{Field: field + ".amount", Code: "invalid_value", Message: "must be positive"})
+        case amount > left:
+            validationErrs = append(validationErrs, FieldError{Field: field + ".amount", Code: "invalid_value", Message: "exceeds the " + left.Format(inv.Currency) + " left to credit"})
+        case amount > 0:
+            credit(field+".amount", line, amount)
+        }
+        // Each billing is credited once per note
+        delete(byBilling, requested.BillingID)
+    }
+    if len(validationErrs) == 0 && len(credited) == 0 {
+        validationErrs = append(validationErrs, FieldError{Field: "lines", Code: "invalid_value", Message: "there is nothing left to credit"})
+    }
+    return credited, validationErrs
+}
+
+// creditInvoice issues a credit note for an issued, overdue or paid invoice. Each
+// of lines takes back amount, including tax, (by default what is left) of one
+// billing; without lines everything that is left is credited. The line's taxes
+// are credited in proportion.
+func creditInvoice(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to credit invoice")
+
+    if req.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var input struct {
+        Lines  []creditRequest `json:"lines"`
+        Reason string          `json:"reason"`
+    }
+    if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    inv, err := invoiceFromPath(req, "/billings/invoices/credit/")
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to credit invoice")
+        return
+    }
+    if inv.Kind != kindInvoice || (inv.Status != invoiceIssued && inv.Status != invoiceOverdue && inv.Status != invoicePaid) {
+        http.Error(w, "Only issued, overdue or paid invoices can be credited", http.StatusConflict)
+        return
+    }
+
+    credited, validationErrs := planCredit(inv, input.Lines)
+    if len(validationErrs) > 0 {
+        writeValidationError(w, validationErrs)
+        return
+    }
+
+    now := time.Now().UTC()
+    note := Invoice{
+        ID:               primitive.NewObjectID(),
+        Kind:             kindCreditNote,
+        Organization:     inv.Organization,
+        Status:           invoiceIssued,
+        Currency:         inv.Currency,
+        Lines:            credited,
+        CreditsInvoiceID: &inv.ID,
+        TaxJurisdiction:  inv.TaxJurisdiction,
+        CustomerTaxID:    inv.CustomerTaxID,
+        TaxNotes:         inv.TaxNotes,
+        Reason:           input.Reason,
+        IssuedAt:         &now,
+        Version:          1,
+        CreatedAt:        now,
+    }
+    for _, line := range credited {
+        note.Subtotal += line.Net
+        note.Tax += line.Tax
+        note.Total += line.Total
+    }
+    note.Taxes, _ = summarizeTaxes(credited, TaxProfile{})
+    // What was already paid of the credited amounts is the customer's credit
+    excess := creditExcess(inv, note.Total)
+    err = withTransaction(func(ctx mongo.SessionContext) error {
+        var err error
+        if note.Number, err = nextInvoiceNumber(ctx, note.Organization, kindCreditNote); err != nil {
+            return err
+        }
+        note.CreditPaymentID = nil
+        if excess > 0 {
+            credit := Payment{
+                ID:           primitive.NewObjectID(),
+                Organization: note.Organization,
+                Currency:     note.Currency,
+                Amount:       excess,
+                Method:       paymentMethodCreditNote,
+                Reference:    note.Number,
+                ReceivedAt:   now,
+                Status:       paymentReceived,
+                Allocations:  []PaymentAllocation{},
+                Unapplied:    excess,
+                Version:      1,
+                CreatedAt:    now,
+            }
+            if _, err := payments().InsertOne(ctx, credit); err != nil {
+                return err
+            }
+            note.CreditPaymentID = &credit.ID
+        }
+        if _, err := invoices().InsertOne(ctx, note); err != nil {
+            return err
+        }
+        // Credit against the version the amounts left were checked on
+        return creditLines(ctx, bson.M{"_id": inv.ID, "version": inv.Version}, credited, excess, 1)
+    })
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to credit invoice")
+        return
+    }
+    log.Printf("Credit note %s issued for invoice %s: %s %s", note.Number, inv.Number, note.Total.Format(note.Currency), note.Currency)
+    writeInvoice(w, http.StatusCreated, note)
+}
+
+func getInvoice(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to get invoice")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    inv, err := invoiceFromPath(req, "/billings/invoices/get/")
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to get invoice")
+        return
+    }
+    writeInvoice(w, http.StatusOK, inv)
+}
+
+// listInvoices lists invoices and credit notes, newest first, optionally those of
+// an organization, status or kind, or credit notes of an invoice (credits).
+func listInvoices(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to list invoices")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := req.URL.Query()
+    filter := bson.M{}
+    for _, key := range []string{"organization", "status", "kind"} {
+        if value := query.Get(key); value != "" {
+            filter[key] = value
+        }
+    }
+    if credits := query.Get("credits"); credits != "" {
+        invoiceID, err := primitive.ObjectIDFromHex(credits)
+        if err != nil {
+            http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+            return
+        }
+        filter["credits_invoice_id"] = invoiceID
+    }
+
+    cursor, err := invoices().Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+    if err != nil {
+        http.Error(w, "Failed to list invoices", http.StatusInternalServerError)
+        return
+    }
+    list := []Invoice{}
+    if err := cursor.All(context.TODO(), &list); err != nil {
+        http.Error(w, "Failed to decode invoices", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(list)
+}
+
+// removeInvoice deletes a draft and releases its billings. Issued invoices keep
+// their number and can only be voided.
+func removeInvoice(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to remove invoice")
+
+    if req.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    inv, err := invoiceFromPath(req, "/billings/invoices/remove/")
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to remove invoice")
+        return
+    }
+    if inv.Status != invoiceDraft {
+        http.Error(w, "Only draft invoices can be removed; void it instead", http.StatusConflict)
+        return
+    }
+
+    err = withTransaction(func(ctx mongo.SessionContext) error {
+        result, err := invoices().DeleteOne(ctx, bson.M{"_id": inv.ID, "version": inv.Version})
+        if err != nil {
+            return err
+        }
+        if result.DeletedCount == 0 {
+            return errInvoiceModified
+        }
+        return voidInvoice(ctx, inv, requestActor(req))
+    })
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to remove invoice")
+        return
+    }
+    log.Printf("Draft invoice %s removed", inv.ID.Hex())
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// billingLockedBy returns the invoice that keeps a billing from being changed, if
+// any. Billings on drafts may change, since issuing copies them again, but not be
+// removed; those on issued invoices are corrected with a credit note.
+func billingLockedBy(ctx context.Context, billing Billing, removing bool) (*Invoice, error) {
+    if billing.InvoiceID == nil {
+        return nil, nil
+    }
+    inv, err := findInvoice(ctx, *billing.InvoiceID)
+    var opErr *invoiceOpError
+    if errors.As(err, &opErr) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if inv.Status == invoiceDraft && !removing {
+        return nil, nil
+    }
+    return &inv, nil
+}
+
+// touchDraftInvoice raises the version of a draft whose billing is about to
+// change, in the transaction changing it. Issuing the draft at the same time
+// then conflicts with the change instead of copying the billing as it was; an
+// invoice no longer a draft is refused.
+func touchDraftInvoice(ctx mongo.SessionContext, invoiceID primitive.ObjectID) error {
+    result, err := invoices().UpdateOne(ctx, bson.M{"_id": invoiceID, "status": invoiceDraft}, bson.M{"$inc": bson.M{"version": 1}})
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return invoiceRefused(http.StatusConflict, "Billing's invoice is no longer a draft; issue a credit note instead")
+    }
+    return nil
+}
+
+// markOverdueInvoices moves issued invoices past their due date to overdue.
+func markOverdueInvoices(now time.Time) (int64, error) {
+    filter := bson.M{"kind": kindInvoice, "status": invoiceIssued, "due_date": bson.M{"$lt": now}}
+    result, err := invoices().UpdateMany(context.TODO(), filter, bson.M{"$set": bson.M{"status": invoiceOverdue}, "$inc": bson.M{"version": 1}})
+    if err != nil {
+        return 0, err
+    }
+    return result.ModifiedCount, nil
+}
+
+// runOverdueSweep marks overdue invoices every INVOICE_OVERDUE_INTERVAL (default 1h).
+func runOverdueSweep() {
+    interval, err := time.ParseDuration(os.Getenv("INVOICE_OVERDUE_INTERVAL"))
+    if err != nil || interval <= 0 {
+        interval = time.Hour
+    }
+    for {
+        if count, err := markOverdueInvoices(time.Now().UTC()); err != nil {
+            log.Printf("Failed to mark overdue invoices: %v", err)
+        } else if count > 0 {
+            log.Printf("Marked %d invoices overdue", count)
+        }
+        time.Sleep(interval)
+    }
+}
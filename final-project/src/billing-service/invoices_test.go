@@ -0,0 +1,205 @@
+package main
+
+import (
+    "encoding/json"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCanTransition(t *testing.T) {
+    tests := []struct {
+        kind, from, to string
+        want           bool
+    }{
+        {kindInvoice, invoiceDraft, invoiceIssued, true},
+        {kindInvoice, invoiceDraft, invoicePaid, false},
+        {kindInvoice, invoiceDraft, invoiceVoid, false},
+        {kindInvoice, invoiceIssued, invoicePaid, true},
+        {kindInvoice, invoiceIssued, invoiceVoid, true},
+        {kindInvoice, invoiceIssued, invoiceOverdue, false},
+        {kindInvoice, invoiceIssued, invoiceDraft, false},
+        {kindInvoice, invoiceOverdue, invoicePaid, true},
+        {kindInvoice, invoiceOverdue, invoiceVoid, true},
+        {kindInvoice, invoicePaid, invoiceVoid, false},
+        {kindInvoice, invoicePaid, invoiceIssued, false},
+        {kindInvoice, invoiceVoid, invoiceIssued, false},
+        {kindInvoice, invoiceIssued, "archived", false},
+        {kindCreditNote, invoiceIssued, invoiceVoid, true},
+        {kindCreditNote, invoiceIssued, invoicePaid, false},
+        {kindCreditNote, invoiceVoid, invoiceIssued, false},
+    }
+    for _, tc := range tests {
+        inv := Invoice{Kind: tc.kind, Status: tc.from}
+        if got := canTransition(inv, tc.to); got != tc.want {
+            t.Errorf("%s %s -> %s: Want %v, Got %v", tc.kind, tc.from, tc.to, tc.want, got)
+        }
+    }
+}
+
+func TestInvoiceNumbering(t *testing.T) {
+    // Each organization numbers its invoices and credit notes on its own
+    counters := map[string]bool{}
+    for _, organization := range []string{"acme", "globex", "default"} {
+        for _, kind := range []string{kindInvoice, kindCreditNote} {
+            id := invoiceCounterID(organization, kind)
+            if counters[id] {
+                t.Errorf("Counter %s is shared", id)
+            }
+            counters[id] = true
+        }
+    }
+    if invoiceCounterID("a:b", kindInvoice) == invoiceCounterID("a", "b:"+kindInvoice) {
+        t.Errorf("Counter IDs are ambiguous")
+    }
+
+    tests := []struct {
+        kind string
+        seq  int64
+        want string
+    }{
+        {kindInvoice, 1, "INV-000001"},
+        {kindInvoice, 2, "INV-000002"},
+        {kindInvoice, 999999, "INV-999999"},
+        {kindInvoice, 1000000, "INV-1000000"},
+        {kindCreditNote, 1, "CN-000001"},
+        {kindCreditNote, 42, "CN-000042"},
+    }
+    for _, tc := range tests {
+        if got := formatInvoiceNumber(tc.kind, tc.seq); got != tc.want {
+            t.Errorf("%s %d: Want %s, Got %s", tc.kind, tc.seq, tc.want, got)
+        }
+    }
+}
+
+func TestPlanCredit(t *testing.T) {
+    taxed, untaxed, other := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+    inv := Invoice{Kind: kindInvoice, Status: invoiceIssued, Currency: "USD", Lines: []InvoiceLine{
+        {BillingID: taxed, Amount: 10000, Net: 10000, Tax: 2100, Total: 12100, Credited: 2100,
+            Taxes: []LineTax{{Name: "VAT", Rate: 210000, Amount: 2100}}},
+        {BillingID: untaxed, Amount: 5000, Net: 5000, Total: 5000},
+    }}
+    amount := func(s string) *json.Number {
+        n := json.Number(s)
+        return &n
+    }
+
+    tests := map[string]struct {
+        requests []creditRequest
+        want     []InvoiceLine
+        errors   []string
+    }{
+        "everything left": {
+            requests: nil,
+            want: []InvoiceLine{
+                {BillingID: taxed, Amount: 8264, Net: 8264, Tax: 1736, Total: 10000},
+                {BillingID: untaxed, Amount: 5000, Net: 5000, Total: 5000},
+            },
+        },
+        "part of a taxed line": {
+            requests: []creditRequest{{BillingID: taxed, Amount: amount("50.00")}},
+            want:     []InvoiceLine{{BillingID: taxed, Amount: 4132, Net: 4132, Tax: 868, Total: 5000}},
+        },
+        "rest of a line": {
+            requests: []creditRequest{{BillingID: untaxed}},
+            want:     []InvoiceLine{{BillingID: untaxed, Amount: 5000, Net: 5000, Total: 5000}},
+        },
+        "exactly what is left": {
+            requests: []creditRequest{{BillingID: taxed, Amount: amount("100")}},
+            want:     []InvoiceLine{{BillingID: taxed, Amount: 8264, Net: 8264, Tax: 1736, Total: 10000}},
+        },
+        "more than is left": {
+            requests: []creditRequest{{BillingID: taxed, Amount: amount("100.01")}},
+            errors:   []string{"lines[0].amount: exceeds the 100.00 left to credit"},
+        },
+        "zero": {
+            requests: []creditRequest{{BillingID: untaxed, Amount: amount("0")}},
+            errors:   []string{"lines[0].amount: must be positive"},
+        },
+        "negative": {
+            requests: []creditRequest{{BillingID: untaxed, Amount: amount("-1")}},
+            errors:   []string{"lines[0].amount: must be positive"},
+        },
+        "too precise": {
+            requests: []creditRequest{{BillingID: untaxed, Amount: amount("1.005")}},
+            errors:   []string{"lines[0].amount: " + mustFail(parseMoney("1.005", "USD")).Error()},
+        },
+        "not on the invoice": {
+            requests: []creditRequest{{BillingID: other}},
+            errors:   []string{"lines[0].billing_id: billing " + other.Hex() + " is not on this invoice"},
+        },
+        "same billing twice": {
+            requests: []creditRequest{{BillingID: untaxed, Amount: amount("1")}, {BillingID: untaxed, Amount: amount("1")}},
+            errors:   []string{"lines[1].billing_id: billing " + untaxed.Hex() + " is not on this invoice"},
+        },
+    }
+    for name, tc := range tests {
+        lines, errs := planCredit(inv, tc.requests)
+        var got []string
+        for _, err := range errs {
+            got = append(got, err.Error())
+        }
+        if len(got) != len(tc.errors) {
+            t.Errorf("%s: Want errors %v, Got %v", name, tc.errors, got)
+            continue
+        }
+        for i := range got {
+            if got[i] != tc.errors[i] {
+                t.Errorf("%s: Want error %q, Got %q", name, tc.errors[i], got[i])
+            }
+        }
+        if len(tc.errors) > 0 {
+            continue
+        }
+        if len(lines) != len(tc.want) {
+            t.Errorf("%s: Want %d lines, Got %+v", name, len(tc.want), lines)
+            continue
+        }
+        for i, want := range tc.want {
+            line := lines[i]
+            if line.BillingID != want.BillingID || line.Amount != want.Amount || line.Net != want.Net || line.Tax != want.Tax || line.Total != want.Total {
+                t.Errorf("%s: line %d: Want %+v, Got %+v", name, i, want, line)
+            }
+            if line.Net+line.Tax != line.Total {
+                t.Errorf("%s: line %d: net and tax don't add up to its total", name, i)
+            }
+        }
+    }
+
+    inv.Lines[0].Credited, inv.Lines[1].Credited = inv.Lines[0].Total, inv.Lines[1].Total
+    if _, errs := planCredit(inv, nil); len(errs) != 1 || errs[0].Message != "there is nothing left to credit" {
+        t.Errorf("Fully credited invoice: Want nothing left to credit, Got %v", errs)
+    }
+}
+
+func mustFail(_ Money, err error) error {
+    return err
+}
+
+func TestCreditExcess(t *testing.T) {
+    tests := []struct {
+        name                  string
+        total, credited, paid Money
+        overpaid, credit      Money
+        want                  Money
+    }{
+        {"unpaid", 10000, 0, 0, 0, 3000, 0},
+        {"partly paid, within the balance", 10000, 0, 5000, 0, 3000, 0},
+        {"partly paid, beyond the balance", 10000, 0, 5000, 0, 8000, 3000},
+        {"paid in full", 10000, 0, 10000, 0, 3000, 3000},
+        {"credited again after overpaid", 10000, 3000, 10000, 3000, 2000, 2000},
+    }
+    for _, tc := range tests {
+        inv := Invoice{Total: tc.total, Credited: tc.credited, Paid: tc.paid, Overpaid: tc.overpaid}
+        got := creditExcess(inv, tc.credit)
+        if got != tc.want {
+            t.Errorf("%s: Want %d, Got %d", tc.name, tc.want, got)
+        }
+        // What isn't owed anymore is credit, never a negative balance
+        inv.Credited += tc.credit
+        inv.Overpaid += got
+        if balance := inv.Balance(); balance < 0 {
+            t.Errorf("%s: Want a balance of at least 0, Got %d", tc.name, balance)
+        }
+    }
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "math/big"
+    "os"
+    "strconv"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Money is an amount in the minor unit of its currency, e.g. cents for USD, so
+// that amounts add up exactly. The currency is kept next to it.
+type Money int64
+
+// currencyExponents holds the number of decimals of the minor unit of each
+// supported ISO 4217 currency.
+var currencyExponents = map[string]int{
+    "AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CLP": 0, "CNY": 2, "CZK": 2,
+    "DKK": 2, "EUR": 2, "GBP": 2, "HKD": 2, "HUF": 2, "INR": 2, "ISK": 0, "JOD": 3,
+    "JPY": 0, "KRW": 0, "KWD": 3, "MXN": 2, "NOK": 2, "NZD": 2, "OMR": 3, "PLN": 2,
+    "SEK": 2, "SGD": 2, "TND": 3, "TRY": 2, "USD": 2, "ZAR": 2,
+}
+
+// hoursScale is the precision hours are billed at: 1/10000 of an hour.
+const hoursScale = 10000
+
+// defaultCurrency is the currency of billings that don't name one, read from
+// BILLING_CURRENCY (default USD).
+func defaultCurrency() string {
+    if currency := strings.ToUpper(os.Getenv("BILLING_CURRENCY")); validCurrency(currency) {
+        return currency
+    }
+    return "USD"
+}
+
+func validCurrency(currency string) bool {
+    _, ok := currencyExponents[currency]
+    return ok
+}
+
+func pow10(n int) int64 {
+    p := int64(1)
+    for i := 0; i < n; i++ {
+        p *= 10
+    }
+    return p
+}
+
+var (
+    errTooPrecise     = errors.New("has more decimals than the currency allows")
+    errAmountTooLarge = errors.New("is too large")
+)
+
+// parseMoney reads a decimal amount such as "12.5" in currency. Amounts with more
+// decimals than the currency's minor unit are refused rather than rounded.
+func parseMoney(text, currency string) (Money, error) {
+    minor, err := parseDecimal(text, currencyExponents[currency])
+    return Money(minor), err
+}
+
+// parseDecimal reads a decimal such as "12.5" as an integer count of
+// 10^-exponent, refusing more decimals than that.
+func parseDecimal(text string, exponent int) (int64, error) {
+    sign := int64(1)
+    switch {
+    case strings.HasPrefix(text, "-"):
+        sign, text = -1, text[1:]
+    case strings.HasPrefix(text, "+"):
+        text = text[1:]
+    }
+    whole, fraction, _ := strings.Cut(text, ".")
+    if whole == "" && fraction == "" || strings.Trim(whole+fraction, "0123456789") != "" {
+        return 0, errors.New("must be a decimal amount")
+    }
+    if len(fraction) > exponent {
+        if strings.Trim(fraction[exponent:], "0") != "" {
+            return 0, errTooPrecise
+        }
+        fraction = fraction[:exponent]
+    }
+    fraction += strings.Repeat("0", exponent-len(fraction))
+    digits := strings.TrimLeft(whole+fraction, "0")
+    if digits == "" {
+        return 0, nil
+    }
+    value, err := strconv.ParseInt(digits, 10, 64)
+    if err != nil {
+        return 0, errAmountTooLarge
+    }
+    return sign * value, nil
+}
+
+// Format returns the amount as a decimal with the currency's number of decimals.
+func (m Money) Format(currency string) string {
+    return formatDecimal(int64(m), currencyExponents[currency])
+}
+
+// formatDecimal writes value, a count of 10^-exponent, as a decimal with exponent
+// decimals.
+func formatDecimal(value int64, exponent int) string {
+    sign := ""
+    if value < 0 {
+        sign, value = "-", -value
+    }
+    if exponent == 0 {
+        return sign + strconv.FormatInt(value, 10)
+    }
+    scale := pow10(exponent)
+    return fmt.Sprintf("%s%d.%0*d", sign, value/scale, exponent, value%scale)
+}
+
+// moneyFromFloat converts a float amount to the currency's minor unit, rounding
+// half away from zero. It's for amounts stored before Money existed.
+func moneyFromFloat(amount float64, currency string) Money {
+    return Money(math.Round(amount * float64(pow10(currencyExponents[currency]))))
+}
+
+// billAmount returns hours times rate. Hours are taken to 1/10000 of an hour and
+// the product is rounded half away from zero to the minor unit, so the same hours
+// and rate always give the same amount. Hours too many to count in 1/10000 of
+// an hour are refused.
+func billAmount(hours float64, rate Money) (Money, error) {
+    scaled := math.Round(hours * hoursScale)
+    if math.IsNaN(scaled) || math.Abs(scaled) >= math.MaxInt64 {
+        return 0, errAmountTooLarge
+    }
+    return mulDiv(int64(scaled), int64(rate), hoursScale)
+}
+
+// mulDiv returns a times b divided by c, a positive divisor, rounded half away
+// from zero to the minor unit without overflowing in between.
+func mulDiv(a, b, c int64) (Money, error) {
+    product := new(big.Int).Mul(big.NewInt(a), big.NewInt(b))
+    amount, remainder := new(big.Int).QuoRem(product, big.NewInt(c), new(big.Int))
+    // Round half away from zero
+    if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(big.NewInt(c)) >= 0 {
+        amount.Add(amount, big.NewInt(int64(product.Sign())))
+    }
+    if !amount.IsInt64() {
+        return 0, errAmountTooLarge
+    }
+    return Money(amount.Int64()), nil
+}
+
+// migrateMoney converts billings stored with float amounts and rates to Money in
+// the default currency. It can run on every start: converted billings have a
+// currency and are skipped.
+func migrateMoney() error {
+    collection := client.Database("billing").Collection("billings")
+    cursor, err := collection.Find(context.Background(), bson.M{"currency": bson.M{"$exists": false}})
+    if err != nil {
+        return err
+    }
+    var legacy []struct {
+        ID         primitive.ObjectID `bson:"_id"`
+        HourlyRate *float64           `bson:"hourly_rate"`
+        Amount     float64            `bson:"amount"`
+    }
+    if err := cursor.All(context.Background(), &legacy); err != nil {
+        return err
+    }
+
+    currency := defaultCurrency()
+    for _, billing := range legacy {
+        set := bson.M{"currency": currency, "amount_minor": moneyFromFloat(billing.Amount, currency)}
+        if billing.HourlyRate != nil {
+            set["hourly_rate_minor"] = moneyFromFloat(*billing.HourlyRate, currency)
+        }
+        filter := bson.M{"_id": billing.ID, "currency": bson.M{"$exists": false}}
+        update := bson.M{"$set": set, "$unset": bson.M{"amount": "", "hourly_rate": ""}}
+        if _, err := collection.UpdateOne(context.Background(), filter, update); err != nil {
+            return err
+        }
+    }
+    if len(legacy) > 0 {
+        log.Printf("Converted %d billings to %s minor units", len(legacy), currency)
+    }
+    return nil
+}
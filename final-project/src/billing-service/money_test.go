@@ -0,0 +1,156 @@
+package main
+
+import (
+    "math"
+    "testing"
+)
+
+func TestParseMoney(t *testing.T) {
+    tests := []struct {
+        text, currency string
+        want           Money
+        err            error
+    }{
+        {"12.5", "USD", 1250, nil},
+        {"12.50", "USD", 1250, nil},
+        {"12", "USD", 1200, nil},
+        {".5", "USD", 50, nil},
+        {"7.", "USD", 700, nil},
+        {"+3.01", "USD", 301, nil},
+        {"-3.01", "USD", -301, nil},
+        {"0.00", "USD", 0, nil},
+        {"-0", "USD", 0, nil},
+        {"12.5000", "USD", 1250, nil},
+        {"12.505", "USD", 0, errTooPrecise},
+        {"-12.505", "USD", 0, errTooPrecise},
+        {"1500", "JPY", 1500, nil},
+        {"1500.0", "JPY", 1500, nil},
+        {"1500.5", "JPY", 0, errTooPrecise},
+        {"1.234", "KWD", 1234, nil},
+        {"1.2", "KWD", 1200, nil},
+        {"1.2345", "KWD", 0, errTooPrecise},
+        {"92233720368547758.07", "USD", math.MaxInt64, nil},
+        {"92233720368547758.08", "USD", 0, errAmountTooLarge},
+        {"9223372036854775808", "JPY", 0, errAmountTooLarge},
+    }
+    for _, tc := range tests {
+        got, err := parseMoney(tc.text, tc.currency)
+        if err != tc.err || got != tc.want {
+            t.Errorf("%s %s: Want %d (%v), Got %d (%v)", tc.text, tc.currency, tc.want, tc.err, got, err)
+        }
+    }
+
+    for _, text := range []string{"", ".", "-", "abc", "1,5", "1.2.3", "1e3", "--1", " 1"} {
+        if _, err := parseMoney(text, "USD"); err == nil || err == errTooPrecise || err == errAmountTooLarge {
+            t.Errorf("%q: Want it refused as not a decimal, Got %v", text, err)
+        }
+    }
+}
+
+func TestFormatMoney(t *testing.T) {
+    tests := []struct {
+        amount   Money
+        currency string
+        want     string
+    }{
+        {1250, "USD", "12.50"},
+        {5, "USD", "0.05"},
+        {-5, "USD", "-0.05"},
+        {-1250, "EUR", "-12.50"},
+        {0, "USD", "0.00"},
+        {1500, "JPY", "1500"},
+        {-1500, "JPY", "-1500"},
+        {1234, "KWD", "1.234"},
+        {-7, "BHD", "-0.007"},
+        {math.MaxInt64, "USD", "92233720368547758.07"},
+    }
+    for _, tc := range tests {
+        if got := tc.amount.Format(tc.currency); got != tc.want {
+            t.Errorf("%d %s: Want %s, Got %s", tc.amount, tc.currency, tc.want, got)
+        }
+        if back, err := parseMoney(tc.want, tc.currency); err != nil || back != tc.amount {
+            t.Errorf("%s %s: Want it to parse back to %d, Got %d (%v)", tc.want, tc.currency, tc.amount, back, err)
+        }
+    }
+}
+
+func TestMulDiv(t *testing.T) {
+    tests := []struct {
+        a, b, c int64
+        want    Money
+        err     error
+    }{
+        {10, 3, 4, 8, nil},   // 7.5 rounds up
+        {-10, 3, 4, -8, nil}, // -7.5 rounds away from zero
+        {10, -3, 4, -8, nil},
+        {-10, -3, 4, 8, nil},
+        {7, 1, 3, 2, nil},   // 2.33
+        {-7, 1, 3, -2, nil}, // -2.33
+        {5, 1, 3, 2, nil},   // 1.67
+        {-5, 1, 3, -2, nil}, // -1.67
+        {0, 5, 3, 0, nil},
+        {math.MaxInt64, 2, 2, math.MaxInt64, nil},
+        {math.MaxInt64, 3, 2, 0, errAmountTooLarge},
+        {math.MinInt64, 3, 2, 0, errAmountTooLarge},
+    }
+    for _, tc := range tests {
+        got, err := mulDiv(tc.a, tc.b, tc.c)
+        if err != tc.err || got != tc.want {
+            t.Errorf("%d*%d/%d: Want %d (%v), Got %d (%v)", tc.a, tc.b, tc.c, tc.want, tc.err, got, err)
+        }
+    }
+}
+
+func TestBillAmount(t *testing.T) {
+    tests := []struct {
+        hours float64
+        rate  Money
+        want  Money
+        err   error
+    }{
+        {2, 10000, 20000, nil},
+        {1.5, 3333, 5000, nil},                // 4999.5 rounds up
+        {-1.5, 3333, -5000, nil},              // -4999.5 rounds away from zero
+        {0.3333, 100, 33, nil},                // 33.33
+        {0.00005, 10000, 1, nil},              // hours round to 0.0001
+        {0.00004, 10000, 0, nil},              // and below that to nothing
+        {1.0 / 3, 9000, 3000, nil},            // 0.3333 hours is 2999.7
+        {2, 1500, 3000, nil},                  // JPY, exponent 0
+        {0.25, 1234, 309, nil},                // KWD, exponent 3: 308.5
+        {-0.25, 1234, -309, nil},              // and negative
+        {1e14, 1000000, 0, errAmountTooLarge}, // the amount overflows
+        {1e16, 1, 0, errAmountTooLarge},       // hours beyond 1/10000 of an hour in int64
+        {-1e16, 1, 0, errAmountTooLarge},
+        {math.Inf(1), 1, 0, errAmountTooLarge},
+        {math.NaN(), 1, 0, errAmountTooLarge},
+    }
+    for _, tc := range tests {
+        got, err := billAmount(tc.hours, tc.rate)
+        if err != tc.err || got != tc.want {
+            t.Errorf("%v hours at %d: Want %d (%v), Got %d (%v)", tc.hours, tc.rate, tc.want, tc.err, got, err)
+        }
+    }
+}
+
+func TestMoneyFromFloat(t *testing.T) {
+    // migrateMoney converts stored float amounts with it
+    tests := []struct {
+        amount   float64
+        currency string
+        want     Money
+    }{
+        {12.5, "USD", 1250},
+        {0.125, "USD", 13},
+        {-0.125, "USD", -13},
+        {19.99, "USD", 1999},
+        {1500.4, "JPY", 1500},
+        {1500.5, "JPY", 1501},
+        {-1500.5, "JPY", -1501},
+        {1.2345, "KWD", 1235},
+    }
+    for _, tc := range tests {
+        if got := moneyFromFloat(tc.amount, tc.currency); got != tc.want {
+            t.Errorf("%v %s: Want %d, Got %d", tc.amount, tc.currency, tc.want, got)
+        }
+    }
+}
@@ -0,0 +1,1084 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// paymentMethodCreditNote is the method of the payment holding the customer
+// credit a credit note gave; only crediting an invoice records it.
+const paymentMethodCreditNote = "credit_note"
+
+// Payment methods.
+var paymentMethods = map[string]bool{
+    "bank_transfer": true,
+    "card":          true,
+    "cash":          true,
+    "check":         true,
+    "online":        true,
+    "other":         true,
+}
+
+// Payment statuses; a void payment no longer pays anything.
+const (
+    paymentReceived = "received"
+    paymentVoid     = "void"
+)
+
+// PaymentAllocation is the part of a payment applied to one invoice.
+type PaymentAllocation struct {
+    InvoiceID primitive.ObjectID `bson:"invoice_id" json:"invoice_id"`
+    Number    string             `bson:"number" json:"number"`
+    Amount    Money              `bson:"amount_minor" json:"-"`
+    AppliedAt time.Time          `bson:"applied_at" json:"applied_at"`
+}
+
+// InvoicePayment is a payment as its invoice lists it.
+type InvoicePayment struct {
+    PaymentID  primitive.ObjectID `bson:"payment_id" json:"payment_id"`
+    Method     string             `bson:"method" json:"method"`
+    Reference  string             `bson:"reference,omitempty" json:"reference,omitempty"`
+    ReceivedAt time.Time          `bson:"received_at" json:"received_at"`
+    Amount     Money              `bson:"amount_minor" json:"-"`
+}
+
+// Payment is money received from an organization. It is applied to its open
+// invoices in Allocations; what is left over, e.g. after paying too much, stays
+// Unapplied as a credit for later invoices.
+type Payment struct {
+    ID           primitive.ObjectID  `bson:"_id" json:"id"`
+    Organization string              `bson:"organization" json:"organization"`
+    Currency     string              `bson:"currency" json:"currency"`
+    Amount       Money               `bson:"amount_minor" json:"-"`
+    Method       string              `bson:"method" json:"method"`
+    Reference    string              `bson:"reference,omitempty" json:"reference,omitempty"`
+    ReceivedAt   time.Time           `bson:"received_at" json:"received_at"`
+    Notes        string              `bson:"notes,omitempty" json:"notes,omitempty"`
+    Status       string              `bson:"status" json:"status"`
+    Allocations  []PaymentAllocation `bson:"allocations" json:"-"`
+    Unapplied    Money               `bson:"unapplied_minor" json:"-"`
+    VoidedAt     *time.Time          `bson:"voided_at,omitempty" json:"voided_at,omitempty"`
+    Version      int64               `bson:"version" json:"version"`
+    CreatedAt    time.Time           `bson:"created_at" json:"created_at"`
+}
+
+// MarshalJSON writes amounts as decimals in the payment's currency.
+func (p Payment) MarshalJSON() ([]byte, error) {
+    type payment Payment
+    type allocation struct {
+        PaymentAllocation
+        Amount string `json:"amount"`
+    }
+    allocations := []allocation{}
+    for _, a := range p.Allocations {
+        allocations = append(allocations, allocation{a, a.Amount.Format(p.Currency)})
+    }
+    return json.Marshal(struct {
+        payment
+        Amount      string       `json:"amount"`
+        Allocations []allocation `json:"allocations"`
+        Unapplied   string       `json:"unapplied"`
+    }{payment(p), p.Amount.Format(p.Currency), allocations, p.Unapplied.Format(p.Currency)})
+}
+
+func payments() *mongo.Collection {
+    return client.Database("billing").Collection("payments")
+}
+
+// ensurePaymentIndexes keeps a payment reference, such as a bank transaction ID,
+// from being recorded twice for an organization.
+func ensurePaymentIndexes() error {
+    _, err := payments().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+        {
+            Keys: bson.D{{Key: "organization", Value: 1}, {Key: "reference", Value: 1}},
+            Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+                "reference": bson.M{"$type": "string"},
+            }),
+        },
+        {Keys: bson.D{{Key: "organization", Value: 1}, {Key: "unapplied_minor", Value: 1}}},
+    })
+    return err
+}
+
+// allocationInput asks for amount of a payment to go to an invoice; without an
+// amount the invoice's whole balance is paid, as far as the payment goes.
+type allocationInput struct {
+    InvoiceID primitive.ObjectID `json:"invoice_id"`
+    Amount    *json.Number       `json:"amount"`
+}
+
+// openInvoicesFilter matches the invoices of an organization that can be paid.
+func openInvoicesFilter(organization, currency string) bson.M {
+    filter := bson.M{"kind": kindInvoice, "status": bson.M{"$in": bson.A{invoiceIssued, invoiceOverdue}}}
+    if organization != "" {
+        filter["organization"] = organization
+    }
+    if currency != "" {
+        filter["currency"] = currency
+    }
+    return filter
+}
+
+// paymentShare is the amount of a payment to apply to an invoice.
+type paymentShare struct {
+    Invoice Invoice
+    Amount  Money
+}
+
+// allocateOldestFirst spreads unapplied over the balances of open invoices, in
+// their order, until it runs out.
+func allocateOldestFirst(unapplied Money, open []Invoice) []paymentShare {
+    var shares []paymentShare
+    for _, inv := range open {
+        if unapplied <= 0 {
+            break
+        }
+        if balance := inv.Balance(); balance > 0 {
+            amount := min(balance, unapplied)
+            shares = append(shares, paymentShare{inv, amount})
+            unapplied -= amount
+        }
+    }
+    return shares
+}
+
+// planAllocations checks the allocations requested of payment against the
+// invoices found by ID. An allocation without an amount pays what it can of the
+// invoice's balance.
+func planAllocations(payment Payment, requested []allocationInput, found map[primitive.ObjectID]Invoice) ([]paymentShare, ValidationError) {
+    var shares []paymentShare
+    var errs ValidationError
+    unapplied := payment.Unapplied
+    allocated := map[primitive.ObjectID]bool{}
+    for i, allocation := range requested {
+        field := fmt.Sprintf("allocations[%d]", i)
+        inv, ok := found[allocation.InvoiceID]
+        switch {
+        case !ok:
+            errs = append(errs, FieldError{Field: field + ".invoice_id", Code: "not_found", Message: "invoice " + allocation.InvoiceID.Hex() + " does not exist"})
+            continue
+        case allocated[inv.ID]:
+            errs = append(errs, FieldError{Field: field + ".invoice_id", Code: "invalid_value", Message: "invoice " + allocation.InvoiceID.Hex() + " is allocated more than once"})
+            continue
+        case inv.Kind != kindInvoice || (inv.Status != invoiceIssued && inv.Status != invoiceOverdue):
+            errs = append(errs, FieldError{Field: field + ".invoice_id", Code: "invalid_value", Message: "invoice " + allocation.InvoiceID.Hex() + " is not open for payment"})
+            continue
+        case inv.Organization != payment.Organization || inv.Currency != payment.Currency:
+            errs = append(errs, FieldError{Field: field + ".invoice_id", Code: "invalid_value", Message: "invoice " + allocation.InvoiceID.Hex() + " is not an invoice of " + payment.Organization + " in " + payment.Currency})
+            continue
+        }
+        allocated[inv.ID] = true
+        amount := min(inv.Balance(), unapplied)
+        if allocation.Amount != nil {
+            var err error
+            if amount, err = parseMoney(allocation.Amount.String(), payment.Currency); err != nil {
+                errs = append(errs, FieldError{Field: field + ".amount", Code: "invalid_value", Message: err.Error()})
+                continue
+            }
+        }
+        switch {
+        case amount <= 0:
+            errs = append(errs, FieldError{Field: field + ".amount", Code: "invalid_value", Message: "must be positive"})
+        case amount > inv.Balance():
+            errs = append(errs, FieldError{Field: field + ".amount", Code: "invalid_value", Message: "exceeds the invoice's balance of " + inv.Balance().Format(inv.Currency)})
+        case amount > unapplied:
+            errs = append(errs, FieldError{Field: field + ".amount", Code: "invalid_value", Message: "exceeds the " + unapplied.Format(payment.Currency) + " left of the payment"})
+        default:
+            shares = append(shares, paymentShare{inv, amount})
+            unapplied -= amount
+        }
+    }
+    return shares, errs
+}
+
+// allocatePayment applies what is unapplied of payment to invoices: to those in
+// requested, or else to the organization's open invoices, the one due first
+// first. An invoice that is paid off becomes paid.
+func allocatePayment(ctx mongo.SessionContext, payment *Payment, requested []allocationInput) error {
+    var shares []paymentShare
+    if len(requested) == 0 {
+        cursor, err := invoices().Find(ctx, openInvoicesFilter(payment.Organization, payment.Currency),
+            options.Find().SetSort(bson.D{{Key: "due_date", Value: 1}, {Key: "created_at", Value: 1}}))
+        if err != nil {
+            return err
+        }
+        var open []Invoice
+        if err := cursor.All(ctx, &open); err != nil {
+            return err
+        }
+        shares = allocateOldestFirst(payment.Unapplied, open)
+    } else {
+        found := map[primitive.ObjectID]Invoice{}
+        for _, allocation := range requested {
+            inv, err := findInvoice(ctx, allocation.InvoiceID)
+            if _, missing := err.(*invoiceOpError); missing {
+                continue
+            } else if err != nil {
+                return err
+            }
+            found[inv.ID] = inv
+        }
+        var errs ValidationError
+        if shares, errs = planAllocations(*payment, requested, found); len(errs) > 0 {
+            return invoiceInvalid(errs)
+        }
+    }
+    for _, share := range shares {
+        if err := applyPayment(ctx, payment, share.Invoice, share.Amount); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// applyPayment pays amount of payment on inv.
+func applyPayment(ctx mongo.SessionContext, payment *Payment, inv Invoice, amount Money) error {
+    update := bson.M{
+        "$inc":  bson.M{"paid_minor": amount, "version": 1},
+        "$push": bson.M{"payments": InvoicePayment{PaymentID: payment.ID, Method: payment.Method, Reference: payment.Reference, ReceivedAt: payment.ReceivedAt, Amount: amount}},
+    }
+    if amount == inv.Balance() {
+        update["$set"] = bson.M{"status": invoicePaid, "paid_at": payment.ReceivedAt}
+        update["$unset"] = bson.M{"payment_link": ""}
+    }
+    result, err := invoices().UpdateOne(ctx, bson.M{"_id": inv.ID, "version": inv.Version}, update)
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return invoiceRefused(http.StatusConflict, "Invoice "+inv.Number+" has been modified")
+    }
+    payment.allocate(inv, amount)
+    return nil
+}
+
+// allocate records on the payment that amount of it went to inv.
+func (p *Payment) allocate(inv Invoice, amount Money) {
+    p.Allocations = append(p.Allocations, PaymentAllocation{InvoiceID: inv.ID, Number: inv.Number, Amount: amount, AppliedAt: time.Now().UTC()})
+    p.Unapplied -= amount
+}
+
+// createPayment records a payment and applies it to invoices of its organization,
+// either the allocations asked for or the oldest open invoices. Whatever isn't
+// applied stays on the payment as a credit.
+func createPayment(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to record payment")
+
+    if req.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var input struct {
+        Organization string            `json:"organization"`
+        Currency     string            `json:"currency"`
+        Amount       *json.Number      `json:"amount"`
+        Method       string            `json:"method"`
+        Reference    string            `json:"reference"`
+        ReceivedAt   *time.Time        `json:"received_at"`
+        Notes        string            `json:"notes"`
+        Allocations  []allocationInput `json:"allocations"`
+    }
+    if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    now := time.Now().UTC()
+    payment := Payment{
+        ID:           primitive.NewObjectID(),
+        Organization: input.Organization,
+        Currency:     strings.ToUpper(input.Currency),
+        Method:       input.Method,
+        Reference:    strings.TrimSpace(input.Reference),
+        ReceivedAt:   now,
+        Notes:        input.Notes,
+        Status:       paymentReceived,
+        Allocations:  []PaymentAllocation{},
+        Version:      1,
+        CreatedAt:    now,
+    }
+    if payment.Organization == "" {
+        payment.Organization = "default"
+    }
+    if payment.Currency == "" {
+        payment.Currency = defaultCurrency()
+    }
+    if input.ReceivedAt != nil {
+        payment.ReceivedAt = input.ReceivedAt.UTC()
+    }
+
+    var validationErrs ValidationError
+    if !validCurrency(payment.Currency) {
+        validationErrs = append(validationErrs, FieldError{Field: "currency", Code: "invalid_value", Message: "must be a supported ISO 4217 currency code"})
+    } else if input.Amount == nil {
+        validationErrs = append(validationErrs, FieldError{Field: "amount", Code: "required", Message: "is required"})
+    } else if amount, err := parseMoney(input.Amount.String(), payment.Currency); err != nil {
+        validationErrs = append(validationErrs, FieldError{Field: "amount", Code: "invalid_value", Message: err.Error()})
+    } else if amount <= 0 {
+        validationErrs = append(validationErrs, FieldError{Field: "amount", Code: "invalid_value", Message: "must be positive"})
+    } else {
+        payment.Amount = amount
+    }
+    if !paymentMethods[payment.Method] {
+        validationErrs = append(validationErrs, FieldError{Field: "method", Code: "invalid_value", Message: "must be bank_transfer, card, cash, check, online or other"})
+    }
+    if payment.ReceivedAt.After(now.Add(time.Minute)) {
+        validationErrs = append(validationErrs, FieldError{Field: "received_at", Code: "invalid_value", Message: "must not be in the future"})
+    }
+    if len(validationErrs) > 0 {
+        writeValidationError(w, validationErrs)
+        return
+    }
+
+    err := withTransaction(func(ctx mongo.SessionContext) error {
+        payment.Allocations, payment.Unapplied = []PaymentAllocation{}, payment.Amount
+        if err := allocatePayment(ctx, &payment, input.Allocations); err != nil {
+            return err
+        }
+        _, err := payments().InsertOne(ctx, payment)
+        return err
+    })
+    if mongo.IsDuplicateKeyError(err) {
+        http.Error(w, "A payment with reference "+payment.Reference+" was already recorded", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to record payment")
+        return
+    }
+    log.Printf("Payment %s of %s %s recorded, %s unapplied", payment.ID.Hex(), payment.Amount.Format(payment.Currency), payment.Currency, payment.Unapplied.Format(payment.Currency))
+    writePayment(w, http.StatusCreated, payment)
+}
+
+func writePayment(w http.ResponseWriter, status int, payment Payment) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("ETag", etag(payment.Version))
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(payment)
+}
+
+// paymentFromPath loads the payment whose ID follows prefix in the request path.
+func paymentFromPath(w http.ResponseWriter, req *http.Request, prefix string) (Payment, bool) {
+    var payment Payment
+    paymentID, err := primitive.ObjectIDFromHex(req.URL.Path[len(prefix):])
+    if err != nil {
+        http.Error(w, "Invalid payment ID", http.StatusBadRequest)
+        return payment, false
+    }
+    err = payments().FindOne(context.TODO(), bson.M{"_id": paymentID}).Decode(&payment)
+    if err == mongo.ErrNoDocuments {
+        http.Error(w, "Payment not found", http.StatusNotFound)
+        return payment, false
+    }
+    if err != nil {
+        http.Error(w, "Failed to get payment", http.StatusInternalServerError)
+        return payment, false
+    }
+    return payment, true
+}
+
+func getPayment(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to get payment")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if payment, ok := paymentFromPath(w, req, "/billings/payments/get/"); ok {
+        writePayment(w, http.StatusOK, payment)
+    }
+}
+
+// listPayments lists payments, newest first, optionally those of an organization,
+// with a status, applied to an invoice_id or with_credit left to apply.
+func listPayments(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to list payments")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := req.URL.Query()
+    filter := bson.M{}
+    for _, key := range []string{"organization", "status"} {
+        if value := query.Get(key); value != "" {
+            filter[key] = value
+        }
+    }
+    if invoiceID := query.Get("invoice_id"); invoiceID != "" {
+        id, err := primitive.ObjectIDFromHex(invoiceID)
+        if err != nil {
+            http.Error(w, "Invalid invoice_id", http.StatusBadRequest)
+            return
+        }
+        filter["allocations.invoice_id"] = id
+    }
+    if query.Get("with_credit") == "true" {
+        filter["status"] = paymentReceived
+        filter["unapplied_minor"] = bson.M{"$gt": 0}
+    }
+
+    cursor, err := payments().Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "received_at", Value: -1}}))
+    if err != nil {
+        http.Error(w, "Failed to list payments", http.StatusInternalServerError)
+        return
+    }
+    list := []Payment{}
+    if err := cursor.All(context.TODO(), &list); err != nil {
+        http.Error(w, "Failed to decode payments", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(list)
+}
+
+// applyPaymentCredit applies the credit left on a payment to invoices, as
+// createPayment does.
+func applyPaymentCredit(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to apply payment credit")
+
+    if req.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var input struct {
+        Allocations []allocationInput `json:"allocations"`
+    }
+    if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    current, ok := paymentFromPath(w, req, "/billings/payments/apply/")
+    if !ok {
+        return
+    }
+    if current.Status != paymentReceived || current.Unapplied <= 0 {
+        http.Error(w, "Payment has no credit left to apply", http.StatusConflict)
+        return
+    }
+
+    payment := current
+    err := withTransaction(func(ctx mongo.SessionContext) error {
+        payment = current
+        payment.Allocations = append([]PaymentAllocation{}, current.Allocations...)
+        if err := allocatePayment(ctx, &payment, input.Allocations); err != nil {
+            return err
+        }
+        result, err := payments().UpdateOne(ctx, bson.M{"_id": payment.ID, "version": current.Version}, bson.M{
+            "$set": bson.M{"allocations": payment.Allocations, "unapplied_minor": payment.Unapplied},
+            "$inc": bson.M{"version": 1},
+        })
+        if err != nil {
+            return err
+        }
+        if result.MatchedCount == 0 {
+            return invoiceRefused(http.StatusConflict, "Payment has been modified")
+        }
+        return nil
+    })
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to apply payment credit")
+        return
+    }
+    payment.Version++
+    log.Printf("Applied credit of payment %s, %s left", payment.ID.Hex(), payment.Unapplied.Format(payment.Currency))
+    writePayment(w, http.StatusOK, payment)
+}
+
+// voidPayment takes back a payment recorded by mistake or returned by the bank:
+// its invoices owe its allocations again, and those it paid off are reopened.
+func voidPayment(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to void payment")
+
+    if req.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    payment, ok := paymentFromPath(w, req, "/billings/payments/void/")
+    if !ok {
+        return
+    }
+    if payment.Status == paymentVoid {
+        http.Error(w, "Payment is already void", http.StatusConflict)
+        return
+    }
+    if payment.Method == paymentMethodCreditNote {
+        http.Error(w, "Payment is the credit of credit note "+payment.Reference+"; void the credit note instead", http.StatusConflict)
+        return
+    }
+
+    now := time.Now().UTC()
+    err := withTransaction(func(ctx mongo.SessionContext) error {
+        return cancelPayment(ctx, payment, now)
+    })
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to void payment")
+        return
+    }
+    payment.Status, payment.VoidedAt = paymentVoid, &now
+    payment.Version++
+    log.Printf("Payment %s voided", payment.ID.Hex())
+    writePayment(w, http.StatusOK, payment)
+}
+
+// cancelPayment voids payment: its invoices owe its allocations again.
+func cancelPayment(ctx mongo.SessionContext, payment Payment, now time.Time) error {
+    for _, allocation := range payment.Allocations {
+        if err := unapplyPayment(ctx, payment.ID, allocation, now); err != nil {
+            return err
+        }
+    }
+    result, err := payments().UpdateOne(ctx, bson.M{"_id": payment.ID, "version": payment.Version}, bson.M{
+        "$set": bson.M{"status": paymentVoid, "voided_at": now},
+        "$inc": bson.M{"version": 1},
+    })
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return invoiceRefused(http.StatusConflict, "Payment has been modified")
+    }
+    return nil
+}
+
+// reopenedStatus is the status a paid invoice gets back when a payment on it is
+// taken back at now: issued, or overdue past its due date. Other invoices keep
+// theirs, so it is empty for them.
+func reopenedStatus(inv Invoice, now time.Time) string {
+    if inv.Status != invoicePaid {
+        return ""
+    }
+    if inv.DueDate != nil && inv.DueDate.Before(now) {
+        return invoiceOverdue
+    }
+    return invoiceIssued
+}
+
+// unapplyPayment removes an allocation from its invoice. A paid invoice that
+// owes money again is issued, or overdue when past its due date.
+func unapplyPayment(ctx mongo.SessionContext, paymentID primitive.ObjectID, allocation PaymentAllocation, now time.Time) error {
+    inv, err := findInvoice(ctx, allocation.InvoiceID)
+    if err != nil {
+        return err
+    }
+    update := bson.M{
+        "$inc":  bson.M{"paid_minor": -allocation.Amount, "version": 1},
+        "$pull": bson.M{"payments": bson.M{"payment_id": paymentID}},
+    }
+    if status := reopenedStatus(inv, now); status != "" {
+        update["$set"] = bson.M{"status": status}
+        update["$unset"] = bson.M{"paid_at": ""}
+    }
+    result, err := invoices().UpdateOne(ctx, bson.M{"_id": inv.ID, "version": inv.Version}, update)
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return errInvoiceModified
+    }
+    return nil
+}
+
+// outstandingRow is what is owed in a currency by an organization or, split over
+// the lines of the invoices, for a user's work.
+type outstandingRow struct {
+    Organization string              `json:"organization,omitempty"`
+    UserID       *primitive.ObjectID `json:"user_id,omitempty"`
+    Currency     string              `json:"currency"`
+    Invoices     int                 `json:"invoices"`
+    Balance      string              `json:"balance"`
+    Overdue      string              `json:"overdue"`
+    Credit       string              `json:"credit,omitempty"`
+    Net          string              `json:"net,omitempty"`
+}
+
+// outstandingBalances reports what is still owed on open invoices, per
+// organization (by=organization, the default) or per user (by=user). An
+// organization's unapplied payments are shown as its credit and taken off in
+// net. For users, an invoice's balance is split over its lines in proportion to
+// what is left of them after credit notes.
+func outstandingBalances(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request for outstanding balances")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := req.URL.Query()
+    by := query.Get("by")
+    if by == "" {
+        by = "organization"
+    }
+    if by != "organization" && by != "user" {
+        http.Error(w, "by must be organization or user", http.StatusBadRequest)
+        return
+    }
+    currency := strings.ToUpper(query.Get("currency"))
+
+    cursor, err := invoices().Find(context.TODO(), openInvoicesFilter(query.Get("organization"), currency))
+    if err != nil {
+        http.Error(w, "Failed to get open invoices", http.StatusInternalServerError)
+        return
+    }
+    var open []Invoice
+    if err := cursor.All(context.TODO(), &open); err != nil {
+        http.Error(w, "Failed to decode invoices", http.StatusInternalServerError)
+        return
+    }
+
+    type key struct {
+        group    string
+        currency string
+    }
+    type sums struct {
+        invoices                 map[primitive.ObjectID]bool
+        balance, overdue, credit Money
+    }
+    totals := map[key]*sums{}
+    add := func(k key) *sums {
+        if totals[k] == nil {
+            totals[k] = &sums{invoices: map[primitive.ObjectID]bool{}}
+        }
+        return totals[k]
+    }
+    for _, inv := range open {
+        balance := inv.Balance()
+        if balance <= 0 {
+            continue
+        }
+        shares := map[string]Money{inv.Organization: balance}
+        if by == "user" {
+            shares = map[string]Money{}
+            if owed := inv.Total - inv.Credited; owed > 0 {
+                for _, line := range inv.Lines {
+                    share, err := mulDiv(int64(line.Total-line.Credited), int64(balance), int64(owed))
+                    if err != nil {
+                        http.Error(w, "Failed to split invoice "+inv.Number, http.StatusInternalServerError)
+                        return
+                    }
+                    shares[line.UserID.Hex()] += share
+                }
+            }
+        }
+        for group, share := range shares {
+            s := add(key{group, inv.Currency})
+            s.invoices[inv.ID] = true
+            s.balance += share
+            if inv.Status == invoiceOverdue {
+                s.overdue += share
+            }
+        }
+    }
+
+    if by == "organization" {
+        filter := bson.M{"status": paymentReceived, "unapplied_minor": bson.M{"$gt": 0}}
+        if organization := query.Get("organization"); organization != "" {
+            filter["organization"] = organization
+        }
+        if currency != "" {
+            filter["currency"] = currency
+        }
+        cursor, err := payments().Find(context.TODO(), filter)
+        if err != nil {
+            http.Error(w, "Failed to get payment credits", http.StatusInternalServerError)
+            return
+        }
+        var credits []Payment
+        if err := cursor.All(context.TODO(), &credits); err != nil {
+            http.Error(w, "Failed to decode payments", http.StatusInternalServerError)
+            return
+        }
+        for _, payment := range credits {
+            add(key{payment.Organization, payment.Currency}).credit += payment.Unapplied
+        }
+    }
+
+    rows := []outstandingRow{}
+    for k, s := range totals {
+        row := outstandingRow{Currency: k.currency, Invoices: len(s.invoices), Balance: s.balance.Format(k.currency), Overdue: s.overdue.Format(k.currency)}
+        if by == "user" {
+            userID, _ := primitive.ObjectIDFromHex(k.group)
+            row.UserID = &userID
+        } else {
+            row.Organization = k.group
+            row.Credit = s.credit.Format(k.currency)
+            row.Net = (s.balance - s.credit).Format(k.currency)
+        }
+        rows = append(rows, row)
+    }
+    sort.Slice(rows, func(i, j int) bool {
+        a, b := rows[i], rows[j]
+        if a.Organization != b.Organization {
+            return a.Organization < b.Organization
+        }
+        if a.UserID != nil && *a.UserID != *b.UserID {
+            return a.UserID.Hex() < b.UserID.Hex()
+        }
+        return a.Currency < b.Currency
+    })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(rows)
+}
+
+// agingBuckets are the ages of open invoices, in days since they were issued.
+var agingBuckets = []struct {
+    name    string
+    maxDays int
+}{{"0-30", 30}, {"31-60", 60}, {"61-90", 90}, {"90+", -1}}
+
+// agingBucket returns the index in agingBuckets of an invoice days old.
+func agingBucket(days int) int {
+    for i, bucket := range agingBuckets {
+        if bucket.maxDays < 0 || days <= bucket.maxDays {
+            return i
+        }
+    }
+    return len(agingBuckets) - 1
+}
+
+// balanceAsOf is what was owed on inv at asOf: payments received later don't
+// count yet.
+func balanceAsOf(inv Invoice, asOf time.Time) Money {
+    balance := inv.Balance()
+    for _, payment := range inv.Payments {
+        if payment.ReceivedAt.After(asOf) {
+            balance += payment.Amount
+        }
+    }
+    return balance
+}
+
+// agingReport buckets the balances of invoices open at as_of (default now) by
+// how many days before as_of they were issued, per organization and currency,
+// with a total per currency. Invoices paid since count with what was owed then.
+func agingReport(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request for aging report")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := req.URL.Query()
+    asOf := time.Now().UTC()
+    if value := query.Get("as_of"); value != "" {
+        t, err := parseReportTime(value)
+        if err != nil {
+            http.Error(w, "Invalid as_of", http.StatusBadRequest)
+            return
+        }
+        asOf = t
+    }
+
+    filter := openInvoicesFilter(query.Get("organization"), strings.ToUpper(query.Get("currency")))
+    filter["issued_at"] = bson.M{"$lte": asOf}
+    filter["$or"] = bson.A{
+        bson.M{"status": filter["status"]},
+        bson.M{"status": invoicePaid, "paid_at": bson.M{"$gt": asOf}},
+    }
+    delete(filter, "status")
+    cursor, err := invoices().Find(context.TODO(), filter)
+    if err != nil {
+        http.Error(w, "Failed to get open invoices", http.StatusInternalServerError)
+        return
+    }
+    var open []Invoice
+    if err := cursor.All(context.TODO(), &open); err != nil {
+        http.Error(w, "Failed to decode invoices", http.StatusInternalServerError)
+        return
+    }
+
+    type key struct{ organization, currency string }
+    amounts := map[key][]Money{}
+    for _, inv := range open {
+        balance := balanceAsOf(inv, asOf)
+        if balance <= 0 || inv.IssuedAt == nil {
+            continue
+        }
+        days := int(asOf.Sub(*inv.IssuedAt).Hours() / 24)
+        for _, k := range []key{{inv.Organization, inv.Currency}, {"", inv.Currency}} {
+            if amounts[k] == nil {
+                amounts[k] = make([]Money, len(agingBuckets))
+            }
+            amounts[k][agingBucket(days)] += balance
+        }
+    }
+
+    type row struct {
+        Organization string            `json:"organization,omitempty"`
+        Currency     string            `json:"currency"`
+        Buckets      map[string]string `json:"buckets"`
+        Total        string            `json:"total"`
+    }
+    rows, totals := []row{}, []row{}
+    for k, buckets := range amounts {
+        r := row{Organization: k.organization, Currency: k.currency, Buckets: map[string]string{}}
+        var total Money
+        for i, bucket := range agingBuckets {
+            r.Buckets[bucket.name] = buckets[i].Format(k.currency)
+            total += buckets[i]
+        }
+        r.Total = total.Format(k.currency)
+        if k.organization == "" {
+            totals = append(totals, r)
+        } else {
+            rows = append(rows, r)
+        }
+    }
+    for _, list := range [][]row{rows, totals} {
+        sort.Slice(list, func(i, j int) bool {
+            if list[i].Organization != list[j].Organization {
+                return list[i].Organization < list[j].Organization
+            }
+            return list[i].Currency < list[j].Currency
+        })
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(struct {
+        AsOf   time.Time `json:"as_of"`
+        Rows   []row     `json:"rows"`
+        Totals []row     `json:"totals"`
+    }{asOf, rows, totals})
+}
+
+// createPaymentLink gets a page from the payment provider where the customer can
+// pay the balance of an issued or overdue invoice online. The link is kept on
+// the invoice and given again until it expires or the balance changes.
+func createPaymentLink(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to create payment link")
+
+    if req.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if provider == nil {
+        http.Error(w, "No payment provider is configured", http.StatusServiceUnavailable)
+        return
+    }
+
+    inv, err := invoiceFromPath(req, "/billings/invoices/paylink/")
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to create payment link")
+        return
+    }
+    if inv.Kind != kindInvoice || (inv.Status != invoiceIssued && inv.Status != invoiceOverdue) {
+        http.Error(w, "Only issued or overdue invoices can be paid online", http.StatusConflict)
+        return
+    }
+    balance := inv.Balance()
+    if balance <= 0 {
+        http.Error(w, "Invoice has nothing left to pay", http.StatusConflict)
+        return
+    }
+    if inv.PaymentLink.Usable(balance, time.Now()) {
+        writeInvoice(w, http.StatusOK, inv)
+        return
+    }
+
+    link, err := provider.CreatePaymentLink(req.Context(), PaymentLinkRequest{
+        InvoiceID:      inv.ID,
+        Number:         inv.Number,
+        Organization:   inv.Organization,
+        Currency:       inv.Currency,
+        Amount:         balance,
+        IdempotencyKey: fmt.Sprintf("invoice-%s-%d", inv.ID.Hex(), inv.Version),
+    })
+    if err != nil {
+        log.Printf("Failed to create payment link for invoice %s: %v", inv.ID.Hex(), err)
+        http.Error(w, "Failed to create payment link", http.StatusBadGateway)
+        return
+    }
+    err = withTransaction(func(ctx mongo.SessionContext) error {
+        return saveInvoice(ctx, inv, bson.M{"payment_link": link})
+    })
+    if err != nil {
+        writeInvoiceError(w, err, "Failed to save payment link")
+        return
+    }
+    inv.PaymentLink = &link
+    inv.Version++
+    log.Printf("Payment link %s created for invoice %s", link.ID, inv.Number)
+    writeInvoice(w, http.StatusCreated, inv)
+}
+
+// errEventHandled means a webhook event has been handled before.
+var errEventHandled = errors.New("event already handled")
+
+func providerEvents() *mongo.Collection {
+    return client.Database("billing").Collection("provider_events")
+}
+
+// paymentWebhook receives the payment provider's events. It isn't behind the
+// JWT middleware: the provider signs its requests instead. Providers deliver
+// events at least once, so each event is handled only once and redeliveries
+// are just acknowledged; failures answer 500 to have the event sent again.
+func paymentWebhook(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received payment provider webhook")
+
+    if req.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if provider == nil {
+        http.Error(w, "No payment provider is configured", http.StatusNotFound)
+        return
+    }
+
+    payload, err := io.ReadAll(http.MaxBytesReader(w, req.Body, 1<<20))
+    if err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    event, err := provider.ParseWebhook(payload, req.Header)
+    if errors.Is(err, errBadSignature) {
+        log.Printf("Rejected webhook: %v", err)
+        http.Error(w, "Invalid signature", http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Invalid event", http.StatusBadRequest)
+        return
+    }
+
+    err = withTransaction(func(ctx mongo.SessionContext) error {
+        return handleProviderEvent(mongoLedger{ctx}, event)
+    })
+    if errors.Is(err, errEventHandled) {
+        log.Printf("Event %s was already handled", event.ID)
+    } else if err != nil {
+        log.Printf("Failed to handle event %s: %v", event.ID, err)
+        http.Error(w, "Failed to handle event", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusOK)
+}
+
+// providerLedger is what handleProviderEvent reads and records: the database,
+// in the webhook's transaction.
+type providerLedger interface {
+    // RecordEvent records event under key, unless it was recorded before
+    RecordEvent(key string, event ProviderEvent) (recorded bool, err error)
+    FindInvoice(id primitive.ObjectID) (Invoice, error)
+    PaymentRecorded(organization, reference string) (bool, error)
+    ApplyPayment(payment *Payment, inv Invoice, amount Money) error
+    InsertPayment(payment Payment) error
+}
+
+// mongoLedger is the providerLedger of a transaction.
+type mongoLedger struct {
+    ctx mongo.SessionContext
+}
+
+func (l mongoLedger) RecordEvent(key string, event ProviderEvent) (bool, error) {
+    _, err := providerEvents().InsertOne(l.ctx, bson.M{
+        "_id":         key,
+        "type":        event.Type,
+        "invoice_id":  event.InvoiceID,
+        "payment_id":  event.PaymentID,
+        "received_at": time.Now().UTC(),
+    })
+    if mongo.IsDuplicateKeyError(err) {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+func (l mongoLedger) FindInvoice(id primitive.ObjectID) (Invoice, error) {
+    return findInvoice(l.ctx, id)
+}
+
+func (l mongoLedger) PaymentRecorded(organization, reference string) (bool, error) {
+    recorded, err := payments().CountDocuments(l.ctx, bson.M{"organization": organization, "reference": reference})
+    return recorded > 0, err
+}
+
+func (l mongoLedger) ApplyPayment(payment *Payment, inv Invoice, amount Money) error {
+    return applyPayment(l.ctx, payment, inv, amount)
+}
+
+func (l mongoLedger) InsertPayment(payment Payment) error {
+    _, err := payments().InsertOne(l.ctx, payment)
+    return err
+}
+
+// handleProviderEvent records event and, for a payment, records the payment and
+// applies it to its invoice. What the invoice doesn't need any more, e.g. when
+// it was paid otherwise meanwhile, stays on the payment as credit. A payment
+// the provider reports twice, in different events, is recorded once.
+func handleProviderEvent(ledger providerLedger, event ProviderEvent) error {
+    recorded, err := ledger.RecordEvent(provider.Name()+":"+event.ID, event)
+    if err != nil {
+        return err
+    }
+    if !recorded {
+        return errEventHandled
+    }
+    if !event.Paid {
+        return nil
+    }
+
+    invoiceID, err := primitive.ObjectIDFromHex(event.InvoiceID)
+    if err != nil {
+        log.Printf("Event %s pays no invoice of ours", event.ID)
+        return nil
+    }
+    inv, err := ledger.FindInvoice(invoiceID)
+    var opErr *invoiceOpError
+    if errors.As(err, &opErr) {
+        log.Printf("Event %s pays invoice %s, which doesn't exist", event.ID, event.InvoiceID)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if paid, err := ledger.PaymentRecorded(inv.Organization, event.PaymentID); err != nil || paid {
+        return err
+    }
+
+    payment := Payment{
+        ID:           primitive.NewObjectID(),
+        Organization: inv.Organization,
+        Currency:     event.Currency,
+        Amount:       event.Amount,
+        Method:       "online",
+        Reference:    event.PaymentID,
+        ReceivedAt:   event.CreatedAt,
+        Notes:        "Paid online through " + provider.Name(),
+        Status:       paymentReceived,
+        Allocations:  []PaymentAllocation{},
+        Unapplied:    event.Amount,
+        Version:      1,
+        CreatedAt:    time.Now().UTC(),
+    }
+    open := inv.Kind == kindInvoice && (inv.Status == invoiceIssued || inv.Status == invoiceOverdue)
+    if open && inv.Currency == payment.Currency && inv.Balance() > 0 && payment.Amount > 0 {
+        if err := ledger.ApplyPayment(&payment, inv, min(inv.Balance(), payment.Amount)); err != nil {
+            return err
+        }
+    }
+    if err := ledger.InsertPayment(payment); err != nil {
+        return err
+    }
+    log.Printf("Payment %s of %s %s received online for invoice %s, %s unapplied", payment.ID.Hex(), payment.Amount.Format(payment.Currency), payment.Currency, inv.Number, payment.Unapplied.Format(payment.Currency))
+    return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func openInvoice(number string, total, paid Money) Invoice {
+    return Invoice{ID: primitive.NewObjectID(), Kind: kindInvoice, Number: number, Organization: "acme", Currency: "USD", Status: invoiceIssued, Total: total, Paid: paid}
+}
+
+func TestAllocateOldestFirst(t *testing.T) {
+    open := []Invoice{
+        openInvoice("INV-1", 10000, 10000),
+        openInvoice("INV-2", 10000, 2500),
+        openInvoice("INV-3", 5000, 0),
+        openInvoice("INV-4", 5000, 0),
+    }
+
+    tests := []struct {
+        name      string
+        unapplied Money
+        want      map[string]Money
+    }{
+        {"pays in order", 10000, map[string]Money{"INV-2": 7500, "INV-3": 2500}},
+        {"pays everything", 20000, map[string]Money{"INV-2": 7500, "INV-3": 5000, "INV-4": 5000}},
+        {"nothing to pay with", 0, map[string]Money{}},
+    }
+    for _, tc := range tests {
+        shares := allocateOldestFirst(tc.unapplied, open)
+        got := map[string]Money{}
+        for _, share := range shares {
+            got[share.Invoice.Number] = share.Amount
+        }
+        if len(got) != len(tc.want) {
+            t.Errorf("%s: Want %v, Got %v", tc.name, tc.want, got)
+            continue
+        }
+        for number, amount := range tc.want {
+            if got[number] != amount {
+                t.Errorf("%s: Want %d on %s, Got %d", tc.name, amount, number, got[number])
+            }
+        }
+    }
+}
+
+func TestPlanAllocations(t *testing.T) {
+    payment := Payment{Organization: "acme", Currency: "USD", Unapplied: 10000}
+    first := openInvoice("INV-1", 6000, 0)
+    second := openInvoice("INV-2", 8000, 0)
+    paid := openInvoice("INV-3", 1000, 1000)
+    paid.Status = invoicePaid
+    other := openInvoice("INV-4", 1000, 0)
+    other.Organization = "globex"
+    found := map[primitive.ObjectID]Invoice{first.ID: first, second.ID: second, paid.ID: paid, other.ID: other}
+    amount := func(value string) *json.Number {
+        n := json.Number(value)
+        return &n
+    }
+
+    tests := []struct {
+        name      string
+        requested []allocationInput
+        want      []Money
+        wantErr   string
+    }{
+        {"whole balances as far as it goes", []allocationInput{{InvoiceID: first.ID}, {InvoiceID: second.ID}}, []Money{6000, 4000}, ""},
+        {"amounts", []allocationInput{{InvoiceID: first.ID, Amount: amount("10.00")}, {InvoiceID: second.ID, Amount: amount("80.00")}}, []Money{1000, 8000}, ""},
+        {"more than the balance", []allocationInput{{InvoiceID: first.ID, Amount: amount("60.01")}}, nil, "allocations[0].amount"},
+        {"more than the payment", []allocationInput{{InvoiceID: second.ID}, {InvoiceID: first.ID, Amount: amount("30.00")}}, []Money{8000}, "allocations[1].amount"},
+        {"not positive", []allocationInput{{InvoiceID: first.ID, Amount: amount("0")}}, nil, "allocations[0].amount"},
+        {"paid invoice", []allocationInput{{InvoiceID: paid.ID}}, nil, "allocations[0].invoice_id"},
+        {"other organization", []allocationInput{{InvoiceID: other.ID}}, nil, "allocations[0].invoice_id"},
+        {"missing invoice", []allocationInput{{InvoiceID: primitive.NewObjectID()}}, nil, "allocations[0].invoice_id"},
+        {"same invoice twice", []allocationInput{{InvoiceID: first.ID, Amount: amount("10.00")}, {InvoiceID: first.ID, Amount: amount("10.00")}}, []Money{1000}, "allocations[1].invoice_id"},
+    }
+    for _, tc := range tests {
+        shares, errs := planAllocations(payment, tc.requested, found)
+        switch {
+        case tc.wantErr == "" && len(errs) > 0:
+            t.Errorf("%s: Want no errors, Got %v", tc.name, errs)
+        case tc.wantErr != "" && (len(errs) != 1 || errs[0].Field != tc.wantErr):
+            t.Errorf("%s: Want an error on %s, Got %v", tc.name, tc.wantErr, errs)
+        }
+        if len(shares) != len(tc.want) {
+            t.Errorf("%s: Want %d shares, Got %d", tc.name, len(tc.want), len(shares))
+            continue
+        }
+        for i, share := range shares {
+            if share.Amount != tc.want[i] {
+                t.Errorf("%s: Want share %d of %d, Got %d", tc.name, i, tc.want[i], share.Amount)
+            }
+        }
+    }
+}
+
+func TestAgingBucket(t *testing.T) {
+    tests := []struct {
+        days int
+        want string
+    }{
+        {0, "0-30"},
+        {30, "0-30"},
+        {31, "31-60"},
+        {60, "31-60"},
+        {61, "61-90"},
+        {90, "61-90"},
+        {91, "90+"},
+        {400, "90+"},
+    }
+    for _, tc := range tests {
+        if got := agingBuckets[agingBucket(tc.days)].name; got != tc.want {
+            t.Errorf("%d days: Want %s, Got %s", tc.days, tc.want, got)
+        }
+    }
+}
+
+func TestBalanceAsOf(t *testing.T) {
+    march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    inv := openInvoice("INV-1", 10000, 10000)
+    inv.Payments = []InvoicePayment{
+        {ReceivedAt: march, Amount: 4000},
+        {ReceivedAt: march.AddDate(0, 1, 0), Amount: 6000},
+    }
+
+    tests := []struct {
+        asOf time.Time
+        want Money
+    }{
+        {march.AddDate(0, 0, -1), 10000},
+        {march, 6000},
+        {march.AddDate(0, 0, 15), 6000},
+        {march.AddDate(0, 2, 0), 0},
+    }
+    for _, tc := range tests {
+        if got := balanceAsOf(inv, tc.asOf); got != tc.want {
+            t.Errorf("As of %s: Want %d, Got %d", tc.asOf.Format("2006-01-02"), tc.want, got)
+        }
+    }
+}
+
+func TestReopenedStatus(t *testing.T) {
+    now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    past, future := now.AddDate(0, 0, -1), now.AddDate(0, 0, 1)
+
+    tests := []struct {
+        name   string
+        status string
+        due    *time.Time
+        want   string
+    }{
+        {"paid before its due date", invoicePaid, &future, invoiceIssued},
+        {"paid past its due date", invoicePaid, &past, invoiceOverdue},
+        {"paid without a due date", invoicePaid, nil, invoiceIssued},
+        {"partly paid", invoiceIssued, &future, ""},
+        {"partly paid and overdue", invoiceOverdue, &past, ""},
+    }
+    for _, tc := range tests {
+        inv := Invoice{Kind: kindInvoice, Status: tc.status, DueDate: tc.due}
+        if got := reopenedStatus(inv, now); got != tc.want {
+            t.Errorf("%s: Want %q, Got %q", tc.name, tc.want, got)
+        }
+    }
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// A4 in points, the unit of PDF coordinates.
+const (
+    pdfPageWidth  = 595.28
+    pdfPageHeight = 841.89
+)
+
+// rgb is a color with components from 0 to 255.
+type rgb struct{ R, G, B uint8 }
+
+func (c rgb) pdf() string {
+    return fmt.Sprintf("%.3f %.3f %.3f", float64(c.R)/255, float64(c.G)/255, float64(c.B)/255)
+}
+
+// pdfDocument draws text, lines and rectangles on A4 pages and writes them as a
+// PDF. It only uses Helvetica and Helvetica-Bold, which every PDF reader has, so
+// no fonts are embedded; text is limited to the WinAnsi (Latin-1) characters.
+// Positions are measured from the top left corner of the page.
+type pdfDocument struct {
+    title   string
+    pages   []*bytes.Buffer
+    current int
+}
+
+func newPDF(title string) *pdfDocument {
+    return &pdfDocument{title: title}
+}
+
+// AddPage starts a new page; everything drawn afterwards goes on it.
+func (d *pdfDocument) AddPage() {
+    d.pages = append(d.pages, &bytes.Buffer{})
+    d.current = len(d.pages) - 1
+}
+
+// PageCount returns the number of pages so far.
+func (d *pdfDocument) PageCount() int {
+    return len(d.pages)
+}
+
+// SetPage makes everything drawn afterwards go on page n, counted from 0, e.g. to
+// add page numbers once all pages exist.
+func (d *pdfDocument) SetPage(n int) {
+    d.current = n
+}
+
+func (d *pdfDocument) page() *bytes.Buffer {
+    if len(d.pages) == 0 {
+        d.AddPage()
+    }
+    return d.pages[d.current]
+}
+
+// Text draws text with its baseline at y.
+func (d *pdfDocument) Text(x, y, size float64, bold bool, color rgb, text string) {
+    font := "F1"
+    if bold {
+        font = "F2"
+    }
+    fmt.Fprintf(d.page(), "BT %s rg /%s %s Tf %s %s Td %s Tj ET\n",
+        color.pdf(), font, pdfNumber(size), pdfNumber(x), pdfNumber(pdfPageHeight-y), pdfString(text))
+}
+
+// TextRight draws text so that it ends at x.
+func (d *pdfDocument) TextRight(x, y, size float64, bold bool, color rgb, text string) {
+    d.Text(x-textWidth(text, size, bold), y, size, bold, color, text)
+}
+
+// Rect fills a rectangle whose top left corner is at x, y.
+func (d *pdfDocument) Rect(x, y, width, height float64, color rgb) {
+    fmt.Fprintf(d.page(), "%s rg %s %s %s %s re f\n",
+        color.pdf(), pdfNumber(x), pdfNumber(pdfPageHeight-y-height), pdfNumber(width), pdfNumber(height))
+}
+
+// Line draws a straight line.
+func (d *pdfDocument) Line(x1, y1, x2, y2, width float64, color rgb) {
+    fmt.Fprintf(d.page(), "%s RG %s w %s %s m %s %s l S\n",
+        color.pdf(), pdfNumber(width), pdfNumber(x1), pdfNumber(pdfPageHeight-y1), pdfNumber(x2), pdfNumber(pdfPageHeight-y2))
+}
+
+// Bytes returns the document as a PDF file.
+func (d *pdfDocument) Bytes() []byte {
+    if len(d.pages) == 0 {
+        d.AddPage()
+    }
+
+    // Objects 1 to 5 are the catalog, the page tree, the two fonts and the
+    // document information; each page then has a page and a content object.
+    objects := []string{
+        "<< /Type /Catalog /Pages 2 0 R >>",
+        "",
+        "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+        "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+        "<< /Title " + pdfString(d.title) + " /Producer (billing-service) >>",
+    }
+    var kids []string
+    for _, content := range d.pages {
+        pageObject := len(objects) + 1
+        kids = append(kids, strconv.Itoa(pageObject)+" 0 R")
+        objects = append(objects,
+            fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+                pdfNumber(pdfPageWidth), pdfNumber(pdfPageHeight), pageObject+1),
+            fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+        )
+    }
+    objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages))
+
+    var out bytes.Buffer
+    out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+    offsets := make([]int, len(objects))
+    for i, object := range objects {
+        offsets[i] = out.Len()
+        fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+    }
+    xref := out.Len()
+    fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+    for _, offset := range offsets {
+        fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+    }
+    fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+    return out.Bytes()
+}
+
+func pdfNumber(f float64) string {
+    return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// winAnsi holds the characters outside Latin-1 that WinAnsiEncoding has.
+var winAnsi = map[rune]byte{
+    '€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92,
+    '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99,
+}
+
+// pdfString encodes text as a WinAnsi PDF string. Characters it doesn't have
+// become question marks.
+func pdfString(text string) string {
+    var b strings.Builder
+    b.WriteByte('(')
+    for _, r := range text {
+        switch {
+        case r == '(' || r == ')' || r == '\\':
+            b.WriteByte('\\')
+            b.WriteRune(r)
+        case r < 0x20:
+            b.WriteByte(' ')
+        case r < 0x7f:
+            b.WriteRune(r)
+        case r >= 0xa0 && r <= 0xff:
+            b.WriteString(fmt.Sprintf("\\%03o", r))
+        case winAnsi[r] != 0:
+            b.WriteString(fmt.Sprintf("\\%03o", winAnsi[r]))
+        default:
+            b.WriteByte('?')
+        }
+    }
+    b.WriteByte(')')
+    return b.String()
+}
+
+// Widths of the printable ASCII characters in Helvetica and Helvetica-Bold, in
+// thousandths of the font size.
+var helveticaWidths = [95]int{
+    278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+    556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+    1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+    667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+    333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+    556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+var helveticaBoldWidths = [95]int{
+    278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+    556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+    975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+    667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+    333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+    611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}
+
+// textWidth returns the width of text in points. Characters outside ASCII are
+// taken to be as wide as a digit.
+func textWidth(text string, size float64, bold bool) float64 {
+    widths := &helveticaWidths
+    if bold {
+        widths = &helveticaBoldWidths
+    }
+    total := 0
+    for _, r := range text {
+        if r >= 0x20 && r < 0x7f {
+            total += widths[r-0x20]
+        } else {
+            total += 556
+        }
+    }
+    return float64(total) * size / 1000
+}
+
+// truncateText shortens text with an ellipsis until it fits in width.
+func truncateText(text string, width, size float64, bold bool) string {
+    if textWidth(text, size, bold) <= width {
+        return text
+    }
+    runes := []rune(text)
+    for len(runes) > 0 && textWidth(string(runes)+"…", size, bold) > width {
+        runes = runes[:len(runes)-1]
+    }
+    return string(runes) + "…"
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var errBadSignature = errors.New("invalid webhook signature")
+
+// PaymentProvider lets customers pay invoices online on a page hosted by a
+// payment provider, and reports the payments through signed webhooks.
+type PaymentProvider interface {
+    Name() string
+    CreatePaymentLink(ctx context.Context, req PaymentLinkRequest) (PaymentLink, error)
+    // ParseWebhook checks the signature of a webhook request and returns its
+    // event; a request that isn't signed by the provider gives errBadSignature.
+    ParseWebhook(payload []byte, header http.Header) (ProviderEvent, error)
+}
+
+// provider is the configured payment provider, nil when online payment is off.
+var provider PaymentProvider
+
+// newPaymentProvider picks the provider from PAYMENT_PROVIDER: none (default)
+// disables online payment, "stripe" uses the Stripe API at STRIPE_API_URL
+// (default https://api.stripe.com, or any server speaking the same API) with
+// STRIPE_SECRET_KEY and STRIPE_WEBHOOK_SECRET.
+func newPaymentProvider() (PaymentProvider, error) {
+    switch os.Getenv("PAYMENT_PROVIDER") {
+    case "", "none":
+        return nil, nil
+    case "stripe":
+        return NewStripeProvider(os.Getenv("STRIPE_API_URL"), os.Getenv("STRIPE_SECRET_KEY"), os.Getenv("STRIPE_WEBHOOK_SECRET"))
+    default:
+        return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", os.Getenv("PAYMENT_PROVIDER"))
+    }
+}
+
+// PaymentLinkRequest asks for a page to pay Amount of an invoice on.
+// IdempotencyKey makes retries of the same request return the same link.
+type PaymentLinkRequest struct {
+    InvoiceID      primitive.ObjectID
+    Number         string
+    Organization   string
+    Currency       string
+    Amount         Money
+    IdempotencyKey string
+}
+
+// PaymentLink is a provider's page to pay an invoice on.
+type PaymentLink struct {
+    Provider  string     `bson:"provider" json:"provider"`
+    ID        string     `bson:"id" json:"id"`
+    URL       string     `bson:"url" json:"url"`
+    Currency  string     `bson:"currency" json:"currency"`
+    Amount    Money      `bson:"amount_minor" json:"-"`
+    ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+    CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+}
+
+// MarshalJSON writes the amount as a decimal in the link's currency.
+func (l PaymentLink) MarshalJSON() ([]byte, error) {
+    type paymentLink PaymentLink
+    return json.Marshal(struct {
+        paymentLink
+        Amount string `json:"amount"`
+    }{paymentLink(l), l.Amount.Format(l.Currency)})
+}
+
+// Usable reports whether the link can still be used to pay amount.
+func (l *PaymentLink) Usable(amount Money, now time.Time) bool {
+    return l != nil && l.Amount == amount && (l.ExpiresAt == nil || l.ExpiresAt.After(now))
+}
+
+// ProviderEvent is a webhook event, reduced to what billing-service needs.
+// Paid events report a completed payment of Amount for InvoiceID; PaymentID
+// is the provider's ID of that payment.
+type ProviderEvent struct {
+    ID        string
+    Type      string
+    Paid      bool
+    InvoiceID string
+    PaymentID string
+    Currency  string
+    Amount    Money
+    CreatedAt time.Time
+}
+
+// stripeSignatureTolerance is how old a webhook may be, against replays.
+const stripeSignatureTolerance = 5 * time.Minute
+
+// StripeProvider creates Stripe Checkout sessions and reads Stripe's webhooks.
+// Amounts are sent in minor units, as Money stores them.
+type StripeProvider struct {
+    baseURL       string
+    secretKey     string
+    webhookSecret string
+    successURL    string
+    cancelURL     string
+    http          *http.Client
+    now           func() time.Time
+}
+
+// NewStripeProvider returns a provider calling the Stripe API at baseURL.
+// Customers are sent back to PAYMENT_SUCCESS_URL or PAYMENT_CANCEL_URL when
+// they are done on the payment page.
+func NewStripeProvider(baseURL, secretKey, webhookSecret string) (*StripeProvider, error) {
+    if secretKey == "" {
+        return nil, errors.New("STRIPE_SECRET_KEY is required")
+    }
+    if webhookSecret == "" {
+        return nil, errors.New("STRIPE_WEBHOOK_SECRET is required")
+    }
+    if baseURL == "" {
+        baseURL = "https://api.stripe.com"
+    }
+    successURL := os.Getenv("PAYMENT_SUCCESS_URL")
+    if successURL == "" {
+        successURL = "http://localhost:8000/payment/success"
+    }
+    cancelURL := os.Getenv("PAYMENT_CANCEL_URL")
+    if cancelURL == "" {
+        cancelURL = "http://localhost:8000/payment/cancel"
+    }
+    return &StripeProvider{
+        baseURL:       strings.TrimRight(baseURL, "/"),
+        secretKey:     secretKey,
+        webhookSecret: webhookSecret,
+        successURL:    successURL,
+        cancelURL:     cancelURL,
+        http:          &http.Client{Timeout: 10 * time.Second},
+        now:           time.Now,
+    }, nil
+}
+
+func (p *StripeProvider) Name() string {
+    return "stripe"
+}
+
+// CreatePaymentLink creates a Checkout session with the invoice as its only
+// item. The invoice's ID is kept in the session's metadata, so that webhooks
+// about the session can be matched to it.
+func (p *StripeProvider) CreatePaymentLink(ctx context.Context, req PaymentLinkRequest) (PaymentLink, error) {
+    form := url.Values{}
+    form.Set("mode", "payment")
+    form.Set("success_url", p.successURL)
+    form.Set("cancel_url", p.cancelURL)
+    form.Set("client_reference_id", req.InvoiceID.Hex())
+    form.Set("line_items[0][quantity]", "1")
+    form.Set("line_items[0][price_data][currency]", strings.ToLower(req.Currency))
+    form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(int64(req.Amount), 10))
+    form.Set("line_items[0][price_data][product_data][name]", "Invoice "+req.Number)
+    for _, prefix := range []string{"metadata", "payment_intent_data[metadata]"} {
+        form.Set(prefix+"[invoice_id]", req.InvoiceID.Hex())
+        form.Set(prefix+"[organization]", req.Organization)
+    }
+
+    httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/checkout/sessions", strings.NewReader(form.Encode()))
+    if err != nil {
+        return PaymentLink{}, err
+    }
+    httpReq.Header.Set("Authorization", "Bearer "+p.secretKey)
+    httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    if req.IdempotencyKey != "" {
+        httpReq.Header.Set("Idempotency-Key", req.IdempotencyKey)
+    }
+    resp, err := p.http.Do(httpReq)
+    if err != nil {
+        return PaymentLink{}, err
+    }
+    defer resp.Body.Close()
+
+    var session struct {
+        ID        string `json:"id"`
+        URL       string `json:"url"`
+        ExpiresAt int64  `json:"expires_at"`
+        Error     *struct {
+            Message string `json:"message"`
+        } `json:"error"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+        return PaymentLink{}, fmt.Errorf("stripe answered %s: %w", resp.Status, err)
+    }
+    if resp.StatusCode != http.StatusOK {
+        if session.Error != nil {
+            return PaymentLink{}, fmt.Errorf("stripe answered %s: %s", resp.Status, session.Error.Message)
+        }
+        return PaymentLink{}, fmt.Errorf("stripe answered %s", resp.Status)
+    }
+    if session.ID == "" || session.URL == "" {
+        return PaymentLink{}, errors.New("stripe returned a session without an ID or URL")
+    }
+
+    link := PaymentLink{
+        Provider:  p.Name(),
+        ID:        session.ID,
+        URL:       session.URL,
+        Currency:  req.Currency,
+        Amount:    req.Amount,
+        CreatedAt: p.now().UTC(),
+    }
+    if session.ExpiresAt > 0 {
+        expiresAt := time.Unix(session.ExpiresAt, 0).UTC()
+        link.ExpiresAt = &expiresAt
+    }
+    return link, nil
+}
+
+// ParseWebhook checks the Stripe-Signature header, an HMAC-SHA256 of the
+// timestamp and the payload with the webhook secret, and reads the event.
+// Completed Checkout sessions that are paid are Paid events.
+func (p *StripeProvider) ParseWebhook(payload []byte, header http.Header) (ProviderEvent, error) {
+    var timestamp int64
+    var signatures [][]byte
+    for _, part := range strings.Split(header.Get("Stripe-Signature"), ",") {
+        key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+        switch key {
+        case "t":
+            timestamp, _ = strconv.ParseInt(value, 10, 64)
+        case "v1":
+            if signature, err := hex.DecodeString(value); err == nil {
+                signatures = append(signatures, signature)
+            }
+        }
+    }
+    if timestamp == 0 || len(signatures) == 0 {
+        return ProviderEvent{}, errBadSignature
+    }
+
+    mac := hmac.New(sha256.New, []byte(p.webhookSecret))
+    fmt.Fprintf(mac, "%d.", timestamp)
+    mac.Write(payload)
+    expected := mac.Sum(nil)
+    valid := false
+    for _, signature := range signatures {
+        if hmac.Equal(signature, expected) {
+            valid = true
+        }
+    }
+    if !valid {
+        return ProviderEvent{}, errBadSignature
+    }
+    if age := p.now().Sub(time.Unix(timestamp, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+        return ProviderEvent{}, fmt.Errorf("%w: timestamp too old", errBadSignature)
+    }
+
+    var event struct {
+        ID      string `json:"id"`
+        Type    string `json:"type"`
+        Created int64  `json:"created"`
+        Data    struct {
+            Object struct {
+                ID                string            `json:"id"`
+                PaymentStatus     string            `json:"payment_status"`
+                AmountTotal       int64             `json:"amount_total"`
+                Currency          string            `json:"currency"`
+                PaymentIntent     string            `json:"payment_intent"`
+                ClientReferenceID string            `json:"client_reference_id"`
+                Metadata          map[string]string `json:"metadata"`
+            } `json:"object"`
+        } `json:"data"`
+    }
+    if err := json.Unmarshal(payload, &event); err != nil {
+        return ProviderEvent{}, err
+    }
+    if event.ID == "" {
+        return ProviderEvent{}, errors.New("event has no ID")
+    }
+
+    object := event.Data.Object
+    result := ProviderEvent{
+        ID:        event.ID,
+        Type:      event.Type,
+        Currency:  strings.ToUpper(object.Currency),
+        Amount:    Money(object.AmountTotal),
+        CreatedAt: time.Unix(event.Created, 0).UTC(),
+    }
+    switch event.Type {
+    case "checkout.session.completed", "checkout.session.async_payment_succeeded":
+        result.Paid = object.PaymentStatus == "paid"
+        result.InvoiceID = object.Metadata["invoice_id"]
+        if result.InvoiceID == "" {
+            result.InvoiceID = object.ClientReferenceID
+        }
+        // The payment intent identifies the payment; the session is a fallback
+        result.PaymentID = object.PaymentIntent
+        if result.PaymentID == "" {
+            result.PaymentID = object.ID
+        }
+    }
+    return result, nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fakeStripe is a minimal Stripe stand-in creating Checkout sessions. Like
+// Stripe, it answers a retried request with the same Idempotency-Key with the
+// session it created first.
+type fakeStripe struct {
+    mu       sync.Mutex
+    forms    []url.Values
+    sessions map[string]string
+}
+
+func (f *fakeStripe) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    w.Header().Set("Content-Type", "application/json")
+    if req.Method != http.MethodPost || req.URL.Path != "/v1/checkout/sessions" {
+        w.WriteHeader(http.StatusNotFound)
+        fmt.Fprint(w, `{"error": {"message": "Unrecognized request URL"}}`)
+        return
+    }
+    if req.Header.Get("Authorization") != "Bearer sk_test" {
+        w.WriteHeader(http.StatusUnauthorized)
+        fmt.Fprint(w, `{"error": {"message": "Invalid API Key provided"}}`)
+        return
+    }
+    req.ParseForm()
+    f.forms = append(f.forms, req.PostForm)
+
+    id, ok := f.sessions[req.Header.Get("Idempotency-Key")]
+    if !ok {
+        id = fmt.Sprintf("cs_test_%d", len(f.sessions)+1)
+        f.sessions[req.Header.Get("Idempotency-Key")] = id
+    }
+    fmt.Fprintf(w, `{"id": %q, "url": "https://checkout.example.com/pay/%s", "expires_at": 1700086400}`, id, id)
+}
+
+func newTestStripe(t *testing.T) (*StripeProvider, *fakeStripe) {
+    fake := &fakeStripe{sessions: map[string]string{}}
+    server := httptest.NewServer(fake)
+    t.Cleanup(server.Close)
+
+    p, err := NewStripeProvider(server.URL, "sk_test", "whsec_test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    p.now = func() time.Time { return time.Unix(1700000000, 0) }
+    return p, fake
+}
+
+func TestStripeCreatePaymentLink(t *testing.T) {
+    p, fake := newTestStripe(t)
+    invoiceID := primitive.NewObjectID()
+    req := PaymentLinkRequest{
+        InvoiceID:      invoiceID,
+        Number:         "INV-000042",
+        Organization:   "acme",
+        Currency:       "USD",
+        Amount:         123456,
+        IdempotencyKey: "invoice-1",
+    }
+
+    link, err := p.CreatePaymentLink(context.Background(), req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if link.Provider != "stripe" || link.ID != "cs_test_1" || link.URL != "https://checkout.example.com/pay/cs_test_1" {
+        t.Errorf("link = %+v", link)
+    }
+    if link.Amount != 123456 || link.ExpiresAt == nil || link.ExpiresAt.Unix() != 1700086400 {
+        t.Errorf("link amount or expiry = %d, %v", link.Amount, link.ExpiresAt)
+    }
+
+    form := fake.forms[0]
+    for key, want := range map[string]string{
+        "mode":                                          "payment",
+        "client_reference_id":                           invoiceID.Hex(),
+        "line_items[0][price_data][currency]":           "usd",
+        "line_items[0][price_data][unit_amount]":        "123456",
+        "line_items[0][price_data][product_data][name]": "Invoice INV-000042",
+        "metadata[invoice_id]":                          invoiceID.Hex(),
+        "payment_intent_data[metadata][invoice_id]":     invoiceID.Hex(),
+    } {
+        if got := form.Get(key); got != want {
+            t.Errorf("%s = %q, want %q", key, got, want)
+        }
+    }
+
+    again, err := p.CreatePaymentLink(context.Background(), req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if again.ID != link.ID {
+        t.Errorf("retry created session %s, want %s", again.ID, link.ID)
+    }
+}
+
+func TestStripeCreatePaymentLinkError(t *testing.T) {
+    p, _ := newTestStripe(t)
+    p.secretKey = "sk_wrong"
+
+    _, err := p.CreatePaymentLink(context.Background(), PaymentLinkRequest{InvoiceID: primitive.NewObjectID(), Currency: "USD", Amount: 100})
+    if err == nil || !strings.Contains(err.Error(), "Invalid API Key") {
+        t.Errorf("err = %v, want Stripe's error message", err)
+    }
+}
+
+func signStripe(secret string, timestamp int64, payload []byte) http.Header {
+    mac := hmac.New(sha256.New, []byte(secret))
+    fmt.Fprintf(mac, "%d.", timestamp)
+    mac.Write(payload)
+    header := http.Header{}
+    header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil))))
+    return header
+}
+
+func checkoutEvent(t *testing.T, eventType, paymentStatus string) []byte {
+    payload, err := json.Marshal(map[string]interface{}{
+        "id":      "evt_1",
+        "type":    eventType,
+        "created": 1699999990,
+        "data": map[string]interface{}{"object": map[string]interface{}{
+            "id":             "cs_test_1",
+            "payment_status": paymentStatus,
+            "amount_total":   123456,
+            "currency":       "usd",
+            "payment_intent": "pi_1",
+            "metadata":       map[string]string{"invoice_id": "65f0c0ffee0000000000abcd"},
+        }},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return payload
+}
+
+func TestStripeParseWebhook(t *testing.T) {
+    p, _ := newTestStripe(t)
+    payload := checkoutEvent(t, "checkout.session.completed", "paid")
+
+    event, err := p.ParseWebhook(payload, signStripe("whsec_test", 1700000000, payload))
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := ProviderEvent{
+        ID:        "evt_1",
+        Type:      "checkout.session.completed",
+        Paid:      true,
+        InvoiceID: "65f0c0ffee0000000000abcd",
+        PaymentID: "pi_1",
+        Currency:  "USD",
+        Amount:    123456,
+        CreatedAt: time.Unix(1699999990, 0).UTC(),
+    }
+    if event != want {
+        t.Errorf("event = %+v, want %+v", event, want)
+    }
+
+    unpaid := checkoutEvent(t, "checkout.session.completed", "unpaid")
+    if event, err := p.ParseWebhook(unpaid, signStripe("whsec_test", 1700000000, unpaid)); err != nil || event.Paid {
+        t.Errorf("unpaid session: Paid = %v, err = %v", event.Paid, err)
+    }
+    other := checkoutEvent(t, "checkout.session.expired", "unpaid")
+    if event, err := p.ParseWebhook(other, signStripe("whsec_test", 1700000000, other)); err != nil || event.Paid || event.Type != "checkout.session.expired" {
+        t.Errorf("expired session: %+v, err = %v", event, err)
+    }
+}
+
+func TestStripeParseWebhookRejectsBadSignatures(t *testing.T) {
+    p, _ := newTestStripe(t)
+    payload := checkoutEvent(t, "checkout.session.completed", "paid")
+
+    tests := map[string]http.Header{
+        "no header":     {},
+        "wrong secret":  signStripe("whsec_other", 1700000000, payload),
+        "other payload": signStripe("whsec_test", 1700000000, append([]byte(" "), payload...)),
+        "too old":       signStripe("whsec_test", 1700000000-600, payload),
+        "from future":   signStripe("whsec_test", 1700000000+600, payload),
+        "malformed":     {"Stripe-Signature": {"t=abc,v1=zz"}},
+    }
+    for name, header := range tests {
+        if _, err := p.ParseWebhook(payload, header); !errors.Is(err, errBadSignature) {
+            t.Errorf("%s: err = %v, want errBadSignature", name, err)
+        }
+    }
+}
+
+func TestPaymentLinkUsable(t *testing.T) {
+    now := time.Unix(1700000000, 0)
+    later := now.Add(time.Hour)
+    link := &PaymentLink{Amount: 1000, ExpiresAt: &later}
+
+    if !link.Usable(1000, now) {
+        t.Errorf("link for the balance should be usable")
+    }
+    if link.Usable(500, now) {
+        t.Errorf("link for another amount should not be usable")
+    }
+    if link.Usable(1000, later.Add(time.Second)) {
+        t.Errorf("expired link should not be usable")
+    }
+    var none *PaymentLink
+    if none.Usable(1000, now) {
+        t.Errorf("missing link should not be usable")
+    }
+}
+
+// memoryLedger keeps what handleProviderEvent records in memory and applies
+// payments to its invoices as applyPayment does.
+type memoryLedger struct {
+    events   map[string]bool
+    invoices map[primitive.ObjectID]*Invoice
+    payments []Payment
+}
+
+func newMemoryLedger(invs ...Invoice) *memoryLedger {
+    l := &memoryLedger{events: map[string]bool{}, invoices: map[primitive.ObjectID]*Invoice{}}
+    for i := range invs {
+        l.invoices[invs[i].ID] = &invs[i]
+    }
+    return l
+}
+
+func (l *memoryLedger) RecordEvent(key string, _ ProviderEvent) (bool, error) {
+    if l.events[key] {
+        return false, nil
+    }
+    l.events[key] = true
+    return true, nil
+}
+
+func (l *memoryLedger) FindInvoice(id primitive.ObjectID) (Invoice, error) {
+    inv, ok := l.invoices[id]
+    if !ok {
+        return Invoice{}, invoiceRefused(http.StatusNotFound, "Invoice not found")
+    }
+    return *inv, nil
+}
+
+func (l *memoryLedger) PaymentRecorded(organization, reference string) (bool, error) {
+    for _, payment := range l.payments {
+        if payment.Organization == organization && payment.Reference == reference {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+func (l *memoryLedger) ApplyPayment(payment *Payment, inv Invoice, amount Money) error {
+    stored := l.invoices[inv.ID]
+    if stored.Version != inv.Version {
+        return errInvoiceModified
+    }
+    if amount == stored.Balance() {
+        stored.Status, stored.PaidAt = invoicePaid, &payment.ReceivedAt
+    }
+    stored.Paid += amount
+    stored.Payments = append(stored.Payments, InvoicePayment{PaymentID: payment.ID, Method: payment.Method, Reference: payment.Reference, ReceivedAt: payment.ReceivedAt, Amount: amount})
+    stored.Version++
+    payment.allocate(inv, amount)
+    return nil
+}
+
+func (l *memoryLedger) InsertPayment(payment Payment) error {
+    l.payments = append(l.payments, payment)
+    return nil
+}
+
+// stripePayment is a signed checkout.session.completed webhook of the test
+// Stripe, as parsed by it.
+func stripePayment(t *testing.T, p *StripeProvider, eventID, paymentIntent string, invoiceID primitive.ObjectID, currency string, amount int64) ProviderEvent {
+    payload, err := json.Marshal(map[string]interface{}{
+        "id":      eventID,
+        "type":    "checkout.session.completed",
+        "created": 1699999990,
+        "data": map[string]interface{}{"object": map[string]interface{}{
+            "id":             "cs_" + eventID,
+            "payment_status": "paid",
+            "amount_total":   amount,
+            "currency":       currency,
+            "payment_intent": paymentIntent,
+            "metadata":       map[string]string{"invoice_id": invoiceID.Hex()},
+        }},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    event, err := p.ParseWebhook(payload, signStripe("whsec_test", 1700000000, payload))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return event
+}
+
+func useTestStripe(t *testing.T) *StripeProvider {
+    p, _ := newTestStripe(t)
+    previous := provider
+    provider = p
+    t.Cleanup(func() { provider = previous })
+    return p
+}
+
+func issuedInvoice(total Money) Invoice {
+    return Invoice{ID: primitive.NewObjectID(), Kind: kindInvoice, Number: "INV-000042", Organization: "acme", Currency: "USD", Status: invoiceIssued, Total: total, Version: 1}
+}
+
+func TestHandleProviderEventPaysInvoice(t *testing.T) {
+    p := useTestStripe(t)
+    inv := issuedInvoice(123456)
+    ledger := newMemoryLedger(inv)
+
+    if err := handleProviderEvent(ledger, stripePayment(t, p, "evt_1", "pi_1", inv.ID, "usd", 123456)); err != nil {
+        t.Fatal(err)
+    }
+    paid := ledger.invoices[inv.ID]
+    if paid.Status != invoicePaid || paid.Balance() != 0 || paid.PaidAt == nil {
+        t.Errorf("Want the invoice paid off, Got %s with a balance of %d", paid.Status, paid.Balance())
+    }
+    if len(ledger.payments) != 1 {
+        t.Fatalf("Want 1 payment, Got %d", len(ledger.payments))
+    }
+    payment := ledger.payments[0]
+    if payment.Method != "online" || payment.Reference != "pi_1" || payment.Unapplied != 0 || len(payment.Allocations) != 1 {
+        t.Errorf("Want an online payment pi_1 applied in full, Got %+v", payment)
+    }
+}
+
+func TestHandleProviderEventRedelivery(t *testing.T) {
+    p := useTestStripe(t)
+    inv := issuedInvoice(10000)
+    ledger := newMemoryLedger(inv)
+    event := stripePayment(t, p, "evt_1", "pi_1", inv.ID, "usd", 4000)
+
+    if err := handleProviderEvent(ledger, event); err != nil {
+        t.Fatal(err)
+    }
+    // Stripe delivers an event again when it isn't sure it arrived
+    if err := handleProviderEvent(ledger, event); !errors.Is(err, errEventHandled) {
+        t.Errorf("Same event again: Want errEventHandled, Got %v", err)
+    }
+    // and may report the same payment in another event
+    if err := handleProviderEvent(ledger, stripePayment(t, p, "evt_2", "pi_1", inv.ID, "usd", 4000)); err != nil {
+        t.Errorf("Same payment in another event: Want it ignored, Got %v", err)
+    }
+    if len(ledger.payments) != 1 || ledger.invoices[inv.ID].Paid != 4000 {
+        t.Errorf("Want 1 payment of 4000, Got %d payments and %d paid", len(ledger.payments), ledger.invoices[inv.ID].Paid)
+    }
+    if status := ledger.invoices[inv.ID].Status; status != invoiceIssued {
+        t.Errorf("Want the partly paid invoice issued, Got %s", status)
+    }
+}
+
+func TestHandleProviderEventCredit(t *testing.T) {
+    p := useTestStripe(t)
+    paidOtherwise := issuedInvoice(10000)
+    paidOtherwise.Status, paidOtherwise.Paid = invoicePaid, 10000
+
+    tests := []struct {
+        name          string
+        inv           Invoice
+        currency      string
+        amount        int64
+        wantPaid      Money
+        wantUnapplied Money
+    }{
+        {"overpayment", issuedInvoice(10000), "usd", 15000, 10000, 5000},
+        {"currency mismatch", issuedInvoice(10000), "eur", 10000, 0, 10000},
+        {"paid otherwise meanwhile", paidOtherwise, "usd", 10000, 10000, 10000},
+    }
+    for i, tc := range tests {
+        ledger := newMemoryLedger(tc.inv)
+        event := stripePayment(t, p, fmt.Sprintf("evt_%d", i), fmt.Sprintf("pi_%d", i), tc.inv.ID, tc.currency, tc.amount)
+        if err := handleProviderEvent(ledger, event); err != nil {
+            t.Errorf("%s: %v", tc.name, err)
+            continue
+        }
+        if len(ledger.payments) != 1 {
+            t.Errorf("%s: Want the payment recorded, Got %d payments", tc.name, len(ledger.payments))
+            continue
+        }
+        payment := ledger.payments[0]
+        if paid := ledger.invoices[tc.inv.ID].Paid; paid != tc.wantPaid {
+            t.Errorf("%s: Want %d paid on the invoice, Got %d", tc.name, tc.wantPaid, paid)
+        }
+        if payment.Unapplied != tc.wantUnapplied || payment.Currency != strings.ToUpper(tc.currency) {
+            t.Errorf("%s: Want %d %s left as credit, Got %d %s", tc.name, tc.wantUnapplied, strings.ToUpper(tc.currency), payment.Unapplied, payment.Currency)
+        }
+    }
+}
+
+func TestHandleProviderEventIgnored(t *testing.T) {
+    p := useTestStripe(t)
+    ledger := newMemoryLedger()
+
+    unknown := stripePayment(t, p, "evt_1", "pi_1", primitive.NewObjectID(), "usd", 10000)
+    if err := handleProviderEvent(ledger, unknown); err != nil {
+        t.Errorf("Unknown invoice: Want it ignored, Got %v", err)
+    }
+    expired := ProviderEvent{ID: "evt_2", Type: "checkout.session.expired"}
+    if err := handleProviderEvent(ledger, expired); err != nil {
+        t.Errorf("Expired session: Want it ignored, Got %v", err)
+    }
+    if len(ledger.payments) != 0 || len(ledger.events) != 2 {
+        t.Errorf("Want 2 events recorded and no payments, Got %d and %d", len(ledger.events), len(ledger.payments))
+    }
+}
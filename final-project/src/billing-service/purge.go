@@ -0,0 +1,87 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// handleUserDeleted keeps a deleted user's billings for accounting but removes the
+// user's ID from them and from their audit log, and reports how many changed
+// with UserDataPurged.
+func handleUserDeleted(ctx context.Context, event Event) error {
+    var deleted UserDeletedEvent
+    if err := json.Unmarshal(event.Data, &deleted); err != nil {
+        log.Printf("Ignoring malformed %s event %s: %v", event.Type, event.ID, err)
+        return nil
+    }
+
+    users.Forget(deleted.UserID)
+    cursor, err := client.Database("billing").Collection("billings").Find(ctx, bson.M{"user_id": deleted.UserID}, options.Find().SetProjection(bson.M{"_id": 1}))
+    if err != nil {
+        return err
+    }
+    var billings []struct {
+        ID primitive.ObjectID `bson:"_id"`
+    }
+    if err := cursor.All(ctx, &billings); err != nil {
+        return err
+    }
+    change := billingChange{Action: auditAnonymized, Actor: userServiceActor, Reason: "user deleted"}
+    var anonymized int64
+    for _, billing := range billings {
+        var matched bool
+        err := withTransaction(func(sctx mongo.SessionContext) error {
+            filter := bson.M{"_id": billing.ID, "user_id": deleted.UserID}
+            update := bson.M{"$set": bson.M{"user_id": primitive.NilObjectID, "anonymized_at": time.Now().UTC()}, "$inc": bson.M{"version": 1}}
+            var err error
+            _, matched, err = mutateBilling(sctx, filter, update, change)
+            return err
+        })
+        if err != nil {
+            return err
+        }
+        if matched {
+            anonymized++
+        }
+    }
+    log.Printf("Anonymized %d billings of deleted user %s", anonymized, deleted.UserID.Hex())
+
+    // The audit log's copies of the billings lose the user too
+    var redacted int64
+    err = withTransaction(func(sctx mongo.SessionContext) error {
+        var err error
+        redacted, err = redactAuditUser(sctx, deleted.UserID)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+
+    // Invoice lines are copies of billings, so they lose the user too
+    lines, err := invoices().UpdateMany(ctx,
+        bson.M{"lines.user_id": deleted.UserID},
+        bson.M{"$set": bson.M{"lines.$[line].user_id": primitive.NilObjectID}, "$inc": bson.M{"version": 1}},
+        options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"line.user_id": deleted.UserID}}}),
+    )
+    if err != nil {
+        return err
+    }
+
+    report, err := newEvent("purge-"+deleted.DeletionID.Hex()+"-billing-service", eventUserDataPurged, UserDataPurgedEvent{
+        DeletionID: deleted.DeletionID,
+        UserID:     deleted.UserID,
+        Service:    "billing-service",
+        Changes:    map[string]int64{"billings_anonymized": anonymized, "invoice_lines_anonymized": lines.ModifiedCount, "audit_entries_redacted": redacted},
+    })
+    if err != nil {
+        return err
+    }
+    return bus.Publish(ctx, report)
+}
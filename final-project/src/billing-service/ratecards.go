@@ -0,0 +1,420 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Where a billing's hourly rate came from.
+const (
+    rateSourceCard    = "rate_card"
+    rateSourceDefault = "default"
+    rateSourceManual  = "manual"
+)
+
+// RateCard is an hourly rate for the work it's scoped to. A card without a
+// scope applies to everyone; UserID, ProjectID, Organization (the client) and Role
+// narrow it down, and ValidFrom and ValidTo (exclusive) limit it to a period.
+type RateCard struct {
+    ID           primitive.ObjectID  `bson:"_id" json:"id"`
+    Name         string              `bson:"name,omitempty" json:"name,omitempty"`
+    UserID       *primitive.ObjectID `bson:"user_id,omitempty" json:"user_id,omitempty"`
+    ProjectID    *primitive.ObjectID `bson:"project_id,omitempty" json:"project_id,omitempty"`
+    Organization string              `bson:"organization,omitempty" json:"organization,omitempty"`
+    Role         string              `bson:"role,omitempty" json:"role,omitempty"`
+    Currency     string              `bson:"currency" json:"currency"`
+    HourlyRate   Money               `bson:"hourly_rate_minor" json:"-"`
+    ValidFrom    *time.Time          `bson:"valid_from,omitempty" json:"valid_from,omitempty"`
+    ValidTo      *time.Time          `bson:"valid_to,omitempty" json:"valid_to,omitempty"`
+    CreatedAt    time.Time           `bson:"created_at" json:"created_at"`
+}
+
+// MarshalJSON writes HourlyRate as a decimal in the card's currency.
+func (c RateCard) MarshalJSON() ([]byte, error) {
+    type rateCard RateCard
+    return json.Marshal(struct {
+        rateCard
+        HourlyRate string `json:"hourly_rate"`
+    }{rateCard(c), c.HourlyRate.Format(c.Currency)})
+}
+
+func rateCards() *mongo.Collection {
+    return client.Database("billing").Collection("rate_cards")
+}
+
+// rateContext is the work a rate is looked up for. Currency, when set, only
+// allows cards in that currency.
+type rateContext struct {
+    UserID       primitive.ObjectID
+    ProjectID    primitive.ObjectID
+    Organization string
+    Role         string
+    Currency     string
+    At           time.Time
+}
+
+// specificity ranks a card by its scope: a card for the user beats any card
+// without one, then a card for the project, then for the organization, then for
+// the role. A card without a scope comes last.
+func (c RateCard) specificity() int {
+    rank := 0
+    if c.UserID != nil {
+        rank += 8
+    }
+    if c.ProjectID != nil {
+        rank += 4
+    }
+    if c.Organization != "" {
+        rank += 2
+    }
+    if c.Role != "" {
+        rank++
+    }
+    return rank
+}
+
+// matches reports whether every part of the card's scope and period fits rc.
+func (c RateCard) matches(rc rateContext) bool {
+    switch {
+    case c.UserID != nil && *c.UserID != rc.UserID,
+        c.ProjectID != nil && *c.ProjectID != rc.ProjectID,
+        c.Organization != "" && c.Organization != rc.Organization,
+        c.Role != "" && c.Role != rc.Role,
+        rc.Currency != "" && c.Currency != rc.Currency,
+        c.ValidFrom != nil && rc.At.Before(*c.ValidFrom),
+        c.ValidTo != nil && !rc.At.Before(*c.ValidTo):
+        return false
+    }
+    return true
+}
+
+// pickRateCard returns the most specific card that matches rc, or nil. Of equally
+// specific cards the one that started last wins, then the one created last, so a
+// new card can take over from an old one without ending it.
+func pickRateCard(cards []RateCard, rc rateContext) *RateCard {
+    var best *RateCard
+    for i := range cards {
+        card := &cards[i]
+        if !card.matches(rc) {
+            continue
+        }
+        if best == nil || newerRateCard(card, best) {
+            best = card
+        }
+    }
+    return best
+}
+
+func newerRateCard(a, b *RateCard) bool {
+    if a.specificity() != b.specificity() {
+        return a.specificity() > b.specificity()
+    }
+    var aFrom, bFrom time.Time
+    if a.ValidFrom != nil {
+        aFrom = *a.ValidFrom
+    }
+    if b.ValidFrom != nil {
+        bFrom = *b.ValidFrom
+    }
+    if !aFrom.Equal(bFrom) {
+        return aFrom.After(bFrom)
+    }
+    return a.CreatedAt.After(b.CreatedAt)
+}
+
+// fallbackHourlyRate is the rate used when no card matches: DEFAULT_HOURLY_RATE
+// (default 100) in the given currency.
+func fallbackHourlyRate(currency string) Money {
+    if rate, err := parseMoney(os.Getenv("DEFAULT_HOURLY_RATE"), currency); err == nil && rate >= 0 {
+        return rate
+    }
+    return Money(100 * pow10(currencyExponents[currency]))
+}
+
+// resolveRate sets the billing's currency and hourly rate from the rate card that
+// applies to rc, or from the fallback rate, and records where the rate came from.
+// The billing keeps that rate, so later changes to the cards don't change it.
+func resolveRate(ctx context.Context, billing *Billing, rc rateContext) error {
+    rc.Currency = billing.Currency
+    filter := bson.M{}
+    if rc.Currency != "" {
+        filter["currency"] = rc.Currency
+    }
+    cursor, err := rateCards().Find(ctx, filter)
+    if err != nil {
+        return err
+    }
+    var cards []RateCard
+    if err := cursor.All(ctx, &cards); err != nil {
+        return err
+    }
+
+    if card := pickRateCard(cards, rc); card != nil {
+        billing.Currency = card.Currency
+        billing.HourlyRate = &card.HourlyRate
+        billing.RateCardID = &card.ID
+        billing.RateSource = rateSourceCard
+        return nil
+    }
+    if billing.Currency == "" {
+        billing.Currency = defaultCurrency()
+    }
+    rate := fallbackHourlyRate(billing.Currency)
+    billing.HourlyRate = &rate
+    billing.RateSource = rateSourceDefault
+    return nil
+}
+
+// taskRateContext fills in the organization and project of the task and the role
+// of the user from task-service and user-service.
+func taskRateContext(ctx context.Context, userID, taskID primitive.ObjectID) (rateContext, error) {
+    rc := rateContext{UserID: userID, At: time.Now().UTC()}
+    var task struct {
+        Organization string             `json:"organization"`
+        ProjectID    primitive.ObjectID `json:"project_id"`
+    }
+    if _, err := tasks.Get(ctx, taskID, &task); err != nil {
+        return rc, err
+    }
+    rc.Organization, rc.ProjectID = task.Organization, task.ProjectID
+    return rc, withUserRole(ctx, &rc)
+}
+
+// withUserRole fills in the role of rc's user, if it has one.
+func withUserRole(ctx context.Context, rc *rateContext) error {
+    if rc.UserID.IsZero() {
+        return nil
+    }
+    var user struct {
+        Role string `json:"role"`
+    }
+    if _, err := users.Get(ctx, rc.UserID, &user); err != nil {
+        return err
+    }
+    rc.Role = user.Role
+    return nil
+}
+
+// rateCardInput is the body of a create request; the rate is a decimal in the
+// card's currency.
+type rateCardInput struct {
+    Name         string              `json:"name"`
+    UserID       *primitive.ObjectID `json:"user_id"`
+    ProjectID    *primitive.ObjectID `json:"project_id"`
+    Organization string              `json:"organization"`
+    Role         string              `json:"role"`
+    Currency     string              `json:"currency"`
+    HourlyRate   *json.Number        `json:"hourly_rate"`
+    ValidFrom    *time.Time          `json:"valid_from"`
+    ValidTo      *time.Time          `json:"valid_to"`
+}
+
+// createRateCard adds a rate card. Cards are never edited: end one with a
+// ValidTo and start its successor there, so the history stays visible.
+func createRateCard(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to create rate card")
+
+    if req.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var input rateCardInput
+    if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    card := RateCard{
+        ID:           primitive.NewObjectID(),
+        Name:         input.Name,
+        UserID:       input.UserID,
+        ProjectID:    input.ProjectID,
+        Organization: input.Organization,
+        Role:         input.Role,
+        Currency:     strings.ToUpper(input.Currency),
+        ValidFrom:    input.ValidFrom,
+        ValidTo:      input.ValidTo,
+        CreatedAt:    time.Now().UTC(),
+    }
+    if card.Currency == "" {
+        card.Currency = defaultCurrency()
+    }
+
+    var validationErrs ValidationError
+    if !validCurrency(card.Currency) {
+        validationErrs = append(validationErrs, FieldError{Field: "currency", Code: "invalid_value", Message: "must be a supported ISO 4217 currency code"})
+    } else if input.HourlyRate == nil {
+        validationErrs = append(validationErrs, FieldError{Field: "hourly_rate", Code: "required", Message: "is required"})
+    } else {
+        rate, err := parseMoney(input.HourlyRate.String(), card.Currency)
+        if err == nil && rate < 0 {
+            validationErrs = append(validationErrs, FieldError{Field: "hourly_rate", Code: "invalid_value", Message: "must not be negative"})
+        } else if err != nil {
+            validationErrs = append(validationErrs, FieldError{Field: "hourly_rate", Code: "invalid_value", Message: err.Error()})
+        }
+        card.HourlyRate = rate
+    }
+    if card.ValidFrom != nil && card.ValidTo != nil && !card.ValidTo.After(*card.ValidFrom) {
+        validationErrs = append(validationErrs, FieldError{Field: "valid_to", Code: "invalid_value", Message: "must be after valid_from"})
+    }
+    if len(validationErrs) == 0 && card.UserID != nil {
+        var err error
+        validationErrs, err = checkReferences(req.Context(), card.UserID, nil)
+        if err != nil {
+            http.Error(w, "Failed to validate rate card: "+err.Error(), http.StatusServiceUnavailable)
+            return
+        }
+    }
+    if len(validationErrs) > 0 {
+        writeValidationError(w, validationErrs)
+        return
+    }
+
+    if _, err := rateCards().InsertOne(context.TODO(), card); err != nil {
+        http.Error(w, "Failed to create rate card", http.StatusInternalServerError)
+        return
+    }
+    log.Printf("Rate card %s created: %s %s", card.ID.Hex(), card.HourlyRate.Format(card.Currency), card.Currency)
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(card)
+}
+
+// listRateCards lists the rate cards, optionally those for a user_id,
+// project_id, organization, role or currency.
+func listRateCards(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to list rate cards")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := req.URL.Query()
+    filter := bson.M{}
+    for _, key := range []string{"user_id", "project_id"} {
+        if value := query.Get(key); value != "" {
+            id, err := primitive.ObjectIDFromHex(value)
+            if err != nil {
+                http.Error(w, "Invalid "+key, http.StatusBadRequest)
+                return
+            }
+            filter[key] = id
+        }
+    }
+    for _, key := range []string{"organization", "role"} {
+        if value := query.Get(key); value != "" {
+            filter[key] = value
+        }
+    }
+    if currency := query.Get("currency"); currency != "" {
+        filter["currency"] = strings.ToUpper(currency)
+    }
+
+    cursor, err := rateCards().Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+    if err != nil {
+        http.Error(w, "Failed to list rate cards", http.StatusInternalServerError)
+        return
+    }
+    cards := []RateCard{}
+    if err := cursor.All(context.TODO(), &cards); err != nil {
+        http.Error(w, "Failed to decode rate cards", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(cards)
+}
+
+// removeRateCard deletes a rate card. Billings keep the rate they were given.
+func removeRateCard(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to remove rate card")
+
+    if req.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    cardID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/billings/rates/remove/"):])
+    if err != nil {
+        http.Error(w, "Invalid rate card ID", http.StatusBadRequest)
+        return
+    }
+    result, err := rateCards().DeleteOne(context.TODO(), bson.M{"_id": cardID})
+    if err != nil {
+        http.Error(w, "Failed to remove rate card", http.StatusInternalServerError)
+        return
+    }
+    if result.DeletedCount == 0 {
+        http.Error(w, "Rate card not found", http.StatusNotFound)
+        return
+    }
+    log.Printf("Rate card %s removed", cardID.Hex())
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// resolveRateCard shows the rate a billing would get for user_id and task_id at
+// date (default now), optionally in a currency.
+func resolveRateCard(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to resolve rate")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := req.URL.Query()
+    userID, err := primitive.ObjectIDFromHex(query.Get("user_id"))
+    if err != nil {
+        http.Error(w, "Invalid user_id", http.StatusBadRequest)
+        return
+    }
+    taskID, err := primitive.ObjectIDFromHex(query.Get("task_id"))
+    if err != nil {
+        http.Error(w, "Invalid task_id", http.StatusBadRequest)
+        return
+    }
+    billing := Billing{Currency: strings.ToUpper(query.Get("currency"))}
+    if billing.Currency != "" && !validCurrency(billing.Currency) {
+        writeValidationError(w, ValidationError{{Field: "currency", Code: "invalid_value", Message: "must be a supported ISO 4217 currency code"}})
+        return
+    }
+
+    rc, err := taskRateContext(req.Context(), userID, taskID)
+    if err != nil {
+        http.Error(w, "Failed to resolve rate: "+err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    if date := query.Get("date"); date != "" {
+        if rc.At, err = time.Parse(time.RFC3339, date); err != nil {
+            writeValidationError(w, ValidationError{{Field: "date", Code: "invalid_value", Message: "must be an RFC 3339 time"}})
+            return
+        }
+    }
+    if err := resolveRate(req.Context(), &billing, rc); err != nil {
+        http.Error(w, "Failed to resolve rate", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(struct {
+        Currency     string              `json:"currency"`
+        HourlyRate   string              `json:"hourly_rate"`
+        RateSource   string              `json:"rate_source"`
+        RateCardID   *primitive.ObjectID `json:"rate_card_id,omitempty"`
+        Organization string              `json:"organization,omitempty"`
+        ProjectID    primitive.ObjectID  `json:"project_id"`
+        Role         string              `json:"role,omitempty"`
+    }{billing.Currency, billing.HourlyRate.Format(billing.Currency), billing.RateSource, billing.RateCardID, rc.Organization, rc.ProjectID, rc.Role})
+}
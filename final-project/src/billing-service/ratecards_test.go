@@ -0,0 +1,119 @@
+package main
+
+import (
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRateCardSpecificity(t *testing.T) {
+    user, project := primitive.NewObjectID(), primitive.NewObjectID()
+    tests := []struct {
+        name string
+        card RateCard
+        want int
+    }{
+        {"everyone", RateCard{}, 0},
+        {"role", RateCard{Role: "engineer"}, 1},
+        {"organization", RateCard{Organization: "acme"}, 2},
+        {"organization and role", RateCard{Organization: "acme", Role: "engineer"}, 3},
+        {"project", RateCard{ProjectID: &project}, 4},
+        {"project, organization and role", RateCard{ProjectID: &project, Organization: "acme", Role: "engineer"}, 7},
+        {"user", RateCard{UserID: &user}, 8},
+        {"everything", RateCard{UserID: &user, ProjectID: &project, Organization: "acme", Role: "engineer"}, 15},
+    }
+    for _, tc := range tests {
+        if got := tc.card.specificity(); got != tc.want {
+            t.Errorf("%s: Want %d, Got %d", tc.name, tc.want, got)
+        }
+    }
+}
+
+func TestNewerRateCard(t *testing.T) {
+    user := primitive.NewObjectID()
+    jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    feb := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+    tests := []struct {
+        name string
+        a, b RateCard
+        want bool
+    }{
+        {"more specific wins", RateCard{UserID: &user}, RateCard{Organization: "acme", Role: "engineer"}, true},
+        {"less specific loses", RateCard{Role: "engineer"}, RateCard{Organization: "acme"}, false},
+        {"started later wins", RateCard{ValidFrom: &feb}, RateCard{ValidFrom: &jan}, true},
+        {"started earlier loses", RateCard{ValidFrom: &jan}, RateCard{ValidFrom: &feb}, false},
+        {"a start beats none", RateCard{ValidFrom: &jan}, RateCard{}, true},
+        {"specificity before start", RateCard{Role: "engineer", ValidFrom: &jan}, RateCard{ValidFrom: &feb}, true},
+        {"created later wins", RateCard{CreatedAt: feb}, RateCard{CreatedAt: jan}, true},
+        {"start before creation", RateCard{ValidFrom: &feb, CreatedAt: jan}, RateCard{ValidFrom: &jan, CreatedAt: feb}, true},
+        {"the same card", RateCard{CreatedAt: jan}, RateCard{CreatedAt: jan}, false},
+    }
+    for _, tc := range tests {
+        if got := newerRateCard(&tc.a, &tc.b); got != tc.want {
+            t.Errorf("%s: Want %v, Got %v", tc.name, tc.want, got)
+        }
+    }
+}
+
+func TestPickRateCard(t *testing.T) {
+    alice, bob := primitive.NewObjectID(), primitive.NewObjectID()
+    website, app := primitive.NewObjectID(), primitive.NewObjectID()
+    jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    jul := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+    created := time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)
+    card := func(name string, c RateCard) RateCard {
+        c.ID, c.Name = primitive.NewObjectID(), name
+        if c.Currency == "" {
+            c.Currency = "USD"
+        }
+        if c.CreatedAt.IsZero() {
+            c.CreatedAt = created
+        }
+        return c
+    }
+    cards := []RateCard{
+        card("everyone", RateCard{}),
+        card("engineers", RateCard{Role: "engineer"}),
+        card("acme", RateCard{Organization: "acme"}),
+        card("acme from July", RateCard{Organization: "acme", ValidFrom: &jul}),
+        card("website", RateCard{ProjectID: &website}),
+        card("alice", RateCard{UserID: &alice, ValidTo: &jul}),
+        card("alice on the website", RateCard{UserID: &alice, ProjectID: &website}),
+        card("everyone in EUR", RateCard{Currency: "EUR", CreatedAt: created.Add(time.Hour)}),
+        card("everyone again", RateCard{CreatedAt: created.Add(time.Hour)}),
+    }
+    march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    august := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+
+    tests := []struct {
+        name string
+        rc   rateContext
+        want string
+    }{
+        {"user and project", rateContext{UserID: alice, ProjectID: website, Organization: "acme", Role: "engineer", At: march}, "alice on the website"},
+        {"user beats project", rateContext{UserID: alice, ProjectID: app, Organization: "acme", At: march}, "alice"},
+        {"user card ended", rateContext{UserID: alice, ProjectID: app, Organization: "acme", At: august}, "acme from July"},
+        {"project beats organization", rateContext{UserID: bob, ProjectID: website, Organization: "acme", At: march}, "website"},
+        {"organization before its new card", rateContext{UserID: bob, ProjectID: app, Organization: "acme", At: march}, "acme"},
+        {"organization with its new card", rateContext{UserID: bob, ProjectID: app, Organization: "acme", At: august}, "acme from July"},
+        {"new card starts on its first day", rateContext{UserID: bob, ProjectID: app, Organization: "acme", At: jul}, "acme from July"},
+        {"organization beats role", rateContext{UserID: bob, Organization: "acme", Role: "engineer", At: jan}, "acme"},
+        {"role", rateContext{UserID: bob, Organization: "globex", Role: "engineer", At: march}, "engineers"},
+        {"newest of the cards for everyone", rateContext{UserID: bob, Organization: "globex", Currency: "USD", At: march}, "everyone again"},
+        {"currency", rateContext{UserID: alice, ProjectID: website, Currency: "EUR", At: march}, "everyone in EUR"},
+    }
+    for _, tc := range tests {
+        got := pickRateCard(cards, tc.rc)
+        if got == nil || got.Name != tc.want {
+            t.Errorf("%s: Want %s, Got %+v", tc.name, tc.want, got)
+        }
+    }
+
+    if got := pickRateCard(cards, rateContext{UserID: bob, Currency: "GBP", At: march}); got != nil {
+        t.Errorf("No card in the currency: Want none, Got %s", got.Name)
+    }
+    if got := pickRateCard(nil, rateContext{At: march}); got != nil {
+        t.Errorf("No cards: Want none, Got %s", got.Name)
+    }
+}
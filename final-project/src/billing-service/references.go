@@ -0,0 +1,180 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Header and secret used to call other services' internal endpoints.
+const (
+    internalServiceHeader = "X-Internal-Service"
+    internalServiceSecret = "your-internal-service-secret" // You should store and retrieve this securely
+)
+
+// lookupClient checks that an entity exists in another service. Entities found
+// are cached for the client's TTL; missing ones are always asked again, since
+// they may have been created since.
+type lookupClient struct {
+    name    string
+    baseURL string
+    path    string
+    ttl     time.Duration
+    http    *http.Client
+
+    mu    sync.Mutex
+    found map[primitive.ObjectID]time.Time
+}
+
+func newLookupClient(name, baseURL, path string, ttl time.Duration) *lookupClient {
+    return &lookupClient{
+        name:    name,
+        baseURL: baseURL,
+        path:    path,
+        ttl:     ttl,
+        http:    &http.Client{Timeout: 5 * time.Second},
+        found:   map[primitive.ObjectID]time.Time{},
+    }
+}
+
+// users and tasks look up IDs in user-service and task-service.
+var users, tasks *lookupClient
+
+var errLookupUnavailable = errors.New("service unavailable")
+
+// newLookupClients returns clients for USER_SERVICE_URL (default http://user-service:8001)
+// and TASK_SERVICE_URL (default http://task-service:8002), caching entities for
+// REFERENCE_CACHE_TTL (default 1m).
+func newLookupClients() (*lookupClient, *lookupClient) {
+    userURL := os.Getenv("USER_SERVICE_URL")
+    if userURL == "" {
+        userURL = "http://user-service:8001"
+    }
+    taskURL := os.Getenv("TASK_SERVICE_URL")
+    if taskURL == "" {
+        taskURL = "http://task-service:8002"
+    }
+    ttl, err := time.ParseDuration(os.Getenv("REFERENCE_CACHE_TTL"))
+    if err != nil || ttl < 0 {
+        ttl = time.Minute
+    }
+    return newLookupClient("user", userURL, "/users/lookup/", ttl), newLookupClient("task", taskURL, "/tasks/lookup/", ttl)
+}
+
+// Exists reports whether the entity exists. An error means the other service
+// could not answer.
+func (c *lookupClient) Exists(ctx context.Context, id primitive.ObjectID) (bool, error) {
+    c.mu.Lock()
+    expires, ok := c.found[id]
+    c.mu.Unlock()
+    if ok && time.Now().Before(expires) {
+        return true, nil
+    }
+    return c.Get(ctx, id, nil)
+}
+
+// Get reads the entity the other service returns into v, if v isn't nil, and
+// reports whether it exists. It always asks the other service.
+func (c *lookupClient) Get(ctx context.Context, id primitive.ObjectID, v interface{}) (bool, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+c.path+id.Hex(), nil)
+    if err != nil {
+        return false, err
+    }
+    req.Header.Set(internalServiceHeader, internalServiceSecret)
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return false, fmt.Errorf("%w: %v", errLookupUnavailable, err)
+    }
+    defer resp.Body.Close()
+
+    switch resp.StatusCode {
+    case http.StatusOK:
+        if v != nil {
+            if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+                return false, fmt.Errorf("%w: %s lookup of %s: %v", errLookupUnavailable, c.name, id.Hex(), err)
+            }
+        }
+        c.mu.Lock()
+        c.found[id] = time.Now().Add(c.ttl)
+        c.mu.Unlock()
+        return true, nil
+    case http.StatusNotFound:
+        c.Forget(id)
+        return false, nil
+    }
+    return false, fmt.Errorf("%w: %s lookup of %s returned status %d", errLookupUnavailable, c.name, id.Hex(), resp.StatusCode)
+}
+
+// Forget drops the entity from the cache, e.g. once it has been deleted.
+func (c *lookupClient) Forget(id primitive.ObjectID) {
+    c.mu.Lock()
+    delete(c.found, id)
+    c.mu.Unlock()
+}
+
+// FieldError reports an invalid value for one field. Code is one of required,
+// not_found, invalid_value or immutable.
+type FieldError struct {
+    Field   string `json:"field"`
+    Code    string `json:"code"`
+    Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+    return e.Field + ": " + e.Message
+}
+
+// ValidationError collects the field errors of a request.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+    messages := make([]string, len(e))
+    for i, fe := range e {
+        messages[i] = fe.Error()
+    }
+    return strings.Join(messages, "; ")
+}
+
+func writeValidationError(w http.ResponseWriter, errs ValidationError) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusUnprocessableEntity)
+    json.NewEncoder(w).Encode(struct {
+        Errors ValidationError `json:"errors"`
+    }{Errors: errs})
+}
+
+// checkReferences returns a not_found error when the user or task a billing
+// refers to doesn't exist. Nil IDs are not checked; an error means a service
+// couldn't answer.
+func checkReferences(ctx context.Context, userID, taskID *primitive.ObjectID) (ValidationError, error) {
+    var errs ValidationError
+    checks := []struct {
+        field  string
+        id     *primitive.ObjectID
+        lookup *lookupClient
+    }{
+        {"user_id", userID, users},
+        {"task_id", taskID, tasks},
+    }
+    for _, check := range checks {
+        if check.id == nil {
+            continue
+        }
+        exists, err := check.lookup.Exists(ctx, *check.id)
+        if err != nil {
+            return nil, err
+        }
+        if !exists {
+            errs = append(errs, FieldError{Field: check.field, Code: "not_found", Message: check.lookup.name + " " + check.id.Hex() + " does not exist"})
+        }
+    }
+    return errs, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLookupClient(t *testing.T) {
+    existing := primitive.NewObjectID()
+    garbled := primitive.NewObjectID()
+    calls := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        calls++
+        if req.Header.Get(internalServiceHeader) != internalServiceSecret {
+            http.Error(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+        switch req.URL.Path {
+        case "/tasks/lookup/" + existing.Hex():
+            w.Write([]byte(`{"title": "Migrate"}`))
+        case "/tasks/lookup/" + garbled.Hex():
+            w.Write([]byte(`{"title":`))
+        case "/tasks/lookup/" + primitive.NilObjectID.Hex():
+            http.Error(w, "Database query error", http.StatusInternalServerError)
+        default:
+            http.Error(w, "Task not found", http.StatusNotFound)
+        }
+    }))
+    defer server.Close()
+
+    lookup := newLookupClient("task", server.URL, "/tasks/lookup/", time.Minute)
+    ctx := context.Background()
+
+    var task struct {
+        Title string `json:"title"`
+    }
+    if found, err := lookup.Get(ctx, existing, &task); err != nil || !found || task.Title != "Migrate" {
+        t.Errorf("Get: Want Migrate, Got %v, %q (%v)", found, task.Title, err)
+    }
+    if exists, err := lookup.Exists(ctx, existing); err != nil || !exists {
+        t.Errorf("Existing task: Want true, Got %v (%v)", exists, err)
+    }
+    if calls != 1 {
+        t.Errorf("Found tasks should be cached: Want 1 call, Got %d", calls)
+    }
+
+    missing := primitive.NewObjectID()
+    for i := 0; i < 2; i++ {
+        if exists, err := lookup.Exists(ctx, missing); err != nil || exists {
+            t.Errorf("Missing task: Want false, Got %v (%v)", exists, err)
+        }
+    }
+    if calls != 3 {
+        t.Errorf("Missing tasks should not be cached: Want 3 calls, Got %d", calls)
+    }
+
+    lookup.Forget(existing)
+    lookup.Exists(ctx, existing)
+    if calls != 4 {
+        t.Errorf("Forgotten tasks should be looked up again: Want 4 calls, Got %d", calls)
+    }
+
+    if _, err := lookup.Exists(ctx, primitive.NilObjectID); !errors.Is(err, errLookupUnavailable) {
+        t.Errorf("Server error: Want errLookupUnavailable, Got %v", err)
+    }
+    if _, err := lookup.Get(ctx, garbled, &task); !errors.Is(err, errLookupUnavailable) {
+        t.Errorf("Unreadable answer: Want errLookupUnavailable, Got %v", err)
+    }
+    if exists, _ := lookup.Exists(ctx, garbled); !exists {
+        t.Errorf("Existence doesn't need the body: Want true, Got false")
+    }
+
+    server.Close()
+    if _, err := lookup.Exists(ctx, primitive.NewObjectID()); !errors.Is(err, errLookupUnavailable) {
+        t.Errorf("Unreachable service: Want errLookupUnavailable, Got %v", err)
+    }
+}
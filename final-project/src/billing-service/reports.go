@@ -0,0 +1,750 @@
+package main
+
+import (
+    "context"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// Billings have no date of their own; reports date them by the creation time
+// in their ObjectID.
+var billedAt = bson.M{"$toDate": "$_id"}
+
+// report is the answer to a report request: rows as JSON, or header and
+// records as a CSV file named name.csv.
+type report struct {
+    name    string
+    rows    interface{}
+    header  []string
+    records [][]string
+}
+
+// reportFormat returns json (default) or csv from the format query parameter,
+// answering 400 for anything else.
+func reportFormat(w http.ResponseWriter, req *http.Request) (string, bool) {
+    switch format := req.URL.Query().Get("format"); format {
+    case "", "json":
+        return "json", true
+    case "csv":
+        return "csv", true
+    default:
+        http.Error(w, "Invalid format, use json or csv", http.StatusBadRequest)
+        return "", false
+    }
+}
+
+func writeReport(w http.ResponseWriter, format string, r report) {
+    if format == "csv" {
+        w.Header().Set("Content-Type", "text/csv")
+        w.Header().Set("Content-Disposition", `attachment; filename="`+r.name+`.csv"`)
+        out := csv.NewWriter(w)
+        out.Write(r.header)
+        out.WriteAll(r.records)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(r.rows)
+}
+
+// reportRange reads the from and to (exclusive) query parameters; a missing
+// bound is the zero time.
+func reportRange(query url.Values) (from, to time.Time, err error) {
+    if value := query.Get("from"); value != "" {
+        if from, err = parseReportTime(value); err != nil {
+            return from, to, errors.New("Invalid from")
+        }
+    }
+    if value := query.Get("to"); value != "" {
+        if to, err = parseReportTime(value); err != nil {
+            return from, to, errors.New("Invalid to")
+        }
+    }
+    if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+        return from, to, errors.New("from must be before to")
+    }
+    return from, to, nil
+}
+
+// billedBetween matches billings created from from to to (exclusive), to the
+// second, using the timestamps in their IDs. Zero bounds are left open.
+func billedBetween(from, to time.Time) bson.M {
+    created := bson.M{}
+    if !from.IsZero() {
+        created["$gte"] = primitive.NewObjectIDFromTimestamp(from)
+    }
+    if !to.IsZero() {
+        created["$lt"] = primitive.NewObjectIDFromTimestamp(to)
+    }
+    if len(created) == 0 {
+        return bson.M{}
+    }
+    return bson.M{"_id": created}
+}
+
+// reportFilter adds the user_id, task_id and currency filters of a report to
+// match, which leaves out removed billings.
+func reportFilter(query url.Values, match bson.M) error {
+    match["deleted_at"] = notDeleted
+    for _, key := range []string{"user_id", "task_id"} {
+        if value := query.Get(key); value != "" {
+            id, err := primitive.ObjectIDFromHex(value)
+            if err != nil {
+                return fmt.Errorf("Invalid %s", key)
+            }
+            match[key] = id
+        }
+    }
+    if currency := query.Get("currency"); currency != "" {
+        match["currency"] = strings.ToUpper(currency)
+    }
+    return nil
+}
+
+// reportMatch is the $match of a report over billings: the billings created in
+// the requested range that pass its filters.
+func reportMatch(query url.Values) (bson.M, error) {
+    from, to, err := reportRange(query)
+    if err != nil {
+        return nil, err
+    }
+    match := billedBetween(from, to)
+    return match, reportFilter(query, match)
+}
+
+func aggregateBillings(pipeline mongo.Pipeline, results interface{}) error {
+    cursor, err := client.Database("billing").Collection("billings").Aggregate(context.TODO(), pipeline)
+    if err != nil {
+        return err
+    }
+    return cursor.All(context.TODO(), results)
+}
+
+// roundHours drops the noise of adding up floats, keeping hundredths of hours.
+func roundHours(hours float64) float64 {
+    return math.Round(hours*100) / 100
+}
+
+func formatHours(hours float64) string {
+    return strconv.FormatFloat(roundHours(hours), 'f', -1, 64)
+}
+
+// BillingTotals are the totals of a group of billings in one currency.
+type BillingTotals struct {
+    Billings int     `bson:"billings"`
+    Hours    float64 `bson:"hours"`
+    Amount   Money   `bson:"amount_minor"`
+}
+
+// totalsGroup are the $group accumulators for BillingTotals.
+func totalsGroup(id interface{}) bson.M {
+    return bson.M{
+        "_id":          id,
+        "billings":     bson.M{"$sum": 1},
+        "hours":        bson.M{"$sum": "$hours"},
+        "amount_minor": bson.M{"$sum": "$amount_minor"},
+    }
+}
+
+// revenueReport adds up billings per period (day, week from Monday or month,
+// in UTC) and currency.
+func revenueReport(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request for revenue report")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    format, ok := reportFormat(w, req)
+    if !ok {
+        return
+    }
+
+    query := req.URL.Query()
+    period := query.Get("period")
+    if period == "" {
+        period = "month"
+    }
+    if period != "day" && period != "week" && period != "month" {
+        http.Error(w, "period must be day, week or month", http.StatusBadRequest)
+        return
+    }
+    match, err := reportMatch(query)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: match}},
+        {{Key: "$group", Value: totalsGroup(bson.M{
+            "period":   bson.M{"$dateTrunc": bson.M{"date": billedAt, "unit": period, "startOfWeek": "monday"}},
+            "currency": "$currency",
+        })}},
+        {{Key: "$sort", Value: bson.D{{Key: "_id.period", Value: 1}, {Key: "_id.currency", Value: 1}}}},
+    }
+    var groups []struct {
+        Key struct {
+            Period   time.Time `bson:"period"`
+            Currency string    `bson:"currency"`
+        } `bson:"_id"`
+        BillingTotals `bson:",inline"`
+    }
+    if err := aggregateBillings(pipeline, &groups); err != nil {
+        log.Printf("Failed to build revenue report: %v", err)
+        http.Error(w, "Failed to build revenue report", http.StatusInternalServerError)
+        return
+    }
+
+    type row struct {
+        PeriodStart string  `json:"period_start"`
+        Currency    string  `json:"currency"`
+        Billings    int     `json:"billings"`
+        Hours       float64 `json:"hours"`
+        Amount      string  `json:"amount"`
+    }
+    r := report{name: "revenue-by-" + period, header: []string{"period_start", "currency", "billings", "hours", "amount"}}
+    rows := []row{}
+    for _, g := range groups {
+        start := g.Key.Period.UTC().Format("2006-01-02")
+        rows = append(rows, row{start, g.Key.Currency, g.Billings, roundHours(g.Hours), g.Amount.Format(g.Key.Currency)})
+        r.records = append(r.records, []string{start, g.Key.Currency, strconv.Itoa(g.Billings), formatHours(g.Hours), g.Amount.Format(g.Key.Currency)})
+    }
+    r.rows = rows
+    writeReport(w, format, r)
+}
+
+// userReport adds up billings per user and currency, largest amount first, and
+// how much of it is on invoices. Billings of deleted users are reported under
+// the zero user ID.
+func userReport(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request for user report")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    format, ok := reportFormat(w, req)
+    if !ok {
+        return
+    }
+    match, err := reportMatch(req.URL.Query())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    group := totalsGroup(bson.M{"user_id": "$user_id", "currency": "$currency"})
+    onInvoice := bson.M{"$ne": bson.A{bson.M{"$ifNull": bson.A{"$invoice_id", nil}}, nil}}
+    group["invoiced_minor"] = bson.M{"$sum": bson.M{"$cond": bson.A{onInvoice, "$amount_minor", 0}}}
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: match}},
+        {{Key: "$group", Value: group}},
+        {{Key: "$sort", Value: bson.D{{Key: "_id.currency", Value: 1}, {Key: "amount_minor", Value: -1}, {Key: "_id.user_id", Value: 1}}}},
+    }
+    var groups []struct {
+        Key struct {
+            UserID   primitive.ObjectID `bson:"user_id"`
+            Currency string             `bson:"currency"`
+        } `bson:"_id"`
+        BillingTotals `bson:",inline"`
+        Invoiced      Money `bson:"invoiced_minor"`
+    }
+    if err := aggregateBillings(pipeline, &groups); err != nil {
+        log.Printf("Failed to build user report: %v", err)
+        http.Error(w, "Failed to build user report", http.StatusInternalServerError)
+        return
+    }
+
+    type row struct {
+        UserID     primitive.ObjectID `json:"user_id"`
+        Currency   string             `json:"currency"`
+        Billings   int                `json:"billings"`
+        Hours      float64            `json:"hours"`
+        Amount     string             `json:"amount"`
+        Invoiced   string             `json:"invoiced"`
+        Uninvoiced string             `json:"uninvoiced"`
+    }
+    r := report{name: "revenue-by-user", header: []string{"user_id", "currency", "billings", "hours", "amount", "invoiced", "uninvoiced"}}
+    rows := []row{}
+    for _, g := range groups {
+        c := g.Key.Currency
+        rw := row{g.Key.UserID, c, g.Billings, roundHours(g.Hours), g.Amount.Format(c), g.Invoiced.Format(c), (g.Amount - g.Invoiced).Format(c)}
+        rows = append(rows, rw)
+        r.records = append(r.records, []string{rw.UserID.Hex(), c, strconv.Itoa(rw.Billings), formatHours(g.Hours), rw.Amount, rw.Invoiced, rw.Uninvoiced})
+    }
+    r.rows = rows
+    writeReport(w, format, r)
+}
+
+// taskInfo is what task-service tells about a task for the task report.
+type taskInfo struct {
+    Title      string              `json:"title"`
+    ParentTask *primitive.ObjectID `json:"parent_task"`
+}
+
+// taskTotals are the billings of one task in one currency.
+type taskTotals struct {
+    TaskID   primitive.ObjectID
+    Currency string
+    BillingTotals
+}
+
+// taskReportRow is a task in the task report: its own billings and, in the
+// Total fields, those of the tasks below it too.
+type taskReportRow struct {
+    TaskID      primitive.ObjectID  `json:"task_id"`
+    ParentTask  *primitive.ObjectID `json:"parent_task,omitempty"`
+    Title       string              `json:"title"`
+    Depth       int                 `json:"depth"`
+    Currency    string              `json:"currency"`
+    Billings    int                 `json:"billings"`
+    Hours       float64             `json:"hours"`
+    Amount      Money               `json:"-"`
+    TotalHours  float64             `json:"total_hours"`
+    TotalAmount Money               `json:"-"`
+}
+
+// MarshalJSON writes the amounts as decimals in the row's currency.
+func (r taskReportRow) MarshalJSON() ([]byte, error) {
+    type row taskReportRow
+    return json.Marshal(struct {
+        row
+        Amount      string `json:"amount"`
+        TotalAmount string `json:"total_amount"`
+    }{row(r), r.Amount.Format(r.Currency), r.TotalAmount.Format(r.Currency)})
+}
+
+// buildTaskTree arranges the billed tasks and their ancestors, as known from
+// infos, into a tree per currency and adds up every task's subtree. Rows come
+// depth first: each root, largest total first, followed by its subtasks.
+// Tasks whose parent is unknown are roots.
+func buildTaskTree(totals []taskTotals, infos map[primitive.ObjectID]taskInfo) []taskReportRow {
+    type node struct {
+        row      taskReportRow
+        children []*node
+    }
+    type key struct {
+        task     primitive.ObjectID
+        currency string
+    }
+    nodes := map[key]*node{}
+    var get func(task primitive.ObjectID, currency string, seen map[primitive.ObjectID]bool) *node
+    get = func(task primitive.ObjectID, currency string, seen map[primitive.ObjectID]bool) *node {
+        if n := nodes[key{task, currency}]; n != nil {
+            return n
+        }
+        info := infos[task]
+        n := &node{row: taskReportRow{TaskID: task, Title: info.Title, Currency: currency}}
+        nodes[key{task, currency}] = n
+        // Parents are created as needed; a cycle makes the task a root
+        seen[task] = true
+        if info.ParentTask != nil && !seen[*info.ParentTask] {
+            n.row.ParentTask = info.ParentTask
+            parent := get(*info.ParentTask, currency, seen)
+            parent.children = append(parent.children, n)
+        }
+        return n
+    }
+    for _, t := range totals {
+        n := get(t.TaskID, t.Currency, map[primitive.ObjectID]bool{})
+        n.row.Billings += t.Billings
+        n.row.Hours += t.Hours
+        n.row.Amount += t.Amount
+    }
+
+    var sum func(n *node)
+    sum = func(n *node) {
+        n.row.TotalHours, n.row.TotalAmount = n.row.Hours, n.row.Amount
+        for _, child := range n.children {
+            sum(child)
+            n.row.TotalHours += child.row.TotalHours
+            n.row.TotalAmount += child.row.TotalAmount
+        }
+    }
+    var roots []*node
+    for _, n := range nodes {
+        if n.row.ParentTask == nil {
+            roots = append(roots, n)
+            sum(n)
+        }
+    }
+
+    byTotal := func(list []*node) {
+        sort.Slice(list, func(i, j int) bool {
+            a, b := list[i].row, list[j].row
+            if a.Currency != b.Currency {
+                return a.Currency < b.Currency
+            }
+            if a.TotalAmount != b.TotalAmount {
+                return a.TotalAmount > b.TotalAmount
+            }
+            return a.TaskID.Hex() < b.TaskID.Hex()
+        })
+    }
+    rows := []taskReportRow{}
+    var walk func(n *node, depth int)
+    walk = func(n *node, depth int) {
+        n.row.Depth = depth
+        n.row.Hours, n.row.TotalHours = roundHours(n.row.Hours), roundHours(n.row.TotalHours)
+        rows = append(rows, n.row)
+        byTotal(n.children)
+        for _, child := range n.children {
+            walk(child, depth+1)
+        }
+    }
+    byTotal(roots)
+    for _, root := range roots {
+        walk(root, 0)
+    }
+    return rows
+}
+
+// taskReport adds up billings per task and rolls them up the task hierarchy,
+// so that a parent task shows what it and its subtasks cost. Titles and parents
+// come from task-service.
+func taskReport(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request for task report")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    format, ok := reportFormat(w, req)
+    if !ok {
+        return
+    }
+    match, err := reportMatch(req.URL.Query())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: match}},
+        {{Key: "$group", Value: totalsGroup(bson.M{"task_id": "$task_id", "currency": "$currency"})}},
+    }
+    var groups []struct {
+        Key struct {
+            TaskID   primitive.ObjectID `bson:"task_id"`
+            Currency string             `bson:"currency"`
+        } `bson:"_id"`
+        BillingTotals `bson:",inline"`
+    }
+    if err := aggregateBillings(pipeline, &groups); err != nil {
+        log.Printf("Failed to build task report: %v", err)
+        http.Error(w, "Failed to build task report", http.StatusInternalServerError)
+        return
+    }
+
+    totals := make([]taskTotals, 0, len(groups))
+    infos := map[primitive.ObjectID]taskInfo{}
+    for _, g := range groups {
+        totals = append(totals, taskTotals{g.Key.TaskID, g.Key.Currency, g.BillingTotals})
+        // Look up the task and its ancestors; deleted tasks have no title or parent
+        for id := &g.Key.TaskID; id != nil; {
+            if _, known := infos[*id]; known {
+                break
+            }
+            var info taskInfo
+            if _, err := tasks.Get(req.Context(), *id, &info); err != nil {
+                http.Error(w, "Failed to look up tasks: "+err.Error(), http.StatusServiceUnavailable)
+                return
+            }
+            infos[*id] = info
+            id = info.ParentTask
+        }
+    }
+
+    rows := buildTaskTree(totals, infos)
+    r := report{name: "revenue-by-task", rows: rows, header: []string{"task_id", "parent_task", "title", "depth", "currency", "billings", "hours", "amount", "total_hours", "total_amount"}}
+    for _, row := range rows {
+        parent := ""
+        if row.ParentTask != nil {
+            parent = row.ParentTask.Hex()
+        }
+        r.records = append(r.records, []string{row.TaskID.Hex(), parent, row.Title, strconv.Itoa(row.Depth), row.Currency, strconv.Itoa(row.Billings),
+            formatHours(row.Hours), row.Amount.Format(row.Currency), formatHours(row.TotalHours), row.TotalAmount.Format(row.Currency)})
+    }
+    writeReport(w, format, r)
+}
+
+// timeTotal is task-service's total of the time logged by a user or on a task.
+type timeTotal struct {
+    ID               primitive.ObjectID `json:"id"`
+    BillableHours    float64            `json:"billable_hours"`
+    NonBillableHours float64            `json:"non_billable_hours"`
+    BilledHours      float64            `json:"billed_hours"`
+}
+
+// fetchTimeTotals asks task-service for the hours logged from from to to per
+// user or task. Only task-service knows about time that isn't billable.
+func fetchTimeTotals(ctx context.Context, group string, from, to time.Time) ([]timeTotal, error) {
+    query := url.Values{"group": {group}}
+    if !from.IsZero() {
+        query.Set("from", from.Format(time.RFC3339))
+    }
+    if !to.IsZero() {
+        query.Set("to", to.Format(time.RFC3339))
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, tasks.baseURL+"/tasks/time/totals?"+query.Encode(), nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set(internalServiceHeader, internalServiceSecret)
+    resp, err := tasks.http.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", errLookupUnavailable, err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%w: time totals returned status %d", errLookupUnavailable, resp.StatusCode)
+    }
+    var totals []timeTotal
+    if err := json.NewDecoder(resp.Body).Decode(&totals); err != nil {
+        return nil, fmt.Errorf("%w: time totals: %v", errLookupUnavailable, err)
+    }
+    return totals, nil
+}
+
+// hoursReport compares billable with non-billable hours per user (group=user,
+// the default) or task, for time logged from from to to, with how much of the
+// billable time has been invoiced.
+func hoursReport(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request for hours report")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    format, ok := reportFormat(w, req)
+    if !ok {
+        return
+    }
+    query := req.URL.Query()
+    group := query.Get("group")
+    if group == "" {
+        group = "user"
+    }
+    if group != "user" && group != "task" {
+        http.Error(w, "group must be user or task", http.StatusBadRequest)
+        return
+    }
+    from, to, err := reportRange(query)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    totals, err := fetchTimeTotals(req.Context(), group, from, to)
+    if err != nil {
+        http.Error(w, "Failed to get time totals: "+err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+
+    type row struct {
+        ID               primitive.ObjectID `json:"id"`
+        BillableHours    float64            `json:"billable_hours"`
+        NonBillableHours float64            `json:"non_billable_hours"`
+        BilledHours      float64            `json:"billed_hours"`
+        UnbilledHours    float64            `json:"unbilled_hours"`
+        TotalHours       float64            `json:"total_hours"`
+        BillablePercent  float64            `json:"billable_percent"`
+    }
+    r := report{name: "hours-by-" + group, header: []string{group + "_id", "billable_hours", "non_billable_hours", "billed_hours", "unbilled_hours", "total_hours", "billable_percent"}}
+    rows := []row{}
+    for _, t := range totals {
+        rw := row{
+            ID:               t.ID,
+            BillableHours:    roundHours(t.BillableHours),
+            NonBillableHours: roundHours(t.NonBillableHours),
+            BilledHours:      roundHours(t.BilledHours),
+            UnbilledHours:    roundHours(t.BillableHours - t.BilledHours),
+            TotalHours:       roundHours(t.BillableHours + t.NonBillableHours),
+        }
+        if total := t.BillableHours + t.NonBillableHours; total > 0 {
+            rw.BillablePercent = math.Round(t.BillableHours/total*1000) / 10
+        }
+        rows = append(rows, rw)
+        r.records = append(r.records, []string{rw.ID.Hex(), formatHours(rw.BillableHours), formatHours(rw.NonBillableHours), formatHours(rw.BilledHours),
+            formatHours(rw.UnbilledHours), formatHours(rw.TotalHours), strconv.FormatFloat(rw.BillablePercent, 'f', -1, 64)})
+    }
+    r.rows = rows
+    writeReport(w, format, r)
+}
+
+// percentChange is the change from previous to current in percent, rounded to
+// a tenth, or nil when there was nothing before.
+func percentChange(previous, current float64) *float64 {
+    if previous == 0 {
+        return nil
+    }
+    change := math.Round((current-previous)/math.Abs(previous)*1000) / 10
+    return &change
+}
+
+// compareReport compares the billings from from to to with those of the period
+// before (against=previous, the default), of the same length, or of the same
+// dates a year earlier (against=year). With by=user or by=task, each user or
+// task is compared on its own.
+func compareReport(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request for comparison report")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    format, ok := reportFormat(w, req)
+    if !ok {
+        return
+    }
+
+    query := req.URL.Query()
+    from, to, err := reportRange(query)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if from.IsZero() || to.IsZero() {
+        http.Error(w, "from and to are required", http.StatusBadRequest)
+        return
+    }
+    var previousFrom, previousTo time.Time
+    switch query.Get("against") {
+    case "", "previous":
+        previousFrom, previousTo = from.Add(-to.Sub(from)), from
+    case "year":
+        previousFrom, previousTo = from.AddDate(-1, 0, 0), to.AddDate(-1, 0, 0)
+        if previousTo.After(from) {
+            http.Error(w, "Comparing against the year before needs a period of at most a year", http.StatusBadRequest)
+            return
+        }
+    default:
+        http.Error(w, "against must be previous or year", http.StatusBadRequest)
+        return
+    }
+    by := query.Get("by")
+    if by == "" {
+        by = "total"
+    }
+    if by != "total" && by != "user" && by != "task" {
+        http.Error(w, "by must be total, user or task", http.StatusBadRequest)
+        return
+    }
+
+    match := bson.M{"$or": bson.A{billedBetween(previousFrom, previousTo), billedBetween(from, to)}}
+    if err := reportFilter(query, match); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    id := bson.M{"currency": "$currency"}
+    if by != "total" {
+        id["key"] = "$" + by + "_id"
+    }
+    current := bson.M{"$gte": bson.A{"$_id", primitive.NewObjectIDFromTimestamp(from)}}
+    when := func(inCurrent bool, value interface{}) bson.M {
+        if inCurrent {
+            return bson.M{"$sum": bson.M{"$cond": bson.A{current, value, 0}}}
+        }
+        return bson.M{"$sum": bson.M{"$cond": bson.A{current, 0, value}}}
+    }
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: match}},
+        {{Key: "$group", Value: bson.M{
+            "_id":                   id,
+            "current_billings":      when(true, 1),
+            "current_hours":         when(true, "$hours"),
+            "current_amount_minor":  when(true, "$amount_minor"),
+            "previous_billings":     when(false, 1),
+            "previous_hours":        when(false, "$hours"),
+            "previous_amount_minor": when(false, "$amount_minor"),
+        }}},
+        {{Key: "$sort", Value: bson.D{{Key: "_id.currency", Value: 1}, {Key: "current_amount_minor", Value: -1}, {Key: "_id.key", Value: 1}}}},
+    }
+    var groups []struct {
+        Key struct {
+            Key      *primitive.ObjectID `bson:"key"`
+            Currency string              `bson:"currency"`
+        } `bson:"_id"`
+        CurrentBillings  int     `bson:"current_billings"`
+        CurrentHours     float64 `bson:"current_hours"`
+        CurrentAmount    Money   `bson:"current_amount_minor"`
+        PreviousBillings int     `bson:"previous_billings"`
+        PreviousHours    float64 `bson:"previous_hours"`
+        PreviousAmount   Money   `bson:"previous_amount_minor"`
+    }
+    if err := aggregateBillings(pipeline, &groups); err != nil {
+        log.Printf("Failed to build comparison report: %v", err)
+        http.Error(w, "Failed to build comparison report", http.StatusInternalServerError)
+        return
+    }
+
+    type totals struct {
+        Billings int     `json:"billings"`
+        Hours    float64 `json:"hours"`
+        Amount   string  `json:"amount"`
+    }
+    type row struct {
+        ID                  *primitive.ObjectID `json:"id,omitempty"`
+        Currency            string              `json:"currency"`
+        Current             totals              `json:"current"`
+        Previous            totals              `json:"previous"`
+        HoursChange         float64             `json:"hours_change"`
+        AmountChange        string              `json:"amount_change"`
+        AmountChangePercent *float64            `json:"amount_change_percent"`
+    }
+    header := []string{"currency", "billings", "hours", "amount", "previous_billings", "previous_hours", "previous_amount", "hours_change", "amount_change", "amount_change_percent"}
+    if by != "total" {
+        header = append([]string{by + "_id"}, header...)
+    }
+    r := report{name: "comparison", header: header}
+    rows := []row{}
+    for _, g := range groups {
+        c := g.Key.Currency
+        rw := row{
+            ID:                  g.Key.Key,
+            Currency:            c,
+            Current:             totals{g.CurrentBillings, roundHours(g.CurrentHours), g.CurrentAmount.Format(c)},
+            Previous:            totals{g.PreviousBillings, roundHours(g.PreviousHours), g.PreviousAmount.Format(c)},
+            HoursChange:         roundHours(g.CurrentHours - g.PreviousHours),
+            AmountChange:        (g.CurrentAmount - g.PreviousAmount).Format(c),
+            AmountChangePercent: percentChange(float64(g.PreviousAmount), float64(g.CurrentAmount)),
+        }
+        rows = append(rows, rw)
+        percent := ""
+        if rw.AmountChangePercent != nil {
+            percent = strconv.FormatFloat(*rw.AmountChangePercent, 'f', -1, 64)
+        }
+        record := []string{c, strconv.Itoa(g.CurrentBillings), formatHours(g.CurrentHours), rw.Current.Amount,
+            strconv.Itoa(g.PreviousBillings), formatHours(g.PreviousHours), rw.Previous.Amount, formatHours(rw.HoursChange), rw.AmountChange, percent}
+        if by != "total" {
+            key := ""
+            if g.Key.Key != nil {
+                key = g.Key.Key.Hex()
+            }
+            record = append([]string{key}, record...)
+        }
+        r.records = append(r.records, record)
+    }
+    r.rows = struct {
+        From         time.Time `json:"from"`
+        To           time.Time `json:"to"`
+        PreviousFrom time.Time `json:"previous_from"`
+        PreviousTo   time.Time `json:"previous_to"`
+        Rows         []row     `json:"rows"`
+    }{from, to, previousFrom, previousTo, rows}
+    writeReport(w, format, r)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBuildTaskTree(t *testing.T) {
+    project, design, build, frontend, deleted := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+    infos := map[primitive.ObjectID]taskInfo{
+        project:  {Title: "Website"},
+        design:   {Title: "Design", ParentTask: &project},
+        build:    {Title: "Build", ParentTask: &project},
+        frontend: {Title: "Frontend", ParentTask: &build},
+    }
+    totals := []taskTotals{
+        {design, "USD", BillingTotals{Billings: 1, Hours: 2, Amount: 20000}},
+        {frontend, "USD", BillingTotals{Billings: 2, Hours: 5.5, Amount: 55000}},
+        {build, "USD", BillingTotals{Billings: 1, Hours: 1, Amount: 10000}},
+        {deleted, "USD", BillingTotals{Billings: 1, Hours: 0.5, Amount: 5000}},
+        {design, "EUR", BillingTotals{Billings: 1, Hours: 1, Amount: 9000}},
+    }
+
+    rows := buildTaskTree(totals, infos)
+    want := []struct {
+        task        primitive.ObjectID
+        currency    string
+        depth       int
+        hours       float64
+        totalHours  float64
+        totalAmount Money
+    }{
+        {project, "EUR", 0, 0, 1, 9000},
+        {design, "EUR", 1, 1, 1, 9000},
+        {project, "USD", 0, 0, 8.5, 85000},
+        {build, "USD", 1, 1, 6.5, 65000},
+        {frontend, "USD", 2, 5.5, 5.5, 55000},
+        {design, "USD", 1, 2, 2, 20000},
+        {deleted, "USD", 0, 0.5, 0.5, 5000},
+    }
+    if len(rows) != len(want) {
+        t.Fatalf("Want %d rows, Got %d: %+v", len(want), len(rows), rows)
+    }
+    for i, w := range want {
+        r := rows[i]
+        if r.TaskID != w.task || r.Currency != w.currency || r.Depth != w.depth || r.Hours != w.hours || r.TotalHours != w.totalHours || r.TotalAmount != w.totalAmount {
+            t.Errorf("Row %d: Want %+v, Got %+v", i, w, r)
+        }
+    }
+    if rows[4].ParentTask == nil || *rows[4].ParentTask != build || rows[4].Title != "Frontend" {
+        t.Errorf("Frontend row: Want parent Build, Got %+v", rows[4])
+    }
+}
+
+func TestBuildTaskTreeCycle(t *testing.T) {
+    a, b := primitive.NewObjectID(), primitive.NewObjectID()
+    infos := map[primitive.ObjectID]taskInfo{
+        a: {Title: "A", ParentTask: &b},
+        b: {Title: "B", ParentTask: &a},
+    }
+    rows := buildTaskTree([]taskTotals{{a, "USD", BillingTotals{Billings: 1, Hours: 1, Amount: 100}}}, infos)
+    if len(rows) != 2 || rows[0].TaskID != b || rows[0].TotalAmount != 100 || rows[1].TaskID != a {
+        t.Errorf("Want B as the root above A, Got %+v", rows)
+    }
+}
+
+func TestPercentChange(t *testing.T) {
+    if change := percentChange(0, 100); change != nil {
+        t.Errorf("Want no change from nothing, Got %v", *change)
+    }
+    for _, tc := range []struct{ previous, current, want float64 }{
+        {200, 300, 50},
+        {300, 200, -33.3},
+        {-100, 100, 200},
+    } {
+        if change := percentChange(tc.previous, tc.current); change == nil || *change != tc.want {
+            t.Errorf("%g to %g: Want %g%%, Got %v", tc.previous, tc.current, tc.want, change)
+        }
+    }
+}
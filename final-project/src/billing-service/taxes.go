@@ -0,0 +1,651 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "regexp"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of tax.
+var taxKinds = map[string]string{
+    "vat":       "VAT",
+    "gst":       "GST",
+    "sales_tax": "Sales tax",
+}
+
+// How a tax rule was applied to an invoice line.
+const (
+    taxCharged       = "charged"
+    taxExempt        = "exempt"
+    taxReverseCharge = "reverse_charge"
+)
+
+// Tax rates are stored in millionths, i.e. a percentage with four decimals, so
+// that 8.875% is 88750.
+const (
+    rateDecimals = 4
+    rateScale    = 1000000
+)
+
+// jurisdictionPattern matches a country code, optionally with a region, such as
+// "DE" or "US-CA".
+var jurisdictionPattern = regexp.MustCompile(`^[A-Z]{2}(-[A-Z0-9]{1,3})?$`)
+
+// TaxRule is a tax charged in a jurisdiction. A rule for a country also applies
+// to its regions, so "US" and "US-CA" rules both apply to a customer in "US-CA".
+// Inclusive rules take the tax out of the billed amount instead of adding it.
+// ReverseCharge rules aren't charged to customers with a tax ID, who account for
+// the tax themselves. ValidTo is exclusive.
+type TaxRule struct {
+    ID            primitive.ObjectID `bson:"_id" json:"id"`
+    Name          string             `bson:"name" json:"name"`
+    Kind          string             `bson:"kind" json:"kind"`
+    Jurisdiction  string             `bson:"jurisdiction" json:"jurisdiction"`
+    Rate          int64              `bson:"rate_ppm" json:"-"`
+    Inclusive     bool               `bson:"inclusive" json:"inclusive"`
+    ReverseCharge bool               `bson:"reverse_charge" json:"reverse_charge"`
+    ValidFrom     *time.Time         `bson:"valid_from,omitempty" json:"valid_from,omitempty"`
+    ValidTo       *time.Time         `bson:"valid_to,omitempty" json:"valid_to,omitempty"`
+    CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// MarshalJSON writes Rate as a percentage such as "19" or "8.875".
+func (r TaxRule) MarshalJSON() ([]byte, error) {
+    type taxRule TaxRule
+    return json.Marshal(struct {
+        taxRule
+        Rate string `json:"rate"`
+    }{taxRule(r), formatRate(r.Rate)})
+}
+
+// formatRate writes a rate as a percentage without trailing zeros.
+func formatRate(rate int64) string {
+    text := formatDecimal(rate, rateDecimals)
+    return strings.TrimSuffix(strings.TrimRight(text, "0"), ".")
+}
+
+// appliesTo reports whether the rule is in force for a customer in jurisdiction
+// at a time.
+func (r TaxRule) appliesTo(jurisdiction string, at time.Time) bool {
+    if r.Jurisdiction != jurisdiction && !strings.HasPrefix(jurisdiction, r.Jurisdiction+"-") {
+        return false
+    }
+    return (r.ValidFrom == nil || !at.Before(*r.ValidFrom)) && (r.ValidTo == nil || at.Before(*r.ValidTo))
+}
+
+// TaxProfile is how an organization, the customer of its invoices, is taxed.
+// Exempt lists the kinds of tax it doesn't pay, for ExemptionReason.
+type TaxProfile struct {
+    Organization    string    `bson:"_id" json:"organization"`
+    Jurisdiction    string    `bson:"jurisdiction" json:"jurisdiction"`
+    TaxID           string    `bson:"tax_id,omitempty" json:"tax_id,omitempty"`
+    Exempt          []string  `bson:"exempt,omitempty" json:"exempt,omitempty"`
+    ExemptionReason string    `bson:"exemption_reason,omitempty" json:"exemption_reason,omitempty"`
+    UpdatedAt       time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+func (p TaxProfile) exempts(kind string) bool {
+    for _, exempt := range p.Exempt {
+        if exempt == kind {
+            return true
+        }
+    }
+    return false
+}
+
+// LineTax is one tax on an invoice line. Exempt and reverse charge taxes are
+// kept with a zero amount, so they show up in the tax report.
+type LineTax struct {
+    RuleID       primitive.ObjectID `bson:"rule_id" json:"rule_id"`
+    Name         string             `bson:"name" json:"name"`
+    Kind         string             `bson:"kind" json:"kind"`
+    Jurisdiction string             `bson:"jurisdiction" json:"jurisdiction"`
+    Rate         int64              `bson:"rate_ppm" json:"-"`
+    Inclusive    bool               `bson:"inclusive" json:"inclusive"`
+    Treatment    string             `bson:"treatment" json:"treatment"`
+    Amount       Money              `bson:"amount_minor" json:"-"`
+}
+
+// InvoiceTax adds up one tax over the lines of an invoice: Taxable is the net
+// amount of the lines it applies to.
+type InvoiceTax struct {
+    LineTax `bson:",inline"`
+    Taxable Money `bson:"taxable_minor" json:"-"`
+}
+
+func taxRules() *mongo.Collection {
+    return client.Database("billing").Collection("tax_rules")
+}
+
+func taxProfiles() *mongo.Collection {
+    return client.Database("billing").Collection("tax_profiles")
+}
+
+// defaultJurisdiction is the jurisdiction of organizations without a tax
+// profile, from TAX_DEFAULT_JURISDICTION. Without it they aren't taxed.
+func defaultJurisdiction() string {
+    return strings.ToUpper(os.Getenv("TAX_DEFAULT_JURISDICTION"))
+}
+
+// taxSetup is what taxing an organization's invoice lines depends on.
+type taxSetup struct {
+    Profile TaxProfile
+    Rules   []TaxRule
+}
+
+// loadTaxSetup reads the organization's tax profile and the rules that apply to
+// it at a time.
+func loadTaxSetup(ctx context.Context, organization string, at time.Time) (taxSetup, error) {
+    setup := taxSetup{Profile: TaxProfile{Organization: organization, Jurisdiction: defaultJurisdiction()}}
+    err := taxProfiles().FindOne(ctx, bson.M{"_id": organization}).Decode(&setup.Profile)
+    if err != nil && err != mongo.ErrNoDocuments {
+        return setup, err
+    }
+    if setup.Profile.Jurisdiction == "" {
+        return setup, nil
+    }
+
+    cursor, err := taxRules().Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "jurisdiction", Value: 1}, {Key: "created_at", Value: 1}}))
+    if err != nil {
+        return setup, err
+    }
+    var rules []TaxRule
+    if err := cursor.All(ctx, &rules); err != nil {
+        return setup, err
+    }
+    for _, rule := range rules {
+        if rule.appliesTo(setup.Profile.Jurisdiction, at) {
+            setup.Rules = append(setup.Rules, rule)
+        }
+    }
+    return setup, nil
+}
+
+// applyTaxes works out the taxes on a line from its Amount. Inclusive taxes are
+// taken out of the amount first, with the last one absorbing the rounding so that
+// net and inclusive taxes add up to the amount; exclusive taxes are then added to
+// the net amount. Every tax is rounded half away from zero per line.
+func applyTaxes(line *InvoiceLine, setup taxSetup) error {
+    line.Taxes = nil
+    var inclusiveRate int64
+    for _, rule := range setup.Rules {
+        tax := LineTax{RuleID: rule.ID, Name: rule.Name, Kind: rule.Kind, Jurisdiction: rule.Jurisdiction, Rate: rule.Rate, Inclusive: rule.Inclusive, Treatment: taxCharged}
+        switch {
+        case setup.Profile.exempts(rule.Kind):
+            tax.Treatment = taxExempt
+        case rule.ReverseCharge && setup.Profile.TaxID != "":
+            tax.Treatment = taxReverseCharge
+        case rule.Inclusive:
+            inclusiveRate += rule.Rate
+        }
+        line.Taxes = append(line.Taxes, tax)
+    }
+
+    net, err := mulDiv(int64(line.Amount), rateScale, rateScale+inclusiveRate)
+    if err != nil {
+        return err
+    }
+    remaining := line.Amount - net
+    last := -1
+    var total Money
+    for i := range line.Taxes {
+        tax := &line.Taxes[i]
+        if tax.Treatment != taxCharged {
+            continue
+        }
+        if tax.Amount, err = mulDiv(int64(net), tax.Rate, rateScale); err != nil {
+            return err
+        }
+        if tax.Inclusive {
+            remaining -= tax.Amount
+            last = i
+        }
+        total += tax.Amount
+    }
+    if last >= 0 {
+        line.Taxes[last].Amount += remaining
+        total += remaining
+    }
+    line.Net, line.Tax, line.Total = net, total, net+total
+    return nil
+}
+
+// summarizeTaxes adds up the taxes of lines per rule and treatment, in the order
+// they first appear, and returns the notes the invoice has to carry for exempt
+// and reverse charge taxes.
+func summarizeTaxes(lines []InvoiceLine, profile TaxProfile) ([]InvoiceTax, []string) {
+    var summary []InvoiceTax
+    index := map[string]int{}
+    for _, line := range lines {
+        for _, tax := range line.Taxes {
+            key := tax.RuleID.Hex() + tax.Treatment
+            i, ok := index[key]
+            if !ok {
+                i = len(summary)
+                index[key] = i
+                summary = append(summary, InvoiceTax{LineTax: tax})
+                summary[i].Amount = 0
+            }
+            summary[i].Taxable += line.Net
+            summary[i].Amount += tax.Amount
+        }
+    }
+
+    var notes []string
+    noted := map[string]bool{}
+    for _, tax := range summary {
+        note := ""
+        switch tax.Treatment {
+        case taxExempt:
+            note = fmt.Sprintf("Exempt from %s: %s", taxKinds[tax.Kind], profile.ExemptionReason)
+        case taxReverseCharge:
+            note = fmt.Sprintf("Reverse charge: %s to be accounted for by the recipient (tax ID %s)", taxKinds[tax.Kind], profile.TaxID)
+        }
+        if note != "" && !noted[note] {
+            noted[note] = true
+            notes = append(notes, note)
+        }
+    }
+    return summary, notes
+}
+
+// taxInvoice applies the organization's taxes to every line of inv and sets its
+// totals. It's called whenever the lines are copied from their billings, so an
+// issued invoice carries the taxes in force when it was issued.
+func taxInvoice(ctx context.Context, inv *Invoice, at time.Time) error {
+    setup, err := loadTaxSetup(ctx, inv.Organization, at)
+    if err != nil {
+        return err
+    }
+    inv.Subtotal, inv.Tax, inv.Total = 0, 0, 0
+    for i := range inv.Lines {
+        if err := applyTaxes(&inv.Lines[i], setup); err != nil {
+            return err
+        }
+        inv.Subtotal += inv.Lines[i].Net
+        inv.Tax += inv.Lines[i].Tax
+        inv.Total += inv.Lines[i].Total
+    }
+    inv.Taxes, inv.TaxNotes = summarizeTaxes(inv.Lines, setup.Profile)
+    inv.TaxJurisdiction, inv.CustomerTaxID = setup.Profile.Jurisdiction, setup.Profile.TaxID
+    return nil
+}
+
+// creditLine is the part of line that a credit of amount, which includes tax,
+// takes back: each of the line's taxes is credited in proportion.
+func creditLine(line InvoiceLine, amount Money) (InvoiceLine, error) {
+    credit := InvoiceLine{BillingID: line.BillingID, TaskID: line.TaskID, UserID: line.UserID, Description: line.Description, HourlyRate: line.HourlyRate, Total: amount}
+    var err error
+    if credit.Amount, err = mulDiv(int64(line.Amount), int64(amount), int64(line.Total)); err != nil {
+        return credit, err
+    }
+    for _, tax := range line.Taxes {
+        if tax.Amount, err = mulDiv(int64(tax.Amount), int64(amount), int64(line.Total)); err != nil {
+            return credit, err
+        }
+        credit.Taxes = append(credit.Taxes, tax)
+        credit.Tax += tax.Amount
+    }
+    credit.Net = amount - credit.Tax
+    return credit, nil
+}
+
+// migrateInvoiceTaxes gives the lines of invoices from before taxes a net amount
+// and total equal to their amount. Migrated invoices have a subtotal and are
+// skipped, so it can run on every start.
+func migrateInvoiceTaxes() error {
+    result, err := invoices().UpdateMany(context.Background(), bson.M{"subtotal_minor": bson.M{"$exists": false}}, bson.A{
+        bson.M{"$set": bson.M{
+            "lines": bson.M{"$map": bson.M{
+                "input": "$lines",
+                "in": bson.M{"$mergeObjects": bson.A{"$$this", bson.M{
+                    "net_minor":   "$$this.amount_minor",
+                    "tax_minor":   0,
+                    "total_minor": "$$this.amount_minor",
+                }}},
+            }},
+            "subtotal_minor": "$total_minor",
+            "tax_minor":      0,
+        }},
+    })
+    if err != nil {
+        return err
+    }
+    if result.ModifiedCount > 0 {
+        log.Printf("Added tax totals to %d invoices", result.ModifiedCount)
+    }
+    return nil
+}
+
+// taxRuleInput is the body of a create request; the rate is a percentage.
+type taxRuleInput struct {
+    Name          string       `json:"name"`
+    Kind          string       `json:"kind"`
+    Jurisdiction  string       `json:"jurisdiction"`
+    Rate          *json.Number `json:"rate"`
+    Inclusive     bool         `json:"inclusive"`
+    ReverseCharge bool         `json:"reverse_charge"`
+    ValidFrom     *time.Time   `json:"valid_from"`
+    ValidTo       *time.Time   `json:"valid_to"`
+}
+
+// createTaxRule adds a tax rule. Like rate cards, rules aren't edited: end one
+// with valid_to and start its successor there. Invoices keep the taxes they were
+// issued with.
+func createTaxRule(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to create tax rule")
+
+    if req.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var input taxRuleInput
+    if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    rule := TaxRule{
+        ID:            primitive.NewObjectID(),
+        Name:          strings.TrimSpace(input.Name),
+        Kind:          input.Kind,
+        Jurisdiction:  strings.ToUpper(input.Jurisdiction),
+        Inclusive:     input.Inclusive,
+        ReverseCharge: input.ReverseCharge,
+        ValidFrom:     input.ValidFrom,
+        ValidTo:       input.ValidTo,
+        CreatedAt:     time.Now().UTC(),
+    }
+
+    var validationErrs ValidationError
+    if _, ok := taxKinds[rule.Kind]; !ok {
+        validationErrs = append(validationErrs, FieldError{Field: "kind", Code: "invalid_value", Message: "must be vat, gst or sales_tax"})
+    }
+    if !jurisdictionPattern.MatchString(rule.Jurisdiction) {
+        validationErrs = append(validationErrs, FieldError{Field: "jurisdiction", Code: "invalid_value", Message: "must be a country code, optionally with a region, such as DE or US-CA"})
+    }
+    if input.Rate == nil {
+        validationErrs = append(validationErrs, FieldError{Field: "rate", Code: "required", Message: "is required"})
+    } else if rate, err := parseDecimal(input.Rate.String(), rateDecimals); err != nil {
+        validationErrs = append(validationErrs, FieldError{Field: "rate", Code: "invalid_value", Message: "must be a percentage with at most 4 decimals"})
+    } else if rate < 0 || rate > rateScale {
+        validationErrs = append(validationErrs, FieldError{Field: "rate", Code: "invalid_value", Message: "must be between 0 and 100"})
+    } else {
+        rule.Rate = rate
+    }
+    if rule.ValidFrom != nil && rule.ValidTo != nil && !rule.ValidTo.After(*rule.ValidFrom) {
+        validationErrs = append(validationErrs, FieldError{Field: "valid_to", Code: "invalid_value", Message: "must be after valid_from"})
+    }
+    if len(validationErrs) > 0 {
+        writeValidationError(w, validationErrs)
+        return
+    }
+    if rule.Name == "" {
+        rule.Name = taxKinds[rule.Kind] + " " + formatRate(rule.Rate) + "%"
+    }
+
+    if _, err := taxRules().InsertOne(context.TODO(), rule); err != nil {
+        http.Error(w, "Failed to create tax rule", http.StatusInternalServerError)
+        return
+    }
+    log.Printf("Tax rule %s created: %s in %s", rule.ID.Hex(), rule.Name, rule.Jurisdiction)
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(rule)
+}
+
+// listTaxRules lists the tax rules, optionally those of a jurisdiction or kind.
+func listTaxRules(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to list tax rules")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := req.URL.Query()
+    filter := bson.M{}
+    if jurisdiction := query.Get("jurisdiction"); jurisdiction != "" {
+        filter["jurisdiction"] = strings.ToUpper(jurisdiction)
+    }
+    if kind := query.Get("kind"); kind != "" {
+        filter["kind"] = kind
+    }
+
+    cursor, err := taxRules().Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "jurisdiction", Value: 1}, {Key: "created_at", Value: 1}}))
+    if err != nil {
+        http.Error(w, "Failed to list tax rules", http.StatusInternalServerError)
+        return
+    }
+    rules := []TaxRule{}
+    if err := cursor.All(context.TODO(), &rules); err != nil {
+        http.Error(w, "Failed to decode tax rules", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(rules)
+}
+
+// removeTaxRule deletes a tax rule. Issued invoices keep their taxes; drafts lose
+// it when they are next changed or issued.
+func removeTaxRule(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request to remove tax rule")
+
+    if req.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ruleID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/billings/taxes/rules/remove/"):])
+    if err != nil {
+        http.Error(w, "Invalid tax rule ID", http.StatusBadRequest)
+        return
+    }
+    result, err := taxRules().DeleteOne(context.TODO(), bson.M{"_id": ruleID})
+    if err != nil {
+        http.Error(w, "Failed to remove tax rule", http.StatusInternalServerError)
+        return
+    }
+    if result.DeletedCount == 0 {
+        http.Error(w, "Tax rule not found", http.StatusNotFound)
+        return
+    }
+    log.Printf("Tax rule %s removed", ruleID.Hex())
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// taxProfileHandler gets (GET) or replaces (PUT) the tax profile of the
+// organization in the path.
+func taxProfileHandler(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request for tax profile")
+
+    organization := req.URL.Path[len("/billings/taxes/customers/"):]
+    if organization == "" || strings.Contains(organization, "/") {
+        http.Error(w, "Invalid organization", http.StatusBadRequest)
+        return
+    }
+
+    switch req.Method {
+    case http.MethodGet:
+        var profile TaxProfile
+        err := taxProfiles().FindOne(context.TODO(), bson.M{"_id": organization}).Decode(&profile)
+        if err == mongo.ErrNoDocuments {
+            http.Error(w, "Tax profile not found", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            http.Error(w, "Failed to get tax profile", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(profile)
+    case http.MethodPut:
+        var profile TaxProfile
+        if err := json.NewDecoder(req.Body).Decode(&profile); err != nil {
+            http.Error(w, "Invalid request body", http.StatusBadRequest)
+            return
+        }
+        profile.Organization = organization
+        profile.Jurisdiction = strings.ToUpper(profile.Jurisdiction)
+        profile.TaxID = strings.TrimSpace(profile.TaxID)
+
+        var validationErrs ValidationError
+        if !jurisdictionPattern.MatchString(profile.Jurisdiction) {
+            validationErrs = append(validationErrs, FieldError{Field: "jurisdiction", Code: "invalid_value", Message: "must be a country code, optionally with a region, such as DE or US-CA"})
+        }
+        for _, kind := range profile.Exempt {
+            if _, ok := taxKinds[kind]; !ok {
+                validationErrs = append(validationErrs, FieldError{Field: "exempt", Code: "invalid_value", Message: "must only contain vat, gst or sales_tax"})
+                break
+            }
+        }
+        if len(profile.Exempt) > 0 && strings.TrimSpace(profile.ExemptionReason) == "" {
+            validationErrs = append(validationErrs, FieldError{Field: "exemption_reason", Code: "required", Message: "is required for exemptions"})
+        }
+        if len(validationErrs) > 0 {
+            writeValidationError(w, validationErrs)
+            return
+        }
+        profile.UpdatedAt = time.Now().UTC()
+        _, err := taxProfiles().ReplaceOne(context.TODO(), bson.M{"_id": organization}, profile, options.Replace().SetUpsert(true))
+        if err != nil {
+            http.Error(w, "Failed to save tax profile", http.StatusInternalServerError)
+            return
+        }
+        log.Printf("Tax profile of %s saved", organization)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(profile)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// parseReportTime reads a report bound, either RFC 3339 or a date.
+func parseReportTime(value string) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, nil
+    }
+    return time.Parse("2006-01-02", value)
+}
+
+// taxReport adds up the taxes of the invoices and credit notes issued from from
+// to to (exclusive), per currency, jurisdiction, rule and treatment, as needed
+// for a tax return. Credit notes count negatively; void documents don't count.
+// Lines without any tax are reported as untaxed.
+func taxReport(w http.ResponseWriter, req *http.Request) {
+    log.Println("Received request for tax report")
+
+    if req.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := req.URL.Query()
+    match := bson.M{"status": bson.M{"$in": bson.A{invoiceIssued, invoiceOverdue, invoicePaid}}}
+    issued := bson.M{}
+    for _, bound := range []struct{ key, op string }{{"from", "$gte"}, {"to", "$lt"}} {
+        if value := query.Get(bound.key); value != "" {
+            t, err := parseReportTime(value)
+            if err != nil {
+                http.Error(w, "Invalid "+bound.key, http.StatusBadRequest)
+                return
+            }
+            issued[bound.op] = t
+        }
+    }
+    if len(issued) > 0 {
+        match["issued_at"] = issued
+    }
+    if organization := query.Get("organization"); organization != "" {
+        match["organization"] = organization
+    }
+
+    sign := bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$kind", kindCreditNote}}, -1, 1}}
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: match}},
+        {{Key: "$unwind", Value: "$lines"}},
+        {{Key: "$unwind", Value: bson.M{"path": "$lines.taxes", "preserveNullAndEmptyArrays": true}}},
+        {{Key: "$group", Value: bson.M{
+            "_id": bson.M{
+                "currency":     "$currency",
+                "jurisdiction": "$lines.taxes.jurisdiction",
+                "rule_id":      "$lines.taxes.rule_id",
+                "name":         "$lines.taxes.name",
+                "kind":         "$lines.taxes.kind",
+                "rate_ppm":     "$lines.taxes.rate_ppm",
+                "treatment":    bson.M{"$ifNull": bson.A{"$lines.taxes.treatment", "untaxed"}},
+            },
+            "taxable_minor": bson.M{"$sum": bson.M{"$multiply": bson.A{sign, "$lines.net_minor"}}},
+            "tax_minor":     bson.M{"$sum": bson.M{"$multiply": bson.A{sign, bson.M{"$ifNull": bson.A{"$lines.taxes.amount_minor", 0}}}}},
+            "documents":     bson.M{"$addToSet": "$_id"},
+        }}},
+        {{Key: "$sort", Value: bson.D{{Key: "_id.currency", Value: 1}, {Key: "_id.jurisdiction", Value: 1}, {Key: "_id.kind", Value: 1}, {Key: "_id.rate_ppm", Value: -1}}}},
+    }
+    cursor, err := invoices().Aggregate(context.TODO(), pipeline)
+    if err != nil {
+        http.Error(w, "Failed to build tax report", http.StatusInternalServerError)
+        return
+    }
+    var groups []struct {
+        Key struct {
+            Currency     string             `bson:"currency"`
+            Jurisdiction string             `bson:"jurisdiction"`
+            RuleID       primitive.ObjectID `bson:"rule_id"`
+            Name         string             `bson:"name"`
+            Kind         string             `bson:"kind"`
+            Rate         int64              `bson:"rate_ppm"`
+            Treatment    string             `bson:"treatment"`
+        } `bson:"_id"`
+        Taxable   Money                `bson:"taxable_minor"`
+        Tax       Money                `bson:"tax_minor"`
+        Documents []primitive.ObjectID `bson:"documents"`
+    }
+    if err := cursor.All(context.TODO(), &groups); err != nil {
+        http.Error(w, "Failed to decode tax report", http.StatusInternalServerError)
+        return
+    }
+
+    type row struct {
+        Currency     string              `json:"currency"`
+        Jurisdiction string              `json:"jurisdiction,omitempty"`
+        RuleID       *primitive.ObjectID `json:"rule_id,omitempty"`
+        Name         string              `json:"name,omitempty"`
+        Kind         string              `json:"kind,omitempty"`
+        Rate         string              `json:"rate,omitempty"`
+        Treatment    string              `json:"treatment"`
+        Taxable      string              `json:"taxable"`
+        Tax          string              `json:"tax"`
+        Documents    int                 `json:"documents"`
+    }
+    rows := []row{}
+    for _, group := range groups {
+        r := row{
+            Currency:     group.Key.Currency,
+            Jurisdiction: group.Key.Jurisdiction,
+            Name:         group.Key.Name,
+            Kind:         group.Key.Kind,
+            Treatment:    group.Key.Treatment,
+            Taxable:      group.Taxable.Format(group.Key.Currency),
+            Tax:          group.Tax.Format(group.Key.Currency),
+            Documents:    len(group.Documents),
+        }
+        if group.Key.Treatment != "untaxed" {
+            r.RuleID, r.Rate = &group.Key.RuleID, formatRate(group.Key.Rate)
+        }
+        rows = append(rows, r)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(rows)
+}
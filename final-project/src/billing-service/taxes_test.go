@@ -0,0 +1,209 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func testTaxRule(name, kind, jurisdiction string, rate int64, inclusive, reverseCharge bool) TaxRule {
+    return TaxRule{ID: primitive.NewObjectID(), Name: name, Kind: kind, Jurisdiction: jurisdiction, Rate: rate, Inclusive: inclusive, ReverseCharge: reverseCharge}
+}
+
+func TestTaxRuleAppliesTo(t *testing.T) {
+    from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    to := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+    country := testTaxRule("US", "sales_tax", "US", 0, false, false)
+    region := testTaxRule("California", "sales_tax", "US-CA", 72500, false, false)
+    dated := testTaxRule("VAT", "vat", "DE", 190000, false, false)
+    dated.ValidFrom, dated.ValidTo = &from, &to
+    during := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+    tests := []struct {
+        name         string
+        rule         TaxRule
+        jurisdiction string
+        at           time.Time
+        want         bool
+    }{
+        {"country in the country", country, "US", during, true},
+        {"country in its region", country, "US-CA", during, true},
+        {"country in another country", country, "DE", during, false},
+        {"country in a country sharing its prefix", country, "USX", during, false},
+        {"region in the region", region, "US-CA", during, true},
+        {"region in its country", region, "US", during, false},
+        {"region in another region", region, "US-NY", during, false},
+        {"region in a region sharing its prefix", region, "US-CAL", during, false},
+        {"from is inclusive", dated, "DE", from, true},
+        {"before from", dated, "DE", from.Add(-time.Second), false},
+        {"to is exclusive", dated, "DE", to, false},
+        {"just before to", dated, "DE", to.Add(-time.Second), true},
+    }
+    for _, tc := range tests {
+        if got := tc.rule.appliesTo(tc.jurisdiction, tc.at); got != tc.want {
+            t.Errorf("%s: Want %v, Got %v", tc.name, tc.want, got)
+        }
+    }
+}
+
+func TestApplyTaxes(t *testing.T) {
+    vat := testTaxRule("VAT", "vat", "DE", 190000, false, false)
+    vatIncluded := testTaxRule("VAT", "vat", "DE", 190000, true, false)
+    gst := testTaxRule("GST", "gst", "CA", 50000, true, false)
+    qst := testTaxRule("QST", "gst", "CA-QC", 99750, true, false)
+    salesTax := testTaxRule("Sales tax", "sales_tax", "CA", 50000, false, false)
+    euVat := testTaxRule("VAT", "vat", "FR", 200000, false, true)
+
+    type tax struct {
+        treatment string
+        amount    Money
+    }
+    tests := []struct {
+        name    string
+        amount  Money
+        rules   []TaxRule
+        profile TaxProfile
+        net     Money
+        total   Money
+        taxes   []tax
+    }{
+        {"no rules", 10000, nil, TaxProfile{}, 10000, 10000, nil},
+        {"exclusive", 10000, []TaxRule{vat}, TaxProfile{}, 10000, 11900, []tax{{taxCharged, 1900}}},
+        {"exclusive rounds half away from zero", 250, []TaxRule{vat}, TaxProfile{}, 250, 298, []tax{{taxCharged, 48}}}, // 47.5
+        {"inclusive", 11900, []TaxRule{vatIncluded}, TaxProfile{}, 10000, 11900, []tax{{taxCharged, 1900}}},
+        {"inclusive with rounding", 1000, []TaxRule{vatIncluded}, TaxProfile{}, 840, 1000, []tax{{taxCharged, 160}}},
+        // 10000 / 1.14975 = 8697.54; 5% and 9.975% of 8698 are 435 and 868,
+        // one too many, which the last one gives back
+        {"several inclusive, last absorbs rounding", 10000, []TaxRule{gst, qst}, TaxProfile{}, 8698, 10000, []tax{{taxCharged, 435}, {taxCharged, 867}}},
+        {"inclusive and exclusive", 11900, []TaxRule{vatIncluded, salesTax}, TaxProfile{}, 10000, 12400, []tax{{taxCharged, 1900}, {taxCharged, 500}}},
+        {"reverse charge without tax ID", 10000, []TaxRule{euVat}, TaxProfile{}, 10000, 12000, []tax{{taxCharged, 2000}}},
+        {"reverse charge with tax ID", 10000, []TaxRule{euVat}, TaxProfile{TaxID: "FR123"}, 10000, 10000, []tax{{taxReverseCharge, 0}}},
+        {"tax ID without reverse charge", 10000, []TaxRule{vat}, TaxProfile{TaxID: "DE123"}, 10000, 11900, []tax{{taxCharged, 1900}}},
+        {"exempt", 10000, []TaxRule{vat, salesTax}, TaxProfile{Exempt: []string{"vat"}}, 10000, 10500, []tax{{taxExempt, 0}, {taxCharged, 500}}},
+        {"exempt inclusive tax isn't taken out", 11900, []TaxRule{vatIncluded}, TaxProfile{Exempt: []string{"vat"}}, 11900, 11900, []tax{{taxExempt, 0}}},
+        {"exempt wins over reverse charge", 10000, []TaxRule{euVat}, TaxProfile{TaxID: "FR123", Exempt: []string{"vat"}}, 10000, 10000, []tax{{taxExempt, 0}}},
+    }
+    for _, tc := range tests {
+        line := InvoiceLine{Amount: tc.amount}
+        if err := applyTaxes(&line, taxSetup{Profile: tc.profile, Rules: tc.rules}); err != nil {
+            t.Errorf("%s: %v", tc.name, err)
+            continue
+        }
+        var got []tax
+        for _, lt := range line.Taxes {
+            got = append(got, tax{lt.Treatment, lt.Amount})
+        }
+        if line.Net != tc.net || line.Total != tc.total || !reflect.DeepEqual(got, tc.taxes) {
+            t.Errorf("%s: Want net %d, total %d and %v, Got %d, %d and %v", tc.name, tc.net, tc.total, tc.taxes, line.Net, line.Total, got)
+        }
+        if line.Net+line.Tax != line.Total {
+            t.Errorf("%s: net %d and tax %d don't add up to %d", tc.name, line.Net, line.Tax, line.Total)
+        }
+        var inclusive Money
+        for _, lt := range line.Taxes {
+            if lt.Inclusive {
+                inclusive += lt.Amount
+            }
+        }
+        if line.Net+inclusive != tc.amount {
+            t.Errorf("%s: net %d and inclusive taxes %d don't add up to the amount %d", tc.name, line.Net, inclusive, tc.amount)
+        }
+    }
+}
+
+func TestSummarizeTaxes(t *testing.T) {
+    vat := testTaxRule("VAT", "vat", "FR", 200000, false, true)
+    salesTax := testTaxRule("Sales tax", "sales_tax", "FR", 50000, false, false)
+    profile := TaxProfile{TaxID: "FR123", Exempt: []string{"sales_tax"}, ExemptionReason: "non-profit"}
+    setup := taxSetup{Profile: profile, Rules: []TaxRule{vat, salesTax}}
+
+    lines := []InvoiceLine{{Amount: 10000}, {Amount: 2500}}
+    for i := range lines {
+        if err := applyTaxes(&lines[i], setup); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // A line taxed before the customer had a tax ID
+    charged := InvoiceLine{Amount: 1000}
+    if err := applyTaxes(&charged, taxSetup{Rules: []TaxRule{vat}}); err != nil {
+        t.Fatal(err)
+    }
+    lines = append(lines, charged)
+
+    summary, notes := summarizeTaxes(lines, profile)
+    want := []struct {
+        rule      primitive.ObjectID
+        treatment string
+        taxable   Money
+        amount    Money
+    }{
+        {vat.ID, taxReverseCharge, 12500, 0},
+        {salesTax.ID, taxExempt, 12500, 0},
+        {vat.ID, taxCharged, 1000, 200},
+    }
+    if len(summary) != len(want) {
+        t.Fatalf("Want %d taxes, Got %+v", len(want), summary)
+    }
+    for i, w := range want {
+        got := summary[i]
+        if got.RuleID != w.rule || got.Treatment != w.treatment || got.Taxable != w.taxable || got.Amount != w.amount {
+            t.Errorf("Tax %d: Want %+v, Got %+v", i, w, got)
+        }
+    }
+    wantNotes := []string{
+        "Reverse charge: VAT to be accounted for by the recipient (tax ID FR123)",
+        "Exempt from Sales tax: non-profit",
+    }
+    if !reflect.DeepEqual(notes, wantNotes) {
+        t.Errorf("Want notes %q, Got %q", wantNotes, notes)
+    }
+}
+
+func TestCreditLine(t *testing.T) {
+    gst := testTaxRule("GST", "gst", "CA", 50000, true, false)
+    qst := testTaxRule("QST", "gst", "CA-QC", 99750, true, false)
+    vat := testTaxRule("VAT", "vat", "DE", 190000, false, false)
+    vatIncluded := testTaxRule("VAT", "vat", "DE", 190000, true, false)
+    taxed := func(amount Money, rules ...TaxRule) InvoiceLine {
+        line := InvoiceLine{BillingID: primitive.NewObjectID(), Description: "Migrate", Amount: amount}
+        if err := applyTaxes(&line, taxSetup{Rules: rules}); err != nil {
+            t.Fatal(err)
+        }
+        return line
+    }
+
+    tests := []struct {
+        name   string
+        line   InvoiceLine
+        credit Money
+        amount Money
+        net    Money
+        taxes  []Money
+    }{
+        {"all of an exclusive line", taxed(10000, vat), 11900, 10000, 10000, []Money{1900}},
+        {"half of an exclusive line", taxed(10000, vat), 5950, 5000, 5000, []Money{950}},
+        {"part of an exclusive line", taxed(10000, vat), 1000, 840, 840, []Money{160}},
+        {"part of an inclusive line", taxed(11900, vatIncluded), 1000, 1000, 840, []Money{160}},
+        {"part of a line with several taxes", taxed(10000, gst, qst), 3333, 3333, 2899, []Money{145, 289}},
+        {"an untaxed line", taxed(10000), 2500, 2500, 2500, nil},
+    }
+    for _, tc := range tests {
+        credit, err := creditLine(tc.line, tc.credit)
+        if err != nil {
+            t.Errorf("%s: %v", tc.name, err)
+            continue
+        }
+        var taxes []Money
+        for _, lt := range credit.Taxes {
+            taxes = append(taxes, lt.Amount)
+        }
+        if credit.BillingID != tc.line.BillingID || credit.Description != tc.line.Description || credit.Total != tc.credit || credit.Amount != tc.amount || credit.Net != tc.net || !reflect.DeepEqual(taxes, tc.taxes) {
+            t.Errorf("%s: Want amount %d, net %d and taxes %v, Got %+v", tc.name, tc.amount, tc.net, tc.taxes, credit)
+        }
+        if credit.Net+credit.Tax != credit.Total {
+            t.Errorf("%s: net %d and tax %d don't add up to %d", tc.name, credit.Net, credit.Tax, credit.Total)
+        }
+    }
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Activity types recorded on a task.
+const (
+	activityCreated       = "created"
+	activityUpdated       = "updated"
+	activityStatusChanged = "status_changed"
+	activityInvoiceIssued = "invoice_created"
+	activityCommented     = "comment_added"
+
+	activityAttachmentAdded   = "attachment_added"
+	activityAttachmentRemoved = "attachment_removed"
+)
+
+// FieldChange is one field's old and new value in an activity entry.
+type FieldChange struct {
+	Field string      `bson:"field" json:"field"`
+	From  interface{} `bson:"from" json:"from"`
+	To    interface{} `bson:"to" json:"to"`
+}
+
+// Activity is an entry in a task's history. ActorID is empty for changes made
+// without a token or by the service itself.
+type Activity struct {
+	ID        primitive.ObjectID  `bson:"_id" json:"id"`
+	TaskID    primitive.ObjectID  `bson:"task_id" json:"task_id"`
+	Type      string              `bson:"type" json:"type"`
+	ActorID   *primitive.ObjectID `bson:"actor_id,omitempty" json:"actor_id,omitempty"`
+	Changes   []FieldChange       `bson:"changes,omitempty" json:"changes,omitempty"`
+	InvoiceID *primitive.ObjectID `bson:"invoice_id,omitempty" json:"invoice_id,omitempty"`
+	CommentID *primitive.ObjectID `bson:"comment_id,omitempty" json:"comment_id,omitempty"`
+	CreatedAt time.Time           `bson:"created_at" json:"created_at"`
+}
+
+func activities() *mongo.Collection {
+	return client.Database("taskmanagement").Collection("activity")
+}
+
+// recordActivity appends an entry to the task's history. History is best effort:
+// a failure is logged and never fails the request that caused it.
+func recordActivity(activity Activity) {
+	activity.ID = primitive.NewObjectID()
+	activity.CreatedAt = time.Now().UTC()
+	if _, err := activities().InsertOne(context.TODO(), activity); err != nil {
+		log.Printf("Failed to record %s activity for task %s: %v", activity.Type, activity.TaskID.Hex(), err)
+	}
+}
+
+// taskChanges compares the task with the values of an update's $set document and
+// returns the fields that actually change.
+func taskChanges(current Task, set bson.M) []FieldChange {
+	before := map[string]interface{}{
+		"title":       current.Title,
+		"description": current.Description,
+		"assigned_to": current.AssignedTo,
+		"status":      current.Status,
+		"hours":       current.Hours,
+		"start_date":  current.StartDate,
+		"end_date":    current.EndDate,
+	}
+	if current.ParentTask != nil {
+		before["parent_task"] = *current.ParentTask
+	}
+
+	var changes []FieldChange
+	for _, field := range []string{"title", "description", "assigned_to", "status", "hours", "start_date", "end_date", "parent_task"} {
+		after, ok := set[field]
+		if !ok || sameValue(before[field], after) {
+			continue
+		}
+		changes = append(changes, FieldChange{Field: field, From: before[field], To: after})
+	}
+	return changes
+}
+
+func sameValue(a, b interface{}) bool {
+	switch a := a.(type) {
+	case time.Time:
+		b, ok := b.(time.Time)
+		return ok && a.Equal(b)
+	case float64:
+		// JSON numbers may arrive as float64 or int depending on the caller
+		switch b := b.(type) {
+		case float64:
+			return a == b
+		case int:
+			return a == float64(b)
+		}
+		return false
+	}
+	return a == b
+}
+
+// recordTaskUpdate records the field changes of an update, with status changes
+// kept as their own entry so transitions are easy to follow.
+func recordTaskUpdate(taskID primitive.ObjectID, actor *primitive.ObjectID, changes []FieldChange) {
+	var fields []FieldChange
+	for _, change := range changes {
+		if change.Field == "status" {
+			recordActivity(Activity{TaskID: taskID, Type: activityStatusChanged, ActorID: actor, Changes: []FieldChange{change}})
+			continue
+		}
+		fields = append(fields, change)
+	}
+	if len(fields) > 0 {
+		recordActivity(Activity{TaskID: taskID, Type: activityUpdated, ActorID: actor, Changes: fields})
+	}
+}
+
+func listActivity(w http.ResponseWriter, req *http.Request, taskID primitive.ObjectID) {
+	log.Printf("Received request to list activity for task ID: %s", taskID.Hex())
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := activities().Find(context.TODO(), bson.M{"task_id": taskID}, opts)
+	if err != nil {
+		http.Error(w, "Failed to list activity", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	history := []Activity{}
+	if err := cursor.All(context.Background(), &history); err != nil {
+		http.Error(w, "Failed to decode activity", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errAttachmentTooLarge = errors.New("attachment too large")
+	errChecksumMismatch   = errors.New("checksum mismatch")
+)
+
+// blobs stores attachment contents; it's set up in main from the BLOB_STORE settings.
+var blobs BlobStore
+
+// Attachment is the metadata of a file attached to a task. The contents live in
+// the blob store under StorageKey; SHA256 is the hex digest of the contents.
+type Attachment struct {
+	ID          primitive.ObjectID  `bson:"_id" json:"id"`
+	TaskID      primitive.ObjectID  `bson:"task_id" json:"task_id"`
+	Filename    string              `bson:"filename" json:"filename"`
+	ContentType string              `bson:"content_type" json:"content_type"`
+	Size        int64               `bson:"size" json:"size"`
+	SHA256      string              `bson:"sha256" json:"sha256"`
+	StorageKey  string              `bson:"storage_key" json:"-"`
+	UploadedBy  *primitive.ObjectID `bson:"uploaded_by,omitempty" json:"uploaded_by,omitempty"`
+	CreatedAt   time.Time           `bson:"created_at" json:"created_at"`
+}
+
+func attachments() *mongo.Collection {
+	return client.Database("taskmanagement").Collection("attachments")
+}
+
+// attachmentMaxBytes is the largest file accepted, from ATTACHMENT_MAX_BYTES (default 10 MiB).
+func attachmentMaxBytes() int64 {
+	max, err := strconv.ParseInt(os.Getenv("ATTACHMENT_MAX_BYTES"), 10, 64)
+	if err != nil || max <= 0 {
+		return 10 << 20
+	}
+	return max
+}
+
+// storeAttachment streams r into the store under key while counting, hashing and
+// sniffing it. The blob is removed again if it exceeds maxBytes or, when
+// expectedSum is set, if its SHA-256 doesn't match.
+func storeAttachment(ctx context.Context, store BlobStore, key string, r io.Reader, maxBytes int64, expectedSum string) (size int64, sum string, contentType string, err error) {
+	br := bufio.NewReaderSize(r, 512)
+	head, _ := br.Peek(512)
+	contentType = http.DetectContentType(head)
+
+	hash := sha256.New()
+	counter := &countingReader{r: io.LimitReader(br, maxBytes+1)}
+	if err := store.Put(ctx, key, io.TeeReader(counter, hash), contentType); err != nil {
+		return 0, "", "", err
+	}
+
+	sum = hex.EncodeToString(hash.Sum(nil))
+	switch {
+	case counter.n > maxBytes:
+		err = errAttachmentTooLarge
+	case expectedSum != "" && !strings.EqualFold(expectedSum, sum):
+		err = errChecksumMismatch
+	}
+	if err != nil {
+		if delErr := store.Delete(ctx, key); delErr != nil {
+			log.Printf("Failed to remove rejected blob %s: %v", key, delErr)
+		}
+		return 0, "", "", err
+	}
+	return counter.n, sum, contentType, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readAttachment loads an attachment's contents and checks them against the
+// size and checksum recorded at upload.
+func readAttachment(ctx context.Context, store BlobStore, attachment Attachment) ([]byte, error) {
+	rc, err := store.Get(ctx, attachment.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, attachment.Size+1))
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	if int64(len(data)) != attachment.Size || hex.EncodeToString(digest[:]) != attachment.SHA256 {
+		return nil, errChecksumMismatch
+	}
+	return data, nil
+}
+
+func uploadAttachment(w http.ResponseWriter, req *http.Request, taskID primitive.ObjectID) {
+	log.Printf("Received request to upload attachment for task ID: %s", taskID.Hex())
+
+	count, err := client.Database("taskmanagement").Collection("tasks").CountDocuments(context.TODO(), bson.M{"_id": taskID})
+	if err != nil || count == 0 {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	// Leave room for the multipart headers around the file itself
+	maxBytes := attachmentMaxBytes()
+	req.Body = http.MaxBytesReader(w, req.Body, maxBytes+1<<20)
+	reader, err := req.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected multipart/form-data with a file field", http.StatusBadRequest)
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, "Missing file field", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		attachment := Attachment{
+			ID:         primitive.NewObjectID(),
+			TaskID:     taskID,
+			Filename:   part.FileName(),
+			UploadedBy: requestActor(req),
+			CreatedAt:  time.Now().UTC(),
+		}
+		attachment.StorageKey = "tasks/" + taskID.Hex() + "/" + attachment.ID.Hex()
+		if attachment.Filename == "" {
+			attachment.Filename = attachment.ID.Hex()
+		}
+
+		attachment.Size, attachment.SHA256, attachment.ContentType, err = storeAttachment(
+			req.Context(), blobs, attachment.StorageKey, part, maxBytes, req.Header.Get("X-Checksum-SHA256"))
+		part.Close()
+		switch {
+		case errors.Is(err, errAttachmentTooLarge):
+			http.Error(w, "Attachment exceeds "+strconv.FormatInt(maxBytes, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		case errors.Is(err, errChecksumMismatch):
+			http.Error(w, "Attachment checksum does not match X-Checksum-SHA256", http.StatusUnprocessableEntity)
+			return
+		case err != nil:
+			log.Printf("Failed to store attachment: %v", err)
+			http.Error(w, "Failed to store attachment", http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := attachments().InsertOne(context.TODO(), attachment); err != nil {
+			blobs.Delete(context.TODO(), attachment.StorageKey)
+			http.Error(w, "Failed to save attachment", http.StatusInternalServerError)
+			return
+		}
+		recordActivity(Activity{TaskID: taskID, Type: activityAttachmentAdded, ActorID: attachment.UploadedBy,
+			Changes: []FieldChange{{Field: "attachment", To: attachment.Filename}}})
+
+		log.Printf("Attachment uploaded successfully: %+v", attachment)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(attachment)
+		return
+	}
+}
+
+func listAttachments(w http.ResponseWriter, req *http.Request, taskID primitive.ObjectID) {
+	log.Printf("Received request to list attachments for task ID: %s", taskID.Hex())
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := attachments().Find(context.TODO(), bson.M{"task_id": taskID}, opts)
+	if err != nil {
+		http.Error(w, "Failed to list attachments", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	list := []Attachment{}
+	if err := cursor.All(context.Background(), &list); err != nil {
+		http.Error(w, "Failed to decode attachments", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func downloadAttachment(w http.ResponseWriter, req *http.Request, taskID, attachmentID primitive.ObjectID) {
+	log.Printf("Received request to download attachment %s", attachmentID.Hex())
+
+	var attachment Attachment
+	if err := attachments().FindOne(context.TODO(), bson.M{"_id": attachmentID, "task_id": taskID}).Decode(&attachment); err != nil {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := readAttachment(req.Context(), blobs, attachment)
+	if errors.Is(err, errBlobNotFound) {
+		http.Error(w, "Attachment contents not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read attachment %s: %v", attachmentID.Hex(), err)
+		http.Error(w, "Failed to read attachment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("X-Checksum-SHA256", attachment.SHA256)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, bytes.NewReader(data))
+}
+
+func removeAttachment(w http.ResponseWriter, req *http.Request, taskID, attachmentID primitive.ObjectID) {
+	log.Printf("Received request to remove attachment %s", attachmentID.Hex())
+
+	var attachment Attachment
+	if err := attachments().FindOne(context.TODO(), bson.M{"_id": attachmentID, "task_id": taskID}).Decode(&attachment); err != nil {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	if err := blobs.Delete(req.Context(), attachment.StorageKey); err != nil {
+		log.Printf("Failed to delete blob %s: %v", attachment.StorageKey, err)
+		http.Error(w, "Failed to remove attachment", http.StatusInternalServerError)
+		return
+	}
+	if _, err := attachments().DeleteOne(context.TODO(), bson.M{"_id": attachmentID}); err != nil {
+		http.Error(w, "Failed to remove attachment", http.StatusInternalServerError)
+		return
+	}
+	recordActivity(Activity{TaskID: taskID, Type: activityAttachmentRemoved, ActorID: requestActor(req),
+		Changes: []FieldChange{{Field: "attachment", From: attachment.Filename}}})
+
+	log.Printf("Attachment removed successfully: ID %s", attachmentID.Hex())
+	w.WriteHeader(http.StatusNoContent)
+}
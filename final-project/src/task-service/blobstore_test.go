@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLocalBlobStore(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+
+	if err := store.Put(context.Background(), "../escape", strings.NewReader("x"), "text/plain"); err == nil {
+		t.Errorf("Put should refuse keys outside the store directory")
+	}
+}
+
+// fakeS3 is a minimal S3 stand-in serving path-style PutObject, GetObject and DeleteObject.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch req.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(req.Body)
+		f.objects[req.URL.Path] = data
+	case http.MethodGet:
+		data, ok := f.objects[req.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, req.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	store, err := NewS3BlobStore("attachments", "us-east-2", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+}
+
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	if err := store.Put(ctx, "tasks/1/a", strings.NewReader("hello"), "text/plain"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	rc, err := store.Get(ctx, "tasks/1/a")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "hello" {
+		t.Errorf("Get: Want hello, Got %q", data)
+	}
+
+	if err := store.Delete(ctx, "tasks/1/a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Get(ctx, "tasks/1/a"); !errors.Is(err, errBlobNotFound) {
+		t.Errorf("Get after Delete: Want errBlobNotFound, Got %v", err)
+	}
+}
+
+func TestStoreAttachment(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+	digest := sha256.Sum256(png)
+	sum := hex.EncodeToString(digest[:])
+
+	size, gotSum, contentType, err := storeAttachment(ctx, store, "ok", bytes.NewReader(png), 1024, strings.ToUpper(sum))
+	if err != nil {
+		t.Fatalf("storeAttachment failed: %v", err)
+	}
+	if size != int64(len(png)) || gotSum != sum || contentType != "image/png" {
+		t.Errorf("Unexpected result: size %d, sum %s, content type %s", size, gotSum, contentType)
+	}
+
+	data, err := readAttachment(ctx, store, Attachment{StorageKey: "ok", Size: size, SHA256: sum})
+	if err != nil || !bytes.Equal(data, png) {
+		t.Errorf("readAttachment: Want the stored file, Got %d bytes, %v", len(data), err)
+	}
+
+	// Corrupting the stored file must be detected on download
+	os.WriteFile(filepath.Join(dir, "ok"), []byte("tampered"), 0o644)
+	if _, err := readAttachment(ctx, store, Attachment{StorageKey: "ok", Size: size, SHA256: sum}); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("readAttachment of a corrupted blob: Want errChecksumMismatch, Got %v", err)
+	}
+
+	if _, _, _, err := storeAttachment(ctx, store, "big", bytes.NewReader(png), 10, ""); !errors.Is(err, errAttachmentTooLarge) {
+		t.Errorf("Want errAttachmentTooLarge, Got %v", err)
+	}
+	if _, _, _, err := storeAttachment(ctx, store, "bad", bytes.NewReader(png), 1024, "00"); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("Want errChecksumMismatch, Got %v", err)
+	}
+	for _, key := range []string{"big", "bad"} {
+		if _, err := os.Stat(filepath.Join(dir, key)); !os.IsNotExist(err) {
+			t.Errorf("Rejected upload %q should have been removed", key)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// rankStep is the gap left between neighbouring tasks when a column is renumbered,
+// so that many moves fit between two tasks before it has to be renumbered again.
+const rankStep = 1024.0
+
+// BoardColumn holds the tasks with one status, in board order.
+type BoardColumn struct {
+	Status string `json:"status"`
+	Tasks  []Task `json:"tasks"`
+}
+
+// boardColumns returns the statuses shown as columns even when they have no
+// tasks, read from BOARD_COLUMNS (default planned,pending,in_progress,done).
+func boardColumns() []string {
+	var columns []string
+	for _, status := range strings.Split(os.Getenv("BOARD_COLUMNS"), ",") {
+		if status = strings.TrimSpace(status); status != "" {
+			columns = append(columns, status)
+		}
+	}
+	if len(columns) == 0 {
+		return []string{"planned", "pending", "in_progress", "done"}
+	}
+	return columns
+}
+
+// sortByRank puts tasks in board order: ranked tasks by rank, then unranked
+// tasks oldest first.
+func sortByRank(tasks []Task) {
+	sort.SliceStable(tasks, func(i, j int) bool {
+		a, b := tasks[i], tasks[j]
+		switch {
+		case a.Rank != 0 && b.Rank != 0 && a.Rank != b.Rank:
+			return a.Rank < b.Rank
+		case (a.Rank == 0) != (b.Rank == 0):
+			return a.Rank != 0
+		}
+		return a.ID.Hex() < b.ID.Hex()
+	})
+}
+
+// buildBoard groups tasks, already in board order, into the given columns
+// followed by a column for each other status, alphabetically.
+func buildBoard(columns []string, tasks []Task) []BoardColumn {
+	byStatus := map[string][]Task{}
+	for _, task := range tasks {
+		byStatus[task.Status] = append(byStatus[task.Status], task)
+	}
+
+	board := make([]BoardColumn, 0, len(columns))
+	for _, status := range columns {
+		board = append(board, BoardColumn{Status: status, Tasks: byStatus[status]})
+		delete(byStatus, status)
+	}
+	var others []string
+	for status := range byStatus {
+		others = append(others, status)
+	}
+	sort.Strings(others)
+	for _, status := range others {
+		board = append(board, BoardColumn{Status: status, Tasks: byStatus[status]})
+	}
+	for i := range board {
+		if board[i].Tasks == nil {
+			board[i].Tasks = []Task{}
+		}
+	}
+	return board
+}
+
+// movableTo reports whether a task with status current can be moved to status:
+// one of the board's columns, or the column it is already in.
+func movableTo(columns []string, current, status string) bool {
+	if status == current {
+		return true
+	}
+	for _, column := range columns {
+		if column == status {
+			return true
+		}
+	}
+	return false
+}
+
+// placeTask returns the rank that puts a task at index i of column, which is in
+// board order and doesn't contain the task. Only the moved task's rank changes,
+// unless no rank fits between its neighbours or the task above has none: then
+// renumbered holds new ranks, in the same order, for the rest of the column.
+func placeTask(column []Task, i int) (rank float64, renumbered map[primitive.ObjectID]float64) {
+	var prev, next float64
+	if i > 0 {
+		prev = column[i-1].Rank
+	}
+	if i < len(column) {
+		next = column[i].Rank
+	}
+
+	if i == 0 || prev != 0 {
+		if next == 0 {
+			return prev + rankStep, nil
+		}
+		if rank = prev + (next-prev)/2; rank > prev && rank < next {
+			return rank, nil
+		}
+	}
+
+	renumbered = map[primitive.ObjectID]float64{}
+	for k, task := range column {
+		position := k
+		if k >= i {
+			position++
+		}
+		if newRank := float64(position+1) * rankStep; newRank != task.Rank {
+			renumbered[task.ID] = newRank
+		}
+	}
+	return float64(i+1) * rankStep, renumbered
+}
+
+func getBoard(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to get task board")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, validationErrs, err := taskFilterFromQuery(req)
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+	if len(validationErrs) > 0 {
+		writeValidationError(w, validationErrs)
+		return
+	}
+	if assignedTo := req.URL.Query().Get("assigned_to"); assignedTo != "" {
+		objectID, err := primitive.ObjectIDFromHex(assignedTo)
+		if err != nil {
+			http.Error(w, "Invalid assigned_to ID", http.StatusBadRequest)
+			return
+		}
+		filter["assigned_to"] = objectID
+	}
+
+	cursor, err := client.Database("taskmanagement").Collection("tasks").Find(context.TODO(), filter)
+	if err != nil {
+		http.Error(w, "Failed to list tasks", http.StatusInternalServerError)
+		return
+	}
+	var tasks []Task
+	if err := cursor.All(context.TODO(), &tasks); err != nil {
+		http.Error(w, "Failed to decode tasks", http.StatusInternalServerError)
+		return
+	}
+	sortByRank(tasks)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Columns []BoardColumn `json:"columns"`
+	}{Columns: buildBoard(boardColumns(), tasks)})
+}
+
+// moveTask moves a task to a column, directly below the task given as after or
+// to the top when after is omitted. The column must be one of the board's columns
+// or the task's own. Moving a task to done completes it like an update.
+func moveTask(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to move task on the board")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	taskID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/tasks/board/move/"):])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	var input struct {
+		Status string              `json:"status"`
+		After  *primitive.ObjectID `json:"after"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	collection := client.Database("taskmanagement").Collection("tasks")
+	var task Task
+	if err := collection.FindOne(context.TODO(), bson.M{"_id": taskID}).Decode(&task); err != nil {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	// Reject the move if the client's copy is stale
+	if expected, ok, err := parseIfMatch(req); err != nil {
+		http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+		return
+	} else if ok && expected != task.Version {
+		http.Error(w, "Task has been modified", http.StatusPreconditionFailed)
+		return
+	}
+
+	status := input.Status
+	if status == "" {
+		status = task.Status
+	}
+	if !movableTo(boardColumns(), task.Status, status) {
+		writeValidationError(w, ValidationError{{Field: "status", Code: "invalid_value", Message: "unknown status " + status}})
+		return
+	}
+
+	set := bson.M{}
+	if status != task.Status {
+		set["status"] = status
+		// Moving a single occurrence detaches it from later edits to its series
+		if task.SeriesID != nil {
+			set["detached"] = true
+		}
+	}
+
+	// Renumbering the column and moving the task commit together, so a failed
+	// move doesn't leave the column half renumbered
+	b := newTaskBatch(req)
+	var rank float64
+	err = withTransaction(func(ctx mongo.SessionContext) error {
+		// A retried transaction starts over
+		b.ctx, b.txn, b.after = ctx, ctx, nil
+
+		// Place the task in the whole column, whatever the client's board was filtered by
+		cursor, err := collection.Find(ctx, bson.M{"status": status, "_id": bson.M{"$ne": taskID}})
+		if err != nil {
+			return err
+		}
+		var column []Task
+		if err := cursor.All(ctx, &column); err != nil {
+			return err
+		}
+		sortByRank(column)
+
+		position := 0
+		if input.After != nil {
+			position = -1
+			for i, other := range column {
+				if other.ID == *input.After {
+					position = i + 1
+					break
+				}
+			}
+			if position < 0 {
+				return opInvalid(ValidationError{{Field: "after", Code: "not_found", Message: "task " + input.After.Hex() + " is not in column " + status}})
+			}
+		}
+
+		var renumbered map[primitive.ObjectID]float64
+		rank, renumbered = placeTask(column, position)
+		for otherID, otherRank := range renumbered {
+			// Renumbering keeps the column's order, so it isn't a change to the tasks
+			if _, err := collection.UpdateOne(ctx, bson.M{"_id": otherID}, bson.M{"$set": bson.M{"rank": otherRank}}); err != nil {
+				return err
+			}
+		}
+		set["rank"] = rank
+		return saveTaskUpdate(b, task, bson.M{"$set": set})
+	})
+	if errors.Is(err, errTaskModified) {
+		http.Error(w, "Task has been modified", http.StatusPreconditionFailed)
+		return
+	}
+	var opErr *taskOpError
+	if errors.As(err, &opErr) {
+		writeTaskOpError(w, opErr)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to move task %s: %v", taskID.Hex(), err)
+		http.Error(w, "Failed to move task", http.StatusInternalServerError)
+		return
+	}
+	for _, fn := range b.after {
+		fn()
+	}
+
+	task.Status = status
+	task.Rank = rank
+	task.Version++
+	if set["detached"] == true {
+		task.Detached = true
+	}
+	log.Printf("Task %s moved to %s with rank %g", taskID.Hex(), status, rank)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(task.Version))
+	json.NewEncoder(w).Encode(task)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSortByRank(t *testing.T) {
+	older, newer := primitive.NewObjectID(), primitive.NewObjectID()
+	high := Task{ID: primitive.NewObjectID(), Rank: 2048}
+	low := Task{ID: primitive.NewObjectID(), Rank: 1024}
+	tasks := []Task{{ID: newer}, high, {ID: older}, low}
+
+	sortByRank(tasks)
+	want := []primitive.ObjectID{low.ID, high.ID, older, newer}
+	for i, task := range tasks {
+		if task.ID != want[i] {
+			t.Errorf("Position %d: Want %s, Got %s", i, want[i].Hex(), task.ID.Hex())
+		}
+	}
+}
+
+func TestPlaceTask(t *testing.T) {
+	a := Task{ID: primitive.NewObjectID(), Rank: 1024}
+	b := Task{ID: primitive.NewObjectID(), Rank: 2048}
+	unranked := Task{ID: primitive.NewObjectID()}
+	column := []Task{a, b, unranked}
+
+	cases := []struct {
+		position int
+		rank     float64
+	}{
+		{0, 512},  // top
+		{1, 1536}, // between a and b
+		{2, 3072}, // after the last ranked task
+	}
+	for _, c := range cases {
+		rank, renumbered := placeTask(column, c.position)
+		if rank != c.rank || renumbered != nil {
+			t.Errorf("Position %d: Want rank %g without renumbering, Got %g, %v", c.position, c.rank, rank, renumbered)
+		}
+	}
+
+	// Below an unranked task the column is renumbered in its current order
+	rank, renumbered := placeTask(column, 3)
+	if rank != 4096 || len(renumbered) != 1 || renumbered[unranked.ID] != 3072 {
+		t.Errorf("After unranked task: Want rank 4096 and %s renumbered to 3072, Got %g, %v", unranked.ID.Hex(), rank, renumbered)
+	}
+
+	// No room left between neighbours
+	tight := []Task{{ID: primitive.NewObjectID(), Rank: 1}, {ID: primitive.NewObjectID(), Rank: math.Nextafter(1, 2)}}
+	rank, renumbered = placeTask(tight, 1)
+	if rank != 2048 || renumbered[tight[0].ID] != 1024 || renumbered[tight[1].ID] != 3072 {
+		t.Errorf("Tight column: Want rank 2048 between 1024 and 3072, Got %g, %v", rank, renumbered)
+	}
+}
+
+func TestBuildBoard(t *testing.T) {
+	tasks := []Task{
+		{ID: primitive.NewObjectID(), Status: "done"},
+		{ID: primitive.NewObjectID(), Status: "blocked"},
+		{ID: primitive.NewObjectID(), Status: "planned"},
+	}
+	board := buildBoard([]string{"planned", "in_progress", "done"}, tasks)
+
+	want := []string{"planned", "in_progress", "done", "blocked"}
+	if len(board) != len(want) {
+		t.Fatalf("Want %d columns, Got %d", len(want), len(board))
+	}
+	for i, column := range board {
+		if column.Status != want[i] {
+			t.Errorf("Column %d: Want %s, Got %s", i, want[i], column.Status)
+		}
+		if column.Tasks == nil {
+			t.Errorf("Column %s: Want an empty list, Got nil", column.Status)
+		}
+	}
+	if len(board[1].Tasks) != 0 || len(board[3].Tasks) != 1 {
+		t.Errorf("Unexpected columns: %+v", board)
+	}
+}
+
+func TestMovableTo(t *testing.T) {
+	columns := []string{"planned", "in_progress", "done"}
+	tests := []struct {
+		current, status string
+		want            bool
+	}{
+		{"planned", "done", true},
+		{"planned", "planned", true},
+		{"blocked", "blocked", true}, // reordering a column no longer on the board
+		{"planned", "blocked", false},
+		{"planned", "Done", false},
+	}
+	for _, tc := range tests {
+		if got := movableTo(columns, tc.current, tc.status); got != tc.want {
+			t.Errorf("%s to %s: Want %v, Got %v", tc.current, tc.status, tc.want, got)
+		}
+	}
+}
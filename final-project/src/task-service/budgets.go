@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Header and secret billing-service expects from task-service.
+const (
+	taskServiceHeader = "X-Task-Service"
+	taskServiceSecret = "your-task-service-secret" // You should store and retrieve this securely
+)
+
+var errBillingServiceUnavailable = errors.New("billing service unavailable")
+
+// budgetLine is work that is about to be billed, as billing-service prices it.
+type budgetLine struct {
+	TaskID       primitive.ObjectID `json:"task_id"`
+	UserID       primitive.ObjectID `json:"user_id"`
+	Organization string             `json:"organization,omitempty"`
+	ProjectID    primitive.ObjectID `json:"project_id"`
+	Hours        float64            `json:"hours"`
+}
+
+// exceededBudget is a hard budget that billing some work would go over. Limit,
+// Used and Projected are hours or amounts, as billing-service writes them.
+type exceededBudget struct {
+	BudgetID  primitive.ObjectID `json:"budget_id"`
+	TaskID    primitive.ObjectID `json:"task_id"`
+	Kind      string             `json:"kind"`
+	Limit     string             `json:"limit"`
+	Used      string             `json:"used"`
+	Projected string             `json:"projected"`
+}
+
+// budgetClient asks billing-service whether work fits the budgets of the task
+// trees it belongs to. The tasks with hard budgets are cached for ttl, and the
+// last ones known are used while billing-service can't be reached. failOpen
+// lets work be completed when billing-service can't answer at all.
+type budgetClient struct {
+	baseURL  string
+	http     *http.Client
+	ttl      time.Duration
+	failOpen bool
+
+	mu        sync.Mutex
+	hard      map[primitive.ObjectID]bool
+	fetchedAt time.Time
+}
+
+var budgets *budgetClient
+
+// newBudgetClient returns a client for BILLING_SERVICE_URL (default
+// http://billing-service:8003) that caches the tasks with hard budgets for
+// BUDGET_CACHE_TTL (default 1m) and, with BUDGET_CHECK_FAILURE=open, doesn't
+// hold up completions while billing-service is down (default closed).
+func newBudgetClient() *budgetClient {
+	baseURL := os.Getenv("BILLING_SERVICE_URL")
+	if baseURL == "" {
+		baseURL = "http://billing-service:8003"
+	}
+	ttl, err := time.ParseDuration(os.Getenv("BUDGET_CACHE_TTL"))
+	if err != nil || ttl < 0 {
+		ttl = time.Minute
+	}
+	return &budgetClient{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		http:     &http.Client{Timeout: 5 * time.Second},
+		ttl:      ttl,
+		failOpen: os.Getenv("BUDGET_CHECK_FAILURE") == "open",
+	}
+}
+
+// HardBudgetTasks returns the tasks that have a hard budget. When
+// billing-service can't be asked it returns those it last told, and an error
+// only if it never has.
+func (c *budgetClient) HardBudgetTasks(ctx context.Context) (map[primitive.ObjectID]bool, error) {
+	c.mu.Lock()
+	hard, fetchedAt := c.hard, c.fetchedAt
+	c.mu.Unlock()
+	if hard != nil && time.Since(fetchedAt) < c.ttl {
+		return hard, nil
+	}
+
+	fetched, err := c.fetchHardBudgetTasks(ctx)
+	if err != nil {
+		if hard != nil {
+			log.Printf("Using the hard budgets known from %s: %v", fetchedAt.Format(time.RFC3339), err)
+			return hard, nil
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	c.hard, c.fetchedAt = fetched, time.Now()
+	c.mu.Unlock()
+	return fetched, nil
+}
+
+func (c *budgetClient) fetchHardBudgetTasks(ctx context.Context) (map[primitive.ObjectID]bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/billings/budgets/hard", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(taskServiceHeader, taskServiceSecret)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBillingServiceUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: hard budgets returned status %d", errBillingServiceUnavailable, resp.StatusCode)
+	}
+	var result struct {
+		TaskIDs []primitive.ObjectID `json:"task_ids"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("%w: hard budgets: %v", errBillingServiceUnavailable, err)
+	}
+	hard := make(map[primitive.ObjectID]bool, len(result.TaskIDs))
+	for _, id := range result.TaskIDs {
+		hard[id] = true
+	}
+	return hard, nil
+}
+
+// Check returns the hard budgets that billing lines would exceed. An error
+// means billing-service could not answer.
+func (c *budgetClient) Check(ctx context.Context, lines []budgetLine) ([]exceededBudget, error) {
+	body, err := json.Marshal(struct {
+		Lines []budgetLine `json:"lines"`
+	}{lines})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/billings/budgets/check", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(taskServiceHeader, taskServiceSecret)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBillingServiceUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: budget check returned status %d", errBillingServiceUnavailable, resp.StatusCode)
+	}
+
+	var result struct {
+		Exceeded []exceededBudget `json:"exceeded"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("%w: budget check: %v", errBillingServiceUnavailable, err)
+	}
+	return result.Exceeded, nil
+}
+
+// completionBudgetError refuses to complete a task when billing its unbilled
+// work, and that of the child tasks completed with it, would exceed a hard
+// budget. Only trees with a hard budget are checked. The check is made before
+// the task's transaction, so completions racing each other can still go over
+// together; billing-service checks again once it has billed them and flags the
+// billings that went over.
+func completionBudgetError(ctx context.Context, task Task) *taskOpError {
+	tasks := []Task{task}
+	if task.ParentTask == nil {
+		cursor, err := client.Database("taskmanagement").Collection("tasks").Find(ctx, bson.M{"parent_task": task.ID, "status": bson.M{"$ne": "done"}})
+		if err != nil {
+			return opFailed(http.StatusInternalServerError, "Database query error")
+		}
+		var children []Task
+		if err := cursor.All(ctx, &children); err != nil {
+			return opFailed(http.StatusInternalServerError, "Database query error")
+		}
+		tasks = append(tasks, children...)
+	}
+
+	hard, err := budgets.HardBudgetTasks(ctx)
+	if err != nil {
+		return budgets.unavailable(task, err)
+	}
+	covered, err := budgetCovered(ctx, task, tasks, hard)
+	if err != nil {
+		return opFailed(http.StatusInternalServerError, "Database query error")
+	}
+	if !covered {
+		return nil
+	}
+
+	var lines []budgetLine
+	for _, t := range tasks {
+		hours, _, err := unbilledWork(ctx, t)
+		if err != nil {
+			return opFailed(http.StatusInternalServerError, "Database query error")
+		}
+		if hours <= 0 {
+			continue
+		}
+		projectID, err := projectOf(ctx, t)
+		if err != nil {
+			return opFailed(http.StatusInternalServerError, "Database query error")
+		}
+		lines = append(lines, budgetLine{TaskID: t.ID, UserID: t.AssignedTo, Organization: t.Organization, ProjectID: projectID, Hours: hours})
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	exceeded, err := budgets.Check(ctx, lines)
+	if err != nil {
+		return budgets.unavailable(task, err)
+	}
+	if len(exceeded) == 0 {
+		return nil
+	}
+	b := exceeded[0]
+	return opFailed(http.StatusConflict, fmt.Sprintf("Completing the task would exceed the hard %s budget of task %s: %s of %s used, %s after billing it", b.Kind, b.TaskID.Hex(), b.Used, b.Limit, b.Projected))
+}
+
+// budgetCovered reports whether a hard budget covers any of tasks, all of them
+// task or below it: one of theirs, or one of a task above task.
+func budgetCovered(ctx context.Context, task Task, tasks []Task, hard map[primitive.ObjectID]bool) (bool, error) {
+	if len(hard) == 0 {
+		return false, nil
+	}
+	for _, t := range tasks {
+		if hard[t.ID] {
+			return true, nil
+		}
+	}
+	ancestors, err := taskAncestors(ctx, task)
+	if err != nil {
+		return false, err
+	}
+	for _, t := range ancestors {
+		if hard[t.ID] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unavailable is the answer to completing task when billing-service couldn't
+// check its budgets: a 503, or nothing when the client fails open.
+func (c *budgetClient) unavailable(task Task, err error) *taskOpError {
+	if c.failOpen {
+		log.Printf("Completing task %s without checking its budgets: %v", task.ID.Hex(), err)
+		return nil
+	}
+	return opFailed(http.StatusServiceUnavailable, "Billing service unavailable")
+}
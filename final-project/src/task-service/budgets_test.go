@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBudgetClientCheck(t *testing.T) {
+	taskID, budgetID := primitive.NewObjectID(), primitive.NewObjectID()
+	var got []budgetLine
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.URL.Path != "/billings/budgets/check" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if req.Header.Get(taskServiceHeader) != taskServiceSecret {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			Lines []budgetLine `json:"lines"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		got = body.Lines
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"allowed":  false,
+			"exceeded": []exceededBudget{{BudgetID: budgetID, TaskID: taskID, Kind: "hours", Limit: "10", Used: "8", Projected: "12.5"}},
+		})
+	}))
+	defer server.Close()
+
+	c := &budgetClient{baseURL: server.URL, http: server.Client()}
+	lines := []budgetLine{{TaskID: taskID, UserID: primitive.NewObjectID(), ProjectID: taskID, Hours: 4.5}}
+	exceeded, err := c.Check(context.Background(), lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != lines[0] {
+		t.Errorf("Want the lines sent, Got %+v", got)
+	}
+	if len(exceeded) != 1 || exceeded[0].BudgetID != budgetID || exceeded[0].Projected != "12.5" {
+		t.Errorf("Want the exceeded budget, Got %+v", exceeded)
+	}
+}
+
+func TestBudgetClientUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "Failed to check budgets", http.StatusInternalServerError)
+	}))
+	c := &budgetClient{baseURL: server.URL, http: server.Client()}
+	if _, err := c.Check(context.Background(), []budgetLine{{Hours: 1}}); !errors.Is(err, errBillingServiceUnavailable) {
+		t.Errorf("Failed check: Want errBillingServiceUnavailable, Got %v", err)
+	}
+
+	server.Close()
+	if _, err := c.Check(context.Background(), []budgetLine{{Hours: 1}}); !errors.Is(err, errBillingServiceUnavailable) {
+		t.Errorf("Closed server: Want errBillingServiceUnavailable, Got %v", err)
+	}
+}
+
+func TestBudgetClientHardBudgetTasks(t *testing.T) {
+	hardTask := primitive.NewObjectID()
+	calls, down := 0, false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if down {
+			http.Error(w, "Failed to list budgets", http.StatusInternalServerError)
+			return
+		}
+		if req.URL.Path != "/billings/budgets/hard" || req.Header.Get(taskServiceHeader) != taskServiceSecret {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"task_ids": []primitive.ObjectID{hardTask}})
+	}))
+	defer server.Close()
+
+	c := &budgetClient{baseURL: server.URL, http: server.Client(), ttl: time.Hour}
+	down = true
+	if _, err := c.HardBudgetTasks(context.Background()); !errors.Is(err, errBillingServiceUnavailable) {
+		t.Errorf("Never fetched: Want errBillingServiceUnavailable, Got %v", err)
+	}
+
+	down = false
+	for i := 0; i < 2; i++ {
+		hard, err := c.HardBudgetTasks(context.Background())
+		if err != nil || len(hard) != 1 || !hard[hardTask] {
+			t.Errorf("Want the task with a hard budget, Got %v (%v)", hard, err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Hard budgets should be cached: Want 2 calls, Got %d", calls)
+	}
+
+	// Once they are stale the last ones known stand in while billing is down
+	c.ttl, down = 0, true
+	if hard, err := c.HardBudgetTasks(context.Background()); err != nil || !hard[hardTask] {
+		t.Errorf("Billing down: Want the hard budgets known, Got %v (%v)", hard, err)
+	}
+	if calls != 3 {
+		t.Errorf("Stale hard budgets should be fetched again: Want 3 calls, Got %d", calls)
+	}
+}
+
+func TestBudgetCovered(t *testing.T) {
+	task, child := Task{ID: primitive.NewObjectID()}, Task{ID: primitive.NewObjectID()}
+	tests := []struct {
+		name string
+		hard map[primitive.ObjectID]bool
+		want bool
+	}{
+		{"no hard budgets", nil, false},
+		{"budget on the task", map[primitive.ObjectID]bool{task.ID: true}, true},
+		{"budget on a child completed with it", map[primitive.ObjectID]bool{child.ID: true}, true},
+		{"budget elsewhere on a top task", map[primitive.ObjectID]bool{primitive.NewObjectID(): true}, false},
+	}
+	for _, tc := range tests {
+		// The task has no parent, so nothing above it is looked up
+		got, err := budgetCovered(context.Background(), task, []Task{task, child}, tc.hard)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: Want %v, Got %v (%v)", tc.name, tc.want, got, err)
+		}
+	}
+}
+
+func TestBudgetClientUnavailableAnswer(t *testing.T) {
+	task := Task{ID: primitive.NewObjectID()}
+	closed := &budgetClient{}
+	if opErr := closed.unavailable(task, errBillingServiceUnavailable); opErr == nil || opErr.Status != http.StatusServiceUnavailable {
+		t.Errorf("Failing closed: Want 503, Got %+v", opErr)
+	}
+	open := &budgetClient{failOpen: true}
+	if opErr := open.unavailable(task, errBillingServiceUnavailable); opErr != nil {
+		t.Errorf("Failing open: Want the completion allowed, Got %+v", opErr)
+	}
+}
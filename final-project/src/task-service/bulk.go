@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxBulkOperations limits the size of one bulk request.
+const maxBulkOperations = 100
+
+// taskOpError is a task operation that failed, with the response the single-task
+// endpoints give for it: Message, the field Errors of a 422, or the Conflicts
+// that the conflict Policy refused with a 409.
+type taskOpError struct {
+	Status    int
+	Message   string
+	Errors    ValidationError
+	Policy    string
+	Conflicts []Conflict
+}
+
+func (e *taskOpError) Error() string {
+	if len(e.Errors) > 0 {
+		return e.Errors.Error()
+	}
+	return e.Message
+}
+
+func opFailed(status int, message string) *taskOpError {
+	return &taskOpError{Status: status, Message: message}
+}
+
+func opInvalid(errs ValidationError) *taskOpError {
+	return &taskOpError{Status: http.StatusUnprocessableEntity, Errors: errs}
+}
+
+// opReferenceError reports a reference check that couldn't be made.
+func opReferenceError(err error) *taskOpError {
+	if errors.Is(err, errLookupUnavailable) {
+		return opFailed(http.StatusServiceUnavailable, "User service unavailable")
+	}
+	return opFailed(http.StatusInternalServerError, "Database query error")
+}
+
+// writeTaskOpError answers a request with a failed operation's response.
+func writeTaskOpError(w http.ResponseWriter, err *taskOpError) {
+	switch {
+	case len(err.Errors) > 0:
+		writeValidationError(w, err.Errors)
+	case err.Conflicts != nil:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(err.Status)
+		json.NewEncoder(w).Encode(struct {
+			Error     string     `json:"error"`
+			Policy    string     `json:"policy"`
+			Conflicts []Conflict `json:"conflicts"`
+		}{
+			Error:     err.Message,
+			Policy:    err.Policy,
+			Conflicts: err.Conflicts,
+		})
+	default:
+		http.Error(w, err.Message, err.Status)
+	}
+}
+
+// taskBatch is what the task operations of one request share: its conflict policy
+// and actor and, for an all-or-nothing bulk request, the transaction they all run
+// in. Activity, events and other side effects then wait until the transaction
+// commits, so nothing is announced for writes that are rolled back.
+type taskBatch struct {
+	ctx    context.Context
+	txn    mongo.SessionContext
+	policy string
+	actor  *primitive.ObjectID
+	after  []func()
+}
+
+func newTaskBatch(req *http.Request) *taskBatch {
+	return &taskBatch{ctx: context.TODO(), policy: conflictPolicyFor(req), actor: requestActor(req)}
+}
+
+// transaction runs fn in the batch's transaction, or in one of its own.
+func (b *taskBatch) transaction(fn func(ctx mongo.SessionContext) error) error {
+	if b.txn != nil {
+		return fn(b.txn)
+	}
+	return withTransaction(fn)
+}
+
+// afterCommit runs fn once the batch's writes are committed: right away, unless
+// the batch runs in a transaction.
+func (b *taskBatch) afterCommit(fn func()) {
+	if b.txn != nil {
+		b.after = append(b.after, fn)
+		return
+	}
+	fn()
+}
+
+// BulkOperation is one item of a bulk request. Op is create (with Task), update
+// (with ID, Changes as for /tasks/update/ and an optional IfMatch version) or delete.
+type BulkOperation struct {
+	Op      string                 `json:"op"`
+	ID      string                 `json:"id,omitempty"`
+	IfMatch *int64                 `json:"if_match,omitempty"`
+	Task    *Task                  `json:"task,omitempty"`
+	Changes map[string]interface{} `json:"changes,omitempty"`
+}
+
+// BulkResult is the outcome of one operation, with the status the single-task
+// endpoint would have answered.
+type BulkResult struct {
+	Index     int                 `json:"index"`
+	Op        string              `json:"op"`
+	ID        *primitive.ObjectID `json:"id,omitempty"`
+	Status    int                 `json:"status"`
+	Version   int64               `json:"version,omitempty"`
+	Task      *Task               `json:"task,omitempty"`
+	Conflicts []Conflict          `json:"conflicts,omitempty"`
+	Error     string              `json:"error,omitempty"`
+	Errors    ValidationError     `json:"errors,omitempty"`
+}
+
+// runBulkOperation applies one operation of a bulk request. Deleting needs an admin
+// token, like /tasks/remove/.
+func runBulkOperation(b *taskBatch, req *http.Request, index int, op BulkOperation) BulkResult {
+	result := BulkResult{Index: index, Op: op.Op}
+	var taskID primitive.ObjectID
+	if op.Op == "update" || op.Op == "delete" {
+		var err error
+		if taskID, err = primitive.ObjectIDFromHex(op.ID); err != nil {
+			return failedResult(result, opFailed(http.StatusBadRequest, "Invalid task ID"))
+		}
+		result.ID = &taskID
+	}
+
+	switch op.Op {
+	case "create":
+		if op.Task == nil {
+			return failedResult(result, opFailed(http.StatusBadRequest, "Missing task"))
+		}
+		task, opErr := createTaskOp(b, *op.Task)
+		if opErr != nil {
+			return failedResult(result, opErr)
+		}
+		result.ID, result.Status, result.Version, result.Task = &task.ID, http.StatusOK, task.Version, &task
+	case "update":
+		version, conflicts, opErr := updateTaskOp(b, taskID, op.Changes, op.IfMatch)
+		if opErr != nil {
+			return failedResult(result, opErr)
+		}
+		result.Status, result.Version, result.Conflicts = http.StatusOK, version, conflicts
+	case "delete":
+		if !isAdminRequest(req) {
+			return failedResult(result, opFailed(http.StatusUnauthorized, "Unauthorized"))
+		}
+		if opErr := removeTaskOp(b, taskID); opErr != nil {
+			return failedResult(result, opErr)
+		}
+		result.Status = http.StatusNoContent
+	default:
+		return failedResult(result, opFailed(http.StatusBadRequest, "Unknown operation "+op.Op))
+	}
+	return result
+}
+
+func failedResult(result BulkResult, err *taskOpError) BulkResult {
+	result.Status = err.Status
+	result.Error = err.Message
+	result.Errors = err.Errors
+	result.Conflicts = err.Conflicts
+	return result
+}
+
+// bulkTasks applies a batch of create, update and delete operations with the same
+// validation and side effects as the single-task endpoints. By default each
+// operation stands on its own; with atomic all of them run in one transaction and
+// nothing is applied unless every one succeeds.
+func bulkTasks(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received bulk task request")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var input struct {
+		Atomic     bool            `json:"atomic"`
+		Operations []BulkOperation `json:"operations"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(input.Operations) == 0 || len(input.Operations) > maxBulkOperations {
+		http.Error(w, fmt.Sprintf("A bulk request needs 1 to %d operations", maxBulkOperations), http.StatusBadRequest)
+		return
+	}
+
+	b := newTaskBatch(req)
+	results := make([]BulkResult, len(input.Operations))
+	status := http.StatusOK
+	if !input.Atomic {
+		for i, op := range input.Operations {
+			results[i] = runBulkOperation(b, req, i, op)
+		}
+	} else {
+		failed := -1
+		err := withTransaction(func(ctx mongo.SessionContext) error {
+			// A retried transaction starts over
+			b.ctx, b.txn, b.after, failed = ctx, ctx, nil, -1
+			for i, op := range input.Operations {
+				results[i] = runBulkOperation(b, req, i, op)
+				if results[i].Error != "" || len(results[i].Errors) > 0 {
+					failed = i
+					return errors.New("bulk operation failed")
+				}
+			}
+			return nil
+		})
+		switch {
+		case failed >= 0:
+			status = results[failed].Status
+			for i := range results {
+				if i == failed {
+					continue
+				}
+				// Tasks created before the failure were rolled back, so only keep existing IDs
+				id := results[i].ID
+				if input.Operations[i].Op == "create" {
+					id = nil
+				}
+				results[i] = BulkResult{Index: i, Op: input.Operations[i].Op, ID: id, Status: http.StatusFailedDependency, Error: fmt.Sprintf("Not applied: operation %d failed", failed)}
+			}
+		case err != nil:
+			log.Printf("Failed to apply bulk request: %v", err)
+			http.Error(w, "Failed to apply bulk request", http.StatusInternalServerError)
+			return
+		default:
+			for _, fn := range b.after {
+				fn()
+			}
+		}
+	}
+
+	succeeded := 0
+	for _, result := range results {
+		if result.Error == "" && len(result.Errors) == 0 {
+			succeeded++
+		}
+	}
+	log.Printf("Bulk request finished: %d of %d operations applied", succeeded, len(results))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Atomic    bool         `json:"atomic"`
+		Succeeded int          `json:"succeeded"`
+		Failed    int          `json:"failed"`
+		Results   []BulkResult `json:"results"`
+	}{input.Atomic, succeeded, len(results) - succeeded, results})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRunBulkOperationRejects(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/tasks/bulk", nil)
+	b := newTaskBatch(req)
+
+	cases := []struct {
+		op     BulkOperation
+		status int
+	}{
+		{BulkOperation{Op: "update", ID: "not-an-id"}, http.StatusBadRequest},
+		{BulkOperation{Op: "create"}, http.StatusBadRequest},
+		{BulkOperation{Op: "rename", ID: primitive.NewObjectID().Hex()}, http.StatusBadRequest},
+		{BulkOperation{Op: "delete", ID: primitive.NewObjectID().Hex()}, http.StatusUnauthorized},
+	}
+	for i, c := range cases {
+		result := runBulkOperation(b, req, i, c.op)
+		if result.Status != c.status || result.Error == "" || result.Index != i {
+			t.Errorf("%s: Want status %d with an error, Got %+v", c.op.Op, c.status, result)
+		}
+	}
+}
+
+func TestTaskBatchAfterCommit(t *testing.T) {
+	b := newTaskBatch(httptest.NewRequest(http.MethodPost, "/tasks/bulk", nil))
+	ran := 0
+	b.afterCommit(func() { ran++ })
+	if ran != 1 || len(b.after) != 0 {
+		t.Errorf("Without a transaction: Want side effects to run right away, Got %d run, %d waiting", ran, len(b.after))
+	}
+}
+
+func TestWriteTaskOpError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeTaskOpError(rec, &taskOpError{Status: http.StatusConflict, Message: "Task overlaps with existing task(s)", Policy: conflictPolicyReject, Conflicts: []Conflict{{Title: "Other"}}})
+	var body struct {
+		Error     string     `json:"error"`
+		Policy    string     `json:"policy"`
+		Conflicts []Conflict `json:"conflicts"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusConflict || body.Policy != conflictPolicyReject || len(body.Conflicts) != 1 {
+		t.Errorf("Conflict: Want 409 with the overlaps, Got %d %+v", rec.Code, body)
+	}
+
+	rec = httptest.NewRecorder()
+	writeTaskOpError(rec, opInvalid(ValidationError{{Field: "priority", Code: "invalid_value", Message: "must be one of low, medium, high"}}))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Validation: Want 422, Got %d", rec.Code)
+	}
+}
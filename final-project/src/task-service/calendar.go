@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CalendarFeed gives a user's calendar feed its secret. Only the token's hash is
+// stored, so the token is shown once, when it is generated.
+type CalendarFeed struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	TokenHash string             `bson:"token_hash" json:"-"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func calendarFeeds() *mongo.Collection {
+	return client.Database("taskmanagement").Collection("calendar_feeds")
+}
+
+// ensureCalendarIndexes gives every user at most one feed, found by its token.
+func ensureCalendarIndexes() error {
+	_, err := calendarFeeds().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	return err
+}
+
+func hashFeedToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// icsTime formats a time as an iCalendar UTC date-time.
+func icsTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icsEscape escapes a TEXT value (RFC 5545, 3.3.11).
+func icsEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", "").Replace(value)
+}
+
+// icsWriter writes content lines, folded at 75 octets and ended with CRLF as
+// RFC 5545 requires.
+type icsWriter struct {
+	strings.Builder
+}
+
+func (w *icsWriter) line(name, value string) {
+	line := name + ":" + value
+	limit := 75
+	for len(line) > limit {
+		// Never split a UTF-8 sequence
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		w.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// The leading space of a continuation line counts towards its length
+		limit = 74
+	}
+	w.WriteString(line + "\r\n")
+}
+
+// icsStatus maps a task status to the STATUS of its VEVENT or VTODO. Statuses
+// without a counterpart have none.
+func icsStatus(component, status string) string {
+	if component == "VEVENT" {
+		switch status {
+		case "planned", "pending":
+			return "TENTATIVE"
+		case "in_progress", "done":
+			return "CONFIRMED"
+		case "cancelled":
+			return "CANCELLED"
+		}
+		return ""
+	}
+	switch status {
+	case "planned", "pending":
+		return "NEEDS-ACTION"
+	case "in_progress":
+		return "IN-PROCESS"
+	case "done":
+		return "COMPLETED"
+	case "cancelled":
+		return "CANCELLED"
+	}
+	return ""
+}
+
+// icsPriority maps a task priority to PRIORITY, where 1 is the highest.
+var icsPriority = map[string]int{"urgent": 1, "high": 3, "medium": 5, "low": 9}
+
+// renderCalendar returns tasks as an iCalendar file. A task with a start date is a
+// VEVENT, any other a VTODO that is due at its end date. SEQUENCE counts the
+// task's changes and LAST-MODIFIED is when it last changed, so calendar apps
+// replace their copy when it is edited.
+func renderCalendar(name string, tasks []Task) string {
+	var w icsWriter
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", "-//Task Management//task-service//EN")
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("X-WR-CALNAME", icsEscape(name))
+	for _, task := range tasks {
+		component := "VTODO"
+		if !task.StartDate.IsZero() {
+			component = "VEVENT"
+		}
+		modified := task.ID.Timestamp()
+		if task.UpdatedAt != nil {
+			modified = *task.UpdatedAt
+		}
+		sequence := task.Version - 1
+		if sequence < 0 {
+			sequence = 0
+		}
+
+		w.line("BEGIN", component)
+		w.line("UID", task.ID.Hex()+"@task-service")
+		w.line("DTSTAMP", icsTime(modified))
+		w.line("CREATED", icsTime(task.ID.Timestamp()))
+		w.line("LAST-MODIFIED", icsTime(modified))
+		w.line("SEQUENCE", strconv.FormatInt(sequence, 10))
+		w.line("SUMMARY", icsEscape(task.Title))
+		if task.Description != "" {
+			w.line("DESCRIPTION", icsEscape(task.Description))
+		}
+		if component == "VEVENT" {
+			w.line("DTSTART", icsTime(task.StartDate))
+			if task.EndDate.After(task.StartDate) {
+				w.line("DTEND", icsTime(task.EndDate))
+			}
+		} else if !task.EndDate.IsZero() {
+			w.line("DUE", icsTime(task.EndDate))
+		}
+		if status := icsStatus(component, task.Status); status != "" {
+			w.line("STATUS", status)
+		}
+		if component == "VTODO" && task.Status == "done" {
+			w.line("PERCENT-COMPLETE", "100")
+		}
+		if priority, ok := icsPriority[task.Priority]; ok {
+			w.line("PRIORITY", strconv.Itoa(priority))
+		}
+		if len(task.Labels) > 0 {
+			labels := make([]string, len(task.Labels))
+			for i, label := range task.Labels {
+				labels[i] = icsEscape(label)
+			}
+			w.line("CATEGORIES", strings.Join(labels, ","))
+		}
+		if task.ParentTask != nil {
+			w.line("RELATED-TO", task.ParentTask.Hex()+"@task-service")
+		}
+		w.line("END", component)
+	}
+	w.line("END", "VCALENDAR")
+	return w.String()
+}
+
+// regenerateCalendarToken gives a user's feed a new secret, which stops the old
+// URL from working, or with DELETE turns the feed off. Users manage their own
+// feed; an admin can pass user_id to manage someone else's.
+func regenerateCalendarToken(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to regenerate calendar feed token")
+
+	if req.Method != http.MethodPost && req.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(req.Context().Value("userID").(string))
+	if err != nil {
+		http.Error(w, "Invalid user ID in token", http.StatusUnauthorized)
+		return
+	}
+	if other := req.URL.Query().Get("user_id"); other != "" {
+		if req.Context().Value("role") != "admin" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if userID, err = primitive.ObjectIDFromHex(other); err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Method == http.MethodDelete {
+		if _, err := calendarFeeds().DeleteOne(context.TODO(), bson.M{"user_id": userID}); err != nil {
+			http.Error(w, "Failed to remove calendar feed", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Calendar feed of user %s removed", userID.Hex())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	_, err = calendarFeeds().UpdateOne(context.TODO(),
+		bson.M{"user_id": userID},
+		bson.M{
+			"$set":         bson.M{"token_hash": hashFeedToken(token), "created_at": time.Now().UTC()},
+			"$setOnInsert": bson.M{"_id": primitive.NewObjectID()},
+		},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		http.Error(w, "Failed to save calendar feed", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Calendar feed token of user %s regenerated", userID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		UserID primitive.ObjectID `json:"user_id"`
+		Token  string             `json:"token"`
+		URL    string             `json:"url"`
+	}{userID, token, "/tasks/calendar/feed/" + token + ".ics"})
+}
+
+// getCalendarFeed serves the tasks assigned to a feed's user as an iCalendar file.
+// Calendar apps can't send a bearer token, so the secret in the URL is what
+// authenticates the request.
+func getCalendarFeed(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request for calendar feed")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimSuffix(req.URL.Path[len("/tasks/calendar/feed/"):], ".ics")
+	var feed CalendarFeed
+	err := calendarFeeds().FindOne(context.TODO(), bson.M{"token_hash": hashFeedToken(token)}).Decode(&feed)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Calendar feed not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "start_date", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := client.Database("taskmanagement").Collection("tasks").Find(context.TODO(), bson.M{"assigned_to": feed.UserID}, opts)
+	if err != nil {
+		http.Error(w, "Failed to list tasks", http.StatusInternalServerError)
+		return
+	}
+	var tasks []Task
+	if err := cursor.All(context.TODO(), &tasks); err != nil {
+		http.Error(w, "Failed to decode tasks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="tasks.ics"`)
+	w.Write([]byte(renderCalendar("Tasks", tasks)))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIcsWriterFolds(t *testing.T) {
+	var w icsWriter
+	w.line("DESCRIPTION", strings.Repeat("é", 60))
+	out := w.String()
+	if !strings.HasSuffix(out, "\r\n") {
+		t.Errorf("Want CRLF line ending, Got %q", out)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+	if len(lines) < 2 {
+		t.Fatalf("Want a folded line, Got %q", out)
+	}
+	var unfolded string
+	for i, line := range lines {
+		if len(line) > 75 {
+			t.Errorf("Line %d: Want at most 75 octets, Got %d", i, len(line))
+		}
+		if i > 0 {
+			if !strings.HasPrefix(line, " ") {
+				t.Errorf("Line %d: Want a leading space, Got %q", i, line)
+			}
+			line = line[1:]
+		}
+		unfolded += line
+	}
+	if unfolded != "DESCRIPTION:"+strings.Repeat("é", 60) {
+		t.Errorf("Unfolded: Got %q", unfolded)
+	}
+}
+
+func TestIcsEscape(t *testing.T) {
+	if got := icsEscape("a,b;c\\d\r\ne"); got != `a\,b\;c\\d\ne` {
+		t.Errorf("Want a\\,b\\;c\\\\d\\ne, Got %s", got)
+	}
+}
+
+func TestRenderCalendar(t *testing.T) {
+	start := time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)
+	updated := start.Add(-time.Hour)
+	parent := primitive.NewObjectID()
+	event := Task{
+		ID: primitive.NewObjectID(), Title: "Review", Status: "in_progress", Priority: "high",
+		StartDate: start, EndDate: start.Add(2 * time.Hour), Version: 3, UpdatedAt: &updated,
+		Labels: []string{"backend", "q1,q2"}, ParentTask: &parent,
+	}
+	todo := Task{ID: primitive.NewObjectID(), Title: "Write docs", Status: "done", EndDate: start, Version: 1}
+
+	out := renderCalendar("Tasks", []Task{event, todo})
+	if !strings.HasPrefix(out, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n") || !strings.HasSuffix(out, "END:VCALENDAR\r\n") {
+		t.Errorf("Want a VCALENDAR, Got %q", out)
+	}
+
+	components := strings.Split(out, "BEGIN:")[2:]
+	if len(components) != 2 {
+		t.Fatalf("Want 2 components, Got %d", len(components))
+	}
+	for _, want := range []string{
+		"VEVENT\r\n",
+		"UID:" + event.ID.Hex() + "@task-service\r\n",
+		"DTSTART:20240304T090000Z\r\n",
+		"DTEND:20240304T110000Z\r\n",
+		"LAST-MODIFIED:20240304T080000Z\r\n",
+		"SEQUENCE:2\r\n",
+		"STATUS:CONFIRMED\r\n",
+		"PRIORITY:3\r\n",
+		"CATEGORIES:backend,q1\\,q2\r\n",
+		"RELATED-TO:" + parent.Hex() + "@task-service\r\n",
+	} {
+		if !strings.Contains(components[0], want) {
+			t.Errorf("Event: Want %q, Got %q", want, components[0])
+		}
+	}
+	for _, want := range []string{
+		"VTODO\r\n",
+		"DUE:20240304T090000Z\r\n",
+		"SEQUENCE:0\r\n",
+		"STATUS:COMPLETED\r\n",
+		"PERCENT-COMPLETE:100\r\n",
+		"LAST-MODIFIED:" + icsTime(todo.ID.Timestamp()) + "\r\n",
+	} {
+		if !strings.Contains(components[1], want) {
+			t.Errorf("Todo: Want %q, Got %q", want, components[1])
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Comment is a message on a task. Replies point at the comment they answer
+// through ParentID; Mentions holds the usernames @mentioned in the body.
+type Comment struct {
+	ID        primitive.ObjectID  `bson:"_id" json:"id"`
+	TaskID    primitive.ObjectID  `bson:"task_id" json:"task_id"`
+	ParentID  *primitive.ObjectID `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
+	AuthorID  primitive.ObjectID  `bson:"author_id" json:"author_id"`
+	Body      string              `bson:"body" json:"body"`
+	Mentions  []string            `bson:"mentions,omitempty" json:"mentions,omitempty"`
+	CreatedAt time.Time           `bson:"created_at" json:"created_at"`
+	EditedAt  *time.Time          `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+}
+
+// CommentThread is a comment with its replies, oldest first.
+type CommentThread struct {
+	Comment
+	Replies []CommentThread `json:"replies"`
+}
+
+// A mention is @ followed by a username, not preceded by a word character so
+// e-mail addresses aren't picked up.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9_.-]*[A-Za-z0-9_])`)
+
+func comments() *mongo.Collection {
+	return client.Database("taskmanagement").Collection("comments")
+}
+
+// parseMentions returns the distinct usernames mentioned in body, in order of appearance.
+func parseMentions(body string) []string {
+	var mentions []string
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		username := match[1]
+		if !seen[username] {
+			seen[username] = true
+			mentions = append(mentions, username)
+		}
+	}
+	return mentions
+}
+
+// buildThreads nests comments under their parents. Replies to a missing parent
+// are shown at the top level rather than dropped.
+func buildThreads(all []Comment) []CommentThread {
+	children := map[primitive.ObjectID][]Comment{}
+	exists := map[primitive.ObjectID]bool{}
+	for _, c := range all {
+		exists[c.ID] = true
+	}
+
+	var roots []Comment
+	for _, c := range all {
+		if c.ParentID != nil && exists[*c.ParentID] {
+			children[*c.ParentID] = append(children[*c.ParentID], c)
+		} else {
+			roots = append(roots, c)
+		}
+	}
+
+	var build func(c Comment) CommentThread
+	build = func(c Comment) CommentThread {
+		thread := CommentThread{Comment: c, Replies: []CommentThread{}}
+		for _, reply := range children[c.ID] {
+			thread.Replies = append(thread.Replies, build(reply))
+		}
+		return thread
+	}
+
+	threads := []CommentThread{}
+	for _, c := range roots {
+		threads = append(threads, build(c))
+	}
+	return threads
+}
+
+// taskSubresource routes /tasks/{id}/comments[/{commentID}], /tasks/{id}/activity
+// and /tasks/{id}/attachments[/{attachmentID}].
+func taskSubresource(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(req.URL.Path[len("/tasks/"):], "/"), "/")
+	if len(parts) < 2 {
+		http.NotFound(w, req)
+		return
+	}
+
+	taskID, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case parts[1] == "activity" && len(parts) == 2:
+		listActivity(w, req, taskID)
+	case parts[1] == "comments" && len(parts) == 2:
+		switch req.Method {
+		case http.MethodGet:
+			listComments(w, req, taskID)
+		case http.MethodPost:
+			authMiddleware(func(w http.ResponseWriter, req *http.Request) {
+				createComment(w, req, taskID)
+			})(w, req)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case parts[1] == "comments" && len(parts) == 3:
+		commentID, err := primitive.ObjectIDFromHex(parts[2])
+		if err != nil {
+			http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+			return
+		}
+		authMiddleware(func(w http.ResponseWriter, req *http.Request) {
+			editComment(w, req, taskID, commentID)
+		})(w, req)
+	case parts[1] == "attachments" && len(parts) == 2:
+		switch req.Method {
+		case http.MethodGet:
+			listAttachments(w, req, taskID)
+		case http.MethodPost:
+			uploadAttachment(w, req, taskID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case parts[1] == "attachments" && len(parts) == 3:
+		attachmentID, err := primitive.ObjectIDFromHex(parts[2])
+		if err != nil {
+			http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+			downloadAttachment(w, req, taskID, attachmentID)
+		case http.MethodDelete:
+			removeAttachment(w, req, taskID, attachmentID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func listComments(w http.ResponseWriter, req *http.Request, taskID primitive.ObjectID) {
+	log.Printf("Received request to list comments for task ID: %s", taskID.Hex())
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := comments().Find(context.TODO(), bson.M{"task_id": taskID}, opts)
+	if err != nil {
+		http.Error(w, "Failed to list comments", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	var all []Comment
+	if err := cursor.All(context.Background(), &all); err != nil {
+		http.Error(w, "Failed to decode comments", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildThreads(all))
+}
+
+func createComment(w http.ResponseWriter, req *http.Request, taskID primitive.ObjectID) {
+	log.Printf("Received request to comment on task ID: %s", taskID.Hex())
+
+	authorID, err := primitive.ObjectIDFromHex(req.Context().Value("userID").(string))
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var input struct {
+		Body     string              `json:"body"`
+		ParentID *primitive.ObjectID `json:"parent_id"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil || strings.TrimSpace(input.Body) == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	count, err := client.Database("taskmanagement").Collection("tasks").CountDocuments(context.TODO(), bson.M{"_id": taskID})
+	if err != nil || count == 0 {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if input.ParentID != nil {
+		count, err := comments().CountDocuments(context.TODO(), bson.M{"_id": *input.ParentID, "task_id": taskID})
+		if err != nil || count == 0 {
+			http.Error(w, "Parent comment not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	comment := Comment{
+		ID:        primitive.NewObjectID(),
+		TaskID:    taskID,
+		ParentID:  input.ParentID,
+		AuthorID:  authorID,
+		Body:      input.Body,
+		Mentions:  parseMentions(input.Body),
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := comments().InsertOne(context.TODO(), comment); err != nil {
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+	recordActivity(Activity{TaskID: taskID, Type: activityCommented, ActorID: &authorID, CommentID: &comment.ID})
+
+	log.Printf("Comment created successfully: %+v", comment)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(comment)
+}
+
+// editComment updates (PUT) or removes (DELETE) a comment. Only its author or
+// an admin may do either; removing a comment also removes its replies.
+func editComment(w http.ResponseWriter, req *http.Request, taskID, commentID primitive.ObjectID) {
+	var comment Comment
+	if err := comments().FindOne(context.TODO(), bson.M{"_id": commentID, "task_id": taskID}).Decode(&comment); err != nil {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	if comment.AuthorID.Hex() != req.Context().Value("userID") && req.Context().Value("role") != "admin" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		var input struct {
+			Body string `json:"body"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil || strings.TrimSpace(input.Body) == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		update := bson.M{"$set": bson.M{"body": input.Body, "mentions": parseMentions(input.Body), "edited_at": time.Now().UTC()}}
+		if _, err := comments().UpdateOne(context.TODO(), bson.M{"_id": commentID}, update); err != nil {
+			http.Error(w, "Failed to update comment", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Comment updated successfully: ID %s", commentID.Hex())
+	case http.MethodDelete:
+		ids := []primitive.ObjectID{commentID}
+		for next := ids; len(next) > 0; {
+			cursor, err := comments().Find(context.TODO(), bson.M{"parent_id": bson.M{"$in": next}})
+			if err != nil {
+				http.Error(w, "Failed to remove comment", http.StatusInternalServerError)
+				return
+			}
+			var replies []Comment
+			err = cursor.All(context.Background(), &replies)
+			cursor.Close(context.Background())
+			if err != nil {
+				http.Error(w, "Failed to remove comment", http.StatusInternalServerError)
+				return
+			}
+			next = nil
+			for _, reply := range replies {
+				next = append(next, reply.ID)
+			}
+			ids = append(ids, next...)
+		}
+		if _, err := comments().DeleteMany(context.TODO(), bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+			http.Error(w, "Failed to remove comment", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Comment removed successfully: ID %s (%d including replies)", commentID.Hex(), len(ids))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listMentions returns the comments that mention a username, newest first.
+func listMentions(w http.ResponseWriter, req *http.Request) {
+	username := req.URL.Path[len("/tasks/mentions/"):]
+	log.Printf("Received request to list mentions of %s", username)
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := comments().Find(context.TODO(), bson.M{"mentions": username}, opts)
+	if err != nil {
+		http.Error(w, "Failed to list comments", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	mentions := []Comment{}
+	if err := cursor.All(context.Background(), &mentions); err != nil {
+		http.Error(w, "Failed to decode comments", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mentions)
+}
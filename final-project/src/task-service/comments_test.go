@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseMentions(t *testing.T) {
+	got := parseMentions("@alice can you check with @bob.smith? cc: @alice, not admin@example.com")
+	want := "alice,bob.smith"
+	if strings.Join(got, ",") != want {
+		t.Errorf("parseMentions: Want %s, Got %v", want, got)
+	}
+}
+
+func TestBuildThreads(t *testing.T) {
+	root := Comment{ID: primitive.NewObjectID()}
+	reply := Comment{ID: primitive.NewObjectID(), ParentID: &root.ID}
+	nested := Comment{ID: primitive.NewObjectID(), ParentID: &reply.ID}
+	missing := primitive.NewObjectID()
+	orphan := Comment{ID: primitive.NewObjectID(), ParentID: &missing}
+
+	threads := buildThreads([]Comment{root, reply, nested, orphan})
+	if len(threads) != 2 {
+		t.Fatalf("Want 2 top-level threads, Got %d", len(threads))
+	}
+	if len(threads[0].Replies) != 1 || len(threads[0].Replies[0].Replies) != 1 || threads[0].Replies[0].Replies[0].ID != nested.ID {
+		t.Errorf("Replies not nested under their parents: %+v", threads[0])
+	}
+	if threads[1].ID != orphan.ID {
+		t.Errorf("Reply to a missing comment should be a top-level thread")
+	}
+}
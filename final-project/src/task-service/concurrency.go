@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// etag formats a document version as a strong entity tag.
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// parseIfMatch returns the version in the request's If-Match header and whether
+// one was sent. "*" matches any version and is treated as no precondition.
+func parseIfMatch(req *http.Request) (int64, bool, error) {
+	header := strings.TrimSpace(req.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, false, nil
+	}
+	header = strings.TrimPrefix(header, "W/")
+	unquoted, err := strconv.Unquote(header)
+	if err != nil {
+		return 0, false, err
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return version, true, nil
+}
+
+// versionFilter matches a document at version. Documents written before versions
+// were introduced have no version field and count as version 0.
+func versionFilter(version int64) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return version
+}
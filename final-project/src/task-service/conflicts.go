@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Conflict policies applied when a task overlaps other work assigned to the same user.
+const (
+	conflictPolicyWarn     = "warn"     // save the task and report the overlaps
+	conflictPolicyReject   = "reject"   // refuse any overlap
+	conflictPolicyCapacity = "capacity" // allow up to conflictCapacity concurrent tasks
+)
+
+// Conflict describes an existing task that overlaps the one being saved.
+type Conflict struct {
+	TaskID    primitive.ObjectID `json:"task_id"`
+	Title     string             `json:"title"`
+	StartDate time.Time          `json:"start_date"`
+	EndDate   time.Time          `json:"end_date"`
+}
+
+// Overlap is a pair of tasks assigned to the same user whose date ranges intersect.
+type Overlap struct {
+	TaskA        primitive.ObjectID `json:"task_a"`
+	TaskB        primitive.ObjectID `json:"task_b"`
+	OverlapStart time.Time          `json:"overlap_start"`
+	OverlapEnd   time.Time          `json:"overlap_end"`
+}
+
+type UserConflicts struct {
+	UserID   primitive.ObjectID `json:"user_id"`
+	Overlaps []Overlap          `json:"overlaps"`
+}
+
+// conflictPolicyFor returns the policy for a request; the conflict_policy query
+// parameter overrides TASK_CONFLICT_POLICY, which defaults to warn.
+func conflictPolicyFor(req *http.Request) string {
+	policy := req.URL.Query().Get("conflict_policy")
+	if policy == "" {
+		policy = os.Getenv("TASK_CONFLICT_POLICY")
+	}
+	switch policy {
+	case conflictPolicyReject, conflictPolicyCapacity:
+		return policy
+	default:
+		return conflictPolicyWarn
+	}
+}
+
+// conflictCapacity is the number of tasks a user may work on at the same time
+// under the capacity policy, read from TASK_CONFLICT_CAPACITY (default 1).
+func conflictCapacity() int {
+	capacity, err := strconv.Atoi(os.Getenv("TASK_CONFLICT_CAPACITY"))
+	if err != nil || capacity < 1 {
+		return 1
+	}
+	return capacity
+}
+
+// findConflicts returns the unfinished tasks of the same assignee that overlap task.
+func findConflicts(ctx context.Context, task Task) ([]Conflict, error) {
+	if task.AssignedTo.IsZero() || task.StartDate.IsZero() || task.EndDate.IsZero() {
+		return nil, nil
+	}
+
+	filter := bson.M{
+		"_id":         bson.M{"$ne": task.ID},
+		"assigned_to": task.AssignedTo,
+		"status":      bson.M{"$ne": "done"},
+		"end_date":    bson.M{"$gt": task.StartDate},
+		"start_date":  bson.M{"$lt": task.EndDate},
+	}
+	cursor, err := client.Database("taskmanagement").Collection("tasks").Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var overlapping []Task
+	if err := cursor.All(ctx, &overlapping); err != nil {
+		return nil, err
+	}
+
+	conflicts := make([]Conflict, 0, len(overlapping))
+	for _, t := range overlapping {
+		conflicts = append(conflicts, Conflict{TaskID: t.ID, Title: t.Title, StartDate: t.StartDate, EndDate: t.EndDate})
+	}
+	return conflicts, nil
+}
+
+// conflictsAllowed reports whether task may be saved alongside conflicts under policy.
+func conflictsAllowed(policy string, capacity int, task Task, conflicts []Conflict) bool {
+	switch policy {
+	case conflictPolicyReject:
+		return len(conflicts) == 0
+	case conflictPolicyCapacity:
+		return maxConcurrent(task, conflicts) <= capacity
+	default:
+		return true
+	}
+}
+
+// maxConcurrent returns the largest number of tasks, task included, running at
+// the same instant within task's date range.
+func maxConcurrent(task Task, conflicts []Conflict) int {
+	type edge struct {
+		at    time.Time
+		delta int
+	}
+	edges := []edge{{task.StartDate, 1}, {task.EndDate, -1}}
+	for _, c := range conflicts {
+		edges = append(edges, edge{c.StartDate, 1}, edge{c.EndDate, -1})
+	}
+	// Ends sort before starts at the same instant so back-to-back tasks don't count as overlapping.
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].at.Equal(edges[j].at) {
+			return edges[i].delta < edges[j].delta
+		}
+		return edges[i].at.Before(edges[j].at)
+	})
+
+	current, max := 0, 0
+	for _, e := range edges {
+		current += e.delta
+		if current > max {
+			max = current
+		}
+	}
+	return max
+}
+
+// checkConflicts looks up the overlaps for task and applies the batch's policy.
+// It returns an error with the overlaps when the task must not be saved.
+func checkConflicts(b *taskBatch, task Task) ([]Conflict, *taskOpError) {
+	conflicts, err := findConflicts(b.ctx, task)
+	if err != nil {
+		return nil, opFailed(http.StatusInternalServerError, "Database query error")
+	}
+
+	if !conflictsAllowed(b.policy, conflictCapacity(), task, conflicts) {
+		log.Printf("Task %s rejected by %s conflict policy: %d overlapping task(s)", task.ID.Hex(), b.policy, len(conflicts))
+		return nil, &taskOpError{
+			Status:    http.StatusConflict,
+			Message:   "Task overlaps with existing task(s)",
+			Policy:    b.policy,
+			Conflicts: conflicts,
+		}
+	}
+	return conflicts, nil
+}
+
+// findOverlaps groups tasks by assignee and returns every intersecting pair.
+func findOverlaps(tasks []Task) []UserConflicts {
+	byUser := map[primitive.ObjectID][]Task{}
+	var users []primitive.ObjectID
+	for _, t := range tasks {
+		if t.AssignedTo.IsZero() {
+			continue
+		}
+		if _, ok := byUser[t.AssignedTo]; !ok {
+			users = append(users, t.AssignedTo)
+		}
+		byUser[t.AssignedTo] = append(byUser[t.AssignedTo], t)
+	}
+
+	result := []UserConflicts{}
+	for _, userID := range users {
+		userTasks := byUser[userID]
+		sort.Slice(userTasks, func(i, j int) bool { return userTasks[i].StartDate.Before(userTasks[j].StartDate) })
+
+		var overlaps []Overlap
+		for i := range userTasks {
+			for j := i + 1; j < len(userTasks); j++ {
+				// Sorted by start, so nothing after j can overlap i either.
+				if !userTasks[j].StartDate.Before(userTasks[i].EndDate) {
+					break
+				}
+				end := userTasks[i].EndDate
+				if userTasks[j].EndDate.Before(end) {
+					end = userTasks[j].EndDate
+				}
+				overlaps = append(overlaps, Overlap{
+					TaskA:        userTasks[i].ID,
+					TaskB:        userTasks[j].ID,
+					OverlapStart: userTasks[j].StartDate,
+					OverlapEnd:   end,
+				})
+			}
+		}
+		if len(overlaps) > 0 {
+			result = append(result, UserConflicts{UserID: userID, Overlaps: overlaps})
+		}
+	}
+	return result
+}
+
+func listConflicts(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to list task conflicts")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	collection := client.Database("taskmanagement").Collection("tasks")
+	cursor, err := collection.Find(context.TODO(), bson.M{"status": bson.M{"$ne": "done"}})
+	if err != nil {
+		http.Error(w, "Failed to list tasks", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	var tasks []Task
+	if err = cursor.All(context.Background(), &tasks); err != nil {
+		http.Error(w, "Failed to decode tasks", http.StatusInternalServerError)
+		return
+	}
+
+	conflicts := findOverlaps(tasks)
+	log.Printf("Found conflicts for %d user(s)", len(conflicts))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conflicts)
+}
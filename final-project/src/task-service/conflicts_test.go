@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func day(d int) time.Time {
+	return time.Date(2024, 4, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestConflictsAllowed(t *testing.T) {
+	task := Task{StartDate: day(1), EndDate: day(5)}
+	conflicts := []Conflict{
+		{StartDate: day(2), EndDate: day(3)},
+		{StartDate: day(3), EndDate: day(4)}, // starts as the previous one ends
+	}
+
+	if !conflictsAllowed(conflictPolicyWarn, 1, task, conflicts) {
+		t.Errorf("warn policy should always allow the task")
+	}
+	if conflictsAllowed(conflictPolicyReject, 1, task, conflicts) {
+		t.Errorf("reject policy should refuse overlapping tasks")
+	}
+	if !conflictsAllowed(conflictPolicyReject, 1, task, nil) {
+		t.Errorf("reject policy should allow a task without conflicts")
+	}
+	if got := maxConcurrent(task, conflicts); got != 2 {
+		t.Errorf("maxConcurrent: Want 2, Got %d", got)
+	}
+	if conflictsAllowed(conflictPolicyCapacity, 1, task, conflicts) {
+		t.Errorf("capacity 1 should refuse two concurrent tasks")
+	}
+	if !conflictsAllowed(conflictPolicyCapacity, 2, task, conflicts) {
+		t.Errorf("capacity 2 should allow two concurrent tasks")
+	}
+}
+
+func TestFindOverlaps(t *testing.T) {
+	alice, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	tasks := []Task{
+		{ID: primitive.NewObjectID(), AssignedTo: alice, StartDate: day(1), EndDate: day(4)},
+		{ID: primitive.NewObjectID(), AssignedTo: alice, StartDate: day(3), EndDate: day(6)},
+		{ID: primitive.NewObjectID(), AssignedTo: alice, StartDate: day(6), EndDate: day(7)},
+		{ID: primitive.NewObjectID(), AssignedTo: bob, StartDate: day(1), EndDate: day(2)},
+	}
+
+	got := findOverlaps(tasks)
+	if len(got) != 1 || got[0].UserID != alice {
+		t.Fatalf("Want overlaps for one user, Got %+v", got)
+	}
+	if len(got[0].Overlaps) != 1 {
+		t.Fatalf("Want 1 overlap, Got %d", len(got[0].Overlaps))
+	}
+	overlap := got[0].Overlaps[0]
+	if overlap.TaskA != tasks[0].ID || overlap.TaskB != tasks[1].ID || !overlap.OverlapStart.Equal(day(3)) || !overlap.OverlapEnd.Equal(day(4)) {
+		t.Errorf("Unexpected overlap %+v", overlap)
+	}
+}
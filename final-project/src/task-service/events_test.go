@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMemoryBus(t *testing.T) {
+	bus := NewMemoryBus()
+	taskID := primitive.NewObjectID()
+
+	var received []TaskInvoiceEvent
+	bus.Subscribe(eventTaskCompleted, func(ctx context.Context, event Event) error {
+		var data TaskInvoiceEvent
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			return err
+		}
+		received = append(received, data)
+		return nil
+	})
+	failing := errors.New("billing unavailable")
+	bus.Subscribe(eventTaskCompleted, func(ctx context.Context, event Event) error {
+		return failing
+	})
+
+	event, err := newEvent("key-1", eventTaskCompleted, TaskInvoiceEvent{IdempotencyKey: "key-1", TaskID: taskID, Hours: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.ID != "key-1" || event.Source != "task-service" {
+		t.Errorf("Unexpected envelope: %+v", event)
+	}
+
+	if err := bus.Publish(context.Background(), event); !errors.Is(err, failing) {
+		t.Errorf("Publish: Want the failing handler's error, Got %v", err)
+	}
+	if len(received) != 1 || received[0].TaskID != taskID || received[0].Hours != 2 {
+		t.Errorf("Want one TaskCompleted for task %s, Got %+v", taskID.Hex(), received)
+	}
+
+	// Events nobody subscribed to are dropped
+	other, _ := newEvent("", eventTaskCreated, TaskEvent{TaskID: taskID})
+	if err := bus.Publish(context.Background(), other); err != nil {
+		t.Errorf("Publish without subscribers: Want no error, Got %v", err)
+	}
+	if other.ID == "" {
+		t.Errorf("newEvent should generate an ID")
+	}
+}
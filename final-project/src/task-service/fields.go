@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultOrganization is used for tasks and field definitions created without one.
+const defaultOrganization = "default"
+
+// Custom field types.
+const (
+	fieldTypeText   = "text"
+	fieldTypeNumber = "number"
+	fieldTypeDate   = "date"
+	fieldTypeEnum   = "enum"
+	fieldTypeUser   = "user"
+)
+
+// Task priorities, lowest first.
+var priorities = []string{"low", "medium", "high", "urgent"}
+
+// FieldDefinition declares a custom field that tasks of an organization may carry
+// in CustomFields under Key.
+type FieldDefinition struct {
+	ID           primitive.ObjectID `bson:"_id" json:"id"`
+	Organization string             `bson:"organization" json:"organization"`
+	Key          string             `bson:"key" json:"key"`
+	Name         string             `bson:"name" json:"name"`
+	Type         string             `bson:"type" json:"type"`
+	Options      []string           `bson:"options,omitempty" json:"options,omitempty"`
+	Required     bool               `bson:"required" json:"required"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// FieldError reports an invalid value for one field. Code is one of
+// unknown_field, invalid_type, invalid_value, required, immutable or not_found.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError collects the field errors of a request.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	messages := make([]string, len(e))
+	for i, fe := range e {
+		messages[i] = fe.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func writeValidationError(w http.ResponseWriter, errs ValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(struct {
+		Errors ValidationError `json:"errors"`
+	}{Errors: errs})
+}
+
+func fieldDefinitions() *mongo.Collection {
+	return client.Database("taskmanagement").Collection("field_definitions")
+}
+
+// ensureFieldIndexes keeps field keys unique within an organization.
+func ensureFieldIndexes() error {
+	_, err := fieldDefinitions().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "organization", Value: 1}, {Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// organizationFilter matches an organization's tasks. Tasks created before
+// organizations existed belong to the default one.
+func organizationFilter(organization string) interface{} {
+	if organization == defaultOrganization {
+		return bson.M{"$in": bson.A{defaultOrganization, nil}}
+	}
+	return organization
+}
+
+// loadFieldDefinitions returns an organization's field definitions by key.
+func loadFieldDefinitions(organization string) (map[string]FieldDefinition, error) {
+	cursor, err := fieldDefinitions().Find(context.TODO(), bson.M{"organization": organization})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var list []FieldDefinition
+	if err := cursor.All(context.Background(), &list); err != nil {
+		return nil, err
+	}
+	defs := make(map[string]FieldDefinition, len(list))
+	for _, def := range list {
+		defs[def.Key] = def
+	}
+	return defs, nil
+}
+
+// normalizeLabels trims, lower-cases, de-duplicates and sorts labels.
+func normalizeLabels(labels []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, label := range labels {
+		label = strings.ToLower(strings.TrimSpace(label))
+		if label != "" && !seen[label] {
+			seen[label] = true
+			result = append(result, label)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func validPriority(priority string) bool {
+	for _, p := range priorities {
+		if p == priority {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLabels converts a decoded JSON value into a label list.
+func parseLabels(value interface{}) ([]string, *FieldError) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, &FieldError{Field: "labels", Code: "invalid_type", Message: "must be an array of strings"}
+	}
+	labels := make([]string, 0, len(items))
+	for _, item := range items {
+		label, ok := item.(string)
+		if !ok {
+			return nil, &FieldError{Field: "labels", Code: "invalid_type", Message: "must be an array of strings"}
+		}
+		labels = append(labels, label)
+	}
+	return normalizeLabels(labels), nil
+}
+
+// convertFieldValue checks a decoded JSON value against a definition and returns
+// the value to store: dates become time.Time and user references ObjectIDs.
+func convertFieldValue(def FieldDefinition, value interface{}) (interface{}, *FieldError) {
+	field := "custom_fields." + def.Key
+	switch def.Type {
+	case fieldTypeText:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return nil, &FieldError{Field: field, Code: "invalid_type", Message: "must be a string"}
+	case fieldTypeNumber:
+		if n, ok := value.(float64); ok {
+			return n, nil
+		}
+		return nil, &FieldError{Field: field, Code: "invalid_type", Message: "must be a number"}
+	case fieldTypeDate:
+		s, ok := value.(string)
+		if !ok {
+			return nil, &FieldError{Field: field, Code: "invalid_type", Message: "must be an RFC 3339 date string"}
+		}
+		for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+		return nil, &FieldError{Field: field, Code: "invalid_value", Message: "must be an RFC 3339 date or YYYY-MM-DD"}
+	case fieldTypeEnum:
+		s, ok := value.(string)
+		if !ok {
+			return nil, &FieldError{Field: field, Code: "invalid_type", Message: "must be a string"}
+		}
+		for _, option := range def.Options {
+			if option == s {
+				return s, nil
+			}
+		}
+		return nil, &FieldError{Field: field, Code: "invalid_value", Message: fmt.Sprintf("must be one of %s", strings.Join(def.Options, ", "))}
+	case fieldTypeUser:
+		s, ok := value.(string)
+		if !ok {
+			return nil, &FieldError{Field: field, Code: "invalid_type", Message: "must be a user ID string"}
+		}
+		id, err := primitive.ObjectIDFromHex(s)
+		if err != nil {
+			return nil, &FieldError{Field: field, Code: "invalid_value", Message: "must be a valid user ID"}
+		}
+		return id, nil
+	}
+	return nil, &FieldError{Field: field, Code: "invalid_type", Message: "has an unknown field type " + def.Type}
+}
+
+// validateCustomFields converts values against defs. A nil value clears the
+// field; with requireAll, required fields missing from values are reported too.
+func validateCustomFields(defs map[string]FieldDefinition, values map[string]interface{}, requireAll bool) (map[string]interface{}, ValidationError) {
+	var errs ValidationError
+	converted := map[string]interface{}{}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		def, ok := defs[key]
+		if !ok {
+			errs = append(errs, FieldError{Field: "custom_fields." + key, Code: "unknown_field", Message: "is not defined for this organization"})
+			continue
+		}
+		if values[key] == nil {
+			if def.Required {
+				errs = append(errs, FieldError{Field: "custom_fields." + key, Code: "required", Message: "cannot be cleared"})
+			} else {
+				converted[key] = nil
+			}
+			continue
+		}
+		value, fieldErr := convertFieldValue(def, values[key])
+		if fieldErr != nil {
+			errs = append(errs, *fieldErr)
+			continue
+		}
+		converted[key] = value
+	}
+
+	if requireAll {
+		var missing []string
+		for key, def := range defs {
+			if _, ok := values[key]; def.Required && !ok {
+				missing = append(missing, key)
+			}
+		}
+		sort.Strings(missing)
+		for _, key := range missing {
+			errs = append(errs, FieldError{Field: "custom_fields." + key, Code: "required", Message: "is required"})
+		}
+	}
+	return converted, errs
+}
+
+// readOnlyChanges returns an immutable error for each read-only field in updates
+// whose value isn't the task's, as the task is returned. Clients send the whole
+// task back, so read-only fields they left alone are fine.
+func readOnlyChanges(task Task, updates map[string]interface{}) ValidationError {
+	if len(updates) == 0 {
+		return nil
+	}
+	var current map[string]interface{}
+	raw, err := json.Marshal(task)
+	if err == nil {
+		err = json.Unmarshal(raw, &current)
+	}
+	keys := make([]string, 0, len(updates))
+	for key := range updates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs ValidationError
+	for _, key := range keys {
+		if err == nil && reflect.DeepEqual(updates[key], current[key]) {
+			continue
+		}
+		message := "cannot be changed"
+		if key == "rank" {
+			message = "is changed by moving the task on the board"
+		}
+		errs = append(errs, FieldError{Field: key, Code: "immutable", Message: message})
+	}
+	return errs
+}
+
+// validateNewTask normalizes the labels, priority and custom fields of a task being created.
+func validateNewTask(task *Task) (ValidationError, error) {
+	var errs ValidationError
+	if task.Organization == "" {
+		task.Organization = defaultOrganization
+	}
+	task.Labels = normalizeLabels(task.Labels)
+	if task.Priority == "" {
+		task.Priority = "medium"
+	} else if !validPriority(task.Priority) {
+		errs = append(errs, FieldError{Field: "priority", Code: "invalid_value", Message: "must be one of " + strings.Join(priorities, ", ")})
+	}
+
+	defs, err := loadFieldDefinitions(task.Organization)
+	if err != nil {
+		return nil, err
+	}
+	converted, fieldErrs := validateCustomFields(defs, task.CustomFields, true)
+	errs = append(errs, fieldErrs...)
+	for key, value := range converted {
+		if value == nil {
+			delete(converted, key)
+		}
+	}
+	task.CustomFields = converted
+	if len(task.CustomFields) == 0 {
+		task.CustomFields = nil
+	}
+	return errs, nil
+}
+
+// taskFilterFromQuery builds a task filter from the label, priority,
+// organization and cf.<key> query parameters. Several label parameters must all match.
+func taskFilterFromQuery(req *http.Request) (bson.M, ValidationError, error) {
+	query := req.URL.Query()
+	filter := bson.M{}
+	var errs ValidationError
+
+	if labels := normalizeLabels(query["label"]); len(labels) > 0 {
+		filter["labels"] = bson.M{"$all": labels}
+	}
+	if priority := query.Get("priority"); priority != "" {
+		if !validPriority(priority) {
+			errs = append(errs, FieldError{Field: "priority", Code: "invalid_value", Message: "must be one of " + strings.Join(priorities, ", ")})
+		}
+		filter["priority"] = priority
+	}
+
+	organization := query.Get("organization")
+	if organization != "" {
+		filter["organization"] = organizationFilter(organization)
+	} else {
+		organization = defaultOrganization
+	}
+
+	var defs map[string]FieldDefinition
+	for param, values := range query {
+		if !strings.HasPrefix(param, "cf.") {
+			continue
+		}
+		if defs == nil {
+			var err error
+			if defs, err = loadFieldDefinitions(organization); err != nil {
+				return nil, nil, err
+			}
+		}
+		key := strings.TrimPrefix(param, "cf.")
+		def, ok := defs[key]
+		if !ok {
+			errs = append(errs, FieldError{Field: "custom_fields." + key, Code: "unknown_field", Message: "is not defined for this organization"})
+			continue
+		}
+		// Query values are strings; numbers are parsed before conversion
+		var raw interface{} = values[0]
+		if def.Type == fieldTypeNumber {
+			var n float64
+			if _, err := fmt.Sscan(values[0], &n); err != nil {
+				errs = append(errs, FieldError{Field: "custom_fields." + key, Code: "invalid_type", Message: "must be a number"})
+				continue
+			}
+			raw = n
+		}
+		value, fieldErr := convertFieldValue(def, raw)
+		if fieldErr != nil {
+			errs = append(errs, *fieldErr)
+			continue
+		}
+		filter["custom_fields."+key] = value
+	}
+	return filter, errs, nil
+}
+
+func createFieldDefinition(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to create field definition")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var def FieldDefinition
+	if err := json.NewDecoder(req.Body).Decode(&def); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if def.Organization == "" {
+		def.Organization = defaultOrganization
+	}
+
+	var errs ValidationError
+	if def.Key == "" || strings.ContainsAny(def.Key, ".$ ") {
+		errs = append(errs, FieldError{Field: "key", Code: "invalid_value", Message: "is required and cannot contain '.', '$' or spaces"})
+	}
+	switch def.Type {
+	case fieldTypeText, fieldTypeNumber, fieldTypeDate, fieldTypeUser:
+	case fieldTypeEnum:
+		if len(def.Options) == 0 {
+			errs = append(errs, FieldError{Field: "options", Code: "required", Message: "enum fields need at least one option"})
+		}
+	default:
+		errs = append(errs, FieldError{Field: "type", Code: "invalid_value", Message: "must be one of text, number, date, enum, user"})
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+	if def.Name == "" {
+		def.Name = def.Key
+	}
+	def.ID = primitive.NewObjectID()
+	def.CreatedAt = time.Now().UTC()
+
+	if _, err := fieldDefinitions().InsertOne(context.TODO(), def); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "Field already defined for this organization", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to create field definition", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Field definition created successfully: %+v", def)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(def)
+}
+
+func listFieldDefinitions(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to list field definitions")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	organization := req.URL.Query().Get("organization")
+	if organization == "" {
+		organization = defaultOrganization
+	}
+	cursor, err := fieldDefinitions().Find(context.TODO(), bson.M{"organization": organization}, options.Find().SetSort(bson.D{{Key: "key", Value: 1}}))
+	if err != nil {
+		http.Error(w, "Failed to list field definitions", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	defs := []FieldDefinition{}
+	if err := cursor.All(context.Background(), &defs); err != nil {
+		http.Error(w, "Failed to decode field definitions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(defs)
+}
+
+// removeFieldDefinition deletes a definition and clears the field from the organization's tasks.
+func removeFieldDefinition(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to remove field definition")
+
+	if req.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	defID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/tasks/fields/remove/"):])
+	if err != nil {
+		http.Error(w, "Invalid field definition ID", http.StatusBadRequest)
+		return
+	}
+
+	var def FieldDefinition
+	if err := fieldDefinitions().FindOneAndDelete(context.TODO(), bson.M{"_id": defID}).Decode(&def); err != nil {
+		http.Error(w, "Field definition not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = client.Database("taskmanagement").Collection("tasks").UpdateMany(context.TODO(),
+		bson.M{"organization": organizationFilter(def.Organization)}, bson.M{"$unset": bson.M{"custom_fields." + def.Key: ""}})
+	if err != nil {
+		log.Printf("Failed to clear field %s from tasks: %v", def.Key, err)
+	}
+
+	log.Printf("Field definition removed successfully: ID %s", defID.Hex())
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNormalizeLabels(t *testing.T) {
+	got := normalizeLabels([]string{" Bug", "frontend", "bug", ""})
+	if strings.Join(got, ",") != "bug,frontend" {
+		t.Errorf("normalizeLabels: Want bug,frontend, Got %v", got)
+	}
+}
+
+func TestValidateCustomFields(t *testing.T) {
+	defs := map[string]FieldDefinition{
+		"client":   {Key: "client", Type: fieldTypeText, Required: true},
+		"estimate": {Key: "estimate", Type: fieldTypeNumber},
+		"due":      {Key: "due", Type: fieldTypeDate},
+		"stage":    {Key: "stage", Type: fieldTypeEnum, Options: []string{"design", "build"}},
+		"reviewer": {Key: "reviewer", Type: fieldTypeUser},
+	}
+	reviewer := primitive.NewObjectID()
+
+	converted, errs := validateCustomFields(defs, map[string]interface{}{
+		"client":   "Acme",
+		"estimate": 3.5,
+		"due":      "2024-05-01",
+		"stage":    "build",
+		"reviewer": reviewer.Hex(),
+	}, true)
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if converted["due"] != time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC) || converted["reviewer"] != reviewer {
+		t.Errorf("Values not converted: %+v", converted)
+	}
+
+	_, errs = validateCustomFields(defs, map[string]interface{}{
+		"estimate": "three",
+		"stage":    "ship",
+		"reviewer": "nobody",
+		"color":    "red",
+	}, true)
+	want := []string{
+		"custom_fields.color:unknown_field",
+		"custom_fields.estimate:invalid_type",
+		"custom_fields.reviewer:invalid_value",
+		"custom_fields.stage:invalid_value",
+		"custom_fields.client:required",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Want %d errors, Got %v", len(want), errs)
+	}
+	for i, fe := range errs {
+		if fe.Field+":"+fe.Code != want[i] {
+			t.Errorf("Error %d: Want %s, Got %s:%s", i, want[i], fe.Field, fe.Code)
+		}
+	}
+
+	// Updates only validate the fields they touch, and required fields can't be cleared
+	_, errs = validateCustomFields(defs, map[string]interface{}{"client": nil, "estimate": nil}, false)
+	if len(errs) != 1 || errs[0].Field != "custom_fields.client" || errs[0].Code != "required" {
+		t.Errorf("Want a single required error for client, Got %v", errs)
+	}
+}
+
+func TestReadOnlyChanges(t *testing.T) {
+	seriesID := primitive.NewObjectID()
+	occurrence := time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC)
+	updated := time.Date(2024, 4, 2, 10, 30, 0, 123000000, time.UTC)
+	task := Task{ID: primitive.NewObjectID(), Title: "Report", Organization: "acme", Version: 3, SeriesID: &seriesID, OccurrenceDate: &occurrence, Detached: true, Rank: 2048, UpdatedAt: &updated}
+
+	// The task as a client gets it and sends it back
+	raw, _ := json.Marshal(task)
+	var sentBack map[string]interface{}
+	json.Unmarshal(raw, &sentBack)
+	readOnly := map[string]interface{}{}
+	for _, key := range []string{"version", "organization", "invoice_id", "series_id", "occurrence_date", "detached", "rank", "updated_at"} {
+		readOnly[key] = sentBack[key]
+	}
+	if errs := readOnlyChanges(task, readOnly); len(errs) != 0 {
+		t.Errorf("Unchanged read-only fields: Want no errors, Got %v", errs)
+	}
+
+	readOnly["rank"], readOnly["organization"] = float64(1), "globex"
+	errs := readOnlyChanges(task, readOnly)
+	if len(errs) != 2 || errs[0].Field != "organization" || errs[1].Field != "rank" || errs[1].Code != "immutable" {
+		t.Errorf("Changed read-only fields: Want organization and rank, Got %v", errs)
+	}
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Task columns of CSV exports and imports. Custom fields follow as cf.<key>.
+var taskColumns = []string{"id", "title", "description", "status", "assigned_to", "hours", "start_date", "end_date", "parent_task", "organization", "labels", "priority"}
+
+// Task fields of an exported NDJSON line that an import leaves to the new task.
+var ignoredImportFields = map[string]bool{"version": true, "invoice_id": true, "series_id": true, "occurrence_date": true, "detached": true, "rank": true, "updated_at": true, "conflicts": true}
+
+// maxImportBytes limits the size of an import file.
+const maxImportBytes = 10 << 20
+
+// importMaxRows is the number of rows one import may create, read from
+// IMPORT_MAX_ROWS (default 1000).
+func importMaxRows() int {
+	rows, err := strconv.Atoi(os.Getenv("IMPORT_MAX_ROWS"))
+	if err != nil || rows < 1 {
+		return 1000
+	}
+	return rows
+}
+
+// transferFormat returns csv or ndjson from the format query parameter, falling
+// back to the Content-Type of an upload. CSV is the default.
+func transferFormat(req *http.Request) (string, bool) {
+	format := req.URL.Query().Get("format")
+	if format == "" && strings.Contains(req.Header.Get("Content-Type"), "ndjson") {
+		format = "ndjson"
+	}
+	switch format {
+	case "", "csv":
+		return "csv", true
+	case "ndjson":
+		return "ndjson", true
+	}
+	return "", false
+}
+
+// csvRecord returns a task's CSV columns, with custom fields in the order of keys.
+func csvRecord(task Task, keys []string) []string {
+	record := []string{
+		task.ID.Hex(),
+		task.Title,
+		task.Description,
+		task.Status,
+		"",
+		strconv.FormatFloat(task.Hours, 'f', -1, 64),
+		"",
+		"",
+		"",
+		task.Organization,
+		strings.Join(task.Labels, ";"),
+		task.Priority,
+	}
+	if !task.AssignedTo.IsZero() {
+		record[4] = task.AssignedTo.Hex()
+	}
+	if !task.StartDate.IsZero() {
+		record[6] = task.StartDate.UTC().Format(time.RFC3339)
+	}
+	if !task.EndDate.IsZero() {
+		record[7] = task.EndDate.UTC().Format(time.RFC3339)
+	}
+	if task.ParentTask != nil {
+		record[8] = task.ParentTask.Hex()
+	}
+	for _, key := range keys {
+		var cell string
+		switch value := task.CustomFields[key].(type) {
+		case nil:
+		case primitive.ObjectID:
+			cell = value.Hex()
+		case primitive.DateTime:
+			cell = value.Time().UTC().Format("2006-01-02")
+		case time.Time:
+			cell = value.UTC().Format("2006-01-02")
+		case float64:
+			cell = strconv.FormatFloat(value, 'f', -1, 64)
+		default:
+			cell = fmt.Sprint(value)
+		}
+		record = append(record, cell)
+	}
+	return record
+}
+
+// exportTasks streams the tasks matching the task list filters as CSV or NDJSON.
+func exportTasks(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to export tasks")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format, ok := transferFormat(req)
+	if !ok {
+		http.Error(w, "Invalid format, use csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	filter, validationErrs, err := taskFilterFromQuery(req)
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+	if len(validationErrs) > 0 {
+		writeValidationError(w, validationErrs)
+		return
+	}
+	if assignedTo := req.URL.Query().Get("assigned_to"); assignedTo != "" {
+		objectID, err := primitive.ObjectIDFromHex(assignedTo)
+		if err != nil {
+			http.Error(w, "Invalid assigned_to ID", http.StatusBadRequest)
+			return
+		}
+		filter["assigned_to"] = objectID
+	}
+
+	// Custom field columns are those of the exported organization
+	organization := req.URL.Query().Get("organization")
+	if organization == "" {
+		organization = defaultOrganization
+	}
+	defs, err := loadFieldDefinitions(organization)
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+	keys := make([]string, 0, len(defs))
+	for key := range defs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := client.Database("taskmanagement").Collection("tasks").Find(context.TODO(), filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to list tasks", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	// Tasks are written as they are read, so large exports aren't held in memory
+	flusher, _ := w.(http.Flusher)
+	var writeTask func(task Task) error
+	var flush func() error
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="tasks.csv"`)
+		out := csv.NewWriter(w)
+		header := append([]string(nil), taskColumns...)
+		for _, key := range keys {
+			header = append(header, "cf."+key)
+		}
+		out.Write(header)
+		writeTask = func(task Task) error { return out.Write(csvRecord(task, keys)) }
+		flush = func() error { out.Flush(); return out.Error() }
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="tasks.ndjson"`)
+		out := bufio.NewWriter(w)
+		encoder := json.NewEncoder(out)
+		writeTask = func(task Task) error { return encoder.Encode(task) }
+		flush = out.Flush
+	}
+
+	count := 0
+	for cursor.Next(context.TODO()) {
+		var task Task
+		if err := cursor.Decode(&task); err != nil {
+			log.Printf("Export stopped: failed to decode task: %v", err)
+			return
+		}
+		if err := writeTask(task); err != nil {
+			log.Printf("Export stopped after %d tasks: %v", count, err)
+			return
+		}
+		if count++; count%100 == 0 {
+			if err := flush(); err != nil {
+				log.Printf("Export stopped after %d tasks: %v", count, err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		// The status is already sent, so the truncated file is all we can give
+		log.Printf("Export stopped after %d tasks: %v", count, err)
+	}
+	flush()
+	log.Printf("Exported %d tasks as %s", count, format)
+}
+
+// importRow is one task of an import file.
+type importRow struct {
+	Row      int    // line of the row in the file
+	Ref      string // the row's id, which parent_task of other rows can refer to
+	Assignee string // username to look up for assigned_to
+	Parent   string // parent_task as given: a row's id or an existing task's ID
+	Task     Task
+	Errors   ValidationError
+
+	parentRow int  // index of the parent's row, or -1
+	input     Task // the task as read, which createTaskOp validates again
+}
+
+// ImportRowResult reports the outcome of one row.
+type ImportRowResult struct {
+	Row    int                 `json:"row"`
+	ID     *primitive.ObjectID `json:"id,omitempty"`
+	Title  string              `json:"title"`
+	Errors ValidationError     `json:"errors,omitempty"`
+	// Error and Conflicts say why a valid row couldn't be created, or which
+	// tasks it overlaps with when the conflict policy allowed it
+	Error     string     `json:"error,omitempty"`
+	Conflicts []Conflict `json:"conflicts,omitempty"`
+}
+
+// readImportRows parses an import file into rows. Values are converted as far as
+// their type goes; the rows aren't validated against each other or the database yet.
+// An error means the file itself can't be read.
+func readImportRows(format string, body io.Reader, defs map[string]FieldDefinition) ([]importRow, error) {
+	var rows []importRow
+	if format == "csv" {
+		reader := csv.NewReader(body)
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("reading CSV header: %v", err)
+		}
+		for i := range header {
+			header[i] = strings.TrimSpace(header[i])
+		}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			line, _ := reader.FieldPos(0)
+			values := map[string]interface{}{}
+			var errs ValidationError
+			if len(record) > len(header) {
+				errs = append(errs, FieldError{Field: "row", Code: "invalid_value", Message: fmt.Sprintf("has %d columns, the header %d", len(record), len(header))})
+			}
+			for i, cell := range record {
+				if i < len(header) && cell != "" {
+					values[header[i]] = cell
+				}
+			}
+			row := rowFromValues(values, defs, true)
+			row.Row = line
+			row.Errors = append(errs, row.Errors...)
+			rows = append(rows, row)
+		}
+		return rows, nil
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxImportBytes)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var values map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &values); err != nil {
+			rows = append(rows, importRow{Row: line, Errors: ValidationError{{Field: "row", Code: "invalid_type", Message: "must be a JSON object"}}})
+			continue
+		}
+		row := rowFromValues(values, defs, false)
+		row.Row = line
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// rowFromValues converts a row's values by column. CSV cells are all strings, so
+// fromCSV also parses numbers of number custom fields and splits labels on ";".
+func rowFromValues(values map[string]interface{}, defs map[string]FieldDefinition, fromCSV bool) importRow {
+	var row importRow
+	task := &row.Task
+	invalid := func(field, code, message string) {
+		row.Errors = append(row.Errors, FieldError{Field: field, Code: code, Message: message})
+	}
+	str := func(field string) (string, bool) {
+		value, ok := values[field].(string)
+		if !ok && values[field] != nil {
+			invalid(field, "invalid_type", "must be a string")
+		}
+		return strings.TrimSpace(value), ok
+	}
+	date := func(field string) time.Time {
+		value, ok := str(field)
+		if !ok || value == "" {
+			return time.Time{}
+		}
+		if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+			return parsed
+		}
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			invalid(field, "invalid_value", "must be an RFC 3339 date or YYYY-MM-DD")
+		}
+		return parsed
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := values[key]
+		switch {
+		case key == "id":
+			row.Ref, _ = str(key)
+		case key == "title":
+			task.Title, _ = str(key)
+		case key == "description":
+			task.Description, _ = str(key)
+		case key == "status":
+			task.Status, _ = str(key)
+		case key == "priority":
+			task.Priority, _ = str(key)
+		case key == "organization":
+			task.Organization, _ = str(key)
+		case key == "assignee":
+			row.Assignee, _ = str(key)
+		case key == "parent_task":
+			row.Parent, _ = str(key)
+		case key == "assigned_to":
+			if id, ok := str(key); ok && id != "" {
+				assignedTo, err := primitive.ObjectIDFromHex(id)
+				if err != nil {
+					invalid(key, "invalid_value", "must be a valid user ID")
+				}
+				task.AssignedTo = assignedTo
+			}
+		case key == "hours":
+			switch hours := value.(type) {
+			case float64:
+				task.Hours = hours
+			case string:
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(hours), 64)
+				if err != nil {
+					invalid(key, "invalid_type", "must be a number")
+				}
+				task.Hours = parsed
+			case nil:
+			default:
+				invalid(key, "invalid_type", "must be a number")
+			}
+		case key == "start_date":
+			task.StartDate = date(key)
+		case key == "end_date":
+			task.EndDate = date(key)
+		case key == "labels":
+			switch labels := value.(type) {
+			case string:
+				task.Labels = normalizeLabels(strings.Split(labels, ";"))
+			case nil:
+			default:
+				parsed, fieldErr := parseLabels(labels)
+				if fieldErr != nil {
+					row.Errors = append(row.Errors, *fieldErr)
+				}
+				task.Labels = parsed
+			}
+		case key == "custom_fields":
+			fields, ok := value.(map[string]interface{})
+			if !ok && value != nil {
+				invalid(key, "invalid_type", "must be an object")
+			}
+			for field, fieldValue := range fields {
+				if task.CustomFields == nil {
+					task.CustomFields = map[string]interface{}{}
+				}
+				task.CustomFields[field] = fieldValue
+			}
+		case strings.HasPrefix(key, "cf."):
+			field := strings.TrimPrefix(key, "cf.")
+			if task.CustomFields == nil {
+				task.CustomFields = map[string]interface{}{}
+			}
+			task.CustomFields[field] = value
+			if s, ok := value.(string); ok && fromCSV && defs[field].Type == fieldTypeNumber {
+				n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+				if err != nil {
+					invalid("custom_fields."+field, "invalid_type", "must be a number")
+					delete(task.CustomFields, field)
+					continue
+				}
+				task.CustomFields[field] = n
+			}
+		case ignoredImportFields[key]:
+		default:
+			invalid(key, "unknown_field", "is not a task field")
+		}
+	}
+	if task.Title == "" {
+		invalid("title", "required", "is required")
+	}
+	if !task.StartDate.IsZero() && !task.EndDate.IsZero() && task.EndDate.Before(task.StartDate) {
+		invalid("end_date", "invalid_value", "must not be before start_date")
+	}
+	return row
+}
+
+// resolveParents gives every row a new task ID and points parent_task references
+// to rows of the file at those IDs. References that match no row are left for the
+// caller to check as existing tasks. Rows that are their own ancestors get an error.
+func resolveParents(rows []importRow) {
+	byRef := map[string]int{}
+	for i := range rows {
+		rows[i].Task.ID = primitive.NewObjectID()
+		rows[i].parentRow = -1
+		if ref := rows[i].Ref; ref != "" {
+			if _, taken := byRef[ref]; taken {
+				rows[i].Errors = append(rows[i].Errors, FieldError{Field: "id", Code: "invalid_value", Message: "is used by another row"})
+				continue
+			}
+			byRef[ref] = i
+		}
+	}
+
+	for i := range rows {
+		if rows[i].Parent == "" {
+			continue
+		}
+		if p, ok := byRef[rows[i].Parent]; ok {
+			rows[i].parentRow = p
+			rows[i].Task.ParentTask = &rows[p].Task.ID
+			continue
+		}
+		parentID, err := primitive.ObjectIDFromHex(rows[i].Parent)
+		if err != nil {
+			rows[i].Errors = append(rows[i].Errors, FieldError{Field: "parent_task", Code: "not_found", Message: "matches no row id or task ID"})
+			continue
+		}
+		rows[i].Task.ParentTask = &parentID
+	}
+
+	for i := range rows {
+		// Walking up from a row in a cycle comes back to it within len(rows) steps
+		for p, steps := rows[i].parentRow, 0; p >= 0 && steps <= len(rows); p, steps = rows[p].parentRow, steps+1 {
+			if p == i {
+				rows[i].Errors = append(rows[i].Errors, FieldError{Field: "parent_task", Code: "invalid_value", Message: "forms a cycle"})
+				break
+			}
+		}
+	}
+}
+
+// rejectInvalidParents adds an error to each row whose parent row in the file is
+// invalid, since its parent won't be created.
+func rejectInvalidParents(rows []importRow) {
+	for changed := true; changed; {
+		changed = false
+		for i := range rows {
+			p := rows[i].parentRow
+			if p < 0 || len(rows[p].Errors) == 0 || len(rows[i].Errors) > 0 {
+				continue
+			}
+			rows[i].Errors = append(rows[i].Errors, FieldError{Field: "parent_task", Code: "invalid_value", Message: fmt.Sprintf("refers to row %d, which is invalid", rows[p].Row)})
+			changed = true
+		}
+	}
+}
+
+// creationOrder lists the indexes of rows with every row after its parent row.
+// Rows in a cycle, which resolveParents rejects, come in no particular order.
+func creationOrder(rows []importRow) []int {
+	order := make([]int, 0, len(rows))
+	placed := make([]bool, len(rows))
+	var place func(i int)
+	place = func(i int) {
+		if placed[i] {
+			return
+		}
+		placed[i] = true
+		if p := rows[i].parentRow; p >= 0 {
+			place(p)
+		}
+		order = append(order, i)
+	}
+	for i := range rows {
+		place(i)
+	}
+	return order
+}
+
+// errImportDryRun rolls back the transaction of a dry run.
+var errImportDryRun = errors.New("dry run")
+
+// importTasks creates tasks from a CSV or NDJSON file. Every row is validated like
+// a created task, assignee usernames are mapped to user IDs, and parent_task may
+// name another row's id. The rows are then created like single tasks, under the
+// conflict policy, in one transaction: nothing is created unless every row is
+// valid and can be created. With dry_run=true the transaction is rolled back and
+// the report shows what would be created.
+func importTasks(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to import tasks")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format, ok := transferFormat(req)
+	if !ok {
+		http.Error(w, "Invalid format, use csv or ndjson", http.StatusBadRequest)
+		return
+	}
+	dryRun := req.URL.Query().Get("dry_run") == "true"
+
+	// The import goes into one organization
+	organization := req.URL.Query().Get("organization")
+	if organization == "" {
+		organization = defaultOrganization
+	}
+	defs, err := loadFieldDefinitions(organization)
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := readImportRows(format, http.MaxBytesReader(w, req.Body, maxImportBytes), defs)
+	if err != nil {
+		http.Error(w, "Invalid import file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rows) == 0 || len(rows) > importMaxRows() {
+		http.Error(w, fmt.Sprintf("An import needs 1 to %d rows", importMaxRows()), http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	assignees := map[string]primitive.ObjectID{}
+	for i := range rows {
+		row := &rows[i]
+		if row.Task.Organization != "" && row.Task.Organization != organization {
+			row.Errors = append(row.Errors, FieldError{Field: "organization", Code: "invalid_value", Message: "must be " + organization + ", the organization imported into"})
+		}
+		row.Task.Organization = organization
+		row.input = row.Task
+		fieldErrs, err := validateNewTask(&row.Task)
+		if err != nil {
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		row.Errors = append(row.Errors, fieldErrs...)
+
+		if row.Assignee != "" {
+			if !row.Task.AssignedTo.IsZero() {
+				row.Errors = append(row.Errors, FieldError{Field: "assignee", Code: "invalid_value", Message: "cannot be given with assigned_to"})
+				continue
+			}
+			userID, seen := assignees[row.Assignee]
+			if !seen {
+				var found bool
+				userID, found, err = users.Resolve(ctx, row.Assignee)
+				if err != nil {
+					writeReferenceError(w, err)
+					return
+				}
+				if !found {
+					userID = primitive.NilObjectID
+				}
+				assignees[row.Assignee] = userID
+			}
+			if userID.IsZero() {
+				row.Errors = append(row.Errors, FieldError{Field: "assignee", Code: "not_found", Message: "user " + row.Assignee + " does not exist"})
+			}
+			row.Task.AssignedTo = userID
+		}
+	}
+
+	resolveParents(rows)
+	inFile := map[primitive.ObjectID]bool{}
+	for _, row := range rows {
+		inFile[row.Task.ID] = true
+	}
+	for i := range rows {
+		row := &rows[i]
+		references := bson.M{}
+		if row.Assignee == "" {
+			references["assigned_to"] = row.Task.AssignedTo
+		}
+		if row.Task.ParentTask != nil && !inFile[*row.Task.ParentTask] {
+			references["parent_task"] = *row.Task.ParentTask
+		}
+		for key, value := range row.Task.CustomFields {
+			references["custom_fields."+key] = value
+		}
+		referenceErrs, err := checkReferences(ctx, references)
+		if err != nil {
+			writeReferenceError(w, err)
+			return
+		}
+		row.Errors = append(row.Errors, referenceErrs...)
+	}
+
+	rejectInvalidParents(rows)
+
+	results := make([]ImportRowResult, len(rows))
+	invalid := 0
+	for i, row := range rows {
+		results[i] = ImportRowResult{Row: row.Row, Title: row.Task.Title, Errors: row.Errors}
+		if len(row.Errors) > 0 {
+			invalid++
+		}
+	}
+	report := struct {
+		DryRun  bool              `json:"dry_run"`
+		Rows    int               `json:"rows"`
+		Invalid int               `json:"invalid"`
+		Created int               `json:"created"`
+		Results []ImportRowResult `json:"results"`
+	}{DryRun: dryRun, Rows: len(rows), Invalid: invalid, Results: results}
+
+	writeReport := func(status int) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	}
+	if invalid > 0 {
+		status := http.StatusUnprocessableEntity
+		if dryRun {
+			status = http.StatusOK
+		}
+		writeReport(status)
+		return
+	}
+
+	b := newTaskBatch(req)
+	created := make([]primitive.ObjectID, len(rows))
+	failed := -1
+	var failure *taskOpError
+	err = withTransaction(func(ctx mongo.SessionContext) error {
+		// A retried transaction starts over
+		b.ctx, b.txn, b.after, failed, failure = ctx, ctx, nil, -1, nil
+		for _, i := range creationOrder(rows) {
+			task := rows[i].input
+			task.AssignedTo = rows[i].Task.AssignedTo
+			task.ParentTask = rows[i].Task.ParentTask
+			if p := rows[i].parentRow; p >= 0 {
+				task.ParentTask = &created[p]
+			}
+			task, opErr := createTaskOp(b, task)
+			if opErr != nil {
+				failed, failure = i, opErr
+				return errors.New("import row failed")
+			}
+			created[i] = task.ID
+			results[i].Conflicts = task.Conflicts
+		}
+		if dryRun {
+			return errImportDryRun
+		}
+		return nil
+	})
+	switch {
+	case failed >= 0:
+		results[failed].Errors = failure.Errors
+		results[failed].Error = failure.Message
+		results[failed].Conflicts = failure.Conflicts
+		report.Invalid = 1
+		status := failure.Status
+		if dryRun {
+			status = http.StatusOK
+		}
+		writeReport(status)
+		return
+	case errors.Is(err, errImportDryRun):
+		writeReport(http.StatusOK)
+		return
+	case err != nil:
+		log.Printf("Failed to import tasks: %v", err)
+		http.Error(w, "Failed to import tasks", http.StatusInternalServerError)
+		return
+	}
+
+	for _, fn := range b.after {
+		fn()
+	}
+	for i := range rows {
+		results[i].ID = &created[i]
+	}
+	report.Created = len(rows)
+	log.Printf("Imported %d tasks into %s", len(rows), organization)
+	writeReport(http.StatusCreated)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReadImportRowsCSV(t *testing.T) {
+	defs := map[string]FieldDefinition{"budget": {Key: "budget", Type: fieldTypeNumber}}
+	file := "id,title,assignee,hours,start_date,labels,parent_task,cf.budget,colour\n" +
+		"epic,Migrate,alice,4,2024-03-04,Backend; ops;backend;,,1200,\n" +
+		"t1,Move data,,two,,,epic,lots,red\n"
+
+	rows, err := readImportRows("csv", strings.NewReader(file), defs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Want 2 rows, Got %d", len(rows))
+	}
+
+	epic := rows[0]
+	if epic.Row != 2 || epic.Ref != "epic" || epic.Assignee != "alice" || epic.Task.Hours != 4 || len(epic.Errors) != 0 {
+		t.Errorf("First row: Unexpected %+v", epic)
+	}
+	if !epic.Task.StartDate.Equal(time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)) || strings.Join(epic.Task.Labels, ";") != "backend;ops" {
+		t.Errorf("First row: Want the date and labels backend;ops, Got %v %v", epic.Task.StartDate, epic.Task.Labels)
+	}
+	if epic.Task.CustomFields["budget"] != 1200.0 {
+		t.Errorf("First row: Want budget 1200 as a number, Got %#v", epic.Task.CustomFields["budget"])
+	}
+
+	want := []string{"custom_fields.budget:invalid_type", "colour:unknown_field", "hours:invalid_type"}
+	task := rows[1]
+	if task.Parent != "epic" || len(task.Errors) != len(want) {
+		t.Fatalf("Second row: Want parent epic and %d errors, Got %+v", len(want), task)
+	}
+	for i, fe := range task.Errors {
+		if fe.Field+":"+fe.Code != want[i] {
+			t.Errorf("Error %d: Want %s, Got %s:%s", i, want[i], fe.Field, fe.Code)
+		}
+	}
+}
+
+func TestReadImportRowsNDJSON(t *testing.T) {
+	parent := primitive.NewObjectID()
+	file := `{"id": "a", "title": "Exported", "labels": ["x"], "hours": 2, "version": 7, "parent_task": "` + parent.Hex() + `"}` + "\n\n" +
+		"not json\n" +
+		`{"description": "no title"}` + "\n"
+
+	rows, err := readImportRows("ndjson", strings.NewReader(file), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("Want 3 rows, Got %d", len(rows))
+	}
+	if len(rows[0].Errors) != 0 || rows[0].Task.Hours != 2 || rows[0].Parent != parent.Hex() {
+		t.Errorf("Line 1: Unexpected %+v", rows[0])
+	}
+	if rows[1].Row != 3 || len(rows[1].Errors) != 1 || rows[1].Errors[0].Field != "row" {
+		t.Errorf("Line 3: Want a row error, Got %+v", rows[1])
+	}
+	if len(rows[2].Errors) != 1 || rows[2].Errors[0].Field != "title" {
+		t.Errorf("Line 4: Want title required, Got %+v", rows[2].Errors)
+	}
+}
+
+func TestResolveParents(t *testing.T) {
+	existing := primitive.NewObjectID()
+	rows := []importRow{
+		{Row: 2, Ref: "child", Parent: "epic"},
+		{Row: 3, Ref: "epic", Parent: existing.Hex()},
+		{Row: 4, Ref: "a", Parent: "b"},
+		{Row: 5, Ref: "b", Parent: "a"},
+		{Row: 6, Parent: "nowhere"},
+	}
+	resolveParents(rows)
+
+	if rows[0].Task.ParentTask == nil || *rows[0].Task.ParentTask != rows[1].Task.ID {
+		t.Errorf("Want the child to point at the epic's new ID")
+	}
+	if rows[1].Task.ParentTask == nil || *rows[1].Task.ParentTask != existing {
+		t.Errorf("Want the epic to keep the existing parent %s", existing.Hex())
+	}
+	for _, i := range []int{2, 3} {
+		if len(rows[i].Errors) != 1 || rows[i].Errors[0].Message != "forms a cycle" {
+			t.Errorf("Row %d: Want a cycle error, Got %+v", rows[i].Row, rows[i].Errors)
+		}
+	}
+	if len(rows[4].Errors) != 1 || rows[4].Errors[0].Code != "not_found" {
+		t.Errorf("Row 6: Want not_found, Got %+v", rows[4].Errors)
+	}
+
+	// Children of an invalid row can't be created either
+	rows[1].Errors = ValidationError{{Field: "title", Code: "required"}}
+	rejectInvalidParents(rows)
+	if len(rows[0].Errors) != 1 || rows[0].Errors[0].Field != "parent_task" {
+		t.Errorf("Row 2: Want an invalid parent error, Got %+v", rows[0].Errors)
+	}
+}
+
+func TestCreationOrder(t *testing.T) {
+	rows := []importRow{
+		{Row: 2, Ref: "task", Parent: "story"},
+		{Row: 3, Ref: "story", Parent: "epic"},
+		{Row: 4, Ref: "epic"},
+		{Row: 5, Ref: "other"},
+		{Row: 6, Ref: "sibling", Parent: "epic"},
+	}
+	resolveParents(rows)
+
+	order := creationOrder(rows)
+	if len(order) != len(rows) {
+		t.Fatalf("Want %d rows, Got %v", len(rows), order)
+	}
+	position := map[int]int{}
+	for at, i := range order {
+		position[i] = at
+	}
+	for i, row := range rows {
+		if row.parentRow >= 0 && position[row.parentRow] > position[i] {
+			t.Errorf("Row %d: Want it after its parent row %d, Got order %v", row.Row, rows[row.parentRow].Row, order)
+		}
+	}
+}
+
+func TestCSVRecord(t *testing.T) {
+	parent, user := primitive.NewObjectID(), primitive.NewObjectID()
+	task := Task{
+		ID:           primitive.NewObjectID(),
+		Title:        "Report",
+		AssignedTo:   user,
+		Hours:        1.5,
+		StartDate:    time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC),
+		ParentTask:   &parent,
+		Labels:       []string{"a", "b"},
+		CustomFields: map[string]interface{}{"budget": 1200.0, "due": primitive.NewDateTimeFromTime(time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC))},
+	}
+	record := csvRecord(task, []string{"budget", "due", "owner"})
+	want := []string{task.ID.Hex(), "Report", "", "", user.Hex(), "1.5", "2024-03-04T09:00:00Z", "", parent.Hex(), "", "a;b", "", "1200", "2024-04-01", ""}
+	if len(record) != len(want) {
+		t.Fatalf("Want %d columns, Got %d", len(want), len(record))
+	}
+	for i := range want {
+		if record[i] != want[i] {
+			t.Errorf("Column %d: Want %q, Got %q", i, want[i], record[i])
+		}
+	}
+}
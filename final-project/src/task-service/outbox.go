@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Invoice request states in the outbox.
+const (
+	invoicePending   = "pending"
+	invoiceDelivered = "delivered"
+)
+
+// InvoiceRequest is an invoice waiting in the outbox to be created in billing-service.
+// It is written in the same transaction as the change that makes the task billable
+// and published by the relay as a TaskCompleted or InvoiceRequested event carrying
+// its IdempotencyKey, so a retry never creates a second invoice. It stays pending
+// until billing-service answers with InvoiceIssued. EntryIDs is empty when the
+// task's Hours are billed instead of time entries; a TaskCompleted request with
+// no Hours only announces the completion.
+type InvoiceRequest struct {
+	ID             primitive.ObjectID   `bson:"_id" json:"id"`
+	Event          string               `bson:"event" json:"event"`
+	IdempotencyKey string               `bson:"idempotency_key" json:"idempotency_key"`
+	TaskID         primitive.ObjectID   `bson:"task_id" json:"task_id"`
+	UserID         primitive.ObjectID   `bson:"user_id" json:"user_id"`
+	Organization   string               `bson:"organization,omitempty" json:"organization,omitempty"`
+	ProjectID      primitive.ObjectID   `bson:"project_id,omitempty" json:"project_id"`
+	Hours          float64              `bson:"hours" json:"hours"`
+	EntryIDs       []primitive.ObjectID `bson:"entry_ids,omitempty" json:"entry_ids,omitempty"`
+	Status         string               `bson:"status" json:"status"`
+	Attempts       int                  `bson:"attempts" json:"attempts"`
+	NextAttemptAt  time.Time            `bson:"next_attempt_at" json:"next_attempt_at"`
+	LastError      string               `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	InvoiceID      *primitive.ObjectID  `bson:"invoice_id,omitempty" json:"invoice_id,omitempty"`
+	CreatedAt      time.Time            `bson:"created_at" json:"created_at"`
+	DeliveredAt    *time.Time           `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+}
+
+// How long a claimed request is hidden from other deliveries, how long a published
+// request waits for InvoiceIssued before it is published again, and the longest
+// wait between retries.
+const (
+	invoiceLease     = time.Minute
+	invoiceRepublish = 10 * time.Minute
+	maxInvoiceRetry  = time.Hour
+)
+
+var errTaskModified = errors.New("task has been modified")
+
+// relayWake lets a request that just queued an invoice start a delivery round early.
+var relayWake = make(chan struct{}, 1)
+
+func invoiceOutbox() *mongo.Collection {
+	return client.Database("taskmanagement").Collection("invoice_outbox")
+}
+
+func ensureOutboxIndexes() error {
+	_, err := invoiceOutbox().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "idempotency_key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+	})
+	return err
+}
+
+// withTransaction runs fn in a MongoDB transaction. fn may be called more than
+// once if the transaction has to be retried.
+func withTransaction(fn func(ctx mongo.SessionContext) error) error {
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	_, err = session.WithTransaction(context.TODO(), func(ctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// enqueueInvoice records an invoice for the task's finished, billable time entries
+// that are not billed or queued yet, and marks those entries as queued. Tasks
+// without any time entries are billed for their Hours field, once. It must run
+// inside a transaction. When there is nothing left to bill it returns nil, except
+// for TaskCompleted, which is always queued so the completion is announced.
+func enqueueInvoice(ctx mongo.SessionContext, task Task, event string) (*InvoiceRequest, error) {
+	request := &InvoiceRequest{
+		ID:           primitive.NewObjectID(),
+		Event:        event,
+		TaskID:       task.ID,
+		UserID:       task.AssignedTo,
+		Organization: task.Organization,
+		Status:       invoicePending,
+	}
+
+	var err error
+	if request.ProjectID, err = projectOf(ctx, task); err != nil {
+		return nil, err
+	}
+	request.Hours, request.EntryIDs, err = unbilledWork(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	if len(request.EntryIDs) > 0 {
+		_, err = timeEntries().UpdateMany(ctx, bson.M{"_id": bson.M{"$in": request.EntryIDs}}, bson.M{"$set": bson.M{"invoice_request_id": request.ID}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if request.Hours <= 0 && event != eventTaskCompleted {
+		log.Printf("No unbilled billable time for task ID: %s", task.ID.Hex())
+		return nil, nil
+	}
+
+	request.IdempotencyKey = "task-invoice-" + request.ID.Hex()
+	request.CreatedAt = time.Now().UTC()
+	request.NextAttemptAt = request.CreatedAt
+	if _, err := invoiceOutbox().InsertOne(ctx, request); err != nil {
+		return nil, err
+	}
+	log.Printf("Queued invoice %s for task ID: %s, hours: %v", request.IdempotencyKey, task.ID.Hex(), request.Hours)
+	return request, nil
+}
+
+// unbilledWork returns the hours an invoice for the task would bill now and the
+// time entries they come from: its finished, billable time entries that are not
+// billed or queued yet or, for a task without time entries, its Hours field
+// unless that has been billed or queued.
+func unbilledWork(ctx context.Context, task Task) (float64, []primitive.ObjectID, error) {
+	cursor, err := timeEntries().Find(ctx, bson.M{"task_id": task.ID})
+	if err != nil {
+		return 0, nil, err
+	}
+	var entries []TimeEntry
+	err = cursor.All(ctx, &entries)
+	cursor.Close(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	hoursQueued := false
+	if len(entries) == 0 && task.Hours > 0 && task.InvoiceID.IsZero() {
+		queued, err := invoiceOutbox().CountDocuments(ctx, bson.M{"task_id": task.ID, "hours": bson.M{"$gt": 0}, "entry_ids": bson.M{"$exists": false}})
+		if err != nil {
+			return 0, nil, err
+		}
+		hoursQueued = queued > 0
+	}
+	hours, ids := pendingWork(task, entries, hoursQueued)
+	return hours, ids, nil
+}
+
+// pendingWork picks what is left to bill of a task from all its time entries:
+// the finished, billable entries that aren't billed or queued yet. A task
+// without entries is billed for its Hours once, so not when they are billed
+// or hoursQueued already.
+func pendingWork(task Task, entries []TimeEntry, hoursQueued bool) (float64, []primitive.ObjectID) {
+	if len(entries) == 0 {
+		if task.Hours <= 0 || !task.InvoiceID.IsZero() || hoursQueued {
+			return 0, nil
+		}
+		return task.Hours, nil
+	}
+
+	var hours float64
+	var ids []primitive.ObjectID
+	for _, e := range entries {
+		if !e.Billable || e.EndedAt == nil || e.InvoiceID != nil || e.InvoiceRequestID != nil {
+			continue
+		}
+		hours += e.Hours
+		ids = append(ids, e.ID)
+	}
+	if hours <= 0 {
+		return 0, nil
+	}
+	return hours, ids
+}
+
+// retryDelay is the wait before the next delivery of a request that has failed
+// attempts times, doubling from 5 seconds up to an hour.
+func retryDelay(attempts int) time.Duration {
+	delay := 5 * time.Second
+	for i := 1; i < attempts && delay < maxInvoiceRetry; i++ {
+		delay *= 2
+	}
+	if delay > maxInvoiceRetry {
+		delay = maxInvoiceRetry
+	}
+	return delay
+}
+
+// wakeInvoiceRelay starts a delivery round without waiting for the next tick.
+func wakeInvoiceRelay() {
+	select {
+	case relayWake <- struct{}{}:
+	default:
+	}
+}
+
+// runInvoiceRelay publishes queued invoices on startup, whenever one is queued
+// and every INVOICE_RELAY_INTERVAL (default 10s) to pick up retries.
+func runInvoiceRelay() {
+	interval, err := time.ParseDuration(os.Getenv("INVOICE_RELAY_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if published, err := relayPendingInvoices(); err != nil {
+			log.Printf("Invoice relay failed: %v", err)
+		} else if published > 0 {
+			log.Printf("Invoice relay published %d invoices", published)
+		}
+		select {
+		case <-ticker.C:
+		case <-relayWake:
+		}
+	}
+}
+
+// invoiceQueue is where the relay takes due invoice requests from and records
+// what became of them.
+type invoiceQueue interface {
+	// Claim takes the oldest pending request due at now and hides it from other
+	// deliveries for invoiceLease, counting the attempt
+	Claim(now time.Time) (InvoiceRequest, bool, error)
+	// Reschedule keeps a pending request for another attempt at next, with the
+	// error of the last one, if any
+	Reschedule(request InvoiceRequest, next time.Time, lastError string) error
+	// Deliver marks a pending request delivered
+	Deliver(request InvoiceRequest, at time.Time) error
+}
+
+// invoiceRequests is the queue the relay works on.
+var invoiceRequests invoiceQueue = outboxQueue{}
+
+// outboxQueue is the invoiceQueue of the outbox collection. Its claims are atomic,
+// so two relays don't publish a request at the same time.
+type outboxQueue struct{}
+
+func (outboxQueue) Claim(now time.Time) (InvoiceRequest, bool, error) {
+	filter := bson.M{"status": invoicePending, "next_attempt_at": bson.M{"$lte": now}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "created_at", Value: 1}}).
+		SetReturnDocument(options.After)
+	update := bson.M{"$set": bson.M{"next_attempt_at": now.Add(invoiceLease)}, "$inc": bson.M{"attempts": 1}}
+
+	var request InvoiceRequest
+	err := invoiceOutbox().FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		return request, false, nil
+	}
+	return request, err == nil, err
+}
+
+func (outboxQueue) Reschedule(request InvoiceRequest, next time.Time, lastError string) error {
+	update := bson.M{"$set": bson.M{"next_attempt_at": next, "last_error": lastError}}
+	if lastError == "" {
+		update = bson.M{"$set": bson.M{"next_attempt_at": next}, "$unset": bson.M{"last_error": ""}}
+	}
+	_, err := invoiceOutbox().UpdateOne(context.TODO(), bson.M{"_id": request.ID, "status": invoicePending}, update)
+	return err
+}
+
+func (outboxQueue) Deliver(request InvoiceRequest, at time.Time) error {
+	update := bson.M{"$set": bson.M{"status": invoiceDelivered, "delivered_at": at}, "$unset": bson.M{"last_error": ""}}
+	_, err := invoiceOutbox().UpdateOne(context.TODO(), bson.M{"_id": request.ID, "status": invoicePending}, update)
+	return err
+}
+
+// relayPendingInvoices publishes every request that is due, oldest first.
+func relayPendingInvoices() (int, error) {
+	published := 0
+	for {
+		request, found, err := invoiceRequests.Claim(time.Now().UTC())
+		if err != nil {
+			return published, err
+		}
+		if !found {
+			return published, nil
+		}
+		if err := publishInvoice(request); err == nil {
+			published++
+		}
+	}
+}
+
+// publishInvoice publishes the request's event. A request with hours stays pending
+// until billing-service answers with InvoiceIssued and is published again if no
+// answer comes; billing-service ignores the repeats by idempotency key.
+func publishInvoice(request InvoiceRequest) error {
+	event, err := newEvent(request.IdempotencyKey, request.Event, TaskInvoiceEvent{
+		IdempotencyKey: request.IdempotencyKey,
+		TaskID:         request.TaskID,
+		UserID:         request.UserID,
+		Organization:   request.Organization,
+		ProjectID:      request.ProjectID,
+		Hours:          request.Hours,
+	})
+	if err == nil {
+		err = bus.Publish(context.TODO(), event)
+	}
+	now := time.Now().UTC()
+	if err != nil {
+		log.Printf("Failed to publish invoice %s (attempt %d): %v", request.IdempotencyKey, request.Attempts, err)
+		if err := invoiceRequests.Reschedule(request, now.Add(retryDelay(request.Attempts)), err.Error()); err != nil {
+			log.Printf("Failed to schedule retry of invoice %s: %v", request.IdempotencyKey, err)
+		}
+		return err
+	}
+
+	if request.Hours <= 0 {
+		err = invoiceRequests.Deliver(request, now)
+	} else {
+		err = invoiceRequests.Reschedule(request, now.Add(invoiceRepublish), "")
+	}
+	if err != nil {
+		log.Printf("Failed to update invoice %s after publishing: %v", request.IdempotencyKey, err)
+	}
+	return nil
+}
+
+// handleInvoiceIssued links an invoice created by billing-service to the task
+// and time entries it was requested for. Every step can be repeated safely, so
+// a redelivered event changes nothing.
+func handleInvoiceIssued(ctx context.Context, event Event) error {
+	var issued InvoiceIssuedEvent
+	if err := json.Unmarshal(event.Data, &issued); err != nil {
+		log.Printf("Ignoring malformed %s event %s: %v", event.Type, event.ID, err)
+		return nil
+	}
+
+	var request InvoiceRequest
+	err := invoiceOutbox().FindOne(ctx, bson.M{"idempotency_key": issued.IdempotencyKey}).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		log.Printf("Ignoring invoice %s for unknown request %s", issued.InvoiceID.Hex(), issued.IdempotencyKey)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	invoiceID := issued.InvoiceID
+
+	if len(request.EntryIDs) > 0 {
+		_, err = timeEntries().UpdateMany(ctx, bson.M{"invoice_request_id": request.ID}, bson.M{"$set": bson.M{"invoice_id": invoiceID}})
+		if err != nil {
+			return err
+		}
+	}
+	tasks := client.Database("taskmanagement").Collection("tasks")
+	_, err = tasks.UpdateOne(ctx, bson.M{"_id": request.TaskID, "invoice_id": bson.M{"$ne": invoiceID}}, bson.M{"$set": bson.M{"invoice_id": invoiceID, "updated_at": time.Now().UTC()}, "$inc": bson.M{"version": 1}})
+	if err != nil {
+		return err
+	}
+
+	done := bson.M{"status": invoiceDelivered, "invoice_id": invoiceID, "delivered_at": time.Now().UTC()}
+	result, err := invoiceOutbox().UpdateOne(ctx, bson.M{"_id": request.ID, "status": invoicePending}, bson.M{"$set": done, "$unset": bson.M{"last_error": ""}})
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount > 0 {
+		recordInvoice(request.TaskID, invoiceID, request.Hours)
+		log.Printf("Invoice %s issued for task ID: %s, Billing ID: %s", request.IdempotencyKey, request.TaskID.Hex(), invoiceID.Hex())
+	}
+	return nil
+}
+
+// listInvoiceRequests returns the outbox, newest first, optionally filtered by
+// status and task_id.
+func listInvoiceRequests(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to list queued invoices")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := bson.M{}
+	if status := req.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+	if param := req.URL.Query().Get("task_id"); param != "" {
+		taskID, err := primitive.ObjectIDFromHex(param)
+		if err != nil {
+			http.Error(w, "Invalid task_id", http.StatusBadRequest)
+			return
+		}
+		filter["task_id"] = taskID
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := invoiceOutbox().Find(context.TODO(), filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to list invoices", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	requests := []InvoiceRequest{}
+	if err := cursor.All(context.Background(), &requests); err != nil {
+		http.Error(w, "Failed to decode invoices", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
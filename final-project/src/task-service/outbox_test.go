@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{4, 40 * time.Second},
+		{20, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempts); got != tt.want {
+			t.Errorf("retryDelay(%d): Want %v, Got %v", tt.attempts, tt.want, got)
+		}
+	}
+}
+
+// memoryQueue is an invoiceQueue in memory that claims like outboxQueue. Its
+// requests are in the order they were created.
+type memoryQueue struct {
+	requests []*InvoiceRequest
+}
+
+func (q *memoryQueue) Claim(now time.Time) (InvoiceRequest, bool, error) {
+	for _, request := range q.requests {
+		if request.Status == invoicePending && !request.NextAttemptAt.After(now) {
+			request.NextAttemptAt = now.Add(invoiceLease)
+			request.Attempts++
+			return *request, true, nil
+		}
+	}
+	return InvoiceRequest{}, false, nil
+}
+
+func (q *memoryQueue) find(id primitive.ObjectID) *InvoiceRequest {
+	for _, request := range q.requests {
+		if request.ID == id && request.Status == invoicePending {
+			return request
+		}
+	}
+	return &InvoiceRequest{}
+}
+
+func (q *memoryQueue) Reschedule(request InvoiceRequest, next time.Time, lastError string) error {
+	stored := q.find(request.ID)
+	stored.NextAttemptAt, stored.LastError = next, lastError
+	return nil
+}
+
+func (q *memoryQueue) Deliver(request InvoiceRequest, at time.Time) error {
+	stored := q.find(request.ID)
+	stored.Status, stored.DeliveredAt, stored.LastError = invoiceDelivered, &at, ""
+	return nil
+}
+
+// useMemoryRelay points the relay at queue and a memory bus whose billing side
+// records the idempotency keys it receives, or fails while failing is set.
+func useMemoryRelay(t *testing.T, queue *memoryQueue) (keys *[]string, failing *bool) {
+	previousQueue, previousBus := invoiceRequests, bus
+	t.Cleanup(func() { invoiceRequests, bus = previousQueue, previousBus })
+
+	keys, failing = &[]string{}, new(bool)
+	memory := NewMemoryBus()
+	for _, eventType := range []string{eventTaskCompleted, eventInvoiceRequested} {
+		memory.Subscribe(eventType, func(ctx context.Context, event Event) error {
+			if *failing {
+				return errors.New("billing unavailable")
+			}
+			var data TaskInvoiceEvent
+			if err := json.Unmarshal(event.Data, &data); err != nil {
+				return err
+			}
+			*keys = append(*keys, data.IdempotencyKey)
+			return nil
+		})
+	}
+	invoiceRequests, bus = queue, memory
+	return keys, failing
+}
+
+func TestRelayPendingInvoices(t *testing.T) {
+	past := time.Now().UTC().Add(-time.Minute)
+	billed := &InvoiceRequest{ID: primitive.NewObjectID(), Event: eventTaskCompleted, IdempotencyKey: "billed", Hours: 2, Status: invoicePending, NextAttemptAt: past}
+	announced := &InvoiceRequest{ID: primitive.NewObjectID(), Event: eventTaskCompleted, IdempotencyKey: "announced", Status: invoicePending, NextAttemptAt: past}
+	later := &InvoiceRequest{ID: primitive.NewObjectID(), Event: eventInvoiceRequested, IdempotencyKey: "later", Hours: 1, Status: invoicePending, NextAttemptAt: past.Add(time.Hour)}
+	delivered := &InvoiceRequest{ID: primitive.NewObjectID(), Event: eventInvoiceRequested, IdempotencyKey: "delivered", Hours: 1, Status: invoiceDelivered, NextAttemptAt: past}
+	queue := &memoryQueue{requests: []*InvoiceRequest{billed, announced, later, delivered}}
+	keys, _ := useMemoryRelay(t, queue)
+
+	published, err := relayPendingInvoices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published != 2 || len(*keys) != 2 || (*keys)[0] != "billed" || (*keys)[1] != "announced" {
+		t.Fatalf("Want the due requests published oldest first, Got %d: %v", published, *keys)
+	}
+	// A request with hours waits for InvoiceIssued; one without is done
+	if billed.Status != invoicePending || billed.Attempts != 1 || billed.NextAttemptAt.Before(time.Now().Add(invoiceRepublish-time.Minute)) {
+		t.Errorf("Billed: Want it pending until republishing, Got %+v", billed)
+	}
+	if announced.Status != invoiceDelivered || announced.DeliveredAt == nil {
+		t.Errorf("Announced: Want it delivered, Got %+v", announced)
+	}
+	if later.Attempts != 0 || delivered.Attempts != 0 {
+		t.Errorf("Want requests not due left alone, Got %d and %d attempts", later.Attempts, delivered.Attempts)
+	}
+
+	// Claimed and published requests are hidden from the next round
+	if published, err := relayPendingInvoices(); err != nil || published != 0 {
+		t.Errorf("Second round: Want nothing published, Got %d, %v", published, err)
+	}
+}
+
+func TestRelayRetriesFailedInvoices(t *testing.T) {
+	request := &InvoiceRequest{ID: primitive.NewObjectID(), Event: eventInvoiceRequested, IdempotencyKey: "key-1", Hours: 2, Status: invoicePending, NextAttemptAt: time.Now().UTC()}
+	queue := &memoryQueue{requests: []*InvoiceRequest{request}}
+	keys, failing := useMemoryRelay(t, queue)
+
+	*failing = true
+	if published, _ := relayPendingInvoices(); published != 0 {
+		t.Fatalf("Want nothing published while billing fails, Got %d", published)
+	}
+	if request.Status != invoicePending || request.Attempts != 1 || request.LastError == "" {
+		t.Errorf("Want the failure recorded on the pending request, Got %+v", request)
+	}
+	if wait := time.Until(request.NextAttemptAt); wait <= 0 || wait > retryDelay(1) {
+		t.Errorf("Want a retry within %v, Got one in %v", retryDelay(1), wait)
+	}
+	if published, _ := relayPendingInvoices(); published != 0 {
+		t.Errorf("Want no retry before its time, Got %d published", published)
+	}
+
+	*failing = false
+	request.NextAttemptAt = time.Now().UTC()
+	if published, _ := relayPendingInvoices(); published != 1 {
+		t.Fatalf("Want the retry published, Got %d", published)
+	}
+	if request.Attempts != 2 || request.LastError != "" || len(*keys) != 1 || (*keys)[0] != "key-1" {
+		t.Errorf("Want the second attempt published with its idempotency key, Got %+v and %v", request, *keys)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// handleUserDeleted removes a deleted user from task-service: their tasks are
+// reassigned, unassigned or deleted as the deletion asks, and their time entries,
+// comments, history and queued invoices are kept without the user's ID. It reports
+// what changed with UserDataPurged. Every step can be repeated safely.
+func handleUserDeleted(ctx context.Context, event Event) error {
+	var deleted UserDeletedEvent
+	if err := json.Unmarshal(event.Data, &deleted); err != nil {
+		log.Printf("Ignoring malformed %s event %s: %v", event.Type, event.ID, err)
+		return nil
+	}
+	userID := deleted.UserID
+	users.Forget(userID)
+	changes := map[string]int64{}
+	tasks := client.Database("taskmanagement").Collection("tasks")
+
+	assignee := primitive.NilObjectID
+	switch {
+	case deleted.TaskPolicy == "reassign" && deleted.ReassignTo != nil:
+		assignee = *deleted.ReassignTo
+		result, err := tasks.UpdateMany(ctx, bson.M{"assigned_to": userID}, bson.M{"$set": bson.M{"assigned_to": assignee, "updated_at": time.Now().UTC()}, "$inc": bson.M{"version": 1}})
+		if err != nil {
+			return err
+		}
+		changes["tasks_reassigned"] = result.ModifiedCount
+	case deleted.TaskPolicy == "delete":
+		cursor, err := tasks.Find(ctx, bson.M{"assigned_to": userID})
+		if err != nil {
+			return err
+		}
+		var owned []Task
+		err = cursor.All(ctx, &owned)
+		cursor.Close(ctx)
+		if err != nil {
+			return err
+		}
+		for _, task := range owned {
+			if _, err := tasks.DeleteOne(ctx, bson.M{"_id": task.ID}); err != nil {
+				return err
+			}
+			// Keep the scheduler from recreating a removed occurrence
+			excludeOccurrence(task)
+			result, err := timeEntries().DeleteMany(ctx, bson.M{"task_id": task.ID})
+			if err != nil {
+				return err
+			}
+			changes["tasks_deleted"]++
+			changes["time_entries_deleted"] += result.DeletedCount
+		}
+	default:
+		result, err := tasks.UpdateMany(ctx, bson.M{"assigned_to": userID}, bson.M{"$set": bson.M{"assigned_to": assignee, "updated_at": time.Now().UTC()}, "$inc": bson.M{"version": 1}})
+		if err != nil {
+			return err
+		}
+		changes["tasks_anonymized"] = result.ModifiedCount
+	}
+
+	// Later occurrences of the user's recurring tasks follow the same policy
+	result, err := taskSeries().UpdateMany(ctx, bson.M{"template.assigned_to": userID}, bson.M{"$set": bson.M{"template.assigned_to": assignee}})
+	if err != nil {
+		return err
+	}
+	changes["series_updated"] = result.ModifiedCount
+
+	// A feed has nothing left to show once its user is gone
+	deletedFeeds, err := calendarFeeds().DeleteMany(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return err
+	}
+	changes["calendar_feeds_deleted"] = deletedFeeds.DeletedCount
+
+	// Work and discussion stay on the tasks, without saying who it was
+	anonymize := []struct {
+		change     string
+		collection *mongo.Collection
+		filter     bson.M
+		update     bson.M
+	}{
+		{"time_entries_anonymized", timeEntries(), bson.M{"user_id": userID}, bson.M{"$set": bson.M{"user_id": primitive.NilObjectID}}},
+		{"comments_anonymized", comments(), bson.M{"author_id": userID}, bson.M{"$set": bson.M{"author_id": primitive.NilObjectID}}},
+		{"activity_anonymized", activities(), bson.M{"actor_id": userID}, bson.M{"$unset": bson.M{"actor_id": ""}}},
+		{"invoice_requests_anonymized", invoiceOutbox(), bson.M{"user_id": userID}, bson.M{"$set": bson.M{"user_id": primitive.NilObjectID}}},
+	}
+	for _, step := range anonymize {
+		result, err := step.collection.UpdateMany(ctx, step.filter, step.update)
+		if err != nil {
+			return err
+		}
+		changes[step.change] = result.ModifiedCount
+	}
+
+	log.Printf("Purged user %s from tasks: %v", userID.Hex(), changes)
+	report, err := newEvent("purge-"+deleted.DeletionID.Hex()+"-task-service", eventUserDataPurged, UserDataPurgedEvent{
+		DeletionID: deleted.DeletionID,
+		UserID:     userID,
+		Service:    "task-service",
+		Changes:    changes,
+	})
+	if err != nil {
+		return err
+	}
+	return bus.Publish(ctx, report)
+}
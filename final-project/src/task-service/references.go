@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Header and secret other services use to call internal endpoints.
+const (
+	internalServiceHeader = "X-Internal-Service"
+	internalServiceSecret = "your-internal-service-secret" // You should store and retrieve this securely
+)
+
+// lookupClient checks that an entity exists in another service. Entities found
+// are cached for the client's TTL; missing ones are always asked again, since
+// they may have been created since.
+type lookupClient struct {
+	name    string
+	baseURL string
+	path    string
+	ttl     time.Duration
+	http    *http.Client
+
+	mu    sync.Mutex
+	found map[primitive.ObjectID]time.Time
+}
+
+func newLookupClient(name, baseURL, path string, ttl time.Duration) *lookupClient {
+	return &lookupClient{
+		name:    name,
+		baseURL: baseURL,
+		path:    path,
+		ttl:     ttl,
+		http:    &http.Client{Timeout: 5 * time.Second},
+		found:   map[primitive.ObjectID]time.Time{},
+	}
+}
+
+// users looks up user IDs in user-service.
+var users *lookupClient
+
+var errLookupUnavailable = errors.New("service unavailable")
+
+// newUserLookup returns a client for USER_SERVICE_URL (default http://user-service:8001)
+// caching users for REFERENCE_CACHE_TTL (default 1m).
+func newUserLookup() *lookupClient {
+	baseURL := os.Getenv("USER_SERVICE_URL")
+	if baseURL == "" {
+		baseURL = "http://user-service:8001"
+	}
+	ttl, err := time.ParseDuration(os.Getenv("REFERENCE_CACHE_TTL"))
+	if err != nil || ttl < 0 {
+		ttl = time.Minute
+	}
+	return newLookupClient("user", baseURL, "/users/lookup/", ttl)
+}
+
+// Exists reports whether the entity exists. An error means the other service
+// could not answer.
+func (c *lookupClient) Exists(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	c.mu.Lock()
+	expires, ok := c.found[id]
+	c.mu.Unlock()
+	if ok && time.Now().Before(expires) {
+		return true, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+c.path+id.Hex(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(internalServiceHeader, internalServiceSecret)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", errLookupUnavailable, err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		c.mu.Lock()
+		c.found[id] = time.Now().Add(c.ttl)
+		c.mu.Unlock()
+		return true, nil
+	case http.StatusNotFound:
+		c.Forget(id)
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: %s lookup of %s returned status %d", errLookupUnavailable, c.name, id.Hex(), resp.StatusCode)
+}
+
+// Resolve returns the ID of the entity with the given name, e.g. a username, and
+// whether it exists. An error means the other service could not answer.
+func (c *lookupClient) Resolve(ctx context.Context, name string) (primitive.ObjectID, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+c.path+"?username="+url.QueryEscape(name), nil)
+	if err != nil {
+		return primitive.NilObjectID, false, err
+	}
+	req.Header.Set(internalServiceHeader, internalServiceSecret)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return primitive.NilObjectID, false, fmt.Errorf("%w: %v", errLookupUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var found struct {
+			ID primitive.ObjectID `json:"id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+			return primitive.NilObjectID, false, fmt.Errorf("%w: %s lookup of %q: %v", errLookupUnavailable, c.name, name, err)
+		}
+		c.mu.Lock()
+		c.found[found.ID] = time.Now().Add(c.ttl)
+		c.mu.Unlock()
+		return found.ID, true, nil
+	case http.StatusNotFound:
+		return primitive.NilObjectID, false, nil
+	}
+	return primitive.NilObjectID, false, fmt.Errorf("%w: %s lookup of %q returned status %d", errLookupUnavailable, c.name, name, resp.StatusCode)
+}
+
+// Forget drops the entity from the cache, e.g. once it has been deleted.
+func (c *lookupClient) Forget(id primitive.ObjectID) {
+	c.mu.Lock()
+	delete(c.found, id)
+	c.mu.Unlock()
+}
+
+// checkReferences returns a not_found error for each user or parent task that
+// fields refer to but doesn't exist. fields holds values by field name as they are
+// stored, with custom fields under "custom_fields.<key>"; ObjectIDs in assigned_to,
+// user_id and custom fields are users. Unset (zero) IDs are skipped. An error
+// means a reference couldn't be checked.
+func checkReferences(ctx context.Context, fields bson.M) (ValidationError, error) {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs ValidationError
+	for _, key := range keys {
+		id, ok := fields[key].(primitive.ObjectID)
+		if !ok || id.IsZero() {
+			continue
+		}
+		switch {
+		case key == "parent_task":
+			count, err := client.Database("taskmanagement").Collection("tasks").CountDocuments(ctx, bson.M{"_id": id})
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				errs = append(errs, FieldError{Field: key, Code: "not_found", Message: "task " + id.Hex() + " does not exist"})
+			}
+		case key == "assigned_to" || key == "user_id" || strings.HasPrefix(key, "custom_fields."):
+			exists, err := users.Exists(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				errs = append(errs, FieldError{Field: key, Code: "not_found", Message: "user " + id.Hex() + " does not exist"})
+			}
+		}
+	}
+	return errs, nil
+}
+
+// writeReferenceError answers a request whose references couldn't be checked.
+func writeReferenceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errLookupUnavailable) {
+		http.Error(w, "User service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Database query error", http.StatusInternalServerError)
+}
+
+// lookupTask answers other services' checks that a task exists, with what
+// billing-service needs to pick its rate and to place it in the task hierarchy.
+func lookupTask(w http.ResponseWriter, req *http.Request) {
+	taskID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/tasks/lookup/"):])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	var task Task
+	err = client.Database("taskmanagement").Collection("tasks").FindOne(context.TODO(), bson.M{"_id": taskID}).Decode(&task)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+
+	projectID, err := projectOf(req.Context(), task)
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID           primitive.ObjectID  `json:"id"`
+		Title        string              `json:"title"`
+		Organization string              `json:"organization,omitempty"`
+		ProjectID    primitive.ObjectID  `json:"project_id"`
+		ParentTask   *primitive.ObjectID `json:"parent_task,omitempty"`
+	}{task.ID, task.Title, task.Organization, projectID, task.ParentTask})
+}
+
+// projectOf returns the project a task is billed to: the task at the top of its
+// tree, or the task itself when it has no parent.
+func projectOf(ctx context.Context, task Task) (primitive.ObjectID, error) {
+	if task.ParentTask == nil {
+		return task.ID, nil
+	}
+	ancestors, err := taskAncestors(ctx, task)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return projectRoot(task, ancestors), nil
+}
+
+// taskAncestors returns the tasks above task, however far up, in no order.
+func taskAncestors(ctx context.Context, task Task) ([]Task, error) {
+	if task.ParentTask == nil {
+		return nil, nil
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"_id": task.ID}}},
+		{{Key: "$graphLookup", Value: bson.M{
+			"from":             "tasks",
+			"startWith":        "$parent_task",
+			"connectFromField": "parent_task",
+			"connectToField":   "_id",
+			"as":               "ancestors",
+		}}},
+		{{Key: "$project", Value: bson.M{"ancestors._id": 1, "ancestors.parent_task": 1}}},
+	}
+	cursor, err := client.Database("taskmanagement").Collection("tasks").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var found []struct {
+		Ancestors []Task `bson:"ancestors"`
+	}
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+	return found[0].Ancestors, nil
+}
+
+// projectRoot follows the parents of task through ancestors up to the top. A
+// parent that no longer exists, or that was passed before, ends the walk.
+func projectRoot(task Task, ancestors []Task) primitive.ObjectID {
+	byID := make(map[primitive.ObjectID]Task, len(ancestors))
+	for _, ancestor := range ancestors {
+		byID[ancestor.ID] = ancestor
+	}
+	seen := map[primitive.ObjectID]bool{task.ID: true}
+	root := task
+	for root.ParentTask != nil {
+		parent, ok := byID[*root.ParentTask]
+		if !ok || seen[parent.ID] {
+			break
+		}
+		seen[parent.ID] = true
+		root = parent
+	}
+	return root.ID
+}
+
+// taskSubtree answers billing-service's budgets with the IDs of a task and of
+// all tasks below it, however deep.
+func taskSubtree(w http.ResponseWriter, req *http.Request) {
+	taskID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/tasks/subtree/"):])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"_id": taskID}}},
+		{{Key: "$graphLookup", Value: bson.M{
+			"from":             "tasks",
+			"startWith":        "$_id",
+			"connectFromField": "_id",
+			"connectToField":   "parent_task",
+			"as":               "descendants",
+		}}},
+		{{Key: "$project", Value: bson.M{"descendants._id": 1}}},
+	}
+	cursor, err := client.Database("taskmanagement").Collection("tasks").Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+	var found []struct {
+		Descendants []struct {
+			ID primitive.ObjectID `bson:"_id"`
+		} `bson:"descendants"`
+	}
+	if err := cursor.All(context.TODO(), &found); err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+	if len(found) == 0 {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	ids := []primitive.ObjectID{taskID}
+	for _, descendant := range found[0].Descendants {
+		if descendant.ID != taskID {
+			ids = append(ids, descendant.ID)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		TaskID  primitive.ObjectID   `json:"task_id"`
+		TaskIDs []primitive.ObjectID `json:"task_ids"`
+	}{taskID, ids})
+}
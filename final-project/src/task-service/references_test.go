@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLookupClient(t *testing.T) {
+	existing := primitive.NewObjectID()
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if req.Header.Get(internalServiceHeader) != internalServiceSecret {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/users/lookup/" + existing.Hex():
+			w.WriteHeader(http.StatusOK)
+		case "/users/lookup/" + primitive.NilObjectID.Hex():
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+		default:
+			http.Error(w, "User not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	lookup := newLookupClient("user", server.URL, "/users/lookup/", time.Minute)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if exists, err := lookup.Exists(ctx, existing); err != nil || !exists {
+			t.Errorf("Existing user: Want true, Got %v (%v)", exists, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Found users should be cached: Want 1 call, Got %d", calls)
+	}
+
+	missing := primitive.NewObjectID()
+	for i := 0; i < 2; i++ {
+		if exists, err := lookup.Exists(ctx, missing); err != nil || exists {
+			t.Errorf("Missing user: Want false, Got %v (%v)", exists, err)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("Missing users should not be cached: Want 3 calls, Got %d", calls)
+	}
+
+	lookup.Forget(existing)
+	lookup.Exists(ctx, existing)
+	if calls != 4 {
+		t.Errorf("Forgotten users should be looked up again: Want 4 calls, Got %d", calls)
+	}
+
+	if _, err := lookup.Exists(ctx, primitive.NilObjectID); !errors.Is(err, errLookupUnavailable) {
+		t.Errorf("Server error: Want errLookupUnavailable, Got %v", err)
+	}
+
+	server.Close()
+	if _, err := lookup.Exists(ctx, primitive.NewObjectID()); !errors.Is(err, errLookupUnavailable) {
+		t.Errorf("Unreachable service: Want errLookupUnavailable, Got %v", err)
+	}
+	if _, _, err := lookup.Resolve(ctx, "alice"); !errors.Is(err, errLookupUnavailable) {
+		t.Errorf("Unreachable resolve: Want errLookupUnavailable, Got %v", err)
+	}
+}
+
+func TestProjectRoot(t *testing.T) {
+	id := func() *primitive.ObjectID {
+		id := primitive.NewObjectID()
+		return &id
+	}
+	project, phase, step, gone := id(), id(), id(), id()
+	tasks := map[string]Task{
+		"project": {ID: *project},
+		"phase":   {ID: *phase, ParentTask: project},
+		"step":    {ID: *step, ParentTask: phase},
+	}
+	ancestors := []Task{tasks["phase"], tasks["project"]}
+	orphan := Task{ID: *id(), ParentTask: gone}
+
+	tests := []struct {
+		name      string
+		task      Task
+		ancestors []Task
+		want      primitive.ObjectID
+	}{
+		{"top task", tasks["project"], nil, *project},
+		{"child", tasks["phase"], ancestors, *project},
+		{"grandchild", tasks["step"], ancestors, *project},
+		{"ancestors in any order", tasks["step"], []Task{tasks["project"], tasks["phase"]}, *project},
+		{"deleted parent", orphan, nil, orphan.ID},
+		{"deleted grandparent", Task{ID: *step, ParentTask: phase}, []Task{{ID: *phase, ParentTask: gone}}, *phase},
+	}
+	for _, tc := range tests {
+		if got := projectRoot(tc.task, tc.ancestors); got != tc.want {
+			t.Errorf("%s: Want %s, Got %s", tc.name, tc.want.Hex(), got.Hex())
+		}
+	}
+
+	// Parents that point back at each other end the walk instead of looping
+	a, b := id(), id()
+	cycle := []Task{{ID: *a, ParentTask: b}, {ID: *b, ParentTask: a}}
+	if got := projectRoot(Task{ID: *step, ParentTask: a}, cycle); got != *b {
+		t.Errorf("Cycle: Want %s, Got %s", b.Hex(), got.Hex())
+	}
+	if got := projectRoot(Task{ID: *a, ParentTask: a}, []Task{{ID: *a, ParentTask: a}}); got != *a {
+		t.Errorf("Own parent: Want %s, Got %s", a.Hex(), got.Hex())
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecurrenceRule is the subset of an RFC 5545 RRULE supported for recurring tasks:
+// FREQ (DAILY, WEEKLY, MONTHLY, YEARLY), INTERVAL, COUNT, UNTIL, BYDAY without
+// ordinals (WEEKLY and MONTHLY) and BYMONTHDAY (MONTHLY).
+type RecurrenceRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time
+	ByDay      []time.Weekday
+	ByMonthDay []int
+}
+
+var rruleWeekdays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+// maxRecurrencePeriods bounds how many periods an expansion walks through, so a
+// rule that never matches (e.g. BYMONTHDAY=31 with FREQ=MONTHLY;INTERVAL=12 from February) terminates.
+const maxRecurrencePeriods = 10000
+
+// parseRRule parses a rule such as "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH;COUNT=10".
+// An optional "RRULE:" prefix is accepted.
+func parseRRule(s string) (RecurrenceRule, error) {
+	rule := RecurrenceRule{Interval: 1}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return rule, fmt.Errorf("empty rule")
+	}
+
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return rule, fmt.Errorf("invalid rule part %q", part)
+		}
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			switch strings.ToUpper(value) {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				rule.Freq = strings.ToUpper(value)
+			default:
+				return rule, fmt.Errorf("unsupported FREQ %q", value)
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return rule, fmt.Errorf("invalid INTERVAL %q", value)
+			}
+			rule.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return rule, fmt.Errorf("invalid COUNT %q", value)
+			}
+			rule.Count = n
+		case "UNTIL":
+			until, err := parseRRuleTime(value)
+			if err != nil {
+				return rule, fmt.Errorf("invalid UNTIL %q", value)
+			}
+			rule.Until = until
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				weekday, ok := rruleWeekdays[strings.ToUpper(day)]
+				if !ok {
+					return rule, fmt.Errorf("unsupported BYDAY %q", day)
+				}
+				rule.ByDay = append(rule.ByDay, weekday)
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(day)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return rule, fmt.Errorf("invalid BYMONTHDAY %q", day)
+				}
+				rule.ByMonthDay = append(rule.ByMonthDay, n)
+			}
+		default:
+			return rule, fmt.Errorf("unsupported rule part %q", key)
+		}
+	}
+
+	if rule.Freq == "" {
+		return rule, fmt.Errorf("FREQ is required")
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return rule, fmt.Errorf("COUNT and UNTIL cannot both be set")
+	}
+	if len(rule.ByDay) > 0 && rule.Freq != "WEEKLY" && rule.Freq != "MONTHLY" {
+		return rule, fmt.Errorf("BYDAY is only supported with FREQ=WEEKLY or FREQ=MONTHLY")
+	}
+	if len(rule.ByMonthDay) > 0 && rule.Freq != "MONTHLY" {
+		return rule, fmt.Errorf("BYMONTHDAY is only supported with FREQ=MONTHLY")
+	}
+	if len(rule.ByDay) > 0 && len(rule.ByMonthDay) > 0 {
+		return rule, fmt.Errorf("BYDAY and BYMONTHDAY cannot be combined")
+	}
+	return rule, nil
+}
+
+func parseRRuleTime(value string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102", time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// Occurrences returns the start times generated from dtstart that fall in [from, to).
+// COUNT is counted from dtstart, so occurrences before from still use up the count.
+func (r RecurrenceRule) Occurrences(dtstart, from, to time.Time) []time.Time {
+	var result []time.Time
+	n := 0
+	for period := 0; period < maxRecurrencePeriods; period++ {
+		for _, t := range r.periodCandidates(dtstart, period) {
+			if t.Before(dtstart) {
+				continue
+			}
+			if !r.Until.IsZero() && t.After(r.Until) {
+				return result
+			}
+			if !t.Before(to) {
+				return result
+			}
+			n++
+			if r.Count > 0 && n > r.Count {
+				return result
+			}
+			if !t.Before(from) {
+				result = append(result, t)
+			}
+		}
+	}
+	return result
+}
+
+// periodCandidates returns the sorted candidate times in the period'th interval after dtstart.
+func (r RecurrenceRule) periodCandidates(dtstart time.Time, period int) []time.Time {
+	y, m, d := dtstart.Date()
+	hh, mm, ss := dtstart.Clock()
+	loc := dtstart.Location()
+	step := period * r.Interval
+
+	var candidates []time.Time
+	switch r.Freq {
+	case "DAILY":
+		candidates = append(candidates, dtstart.AddDate(0, 0, step))
+	case "WEEKLY":
+		if len(r.ByDay) == 0 {
+			candidates = append(candidates, dtstart.AddDate(0, 0, 7*step))
+			break
+		}
+		// Weeks start on Monday, as RFC 5545's default WKST
+		offset := (int(dtstart.Weekday()) + 6) % 7
+		monday := time.Date(y, m, d-offset+7*step, hh, mm, ss, 0, loc)
+		for _, weekday := range r.ByDay {
+			candidates = append(candidates, monday.AddDate(0, 0, (int(weekday)+6)%7))
+		}
+	case "MONTHLY":
+		first := time.Date(y, m+time.Month(step), 1, hh, mm, ss, 0, loc)
+		days := daysIn(first)
+		switch {
+		case len(r.ByDay) > 0:
+			for day := 1; day <= days; day++ {
+				t := first.AddDate(0, 0, day-1)
+				for _, weekday := range r.ByDay {
+					if t.Weekday() == weekday {
+						candidates = append(candidates, t)
+					}
+				}
+			}
+		case len(r.ByMonthDay) > 0:
+			for _, day := range r.ByMonthDay {
+				if day < 0 {
+					day = days + day + 1
+				}
+				if day >= 1 && day <= days {
+					candidates = append(candidates, first.AddDate(0, 0, day-1))
+				}
+			}
+		default:
+			// Months without dtstart's day (e.g. the 31st) are skipped, as RFC 5545 requires
+			if d <= days {
+				candidates = append(candidates, first.AddDate(0, 0, d-1))
+			}
+		}
+	case "YEARLY":
+		first := time.Date(y+step, m, 1, hh, mm, ss, 0, loc)
+		if d <= daysIn(first) {
+			candidates = append(candidates, first.AddDate(0, 0, d-1))
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	return candidates
+}
+
+// daysIn returns the number of days in t's month.
+func daysIn(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRRule(t *testing.T) {
+	invalid := []string{"", "INTERVAL=2", "FREQ=HOURLY", "FREQ=DAILY;BYDAY=MO", "FREQ=WEEKLY;BYDAY=1MO", "FREQ=DAILY;COUNT=2;UNTIL=20240101"}
+	for _, s := range invalid {
+		if _, err := parseRRule(s); err == nil {
+			t.Errorf("parseRRule(%q) should fail", s)
+		}
+	}
+
+	rule, err := parseRRule("RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH;COUNT=5")
+	if err != nil {
+		t.Fatalf("parseRRule failed: %v", err)
+	}
+	if rule.Freq != "WEEKLY" || rule.Interval != 2 || rule.Count != 5 || len(rule.ByDay) != 2 {
+		t.Errorf("Unexpected rule %+v", rule)
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	tests := []struct {
+		rule    string
+		dtstart time.Time
+		from    time.Time
+		to      time.Time
+		want    []string
+	}{
+		{
+			// COUNT is counted from dtstart even when the window starts later
+			rule:    "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH;COUNT=5",
+			dtstart: time.Date(2024, 4, 4, 9, 0, 0, 0, time.UTC), // Thursday
+			from:    time.Date(2024, 4, 16, 0, 0, 0, 0, time.UTC),
+			to:      time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC),
+			want:    []string{"2024-04-18", "2024-04-29", "2024-05-02"},
+		},
+		{
+			// Months without a 31st are skipped
+			rule:    "FREQ=MONTHLY;COUNT=3",
+			dtstart: time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC),
+			from:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:      time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:    []string{"2024-01-31", "2024-03-31", "2024-05-31"},
+		},
+		{
+			rule:    "FREQ=MONTHLY;BYMONTHDAY=1,-1;UNTIL=20240301T000000Z",
+			dtstart: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			from:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:      time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:    []string{"2024-01-01", "2024-01-31", "2024-02-01", "2024-02-29", "2024-03-01"},
+		},
+		{
+			rule:    "FREQ=DAILY;INTERVAL=3",
+			dtstart: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			from:    time.Date(2024, 4, 5, 0, 0, 0, 0, time.UTC),
+			to:      time.Date(2024, 4, 12, 0, 0, 0, 0, time.UTC),
+			want:    []string{"2024-04-07", "2024-04-10"},
+		},
+	}
+
+	for _, test := range tests {
+		rule, err := parseRRule(test.rule)
+		if err != nil {
+			t.Fatalf("parseRRule(%q) failed: %v", test.rule, err)
+		}
+		var got []string
+		for _, occurrence := range rule.Occurrences(test.dtstart, test.from, test.to) {
+			got = append(got, occurrence.Format("2006-01-02"))
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: Want %v, Got %v", test.rule, test.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: Want %v, Got %v", test.rule, test.want, got)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TaskSeries is a recurring task. Template holds the fields copied to every
+// occurrence; its StartDate is the series' DTSTART and EndDate-StartDate the
+// duration of each occurrence. ExDates are occurrences removed by the user,
+// which the scheduler must not create again.
+type TaskSeries struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Template  Task               `bson:"template" json:"template"`
+	RRule     string             `bson:"rrule" json:"rrule"`
+	ExDates   []time.Time        `bson:"exdates,omitempty" json:"exdates,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func taskSeries() *mongo.Collection {
+	return client.Database("taskmanagement").Collection("task_series")
+}
+
+// ensureSeriesIndexes makes occurrence creation idempotent: a series can hold at
+// most one task per occurrence date, however many schedulers race on it.
+func ensureSeriesIndexes() error {
+	_, err := client.Database("taskmanagement").Collection("tasks").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "series_id", Value: 1}, {Key: "occurrence_date", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+			"series_id": bson.M{"$exists": true},
+		}),
+	})
+	return err
+}
+
+// recurrenceHorizon is how far ahead occurrences are created, from TASK_RECURRENCE_HORIZON_DAYS (default 30).
+func recurrenceHorizon() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("TASK_RECURRENCE_HORIZON_DAYS"))
+	if err != nil || days < 1 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// runRecurrenceScheduler materializes upcoming occurrences for every series on
+// startup and then every TASK_SCHEDULER_INTERVAL (default 1h).
+func runRecurrenceScheduler() {
+	interval, err := time.ParseDuration(os.Getenv("TASK_SCHEDULER_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = time.Hour
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if created, err := materializeAllSeries(); err != nil {
+			log.Printf("Recurrence scheduler failed: %v", err)
+		} else if created > 0 {
+			log.Printf("Recurrence scheduler created %d task(s)", created)
+		}
+		<-ticker.C
+	}
+}
+
+func materializeAllSeries() (int, error) {
+	cursor, err := taskSeries().Find(context.TODO(), bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	var allSeries []TaskSeries
+	if err := cursor.All(context.Background(), &allSeries); err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, series := range allSeries {
+		created, err := materializeSeries(series, time.Now().UTC())
+		if err != nil {
+			log.Printf("Failed to materialize series %s: %v", series.ID.Hex(), err)
+			continue
+		}
+		total += created
+	}
+	return total, nil
+}
+
+// materializeSeries creates the series' occurrences that start between now and the
+// recurrence horizon and don't exist yet. It returns how many tasks were created.
+func materializeSeries(series TaskSeries, now time.Time) (int, error) {
+	rule, err := parseRRule(series.RRule)
+	if err != nil {
+		return 0, err
+	}
+
+	collection := client.Database("taskmanagement").Collection("tasks")
+	duration := series.Template.EndDate.Sub(series.Template.StartDate)
+	created := 0
+	for _, start := range rule.Occurrences(series.Template.StartDate, now, now.Add(recurrenceHorizon())) {
+		if isExDate(series, start) {
+			continue
+		}
+
+		occurrence := series.Template
+		occurrence.ID = primitive.NewObjectID()
+		occurrence.StartDate = start
+		occurrence.EndDate = start.Add(duration)
+		occurrence.SeriesID = &series.ID
+		occurrence.OccurrenceDate = &start
+		occurrence.Version = 1
+		occurrence.UpdatedAt = &now
+
+		// $setOnInsert leaves an existing occurrence, including one edited on its own, untouched
+		filter := bson.M{"series_id": series.ID, "occurrence_date": start}
+		result, err := collection.UpdateOne(context.TODO(), filter, bson.M{"$setOnInsert": occurrence}, options.Update().SetUpsert(true))
+		if err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+			return created, err
+		}
+		if result.UpsertedCount > 0 {
+			created++
+		}
+	}
+	return created, nil
+}
+
+func isExDate(series TaskSeries, t time.Time) bool {
+	for _, exdate := range series.ExDates {
+		if exdate.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeOccurrence records a removed occurrence on its series so it isn't recreated.
+func excludeOccurrence(task Task) {
+	if task.SeriesID == nil || task.OccurrenceDate == nil {
+		return
+	}
+	_, err := taskSeries().UpdateOne(context.TODO(), bson.M{"_id": *task.SeriesID}, bson.M{"$addToSet": bson.M{"exdates": *task.OccurrenceDate}})
+	if err != nil {
+		log.Printf("Failed to exclude occurrence %s from series %s: %v", task.OccurrenceDate, task.SeriesID.Hex(), err)
+	}
+}
+
+func createSeries(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to create task series")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var input struct {
+		Task
+		RRule string `json:"rrule"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, err := parseRRule(input.RRule); err != nil {
+		http.Error(w, "Invalid rrule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if input.Task.StartDate.IsZero() || input.Task.EndDate.Before(input.Task.StartDate) {
+		http.Error(w, "start_date is required and must not be after end_date", http.StatusBadRequest)
+		return
+	}
+	// Occurrences are completed one by one, so each is billed
+	if input.Task.Status == "done" {
+		writeValidationError(w, ValidationError{{Field: "status", Code: "invalid_value", Message: "occurrences cannot be created done"}})
+		return
+	}
+	referenceErrs, err := checkReferences(req.Context(), bson.M{"assigned_to": input.Task.AssignedTo})
+	if err != nil {
+		writeReferenceError(w, err)
+		return
+	}
+	if len(referenceErrs) > 0 {
+		writeValidationError(w, referenceErrs)
+		return
+	}
+
+	series := TaskSeries{
+		ID:        primitive.NewObjectID(),
+		Template:  input.Task,
+		RRule:     input.RRule,
+		CreatedAt: time.Now().UTC(),
+	}
+	series.Template.ID = primitive.NilObjectID
+
+	if _, err := taskSeries().InsertOne(context.TODO(), series); err != nil {
+		http.Error(w, "Failed to create task series", http.StatusInternalServerError)
+		return
+	}
+	if _, err := materializeSeries(series, time.Now().UTC()); err != nil {
+		log.Printf("Failed to materialize series %s: %v", series.ID.Hex(), err)
+	}
+
+	log.Printf("Task series created successfully: %+v", series)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+func listSeries(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to list task series")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cursor, err := taskSeries().Find(context.TODO(), bson.M{})
+	if err != nil {
+		http.Error(w, "Failed to list task series", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	allSeries := []TaskSeries{}
+	if err := cursor.All(context.Background(), &allSeries); err != nil {
+		http.Error(w, "Failed to decode task series", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(allSeries)
+}
+
+func getSeries(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to get task series")
+
+	seriesID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/tasks/series/get/"):])
+	if err != nil {
+		http.Error(w, "Invalid series ID", http.StatusBadRequest)
+		return
+	}
+
+	var series TaskSeries
+	if err := taskSeries().FindOne(context.TODO(), bson.M{"_id": seriesID}).Decode(&series); err != nil {
+		http.Error(w, "Task series not found", http.StatusNotFound)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "occurrence_date", Value: 1}})
+	cursor, err := client.Database("taskmanagement").Collection("tasks").Find(context.TODO(), bson.M{"series_id": seriesID}, opts)
+	if err != nil {
+		http.Error(w, "Failed to list occurrences", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	occurrences := []Task{}
+	if err := cursor.All(context.Background(), &occurrences); err != nil {
+		http.Error(w, "Failed to decode occurrences", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Series      TaskSeries `json:"series"`
+		Occurrences []Task     `json:"occurrences"`
+	}{
+		Series:      series,
+		Occurrences: occurrences,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// updateSeries edits the whole series. Template field changes are applied to
+// upcoming occurrences that haven't been edited on their own; changing the rule
+// or the dates replaces those occurrences with newly generated ones. The status
+// can't be changed for the whole series.
+func updateSeries(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to update task series")
+
+	if req.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seriesID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/tasks/series/update/"):])
+	if err != nil {
+		http.Error(w, "Invalid series ID", http.StatusBadRequest)
+		return
+	}
+
+	var input struct {
+		Title       *string             `json:"title"`
+		Description *string             `json:"description"`
+		AssignedTo  *primitive.ObjectID `json:"assigned_to"`
+		Status      *string             `json:"status"`
+		Hours       *float64            `json:"hours"`
+		StartDate   *time.Time          `json:"start_date"`
+		EndDate     *time.Time          `json:"end_date"`
+		RRule       *string             `json:"rrule"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// Completing occurrences bills them and checks budgets, which only the task
+	// update does
+	if input.Status != nil {
+		writeValidationError(w, ValidationError{{Field: "status", Code: "immutable", Message: "change the status of each occurrence with the task update"}})
+		return
+	}
+
+	var series TaskSeries
+	if err := taskSeries().FindOne(context.TODO(), bson.M{"_id": seriesID}).Decode(&series); err != nil {
+		http.Error(w, "Task series not found", http.StatusNotFound)
+		return
+	}
+
+	// Fields copied onto upcoming occurrences
+	fields := bson.M{}
+	if input.Title != nil {
+		series.Template.Title = *input.Title
+		fields["title"] = *input.Title
+	}
+	if input.Description != nil {
+		series.Template.Description = *input.Description
+		fields["description"] = *input.Description
+	}
+	if input.AssignedTo != nil {
+		series.Template.AssignedTo = *input.AssignedTo
+		fields["assigned_to"] = *input.AssignedTo
+	}
+	if input.Hours != nil {
+		series.Template.Hours = *input.Hours
+		fields["hours"] = *input.Hours
+	}
+
+	reschedule := false
+	if input.StartDate != nil {
+		series.Template.StartDate = *input.StartDate
+		reschedule = true
+	}
+	if input.EndDate != nil {
+		series.Template.EndDate = *input.EndDate
+		reschedule = true
+	}
+	if input.RRule != nil {
+		if _, err := parseRRule(*input.RRule); err != nil {
+			http.Error(w, "Invalid rrule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		series.RRule = *input.RRule
+		reschedule = true
+	}
+	if series.Template.EndDate.Before(series.Template.StartDate) {
+		http.Error(w, "start_date must not be after end_date", http.StatusBadRequest)
+		return
+	}
+	referenceErrs, err := checkReferences(req.Context(), bson.M{"assigned_to": fields["assigned_to"]})
+	if err != nil {
+		writeReferenceError(w, err)
+		return
+	}
+	if len(referenceErrs) > 0 {
+		writeValidationError(w, referenceErrs)
+		return
+	}
+
+	_, err = taskSeries().UpdateOne(context.TODO(), bson.M{"_id": seriesID}, bson.M{"$set": bson.M{"template": series.Template, "rrule": series.RRule}})
+	if err != nil {
+		http.Error(w, "Failed to update task series", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	collection := client.Database("taskmanagement").Collection("tasks")
+	upcoming := upcomingOccurrences(seriesID, now)
+	if reschedule {
+		if err := dropUpcomingOccurrences(seriesID, now); err != nil {
+			http.Error(w, "Failed to reschedule occurrences", http.StatusInternalServerError)
+			return
+		}
+		if _, err := materializeSeries(series, now); err != nil {
+			log.Printf("Failed to materialize series %s: %v", series.ID.Hex(), err)
+		}
+	} else if len(fields) > 0 {
+		if _, err := collection.UpdateMany(context.TODO(), upcoming, bson.M{"$set": fields, "$currentDate": bson.M{"updated_at": true}, "$inc": bson.M{"version": 1}}); err != nil {
+			http.Error(w, "Failed to update occurrences", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Printf("Task series updated successfully: ID %s", seriesID.Hex())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// upcomingOccurrences matches the series' unfinished occurrences from now on that
+// haven't been edited on their own: those that series edits update or replace.
+func upcomingOccurrences(seriesID primitive.ObjectID, now time.Time) bson.M {
+	return bson.M{
+		"series_id":       seriesID,
+		"detached":        bson.M{"$ne": true},
+		"status":          bson.M{"$ne": "done"},
+		"occurrence_date": bson.M{"$gte": now},
+	}
+}
+
+// dropUpcomingOccurrences deletes the series' upcoming occurrences. Those with
+// time entries, comments or attachments are detached instead, so the work on
+// them isn't deleted with them.
+func dropUpcomingOccurrences(seriesID primitive.ObjectID, now time.Time) error {
+	collection := client.Database("taskmanagement").Collection("tasks")
+	return withTransaction(func(ctx mongo.SessionContext) error {
+		ids, err := collection.Distinct(ctx, "_id", upcomingOccurrences(seriesID, now))
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		worked := []interface{}{}
+		for _, related := range []*mongo.Collection{timeEntries(), comments(), attachments()} {
+			taskIDs, err := related.Distinct(ctx, "task_id", bson.M{"task_id": bson.M{"$in": ids}})
+			if err != nil {
+				return err
+			}
+			worked = append(worked, taskIDs...)
+		}
+
+		if len(worked) > 0 {
+			detach := bson.M{"$set": bson.M{"detached": true}, "$currentDate": bson.M{"updated_at": true}, "$inc": bson.M{"version": 1}}
+			if _, err := collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": worked}}, detach); err != nil {
+				return err
+			}
+		}
+		_, err = collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids, "$nin": worked}})
+		return err
+	})
+}
+
+// removeSeries deletes the series and its upcoming occurrences, except those
+// detached or worked on; past and completed occurrences are kept as regular tasks.
+func removeSeries(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to remove task series")
+
+	if req.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seriesID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/tasks/series/remove/"):])
+	if err != nil {
+		http.Error(w, "Invalid series ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := taskSeries().DeleteOne(context.TODO(), bson.M{"_id": seriesID}); err != nil {
+		http.Error(w, "Failed to remove task series", http.StatusInternalServerError)
+		return
+	}
+
+	if err := dropUpcomingOccurrences(seriesID, time.Now().UTC()); err != nil {
+		http.Error(w, "Failed to remove occurrences", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Task series removed successfully: ID %s", seriesID.Hex())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func materializeSeriesNow(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to materialize task series")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	created, err := materializeAllSeries()
+	if err != nil {
+		http.Error(w, "Failed to materialize task series", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"created": created})
+}
@@ -6,8 +6,8 @@ import (
 	"log"
 	"net/http"
 	"time"
-	"bytes"
-	"fmt"
+	"errors"
+	"strings"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -20,7 +20,7 @@ var client *mongo.Client
 func main() {
 	// Create a new MongoDB client
 	var err error
-	client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://task-mongodb:27017"))
+	client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://task-mongodb:27017/?replicaSet=rs0"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -39,6 +39,53 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	err = ensureSeriesIndexes()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ensureFieldIndexes()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ensureOutboxIndexes()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ensureCalendarIndexes()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ensureTimeEntryIndexes()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	blobs, err = newBlobStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	users = newUserLookup()
+	budgets = newBudgetClient()
+
+	bus, err = newEventBus("task-service")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer bus.Close()
+	err = bus.Subscribe(eventInvoiceIssued, handleInvoiceIssued)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = bus.Subscribe(eventUserDeleted, handleUserDeleted)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create upcoming occurrences of recurring tasks in the background
+	go runRecurrenceScheduler()
+	// Publish queued invoices for billing-service
+	go runInvoiceRelay()
 
 	// Create a new HTTP server
 	mux := http.NewServeMux()
@@ -50,6 +97,37 @@ mux.Handle("/tasks/update/", http.HandlerFunc(updateTask))
 mux.Handle("/tasks/remove/", authMiddleware(adminMiddleware(http.HandlerFunc(removeTask))))
 mux.Handle("/tasks/removeAllTasks", http.HandlerFunc(removeAllTasks))
 mux.Handle("/tasks/listByUser/", http.HandlerFunc(listTasksByUser))
+mux.Handle("/tasks/conflicts", http.HandlerFunc(listConflicts))
+mux.Handle("/tasks/bulk", http.HandlerFunc(bulkTasks))
+mux.Handle("/tasks/export", http.HandlerFunc(exportTasks))
+mux.Handle("/tasks/import", http.HandlerFunc(importTasks))
+mux.Handle("/tasks/board", http.HandlerFunc(getBoard))
+mux.Handle("/tasks/board/move/", http.HandlerFunc(moveTask))
+mux.Handle("/tasks/workload", http.HandlerFunc(getWorkload))
+mux.Handle("/tasks/calendar/token", authMiddleware(http.HandlerFunc(regenerateCalendarToken)))
+mux.Handle("/tasks/calendar/feed/", http.HandlerFunc(getCalendarFeed))
+mux.Handle("/tasks/time/start", http.HandlerFunc(startTimer))
+mux.Handle("/tasks/time/stop/", http.HandlerFunc(stopTimer))
+mux.Handle("/tasks/time/create", http.HandlerFunc(createTimeEntry))
+mux.Handle("/tasks/time/list", http.HandlerFunc(listTimeEntries))
+mux.Handle("/tasks/time/update/", http.HandlerFunc(updateTimeEntry))
+mux.Handle("/tasks/time/remove/", http.HandlerFunc(removeTimeEntry))
+mux.Handle("/tasks/time/totals", internalServiceMiddleware(http.HandlerFunc(timeTotals)))
+mux.Handle("/tasks/invoice/", http.HandlerFunc(invoiceTaskNow))
+mux.Handle("/tasks/outbox", authMiddleware(adminMiddleware(http.HandlerFunc(listInvoiceRequests))))
+mux.Handle("/tasks/series/create", http.HandlerFunc(createSeries))
+mux.Handle("/tasks/series/list", http.HandlerFunc(listSeries))
+mux.Handle("/tasks/series/get/", http.HandlerFunc(getSeries))
+mux.Handle("/tasks/series/update/", http.HandlerFunc(updateSeries))
+mux.Handle("/tasks/series/remove/", http.HandlerFunc(removeSeries))
+mux.Handle("/tasks/series/materialize", http.HandlerFunc(materializeSeriesNow))
+mux.Handle("/tasks/mentions/", http.HandlerFunc(listMentions))
+mux.Handle("/tasks/fields/create", authMiddleware(adminMiddleware(http.HandlerFunc(createFieldDefinition))))
+mux.Handle("/tasks/fields/list", http.HandlerFunc(listFieldDefinitions))
+mux.Handle("/tasks/fields/remove/", authMiddleware(adminMiddleware(http.HandlerFunc(removeFieldDefinition))))
+mux.Handle("/tasks/lookup/", internalServiceMiddleware(http.HandlerFunc(lookupTask)))
+mux.Handle("/tasks/subtree/", internalServiceMiddleware(http.HandlerFunc(taskSubtree)))
+mux.Handle("/tasks/", http.HandlerFunc(taskSubresource))
 
 	// Start the server
 	log.Println("Task Service listening on port 8002...")
@@ -120,14 +198,19 @@ type Task struct {
     EndDate     time.Time          `bson:"end_date" json:"end_date"`
     InvoiceID   primitive.ObjectID `bson:"invoice_id,omitempty" json:"invoice_id,omitempty"`
     ParentTask  *primitive.ObjectID `bson:"parent_task,omitempty" json:"parent_task,omitempty"`
-}
-
-type Billing struct {
-    ID     primitive.ObjectID `bson:"_id" json:"id"`
-    UserID primitive.ObjectID `bson:"user_id" json:"user_id"`
-    TaskID primitive.ObjectID `bson:"task_id" json:"task_id"`
-    Hours  float64             `bson:"hours" json:"hours"`
-    Amount float64             `bson:"amount" json:"amount"`
+    Organization string                 `bson:"organization,omitempty" json:"organization,omitempty"`
+    Labels       []string               `bson:"labels,omitempty" json:"labels,omitempty"`
+    Priority     string                 `bson:"priority,omitempty" json:"priority,omitempty"`
+    CustomFields map[string]interface{} `bson:"custom_fields,omitempty" json:"custom_fields,omitempty"`
+    Version      int64                  `bson:"version" json:"version"`
+    SeriesID       *primitive.ObjectID `bson:"series_id,omitempty" json:"series_id,omitempty"`
+    OccurrenceDate *time.Time          `bson:"occurrence_date,omitempty" json:"occurrence_date,omitempty"`
+    Detached       bool                `bson:"detached,omitempty" json:"detached,omitempty"`
+    // Rank orders the task within its board column; unranked tasks come last
+    Rank           float64             `bson:"rank,omitempty" json:"rank,omitempty"`
+    // UpdatedAt is when the task was last changed; tasks from before it was kept don't have it
+    UpdatedAt      *time.Time          `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+    Conflicts   []Conflict          `bson:"-" json:"conflicts,omitempty"`
 }
 
 func createTask(w http.ResponseWriter, req *http.Request) {
@@ -142,34 +225,66 @@ func createTask(w http.ResponseWriter, req *http.Request) {
 
     log.Printf("Attempting to insert task: %+v", task)  // Log the task details being inserted
 
+    task, opErr := createTaskOp(newTaskBatch(req), task)
+    if opErr != nil {
+        writeTaskOpError(w, opErr)
+        return
+    }
+
+    log.Printf("Task created successfully: %+v", task)  // Confirm successful creation
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("ETag", etag(task.Version))
+    json.NewEncoder(w).Encode(task)
+}
 
-    // Check for overlapping tasks
-    var overlappingTasks []Task
-    filter := bson.M{
-        "assigned_to": task.AssignedTo,
-        "end_date": bson.M{"$gt": task.StartDate},
-        "start_date": bson.M{"$lt": task.EndDate},
+// createTaskOp validates and inserts a new task, applying the conflict policy.
+func createTaskOp(b *taskBatch, task Task) (Task, *taskOpError) {
+    // Validate labels, priority and custom fields
+    validationErrs, err := validateNewTask(&task)
+    if err != nil {
+        return Task{}, opFailed(http.StatusInternalServerError, "Database query error")
+    }
+    // The assignee, parent task and users in custom fields must exist
+    references := bson.M{"assigned_to": task.AssignedTo}
+    if task.ParentTask != nil {
+        references["parent_task"] = *task.ParentTask
+    }
+    for key, value := range task.CustomFields {
+        references["custom_fields."+key] = value
     }
-    cursor, err := client.Database("taskmanagement").Collection("tasks").Find(context.TODO(), filter)
+    referenceErrs, err := checkReferences(b.ctx, references)
     if err != nil {
-        http.Error(w, "Database query error", http.StatusInternalServerError)
-        return
+        return Task{}, opReferenceError(err)
     }
-    if cursor.All(context.Background(), &overlappingTasks); len(overlappingTasks) > 0 {
-        // Append a warning to the task description indicating overlapping dates
-        task.Description += " Warning: This task overlaps with existing task(s)."
+    validationErrs = append(validationErrs, referenceErrs...)
+    if len(validationErrs) > 0 {
+        return Task{}, opInvalid(validationErrs)
     }
 
     task.ID = primitive.NewObjectID()
-    _, err = client.Database("taskmanagement").Collection("tasks").InsertOne(context.TODO(), task)
+    task.Version = 1
+    now := time.Now().UTC()
+    task.UpdatedAt = &now
+    task.Rank = 0 // New tasks go to the bottom of their board column
+
+    // Check for overlapping tasks and apply the conflict policy
+    conflicts, opErr := checkConflicts(b, task)
+    if opErr != nil {
+        return Task{}, opErr
+    }
+
+    _, err = client.Database("taskmanagement").Collection("tasks").InsertOne(b.ctx, task)
     if err != nil {
-        http.Error(w, "Failed to create task", http.StatusInternalServerError)
-        return
+        return Task{}, opFailed(http.StatusInternalServerError, "Failed to create task")
     }
 
-    log.Printf("Task created successfully: %+v", task)  // Confirm successful creation
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(task)
+    b.afterCommit(func() {
+        recordActivity(Activity{TaskID: task.ID, Type: activityCreated, ActorID: b.actor})
+        publishEvent(eventTaskCreated, TaskEvent{TaskID: task.ID, Title: task.Title, AssignedTo: task.AssignedTo, Status: task.Status, Hours: task.Hours})
+    })
+
+    task.Conflicts = conflicts
+    return task, nil
 }
 
 
@@ -210,6 +325,7 @@ func getTask(w http.ResponseWriter, req *http.Request) {
         log.Printf("Task retrieved successfully: %+v", task)  // Confirm the task was retrieved successfully
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(task.Version))
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -237,19 +353,59 @@ func updateTask(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+    // Clients that send If-Match only update the version they have
+    var ifMatch *int64
+    if expected, ok, err := parseIfMatch(req); err != nil {
+        http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+        return
+    } else if ok {
+        ifMatch = &expected
+    }
+
+    version, conflicts, opErr := updateTaskOp(newTaskBatch(req), objectID, updates, ifMatch)
+    if opErr != nil {
+        writeTaskOpError(w, opErr)
+        return
+    }
+
+        log.Printf("Task updated successfully: ID %s", taskID)  // Confirm successful update
+	w.Header().Set("ETag", etag(version))
+	if len(conflicts) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Conflicts []Conflict `json:"conflicts"`
+		}{Conflicts: conflicts})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateTaskOp applies the changes sent to /tasks/update/ to a task and returns its
+// new version. With ifMatch set, only that version of the task is updated.
+func updateTaskOp(b *taskBatch, objectID primitive.ObjectID, updates map[string]interface{}, ifMatch *int64) (int64, []Conflict, *taskOpError) {
 // Prepare update document
     updateDoc := bson.M{"$set": bson.M{}}
+    var validationErrs ValidationError
+    var customFields map[string]interface{}
+    readOnly := map[string]interface{}{}
     for key, value := range updates {
         // Ensure only allowed fields are updated and handle date parsing
         switch key {
-        case "title", "description", "assigned_to", "status", "hours":
+        case "title", "description", "status", "hours":
             updateDoc["$set"].(bson.M)[key] = value
+        case "assigned_to":
+            if assignedToString, ok := value.(string); ok {
+                assignedTo, err := primitive.ObjectIDFromHex(assignedToString)
+                if err != nil {
+                    return 0, nil, opFailed(http.StatusBadRequest, "Invalid assigned_to ID")
+                }
+                updateDoc["$set"].(bson.M)["assigned_to"] = assignedTo
+            }
         case "start_date", "end_date":
             if dateString, ok := value.(string); ok {
                 parsedDate, err := time.Parse(time.RFC3339, dateString)
                 if err != nil {
-                    http.Error(w, "Invalid date format", http.StatusBadRequest)
-                    return
+                    return 0, nil, opFailed(http.StatusBadRequest, "Invalid date format")
                 }
                 updateDoc["$set"].(bson.M)[key] = parsedDate
             }
@@ -257,81 +413,215 @@ func updateTask(w http.ResponseWriter, req *http.Request) {
             if parentTaskIDString, ok := value.(string); ok {
                 parentTaskID, err := primitive.ObjectIDFromHex(parentTaskIDString)
                 if err != nil {
-                    http.Error(w, "Invalid parent task ID", http.StatusBadRequest)
-                    return
+                    return 0, nil, opFailed(http.StatusBadRequest, "Invalid parent task ID")
                 }
                 updateDoc["$set"].(bson.M)["parent_task"] = parentTaskID
             }
+        case "labels":
+            labels, fieldErr := parseLabels(value)
+            if fieldErr != nil {
+                validationErrs = append(validationErrs, *fieldErr)
+                continue
+            }
+            updateDoc["$set"].(bson.M)["labels"] = labels
+        case "priority":
+            if priority, ok := value.(string); !ok || !validPriority(priority) {
+                validationErrs = append(validationErrs, FieldError{Field: "priority", Code: "invalid_value", Message: "must be one of " + strings.Join(priorities, ", ")})
+                continue
+            }
+            updateDoc["$set"].(bson.M)["priority"] = value
+        case "custom_fields":
+            // Validated against the task's organization once the task is loaded
+            var ok bool
+            if customFields, ok = value.(map[string]interface{}); !ok {
+                validationErrs = append(validationErrs, FieldError{Field: "custom_fields", Code: "invalid_type", Message: "must be an object"})
+            }
+        case "id":
+            // Clients often send the whole task back; the ID comes from the URL
+        case "version", "organization", "invoice_id", "series_id", "occurrence_date", "detached", "rank", "updated_at":
+            // Checked against the task once it is loaded
+            readOnly[key] = value
+        default:
+            validationErrs = append(validationErrs, FieldError{Field: key, Code: "unknown_field", Message: "is not a task field"})
         }
     }
 
 	collection := client.Database("taskmanagement").Collection("tasks")
 	// Fetch the current task to compare changes
 	var currentTask Task
-	err = collection.FindOne(context.TODO(), bson.M{"_id": objectID}).Decode(&currentTask)
+	err := collection.FindOne(b.ctx, bson.M{"_id": objectID}).Decode(&currentTask)
 	if err != nil {
-		http.Error(w, "Task not found", http.StatusNotFound)
-		return
+		return 0, nil, opFailed(http.StatusNotFound, "Task not found")
 	}
+    validationErrs = append(validationErrs, readOnlyChanges(currentTask, readOnly)...)
 
-
-    // Handle InvoiceID creation if task status changes to 'done'
- if currentTask.Status != "done" && updates["status"] == "done" {
-        if currentTask.ParentTask == nil {
-            // If the current task is a parent task, set all child tasks to 'done' and generate invoices for each
-            var childTasks []Task
-            cursor, err := collection.Find(context.TODO(), bson.M{"parent_task": currentTask.ID})
-            if err == nil {
-                defer cursor.Close(context.Background())
-                cursor.All(context.Background(), &childTasks)
-
-                for _, childTask := range childTasks {
-                    childInvoiceID, err := createInvoiceInBillingService(childTask)
-                    if err != nil {
-                        log.Printf("Failed to create invoice for child task: %v", err)
-                        continue
-                    }
-
-                    _, err = collection.UpdateOne(context.TODO(), bson.M{"_id": childTask.ID}, bson.M{"$set": bson.M{"status": "done", "invoice_id": childInvoiceID}})
-                    if err != nil {
-                        log.Printf("Failed to update child task with invoice ID: %v", err)
-                    } else {
-                        log.Printf("Child task updated with InvoiceID: %v", childInvoiceID)
-                    }
+    if customFields != nil {
+        organization := currentTask.Organization
+        if organization == "" {
+            organization = defaultOrganization
+        }
+        defs, err := loadFieldDefinitions(organization)
+        if err != nil {
+            return 0, nil, opFailed(http.StatusInternalServerError, "Database query error")
+        }
+        converted, fieldErrs := validateCustomFields(defs, customFields, false)
+        validationErrs = append(validationErrs, fieldErrs...)
+        for key, value := range converted {
+            if value == nil {
+                if updateDoc["$unset"] == nil {
+                    updateDoc["$unset"] = bson.M{}
                 }
+                updateDoc["$unset"].(bson.M)["custom_fields."+key] = ""
+            } else {
+                updateDoc["$set"].(bson.M)["custom_fields."+key] = value
             }
+        }
+    }
+    // New references must exist; cleared ones are zero and skipped
+    referenceErrs, err := checkReferences(b.ctx, updateDoc["$set"].(bson.M))
+    if err != nil {
+        return 0, nil, opReferenceError(err)
+    }
+    validationErrs = append(validationErrs, referenceErrs...)
+    if len(validationErrs) > 0 {
+        return 0, nil, opInvalid(validationErrs)
+    }
 
-            // Generate invoice for the parent task
-            invoiceID, err := createInvoiceInBillingService(currentTask)
-            if err != nil {
-                log.Printf("Failed to create invoice: %v", err)
-                http.Error(w, "Failed to create invoice", http.StatusInternalServerError)
-                return
-            }
-
-            updateDoc["$set"].(bson.M)["invoice_id"] = invoiceID
-            log.Printf("Parent task updated to 'done'. New InvoiceID: %v generated", invoiceID)
-        } else {
-            // If the current task is a child task, generate an invoice for it
-            invoiceID, err := createInvoiceInBillingService(currentTask)
-            if err != nil {
-                log.Printf("Failed to create invoice: %v", err)
-                http.Error(w, "Failed to create invoice", http.StatusInternalServerError)
-                return
-            }
+    // Editing a single occurrence detaches it from later edits to its series
+    if currentTask.SeriesID != nil && (len(updateDoc["$set"].(bson.M)) > 0 || updateDoc["$unset"] != nil) {
+        updateDoc["$set"].(bson.M)["detached"] = true
+    }
 
-            updateDoc["$set"].(bson.M)["invoice_id"] = invoiceID
-            log.Printf("Child task updated to 'done'. New InvoiceID: %v generated", invoiceID)
+    // Re-check overlaps when the assignee or the schedule changes
+    var conflicts []Conflict
+    set := updateDoc["$set"].(bson.M)
+    _, assigneeChanged := set["assigned_to"]
+    _, startChanged := set["start_date"]
+    _, endChanged := set["end_date"]
+    if assigneeChanged || startChanged || endChanged {
+        updatedTask := currentTask
+        if assignedTo, ok := set["assigned_to"].(primitive.ObjectID); ok {
+            updatedTask.AssignedTo = assignedTo
         }
+        if startDate, ok := set["start_date"].(time.Time); ok {
+            updatedTask.StartDate = startDate
+        }
+        if endDate, ok := set["end_date"].(time.Time); ok {
+            updatedTask.EndDate = endDate
+        }
+        var opErr *taskOpError
+        if conflicts, opErr = checkConflicts(b, updatedTask); opErr != nil {
+            return 0, nil, opErr
+        }
+    }
+
+    // Reject the update if the client's copy is stale
+    if ifMatch != nil && *ifMatch != currentTask.Version {
+        return 0, nil, opFailed(http.StatusPreconditionFailed, "Task has been modified")
     }
 
-	_, err = collection.UpdateOne(context.TODO(), bson.M{"_id": objectID}, updateDoc)
+    err = saveTaskUpdate(b, currentTask, updateDoc)
+    if errors.Is(err, errTaskModified) {
+        return 0, nil, opFailed(http.StatusPreconditionFailed, "Task has been modified")
+    }
+    var opErr *taskOpError
+    if errors.As(err, &opErr) {
+        return 0, nil, opErr
+    }
 	if err != nil {
-		http.Error(w, "Failed to update task", http.StatusInternalServerError)
-		return
+		log.Printf("Failed to update task %s: %v", objectID.Hex(), err)
+		return 0, nil, opFailed(http.StatusInternalServerError, "Failed to update task")
 	}
-        log.Printf("Task updated successfully: ID %s", taskID)  // Confirm successful update
-	w.WriteHeader(http.StatusNoContent)
+    return currentTask.Version + 1, conflicts, nil
+}
+
+// saveTaskUpdate applies updateDoc to the task only if nobody changed it since
+// currentTask was read, and records the change once it's committed. When the task is being marked done,
+// this conditional update is also the claim that lets exactly one request queue its
+// invoice, in the same transaction as the invoice itself. It returns errTaskModified
+// when the task has changed, and a *taskOpError when completing it would exceed a
+// hard budget.
+func saveTaskUpdate(b *taskBatch, currentTask Task, updateDoc bson.M) error {
+    collection := client.Database("taskmanagement").Collection("tasks")
+    completing := currentTask.Status != "done" && updateDoc["$set"].(bson.M)["status"] == "done"
+    if completing {
+        if opErr := completionBudgetError(b.ctx, currentTask); opErr != nil {
+            return opErr
+        }
+    }
+    filter := bson.M{"_id": currentTask.ID, "version": versionFilter(currentTask.Version)}
+    if completing {
+        filter["status"] = bson.M{"$ne": "done"}
+    }
+    updateDoc["$set"].(bson.M)["updated_at"] = time.Now().UTC()
+    updateDoc["$inc"] = bson.M{"version": 1}
+    var completedChildren []Task
+    err := b.transaction(func(ctx mongo.SessionContext) error {
+        result, err := collection.UpdateOne(ctx, filter, updateDoc)
+        if err != nil {
+            return err
+        }
+        if result.MatchedCount == 0 {
+            return errTaskModified
+        }
+        if !completing {
+            return nil
+        }
+
+        // If the current task is a parent task, set all child tasks to 'done' and queue invoices for each
+        completedChildren = nil
+        if currentTask.ParentTask == nil {
+            if completedChildren, err = completeChildTasks(ctx, currentTask); err != nil {
+                return err
+            }
+        }
+        _, err = enqueueInvoice(ctx, currentTask, eventTaskCompleted)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+
+    b.afterCommit(func() {
+        if completing {
+            for _, childTask := range completedChildren {
+                recordTaskUpdate(childTask.ID, b.actor, taskChanges(childTask, bson.M{"status": "done"}))
+            }
+            wakeInvoiceRelay()
+            log.Printf("Task updated to 'done'. Invoices queued for delivery")
+        }
+        recordTaskUpdate(currentTask.ID, b.actor, taskChanges(currentTask, updateDoc["$set"].(bson.M)))
+    })
+    return nil
+}
+
+// completeChildTasks marks the parent's unfinished child tasks done and queues an
+// invoice for each, as part of the parent's transaction. It returns the children
+// it completed.
+func completeChildTasks(ctx mongo.SessionContext, parent Task) ([]Task, error) {
+    collection := client.Database("taskmanagement").Collection("tasks")
+    cursor, err := collection.Find(ctx, bson.M{"parent_task": parent.ID, "status": bson.M{"$ne": "done"}})
+    if err != nil {
+        return nil, err
+    }
+    var childTasks []Task
+    err = cursor.All(ctx, &childTasks)
+    cursor.Close(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, childTask := range childTasks {
+        claim := bson.M{"_id": childTask.ID, "status": bson.M{"$ne": "done"}}
+        if _, err := collection.UpdateOne(ctx, claim, bson.M{"$set": bson.M{"status": "done", "updated_at": time.Now().UTC()}, "$inc": bson.M{"version": 1}}); err != nil {
+            return nil, err
+        }
+        if _, err := enqueueInvoice(ctx, childTask, eventTaskCompleted); err != nil {
+            return nil, err
+        }
+        log.Printf("Child task %s marked done", childTask.ID.Hex())
+    }
+    return childTasks, nil
 }
 
 func removeTask(w http.ResponseWriter, req *http.Request) {
@@ -349,16 +639,81 @@ func removeTask(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if opErr := removeTaskOp(newTaskBatch(req), objectID); opErr != nil {
+		writeTaskOpError(w, opErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeTaskOp deletes a task with its comments, attachments and unbilled time
+// entries. Time already billed or queued for an invoice is kept for the invoice.
+func removeTaskOp(b *taskBatch, objectID primitive.ObjectID) *taskOpError {
 	collection := client.Database("taskmanagement").Collection("tasks")
 	filter := bson.M{"_id": objectID}
 
-	_, err = collection.DeleteOne(context.TODO(), filter)
+	var task Task
+	var storageKeys []string
+	err := b.transaction(func(ctx mongo.SessionContext) error {
+		if err := collection.FindOneAndDelete(ctx, filter).Decode(&task); err != nil {
+			return err
+		}
+		var err error
+		storageKeys, err = removeTaskWork(ctx, objectID)
+		return err
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return opFailed(http.StatusNotFound, "Task not found")
+	}
 	if err != nil {
-		http.Error(w, "Failed to remove task", http.StatusInternalServerError)
-		return
+		log.Printf("Failed to remove task %s: %v", objectID.Hex(), err)
+		return opFailed(http.StatusInternalServerError, "Failed to remove task")
 	}
+	b.afterCommit(func() {
+		// Keep the scheduler from recreating a removed occurrence
+		excludeOccurrence(task)
+		// Contents go once nothing can roll their metadata back
+		for _, key := range storageKeys {
+			if err := blobs.Delete(context.TODO(), key); err != nil {
+				log.Printf("Failed to delete blob %s of task %s: %v", key, objectID.Hex(), err)
+			}
+		}
+	})
+	return nil
+}
 
-	w.WriteHeader(http.StatusNoContent)
+// removeTaskWork deletes the comments, attachment metadata and unbilled time
+// entries of a task being removed, and returns the storage keys of the
+// attachments' contents for the caller to delete once that is committed.
+func removeTaskWork(ctx mongo.SessionContext, taskID primitive.ObjectID) ([]string, error) {
+	cursor, err := attachments().Find(ctx, bson.M{"task_id": taskID})
+	if err != nil {
+		return nil, err
+	}
+	var attached []Attachment
+	if err := cursor.All(ctx, &attached); err != nil {
+		return nil, err
+	}
+	storageKeys := make([]string, 0, len(attached))
+	for _, attachment := range attached {
+		storageKeys = append(storageKeys, attachment.StorageKey)
+	}
+
+	unbilled := bson.M{"task_id": taskID, "invoice_id": bson.M{"$exists": false}, "invoice_request_id": bson.M{"$exists": false}}
+	for _, step := range []struct {
+		collection *mongo.Collection
+		filter     bson.M
+	}{
+		{attachments(), bson.M{"task_id": taskID}},
+		{comments(), bson.M{"task_id": taskID}},
+		{timeEntries(), unbilled},
+	} {
+		if _, err := step.collection.DeleteMany(ctx, step.filter); err != nil {
+			return nil, err
+		}
+	}
+	return storageKeys, nil
 }
 
 func listTasks(w http.ResponseWriter, req *http.Request) {
@@ -369,8 +724,18 @@ func listTasks(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	filter, validationErrs, err := taskFilterFromQuery(req)
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+	if len(validationErrs) > 0 {
+		writeValidationError(w, validationErrs)
+		return
+	}
+
 	collection := client.Database("taskmanagement").Collection("tasks")
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	cursor, err := collection.Find(context.TODO(), filter)
 	if err != nil {
 		http.Error(w, "Failed to list tasks", http.StatusInternalServerError)
 		return
@@ -398,7 +763,16 @@ func listTasksByUser(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	filter := bson.M{"assigned_to": objectID}
+	filter, validationErrs, err := taskFilterFromQuery(req)
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+	if len(validationErrs) > 0 {
+		writeValidationError(w, validationErrs)
+		return
+	}
+	filter["assigned_to"] = objectID
 
 	collection := client.Database("taskmanagement").Collection("tasks")
 	cursor, err := collection.Find(context.TODO(), filter)
@@ -427,64 +801,11 @@ func removeAllTasks(w http.ResponseWriter, req *http.Request) {
 
 	collection := client.Database("taskmanagement").Collection("tasks")
 
-	_, err := collection.DeleteMany(context.TODO(), bson.M{})
+	result, err := collection.DeleteMany(context.TODO(), bson.M{})
 	if err != nil {
 		http.Error(w, "Failed to remove all tasks", http.StatusInternalServerError)
 		return
 	}
-    log.Printf("All tasks removed successfully, count: %d")  // Confirm successful deletion
+    log.Printf("All tasks removed successfully, count: %d", result.DeletedCount)  // Confirm successful deletion
     w.WriteHeader(http.StatusNoContent)
 }
-
-func createInvoiceInBillingService(task Task) (primitive.ObjectID, error) {
-    hourlyRate := 100.0  // Ensure this is defined or passed correctly
-    amount := task.Hours * hourlyRate
-    log.Printf("Attempting to create invoice for task ID: %s", task.ID.Hex())  // Log the task ID for which invoice is being created
-
-    billing := Billing{
-        UserID: task.AssignedTo,
-        TaskID: task.ID,
-        Hours:  task.Hours,
-        Amount: amount,
-    }
-
-    jsonData, err := json.Marshal(billing)
-    if err != nil {
-        log.Printf("Error marshalling invoice data: %v", err)
-        return primitive.NilObjectID, err
-    }
-
-    req, err := http.NewRequest("POST", "http://api-gateway:8000/billings/createForTaskService", bytes.NewBuffer(jsonData))
-    if err != nil {
-        log.Printf("Error creating request: %v", err)
-        return primitive.NilObjectID, err
-    }
-    req.Header.Set("Content-Type", "application/json")
-    req.Header.Set("X-Task-Service", "your-task-service-secret")
-
-    log.Printf("Sending request to billing service with headers: %+v and body: %s", req.Header, jsonData)
-
-    client := &http.Client{}
-    resp, err := client.Do(req)
-    if err != nil {
-        log.Printf("Error sending request to billing service: %v", err)
-        return primitive.NilObjectID, err
-    }
-    defer resp.Body.Close()
-
-    log.Printf("Billing service responded with status: %d", resp.StatusCode)
-
-    if resp.StatusCode != http.StatusOK {
-        log.Printf("Failed to create invoice, billing service responded with status: %d", resp.StatusCode)
-        return primitive.NilObjectID, fmt.Errorf("billing service error: %d", resp.StatusCode)
-    }
-
-    var createdBilling Billing
-    if err := json.NewDecoder(resp.Body).Decode(&createdBilling); err != nil {
-        log.Printf("Error decoding response from billing service: %v", err)
-        return primitive.NilObjectID, err
-    }
-
-    log.Printf("Invoice created successfully for task ID: %s, Billing ID: %s", task.ID.Hex(), createdBilling.ID.Hex())  // Confirm successful invoice creation
-    return createdBilling.ID, nil
-}
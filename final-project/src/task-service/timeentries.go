@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TimeEntry is a block of work logged by a user against a task, either with a
+// running timer or entered manually. EndedAt is nil while the timer is running.
+type TimeEntry struct {
+	ID        primitive.ObjectID  `bson:"_id" json:"id"`
+	TaskID    primitive.ObjectID  `bson:"task_id" json:"task_id"`
+	UserID    primitive.ObjectID  `bson:"user_id" json:"user_id"`
+	StartedAt time.Time           `bson:"started_at" json:"started_at"`
+	EndedAt   *time.Time          `bson:"ended_at,omitempty" json:"ended_at,omitempty"`
+	Hours     float64             `bson:"hours" json:"hours"`
+	Note      string              `bson:"note" json:"note"`
+	Billable  bool                `bson:"billable" json:"billable"`
+	InvoiceID *primitive.ObjectID `bson:"invoice_id,omitempty" json:"invoice_id,omitempty"`
+
+	// InvoiceRequestID is the queued invoice the entry is billed on, set until
+	// billing-service has created it and InvoiceID is known.
+	InvoiceRequestID *primitive.ObjectID `bson:"invoice_request_id,omitempty" json:"invoice_request_id,omitempty"`
+
+	// Running is set while the timer runs, for the index that allows one
+	// running timer per user and task.
+	Running bool `bson:"running,omitempty" json:"-"`
+}
+
+func timeEntries() *mongo.Collection {
+	return client.Database("taskmanagement").Collection("time_entries")
+}
+
+// ensureTimeEntryIndexes lets a user run at most one timer per task, however
+// many starts race. Partial indexes can't match a missing ended_at, so running
+// timers are marked, including those started before the mark existed.
+func ensureTimeEntryIndexes() error {
+	_, err := timeEntries().UpdateMany(context.Background(), bson.M{"ended_at": bson.M{"$exists": false}, "running": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"running": true}})
+	if err != nil {
+		return err
+	}
+	_, err = timeEntries().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "task_id", Value: 1}, {Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"running": true}),
+	})
+	return err
+}
+
+// entryHours returns the duration between start and end in hours, rounded to the minute.
+func entryHours(start, end time.Time) float64 {
+	return math.Round(end.Sub(start).Minutes()) / 60
+}
+
+// startEntry makes entry a timer running from now.
+func startEntry(entry *TimeEntry, now time.Time) {
+	entry.StartedAt = now
+	entry.EndedAt = nil
+	entry.Hours = 0
+	entry.Running = true
+}
+
+// stopEntry stops the entry's timer at now and works out its hours. It reports
+// false for a timer that was stopped already.
+func stopEntry(entry *TimeEntry, now time.Time) bool {
+	if entry.EndedAt != nil {
+		return false
+	}
+	entry.EndedAt = &now
+	entry.Hours = entryHours(entry.StartedAt, now)
+	entry.Running = false
+	return true
+}
+
+// setEntryHours gives a stopped or manual entry hours of work from its start,
+// moving its end to match.
+func setEntryHours(entry *TimeEntry, hours float64) {
+	endedAt := entry.StartedAt.Add(time.Duration(hours * float64(time.Hour)))
+	entry.Hours = hours
+	entry.EndedAt = &endedAt
+}
+
+// syncTaskHours sets the task's Hours to the total of its finished time entries.
+// Tasks without any entries keep the Hours they were created with.
+func syncTaskHours(taskID primitive.ObjectID) error {
+	cursor, err := timeEntries().Find(context.TODO(), bson.M{"task_id": taskID, "ended_at": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var entries []TimeEntry
+	if err := cursor.All(context.Background(), &entries); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	total := 0.0
+	for _, e := range entries {
+		total += e.Hours
+	}
+	_, err = client.Database("taskmanagement").Collection("tasks").UpdateOne(context.TODO(), bson.M{"_id": taskID}, bson.M{"$set": bson.M{"hours": total, "updated_at": time.Now().UTC()}, "$inc": bson.M{"version": 1}})
+	return err
+}
+
+// decodeEntryRequest reads a time entry from the request body and checks that its task and user exist.
+// The entry defaults to the task's assignee and to billable when those are omitted.
+func decodeEntryRequest(w http.ResponseWriter, req *http.Request) (TimeEntry, bool) {
+	var input struct {
+		TaskID    primitive.ObjectID  `json:"task_id"`
+		UserID    *primitive.ObjectID `json:"user_id"`
+		StartedAt *time.Time          `json:"started_at"`
+		EndedAt   *time.Time          `json:"ended_at"`
+		Hours     *float64            `json:"hours"`
+		Note      string              `json:"note"`
+		Billable  *bool               `json:"billable"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return TimeEntry{}, false
+	}
+
+	var task Task
+	err := client.Database("taskmanagement").Collection("tasks").FindOne(context.TODO(), bson.M{"_id": input.TaskID}).Decode(&task)
+	if err != nil {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return TimeEntry{}, false
+	}
+
+	entry := TimeEntry{
+		ID:       primitive.NewObjectID(),
+		TaskID:   task.ID,
+		UserID:   task.AssignedTo,
+		Note:     input.Note,
+		Billable: true,
+		EndedAt:  input.EndedAt,
+	}
+	if input.UserID != nil {
+		referenceErrs, err := checkReferences(req.Context(), bson.M{"user_id": *input.UserID})
+		if err != nil {
+			writeReferenceError(w, err)
+			return TimeEntry{}, false
+		}
+		if len(referenceErrs) > 0 {
+			writeValidationError(w, referenceErrs)
+			return TimeEntry{}, false
+		}
+		entry.UserID = *input.UserID
+	}
+	if input.Billable != nil {
+		entry.Billable = *input.Billable
+	}
+	if input.StartedAt != nil {
+		entry.StartedAt = *input.StartedAt
+	}
+	if input.Hours != nil {
+		entry.Hours = *input.Hours
+	}
+	return entry, true
+}
+
+func startTimer(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to start timer")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entry, ok := decodeEntryRequest(w, req)
+	if !ok {
+		return
+	}
+	startEntry(&entry, time.Now().UTC())
+
+	// A user can only run one timer per task at a time
+	_, err := timeEntries().InsertOne(context.TODO(), entry)
+	if mongo.IsDuplicateKeyError(err) {
+		http.Error(w, "Timer already running for this task", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to start timer", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Timer started: %+v", entry)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+func stopTimer(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to stop timer")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entryID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/tasks/time/stop/"):])
+	if err != nil {
+		http.Error(w, "Invalid time entry ID", http.StatusBadRequest)
+		return
+	}
+
+	var entry TimeEntry
+	if err := timeEntries().FindOne(context.TODO(), bson.M{"_id": entryID}).Decode(&entry); err != nil {
+		http.Error(w, "Time entry not found", http.StatusNotFound)
+		return
+	}
+	if !stopEntry(&entry, time.Now().UTC()) {
+		http.Error(w, "Timer already stopped", http.StatusConflict)
+		return
+	}
+
+	result, err := timeEntries().UpdateOne(context.TODO(), bson.M{"_id": entryID, "ended_at": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"ended_at": *entry.EndedAt, "hours": entry.Hours}, "$unset": bson.M{"running": ""}})
+	if err != nil {
+		http.Error(w, "Failed to stop timer", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Timer already stopped", http.StatusConflict)
+		return
+	}
+	if err := syncTaskHours(entry.TaskID); err != nil {
+		log.Printf("Failed to update hours for task %s: %v", entry.TaskID.Hex(), err)
+	}
+
+	log.Printf("Timer stopped: %+v", entry)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+func createTimeEntry(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to create time entry")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entry, ok := decodeEntryRequest(w, req)
+	if !ok {
+		return
+	}
+
+	// Manual entries give either a start and end time or a number of hours
+	switch {
+	case entry.EndedAt != nil:
+		if entry.StartedAt.IsZero() || !entry.EndedAt.After(entry.StartedAt) {
+			http.Error(w, "ended_at must be after started_at", http.StatusBadRequest)
+			return
+		}
+		entry.Hours = entryHours(entry.StartedAt, *entry.EndedAt)
+	case entry.Hours > 0:
+		if entry.StartedAt.IsZero() {
+			entry.StartedAt = time.Now().UTC()
+		}
+		setEntryHours(&entry, entry.Hours)
+	default:
+		http.Error(w, "Either hours or started_at and ended_at are required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := timeEntries().InsertOne(context.TODO(), entry); err != nil {
+		http.Error(w, "Failed to create time entry", http.StatusInternalServerError)
+		return
+	}
+	if err := syncTaskHours(entry.TaskID); err != nil {
+		log.Printf("Failed to update hours for task %s: %v", entry.TaskID.Hex(), err)
+	}
+
+	log.Printf("Time entry created: %+v", entry)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+func listTimeEntries(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to list time entries")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := bson.M{}
+	for _, key := range []string{"task_id", "user_id"} {
+		if param := req.URL.Query().Get(key); param != "" {
+			id, err := primitive.ObjectIDFromHex(param)
+			if err != nil {
+				http.Error(w, "Invalid "+key, http.StatusBadRequest)
+				return
+			}
+			filter[key] = id
+		}
+	}
+	switch req.URL.Query().Get("billed") {
+	case "true":
+		filter["invoice_id"] = bson.M{"$exists": true}
+	case "false":
+		filter["invoice_id"] = bson.M{"$exists": false}
+	}
+
+	cursor, err := timeEntries().Find(context.TODO(), filter)
+	if err != nil {
+		http.Error(w, "Failed to list time entries", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	entries := []TimeEntry{}
+	if err := cursor.All(context.Background(), &entries); err != nil {
+		http.Error(w, "Failed to decode time entries", http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Time entries listed successfully")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// timeTotals answers billing-service's hours report with the hours of finished
+// time entries started from from to to (exclusive), per user (group=user, the
+// default) or task: billable, not billable and, of the billable ones, invoiced.
+func timeTotals(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request for time totals")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	group := query.Get("group")
+	if group == "" {
+		group = "user"
+	}
+	if group != "user" && group != "task" {
+		http.Error(w, "group must be user or task", http.StatusBadRequest)
+		return
+	}
+	match := bson.M{"ended_at": bson.M{"$exists": true}}
+	started := bson.M{}
+	for _, bound := range []struct{ key, op string }{{"from", "$gte"}, {"to", "$lt"}} {
+		if value := query.Get(bound.key); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid "+bound.key, http.StatusBadRequest)
+				return
+			}
+			started[bound.op] = t
+		}
+	}
+	if len(started) > 0 {
+		match["started_at"] = started
+	}
+
+	invoiced := bson.M{"$and": bson.A{"$billable", bson.M{"$ne": bson.A{bson.M{"$ifNull": bson.A{"$invoice_id", nil}}, nil}}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":                "$" + group + "_id",
+			"billable_hours":     bson.M{"$sum": bson.M{"$cond": bson.A{"$billable", "$hours", 0}}},
+			"non_billable_hours": bson.M{"$sum": bson.M{"$cond": bson.A{"$billable", 0, "$hours"}}},
+			"billed_hours":       bson.M{"$sum": bson.M{"$cond": bson.A{invoiced, "$hours", 0}}},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	cursor, err := timeEntries().Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		http.Error(w, "Failed to total time entries", http.StatusInternalServerError)
+		return
+	}
+	totals := []struct {
+		ID               primitive.ObjectID `bson:"_id" json:"id"`
+		BillableHours    float64            `bson:"billable_hours" json:"billable_hours"`
+		NonBillableHours float64            `bson:"non_billable_hours" json:"non_billable_hours"`
+		BilledHours      float64            `bson:"billed_hours" json:"billed_hours"`
+	}{}
+	if err := cursor.All(context.TODO(), &totals); err != nil {
+		http.Error(w, "Failed to decode time totals", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(totals)
+}
+
+func updateTimeEntry(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to update time entry")
+
+	if req.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entryID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/tasks/time/update/"):])
+	if err != nil {
+		http.Error(w, "Invalid time entry ID", http.StatusBadRequest)
+		return
+	}
+
+	var input struct {
+		Note     *string  `json:"note"`
+		Billable *bool    `json:"billable"`
+		Hours    *float64 `json:"hours"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var entry TimeEntry
+	if err := timeEntries().FindOne(context.TODO(), bson.M{"_id": entryID}).Decode(&entry); err != nil {
+		http.Error(w, "Time entry not found", http.StatusNotFound)
+		return
+	}
+	if entry.InvoiceID != nil || entry.InvoiceRequestID != nil {
+		http.Error(w, "Time entry has already been invoiced", http.StatusConflict)
+		return
+	}
+
+	update := bson.M{}
+	if input.Note != nil {
+		update["note"] = *input.Note
+	}
+	if input.Billable != nil {
+		update["billable"] = *input.Billable
+	}
+	if input.Hours != nil {
+		if *input.Hours <= 0 || entry.EndedAt == nil {
+			http.Error(w, "Hours can only be set to a positive value on a stopped entry", http.StatusBadRequest)
+			return
+		}
+		// The end moves with the hours, so the entry's times still add up to them
+		setEntryHours(&entry, *input.Hours)
+		update["hours"], update["ended_at"] = entry.Hours, *entry.EndedAt
+	}
+
+	// Only update unbilled entries so an invoice never changes under us
+	filter := bson.M{"_id": entryID, "invoice_id": bson.M{"$exists": false}, "invoice_request_id": bson.M{"$exists": false}}
+	if _, err := timeEntries().UpdateOne(context.TODO(), filter, bson.M{"$set": update}); err != nil {
+		http.Error(w, "Failed to update time entry", http.StatusInternalServerError)
+		return
+	}
+	if err := syncTaskHours(entry.TaskID); err != nil {
+		log.Printf("Failed to update hours for task %s: %v", entry.TaskID.Hex(), err)
+	}
+
+	log.Printf("Time entry updated successfully: ID %s", entryID.Hex())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func removeTimeEntry(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to remove time entry")
+
+	if req.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entryID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/tasks/time/remove/"):])
+	if err != nil {
+		http.Error(w, "Invalid time entry ID", http.StatusBadRequest)
+		return
+	}
+
+	var entry TimeEntry
+	if err := timeEntries().FindOne(context.TODO(), bson.M{"_id": entryID}).Decode(&entry); err != nil {
+		http.Error(w, "Time entry not found", http.StatusNotFound)
+		return
+	}
+	if entry.InvoiceID != nil || entry.InvoiceRequestID != nil {
+		http.Error(w, "Time entry has already been invoiced", http.StatusConflict)
+		return
+	}
+
+	if _, err := timeEntries().DeleteOne(context.TODO(), bson.M{"_id": entryID, "invoice_id": bson.M{"$exists": false}, "invoice_request_id": bson.M{"$exists": false}}); err != nil {
+		http.Error(w, "Failed to remove time entry", http.StatusInternalServerError)
+		return
+	}
+	if err := syncTaskHours(entry.TaskID); err != nil {
+		log.Printf("Failed to update hours for task %s: %v", entry.TaskID.Hex(), err)
+	}
+
+	log.Printf("Time entry removed successfully: ID %s", entryID.Hex())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recordInvoice adds an invoice to the task's history.
+func recordInvoice(taskID primitive.ObjectID, invoiceID primitive.ObjectID, hours float64) {
+	recordActivity(Activity{
+		TaskID:    taskID,
+		Type:      activityInvoiceIssued,
+		InvoiceID: &invoiceID,
+		Changes:   []FieldChange{{Field: "hours", To: hours}},
+	})
+}
+
+// invoiceTaskNow queues an invoice for the task's unbilled time without changing its
+// status, so long-running work can be invoiced incrementally.
+func invoiceTaskNow(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to invoice task time")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	taskID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/tasks/invoice/"):])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	collection := client.Database("taskmanagement").Collection("tasks")
+	var task Task
+	if err := collection.FindOne(context.TODO(), bson.M{"_id": taskID}).Decode(&task); err != nil {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	var request *InvoiceRequest
+	err = withTransaction(func(ctx mongo.SessionContext) error {
+		var err error
+		request, err = enqueueInvoice(ctx, task, eventInvoiceRequested)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to queue invoice: %v", err)
+		http.Error(w, "Failed to create invoice", http.StatusInternalServerError)
+		return
+	}
+	if request == nil {
+		http.Error(w, "No unbilled billable time", http.StatusConflict)
+		return
+	}
+
+	wakeInvoiceRelay()
+	log.Printf("Invoice for task %s queued: %s", taskID.Hex(), request.IdempotencyKey)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(request)
+}
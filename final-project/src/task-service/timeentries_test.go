@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTimer(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	entry := TimeEntry{ID: primitive.NewObjectID(), Hours: 3}
+	stopped := start.Add(-time.Hour)
+	entry.EndedAt = &stopped
+
+	startEntry(&entry, start)
+	if entry.StartedAt != start || entry.EndedAt != nil || entry.Hours != 0 || !entry.Running {
+		t.Fatalf("Want a running timer from %v, Got %+v", start, entry)
+	}
+	if !stopEntry(&entry, start.Add(90*time.Minute+20*time.Second)) {
+		t.Fatal("Want the running timer stopped")
+	}
+	if entry.EndedAt == nil || entry.Hours != 1.5 || entry.Running {
+		t.Errorf("Want 1.5 hours, Got %+v", entry)
+	}
+	if stopEntry(&entry, start.Add(3*time.Hour)) || entry.Hours != 1.5 {
+		t.Errorf("A stopped timer should not stop again, Got %+v", entry)
+	}
+}
+
+func TestSetEntryHours(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	ended := start.Add(time.Hour)
+	entry := TimeEntry{StartedAt: start, EndedAt: &ended, Hours: 1}
+
+	setEntryHours(&entry, 2.25)
+	if entry.Hours != 2.25 || entry.EndedAt == nil || !entry.EndedAt.Equal(start.Add(135*time.Minute)) {
+		t.Errorf("Want 2.25 hours ending at 11:15, Got %+v", entry)
+	}
+	if got := entryHours(entry.StartedAt, *entry.EndedAt); got != entry.Hours {
+		t.Errorf("Times should add up to the hours: Want %v, Got %v", entry.Hours, got)
+	}
+}
+
+func TestEntryHours(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		d    time.Duration
+		want float64
+	}{
+		{0, 0},
+		{29 * time.Second, 0},
+		{30 * time.Second, 1.0 / 60},
+		{45 * time.Minute, 0.75},
+		{2*time.Hour + 15*time.Minute + 10*time.Second, 2.25},
+	}
+	for _, tt := range tests {
+		if got := entryHours(start, start.Add(tt.d)); got != tt.want {
+			t.Errorf("%v: Want %v hours, Got %v", tt.d, tt.want, got)
+		}
+	}
+}
+
+func TestPendingWork(t *testing.T) {
+	ended := time.Date(2024, 3, 1, 17, 0, 0, 0, time.UTC)
+	invoiceID, requestID := primitive.NewObjectID(), primitive.NewObjectID()
+	entry := func(hours float64, change func(*TimeEntry)) TimeEntry {
+		e := TimeEntry{ID: primitive.NewObjectID(), Hours: hours, Billable: true, EndedAt: &ended}
+		if change != nil {
+			change(&e)
+		}
+		return e
+	}
+	first, second := entry(2, nil), entry(1.5, nil)
+	running := entry(0, func(e *TimeEntry) { e.EndedAt = nil })
+	unbillable := entry(4, func(e *TimeEntry) { e.Billable = false })
+	billed := entry(3, func(e *TimeEntry) { e.InvoiceID = &invoiceID })
+	queued := entry(1, func(e *TimeEntry) { e.InvoiceRequestID = &requestID })
+	task := Task{ID: primitive.NewObjectID(), Hours: 5}
+
+	tests := []struct {
+		name        string
+		task        Task
+		entries     []TimeEntry
+		hoursQueued bool
+		hours       float64
+		ids         []primitive.ObjectID
+	}{
+		{"finished billable entries", task, []TimeEntry{first, second, running, unbillable}, false, 3.5, []primitive.ObjectID{first.ID, second.ID}},
+		{"only entries since the last invoice", task, []TimeEntry{billed, queued, second}, false, 1.5, []primitive.ObjectID{second.ID}},
+		{"nothing new since the last invoice", task, []TimeEntry{billed, queued, running}, false, 0, nil},
+		{"task hours without entries", task, nil, false, 5, nil},
+		{"task hours queued already", task, nil, true, 0, nil},
+		{"task hours billed already", Task{ID: task.ID, Hours: 5, InvoiceID: invoiceID}, nil, false, 0, nil},
+		{"entries win over task hours", task, []TimeEntry{running}, false, 0, nil},
+		{"no hours", Task{ID: task.ID}, nil, false, 0, nil},
+	}
+	for _, tt := range tests {
+		hours, ids := pendingWork(tt.task, tt.entries, tt.hoursQueued)
+		if hours != tt.hours || len(ids) != len(tt.ids) {
+			t.Errorf("%s: Want %v hours from %v, Got %v from %v", tt.name, tt.hours, tt.ids, hours, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.ids[i] {
+				t.Errorf("%s: Want entries %v, Got %v", tt.name, tt.ids, ids)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxWorkloadDays limits the range of one workload request.
+const maxWorkloadDays = 92
+
+// WorkloadDay is the work scheduled for a user on one day.
+type WorkloadDay struct {
+	Date         string               `json:"date"`
+	Hours        float64              `json:"hours"`
+	OverCapacity bool                 `json:"over_capacity"`
+	Tasks        []primitive.ObjectID `json:"tasks"`
+}
+
+// UserWorkload is a user's scheduled work, with an entry for every day of the range.
+type UserWorkload struct {
+	UserID     primitive.ObjectID `json:"user_id"`
+	TotalHours float64            `json:"total_hours"`
+	Days       []WorkloadDay      `json:"days"`
+}
+
+// dailyCapacity is the number of hours a user can work in a day, read from
+// WORKLOAD_DAILY_HOURS (default 8).
+func dailyCapacity() float64 {
+	capacity, err := strconv.ParseFloat(os.Getenv("WORKLOAD_DAILY_HOURS"), 64)
+	if err != nil || capacity <= 0 {
+		return 8
+	}
+	return capacity
+}
+
+// scheduledHours spreads a task's hours over the UTC days it spans, in proportion
+// to how much of its time falls on each day, and returns those within [from, to)
+// keyed by the start of the day. A task without duration counts on its start day.
+func scheduledHours(task Task, from, to time.Time) map[time.Time]float64 {
+	hours := map[time.Time]float64{}
+	start, end := task.StartDate.UTC(), task.EndDate.UTC()
+	if !end.After(start) {
+		day := start.Truncate(24 * time.Hour)
+		if !day.Before(from) && day.Before(to) {
+			hours[day] = task.Hours
+		}
+		return hours
+	}
+
+	duration := end.Sub(start)
+	for day := start.Truncate(24 * time.Hour); day.Before(end) && day.Before(to); day = day.Add(24 * time.Hour) {
+		if day.Before(from) {
+			continue
+		}
+		overlapStart, overlapEnd := day, day.Add(24*time.Hour)
+		if start.After(overlapStart) {
+			overlapStart = start
+		}
+		if end.Before(overlapEnd) {
+			overlapEnd = end
+		}
+		hours[day] = task.Hours * float64(overlapEnd.Sub(overlapStart)) / float64(duration)
+	}
+	return hours
+}
+
+// buildWorkload adds up the scheduled hours of each assignee's tasks per day in
+// [from, to), both at midnight UTC. Users are ordered by ID.
+func buildWorkload(tasks []Task, from, to time.Time, capacity float64) []UserWorkload {
+	byUser := map[primitive.ObjectID]map[time.Time]*WorkloadDay{}
+	for _, task := range tasks {
+		if task.AssignedTo.IsZero() || task.StartDate.IsZero() {
+			continue
+		}
+		days := byUser[task.AssignedTo]
+		if days == nil {
+			days = map[time.Time]*WorkloadDay{}
+			byUser[task.AssignedTo] = days
+		}
+		for day, hours := range scheduledHours(task, from, to) {
+			if days[day] == nil {
+				days[day] = &WorkloadDay{}
+			}
+			days[day].Hours += hours
+			days[day].Tasks = append(days[day].Tasks, task.ID)
+		}
+	}
+
+	workloads := make([]UserWorkload, 0, len(byUser))
+	for userID, days := range byUser {
+		workload := UserWorkload{UserID: userID}
+		for day := from; day.Before(to); day = day.Add(24 * time.Hour) {
+			entry := WorkloadDay{Tasks: []primitive.ObjectID{}}
+			if days[day] != nil {
+				entry = *days[day]
+			}
+			entry.Date = day.Format("2006-01-02")
+			entry.Hours = roundHours(entry.Hours)
+			entry.OverCapacity = entry.Hours > capacity
+			workload.TotalHours += entry.Hours
+			workload.Days = append(workload.Days, entry)
+		}
+		workload.TotalHours = roundHours(workload.TotalHours)
+		workloads = append(workloads, workload)
+	}
+	sort.Slice(workloads, func(i, j int) bool {
+		return workloads[i].UserID.Hex() < workloads[j].UserID.Hex()
+	})
+	return workloads
+}
+
+// roundHours rounds hours to two decimals, so that spreading doesn't show as 2.9999999.
+func roundHours(hours float64) float64 {
+	return float64(int64(hours*100+0.5)) / 100
+}
+
+func getWorkload(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to get workload")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, validationErrs, err := taskFilterFromQuery(req)
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+
+	// The range defaults to two weeks from today; to is inclusive
+	query := req.URL.Query()
+	from := time.Now().UTC().Truncate(24 * time.Hour)
+	if value := query.Get("from"); value != "" {
+		if from, err = time.Parse("2006-01-02", value); err != nil {
+			validationErrs = append(validationErrs, FieldError{Field: "from", Code: "invalid_value", Message: "must be a date (YYYY-MM-DD)"})
+		}
+	}
+	to := from.Add(14 * 24 * time.Hour)
+	if value := query.Get("to"); value != "" {
+		last, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			validationErrs = append(validationErrs, FieldError{Field: "to", Code: "invalid_value", Message: "must be a date (YYYY-MM-DD)"})
+		}
+		to = last.Add(24 * time.Hour)
+	}
+	if days := to.Sub(from).Hours() / 24; len(validationErrs) == 0 && (days < 1 || days > maxWorkloadDays) {
+		validationErrs = append(validationErrs, FieldError{Field: "to", Code: "invalid_value", Message: "must be on or after from and at most " + strconv.Itoa(maxWorkloadDays) + " days later"})
+	}
+	if assignedTo := query.Get("assigned_to"); assignedTo != "" {
+		objectID, err := primitive.ObjectIDFromHex(assignedTo)
+		if err != nil {
+			validationErrs = append(validationErrs, FieldError{Field: "assigned_to", Code: "invalid_value", Message: "must be a valid user ID"})
+		}
+		filter["assigned_to"] = objectID
+	} else {
+		filter["assigned_to"] = bson.M{"$ne": primitive.NilObjectID}
+	}
+	if len(validationErrs) > 0 {
+		writeValidationError(w, validationErrs)
+		return
+	}
+
+	// Finished work no longer takes anyone's time unless asked for
+	if query.Get("include_done") != "true" {
+		filter["status"] = bson.M{"$ne": "done"}
+	}
+	filter["start_date"] = bson.M{"$lt": to}
+	filter["$or"] = bson.A{bson.M{"end_date": bson.M{"$gte": from}}, bson.M{"start_date": bson.M{"$gte": from}}}
+
+	cursor, err := client.Database("taskmanagement").Collection("tasks").Find(context.TODO(), filter)
+	if err != nil {
+		http.Error(w, "Failed to list tasks", http.StatusInternalServerError)
+		return
+	}
+	var tasks []Task
+	if err := cursor.All(context.TODO(), &tasks); err != nil {
+		http.Error(w, "Failed to decode tasks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		From          string         `json:"from"`
+		To            string         `json:"to"`
+		DailyCapacity float64        `json:"daily_capacity"`
+		Users         []UserWorkload `json:"users"`
+	}{
+		From:          from.Format("2006-01-02"),
+		To:            to.Add(-24 * time.Hour).Format("2006-01-02"),
+		DailyCapacity: dailyCapacity(),
+		Users:         buildWorkload(tasks, from, to, dailyCapacity()),
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestScheduledHours(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+
+	// 12 hours of work from noon on the 4th to noon on the 7th: 2 + 4 + 4 + 2
+	task := Task{Hours: 12, StartDate: day(4).Add(12 * time.Hour), EndDate: day(7).Add(12 * time.Hour)}
+	hours := scheduledHours(task, day(1), day(10))
+	want := map[time.Time]float64{day(4): 2, day(5): 4, day(6): 4, day(7): 2}
+	if len(hours) != len(want) {
+		t.Errorf("Want %d days, Got %v", len(want), hours)
+	}
+	for d, h := range want {
+		if hours[d] != h {
+			t.Errorf("%s: Want %g hours, Got %g", d.Format("2006-01-02"), h, hours[d])
+		}
+	}
+
+	// Only days in range are returned
+	if hours := scheduledHours(task, day(5), day(6)); len(hours) != 1 || hours[day(5)] != 4 {
+		t.Errorf("Clipped range: Want 4 hours on the 5th, Got %v", hours)
+	}
+
+	// A task without duration counts on its start day
+	instant := Task{Hours: 3, StartDate: day(4).Add(9 * time.Hour), EndDate: day(4).Add(9 * time.Hour)}
+	if hours := scheduledHours(instant, day(1), day(10)); hours[day(4)] != 3 {
+		t.Errorf("Zero duration: Want 3 hours on the 4th, Got %v", hours)
+	}
+}
+
+func TestBuildWorkload(t *testing.T) {
+	from := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	user := primitive.NewObjectID()
+	tasks := []Task{
+		{ID: primitive.NewObjectID(), AssignedTo: user, Hours: 6, StartDate: from, EndDate: from.Add(24 * time.Hour)},
+		{ID: primitive.NewObjectID(), AssignedTo: user, Hours: 4, StartDate: from, EndDate: from.Add(24 * time.Hour)},
+		{ID: primitive.NewObjectID(), Hours: 5, StartDate: from, EndDate: from.Add(24 * time.Hour)},
+	}
+
+	workloads := buildWorkload(tasks, from, from.Add(3*24*time.Hour), 8)
+	if len(workloads) != 1 || workloads[0].UserID != user {
+		t.Fatalf("Want the workload of one user, Got %+v", workloads)
+	}
+	days := workloads[0].Days
+	if len(days) != 3 || days[0].Date != "2024-03-04" {
+		t.Fatalf("Want 3 days from 2024-03-04, Got %+v", days)
+	}
+	if days[0].Hours != 10 || !days[0].OverCapacity || len(days[0].Tasks) != 2 {
+		t.Errorf("First day: Want 10 hours over capacity from 2 tasks, Got %+v", days[0])
+	}
+	if days[1].Hours != 0 || days[1].OverCapacity || days[1].Tasks == nil {
+		t.Errorf("Free day: Want 0 hours and no tasks, Got %+v", days[1])
+	}
+	if workloads[0].TotalHours != 10 {
+		t.Errorf("Total: Want 10 hours, Got %g", workloads[0].TotalHours)
+	}
+}
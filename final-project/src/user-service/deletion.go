@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// What happens to a deleted user's tasks.
+const (
+	taskPolicyReassign  = "reassign"
+	taskPolicyAnonymize = "anonymize"
+	taskPolicyDelete    = "delete"
+)
+
+// Deletion states. A scheduled deletion can be restored until its grace period
+// ends; after that it is purged and completes once every service has reported.
+const (
+	deletionScheduled = "scheduled"
+	deletionRestored  = "restored"
+	deletionPurging   = "purging"
+	deletionCompleted = "completed"
+)
+
+// purgingServices are the services that report what they changed for a deletion.
+var purgingServices = []string{"user-service", "task-service", "billing-service"}
+
+// ServiceReport is what one service changed for a deletion, as counts per kind of change.
+type ServiceReport struct {
+	Service    string           `bson:"service" json:"service"`
+	Changes    map[string]int64 `bson:"changes" json:"changes"`
+	ReportedAt time.Time        `bson:"reported_at" json:"reported_at"`
+}
+
+// UserDeletion tracks the deletion of a user from the request to the reports of
+// every service. It is kept after the user is gone as the record of what was done.
+type UserDeletion struct {
+	ID          primitive.ObjectID  `bson:"_id" json:"id"`
+	UserID      primitive.ObjectID  `bson:"user_id" json:"user_id"`
+	TaskPolicy  string              `bson:"task_policy" json:"task_policy"`
+	ReassignTo  *primitive.ObjectID `bson:"reassign_to,omitempty" json:"reassign_to,omitempty"`
+	RequestedBy string              `bson:"requested_by" json:"requested_by"`
+	RequestedAt time.Time           `bson:"requested_at" json:"requested_at"`
+	PurgeAt     time.Time           `bson:"purge_at" json:"purge_at"`
+	Status      string              `bson:"status" json:"status"`
+	Reports     []ServiceReport     `bson:"reports" json:"reports"`
+	Announced   bool                `bson:"announced,omitempty" json:"announced,omitempty"`
+	ClaimedAt   *time.Time          `bson:"claimed_at,omitempty" json:"claimed_at,omitempty"`
+	CompletedAt *time.Time          `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+}
+
+func deletions() *mongo.Collection {
+	return client.Database("user").Collection("deletions")
+}
+
+// deletionGrace is how long a deleted user can be restored, from USER_DELETION_GRACE (default 720h).
+func deletionGrace() time.Duration {
+	grace, err := time.ParseDuration(os.Getenv("USER_DELETION_GRACE"))
+	if err != nil || grace < 0 {
+		grace = 30 * 24 * time.Hour
+	}
+	return grace
+}
+
+// purgeLease is how long a purge may take before a deletion left purging, by
+// a purger that stopped halfway, is purged again.
+const purgeLease = 10 * time.Minute
+
+// newDeletion is the deletion of userID that query asks for, with a grace
+// period from now, or what is wrong with the query.
+func newDeletion(userID primitive.ObjectID, query url.Values, requestedBy string, now time.Time, grace time.Duration) (UserDeletion, string) {
+	deletion := UserDeletion{
+		ID:          primitive.NewObjectID(),
+		UserID:      userID,
+		TaskPolicy:  query.Get("tasks"),
+		RequestedBy: requestedBy,
+		RequestedAt: now,
+		PurgeAt:     now.Add(grace),
+		Status:      deletionScheduled,
+		Reports:     []ServiceReport{},
+	}
+	switch deletion.TaskPolicy {
+	case "":
+		deletion.TaskPolicy = taskPolicyAnonymize
+	case taskPolicyAnonymize, taskPolicyDelete:
+	case taskPolicyReassign:
+		reassignTo, err := primitive.ObjectIDFromHex(query.Get("reassign_to"))
+		if err != nil || reassignTo == userID {
+			return deletion, "reassign_to must be another user's ID"
+		}
+		deletion.ReassignTo = &reassignTo
+	default:
+		return deletion, "tasks must be reassign, anonymize or delete"
+	}
+	if query.Get("immediate") == "true" {
+		deletion.PurgeAt = now
+	}
+	return deletion, ""
+}
+
+// restorable reports whether the deletion can still be cancelled at now: it is
+// in its grace period and the other services haven't been told about it.
+// restoreUser's filter is the same rule.
+func restorable(deletion UserDeletion, now time.Time) bool {
+	return deletion.Status == deletionScheduled && !deletion.Announced && now.Before(deletion.PurgeAt)
+}
+
+// purgeDue reports whether the purger should purge the deletion at now: its
+// grace period is over, or a purge of it stopped before user-service had done
+// its part. dueDeletionFilter is the same rule.
+func purgeDue(deletion UserDeletion, now time.Time) bool {
+	switch deletion.Status {
+	case deletionScheduled:
+		return !deletion.PurgeAt.After(now)
+	case deletionPurging:
+		// Deletions claimed before claims were timed have no lease to wait out
+		return !hasReport(deletion.Reports, "user-service") && (deletion.ClaimedAt == nil || !deletion.ClaimedAt.After(now.Add(-purgeLease)))
+	}
+	return false
+}
+
+func dueDeletionFilter(now time.Time) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"status": deletionScheduled, "purge_at": bson.M{"$lte": now}},
+		bson.M{"status": deletionPurging, "reports.service": bson.M{"$ne": "user-service"}, "$or": bson.A{
+			bson.M{"claimed_at": bson.M{"$lte": now.Add(-purgeLease)}},
+			bson.M{"claimed_at": bson.M{"$exists": false}},
+		}},
+	}}
+}
+
+func hasReport(reports []ServiceReport, service string) bool {
+	for _, report := range reports {
+		if report.Service == service {
+			return true
+		}
+	}
+	return false
+}
+
+// removeUser schedules the user's deletion. The user can no longer log in and is
+// purged from every service once the grace period is over, unless restored first.
+// ?tasks= chooses what happens to their tasks (reassign with ?reassign_to=,
+// anonymize or delete; anonymize by default) and ?immediate=true skips the grace period.
+func removeUser(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to remove user")
+
+	if req.Method != http.MethodDelete {
+		log.Println("Invalid request method")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := req.URL.Path[len("/users/remove/"):]
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		log.Printf("Invalid user ID: %v", err)
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	collection := client.Database("user").Collection("users")
+	requestedBy, _ := req.Context().Value("userID").(string)
+	deletion, problem := newDeletion(objectID, req.URL.Query(), requestedBy, time.Now().UTC(), deletionGrace())
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+	if deletion.ReassignTo != nil {
+		count, err := collection.CountDocuments(context.TODO(), bson.M{"_id": *deletion.ReassignTo, "deleted_at": bson.M{"$exists": false}})
+		if err != nil || count == 0 {
+			http.Error(w, "User to reassign tasks to not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("Scheduling removal of user with ID: %s", userID)
+
+	// Marking the user deleted is the claim; a user already being deleted doesn't match
+	filter := bson.M{"_id": objectID, "deleted_at": bson.M{"$exists": false}}
+	result, err := collection.UpdateOne(context.TODO(), filter, bson.M{"$set": bson.M{"deleted_at": deletion.RequestedAt}})
+	if err != nil {
+		log.Printf("Failed to remove user: %v", err)
+		http.Error(w, "Failed to remove user", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		if count, _ := collection.CountDocuments(context.TODO(), bson.M{"_id": objectID}); count > 0 {
+			http.Error(w, "User is already being deleted", http.StatusConflict)
+			return
+		}
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := deletions().InsertOne(context.TODO(), deletion); err != nil {
+		log.Printf("Failed to record deletion of user %s: %v", userID, err)
+		collection.UpdateOne(context.TODO(), bson.M{"_id": objectID}, bson.M{"$unset": bson.M{"deleted_at": ""}})
+		http.Error(w, "Failed to remove user", http.StatusInternalServerError)
+		return
+	}
+	if !deletion.PurgeAt.After(deletion.RequestedAt) {
+		go purgeDueDeletions()
+	}
+
+	log.Printf("User %s scheduled for removal at %s", userID, deletion.PurgeAt)
+	w.Header().Set("Location", "/users/deletions?user_id="+userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreUser cancels a scheduled deletion during its grace period.
+func restoreUser(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to restore user")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/users/restore/"):])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	// Only a deletion in its grace period that the other services haven't been
+	// told about can be cancelled, as restorable says
+	filter := bson.M{"user_id": objectID, "status": deletionScheduled, "announced": bson.M{"$ne": true}, "purge_at": bson.M{"$gt": time.Now().UTC()}}
+	result, err := deletions().UpdateOne(context.TODO(), filter, bson.M{"$set": bson.M{"status": deletionRestored}})
+	if err != nil {
+		http.Error(w, "Failed to restore user", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "No deletion to restore for this user", http.StatusConflict)
+		return
+	}
+
+	_, err = client.Database("user").Collection("users").UpdateOne(context.TODO(), bson.M{"_id": objectID}, bson.M{"$unset": bson.M{"deleted_at": ""}})
+	if err != nil {
+		http.Error(w, "Failed to restore user", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User restored successfully: %s", objectID.Hex())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listDeletions returns deletions with their reports, newest first, optionally
+// for one user_id or status.
+func listDeletions(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to list user deletions")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := bson.M{}
+	if status := req.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+	if param := req.URL.Query().Get("user_id"); param != "" {
+		userID, err := primitive.ObjectIDFromHex(param)
+		if err != nil {
+			http.Error(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+		filter["user_id"] = userID
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "requested_at", Value: -1}})
+	cursor, err := deletions().Find(context.TODO(), filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to list deletions", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	result := []UserDeletion{}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		http.Error(w, "Failed to decode deletions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// runDeletionPurger purges users whose grace period is over on startup and then
+// every USER_PURGE_INTERVAL (default 1h).
+func runDeletionPurger() {
+	interval, err := time.ParseDuration(os.Getenv("USER_PURGE_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = time.Hour
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purgeDueDeletions()
+		<-ticker.C
+	}
+}
+
+// purgeDueDeletions announces every due deletion to the other services and removes
+// the user. A deletion whose announcement fails is left scheduled and retried, and
+// one a purger claimed but never finished is purged again once its lease is over.
+func purgeDueDeletions() {
+	for {
+		var deletion UserDeletion
+		now := time.Now().UTC()
+		update := bson.M{"$set": bson.M{"status": deletionPurging, "claimed_at": now}}
+		err := deletions().FindOneAndUpdate(context.TODO(), dueDeletionFilter(now), update).Decode(&deletion)
+		if err == mongo.ErrNoDocuments {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to claim due deletions: %v", err)
+			return
+		}
+
+		event, err := newEvent(deletion.ID.Hex(), eventUserDeleted, UserDeletedEvent{
+			UserID:     deletion.UserID,
+			DeletionID: deletion.ID,
+			TaskPolicy: deletion.TaskPolicy,
+			ReassignTo: deletion.ReassignTo,
+		})
+		if err == nil {
+			err = bus.Publish(context.TODO(), event)
+		}
+		if err != nil {
+			log.Printf("Failed to announce deletion of user %s, will retry: %v", deletion.UserID.Hex(), err)
+			deletions().UpdateOne(context.TODO(), bson.M{"_id": deletion.ID}, bson.M{"$set": bson.M{"status": deletionScheduled}})
+			return
+		}
+
+		result, err := client.Database("user").Collection("users").DeleteOne(context.TODO(), bson.M{"_id": deletion.UserID})
+		if err != nil {
+			// The services handle the announcement idempotently, so the whole purge is simply retried
+			log.Printf("Failed to remove user %s, will retry: %v", deletion.UserID.Hex(), err)
+			deletions().UpdateOne(context.TODO(), bson.M{"_id": deletion.ID}, bson.M{"$set": bson.M{"status": deletionScheduled, "announced": true}})
+			return
+		}
+		err = addDeletionReport(context.TODO(), deletion.ID, ServiceReport{
+			Service: "user-service",
+			Changes: map[string]int64{"users_deleted": result.DeletedCount},
+		})
+		if err != nil {
+			log.Printf("Failed to record the user-service report for deletion %s: %v", deletion.ID.Hex(), err)
+		}
+		log.Printf("User removed successfully: %s", deletion.UserID.Hex())
+	}
+}
+
+// handleUserDataPurged records another service's report on a deletion.
+func handleUserDataPurged(ctx context.Context, event Event) error {
+	var purged UserDataPurgedEvent
+	if err := json.Unmarshal(event.Data, &purged); err != nil {
+		log.Printf("Ignoring malformed %s event %s: %v", event.Type, event.ID, err)
+		return nil
+	}
+	return addDeletionReport(ctx, purged.DeletionID, ServiceReport{Service: purged.Service, Changes: purged.Changes})
+}
+
+// addDeletionReport adds a service's report to the deletion, once per service, and
+// completes the deletion when every service has reported.
+func addDeletionReport(ctx context.Context, deletionID primitive.ObjectID, report ServiceReport) error {
+	report.ReportedAt = time.Now().UTC()
+	filter := bson.M{"_id": deletionID, "reports.service": bson.M{"$ne": report.Service}}
+	if _, err := deletions().UpdateOne(ctx, filter, bson.M{"$push": bson.M{"reports": report}}); err != nil {
+		return err
+	}
+
+	complete := bson.M{"_id": deletionID, "status": deletionPurging, "reports.service": bson.M{"$all": purgingServices}}
+	_, err := deletions().UpdateOne(ctx, complete, bson.M{"$set": bson.M{"status": deletionCompleted, "completed_at": time.Now().UTC()}})
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewDeletion(t *testing.T) {
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	grace := 720 * time.Hour
+	userID := primitive.NewObjectID()
+	otherID := primitive.NewObjectID()
+
+	tests := []struct {
+		name       string
+		query      url.Values
+		wantPolicy string
+		wantPurge  time.Time
+		wantFailed bool
+	}{
+		{"default policy", url.Values{}, taskPolicyAnonymize, now.Add(grace), false},
+		{"delete", url.Values{"tasks": {"delete"}}, taskPolicyDelete, now.Add(grace), false},
+		{"reassign", url.Values{"tasks": {"reassign"}, "reassign_to": {otherID.Hex()}}, taskPolicyReassign, now.Add(grace), false},
+		{"immediate", url.Values{"immediate": {"true"}}, taskPolicyAnonymize, now, false},
+		{"reassign to nobody", url.Values{"tasks": {"reassign"}}, "", time.Time{}, true},
+		{"reassign to the user", url.Values{"tasks": {"reassign"}, "reassign_to": {userID.Hex()}}, "", time.Time{}, true},
+		{"unknown policy", url.Values{"tasks": {"archive"}}, "", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		deletion, problem := newDeletion(userID, tt.query, "admin", now, grace)
+		if tt.wantFailed {
+			if problem == "" {
+				t.Errorf("%s: Want a problem, Got none", tt.name)
+			}
+			continue
+		}
+		if problem != "" {
+			t.Errorf("%s: Want no problem, Got %q", tt.name, problem)
+			continue
+		}
+		if deletion.TaskPolicy != tt.wantPolicy {
+			t.Errorf("%s: Want policy %s, Got %s", tt.name, tt.wantPolicy, deletion.TaskPolicy)
+		}
+		if !deletion.PurgeAt.Equal(tt.wantPurge) {
+			t.Errorf("%s: Want purge at %s, Got %s", tt.name, tt.wantPurge, deletion.PurgeAt)
+		}
+		if deletion.Status != deletionScheduled || deletion.UserID != userID {
+			t.Errorf("%s: Want a scheduled deletion of %s, Got %s of %s", tt.name, userID.Hex(), deletion.Status, deletion.UserID.Hex())
+		}
+	}
+}
+
+func TestRestorable(t *testing.T) {
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		deletion UserDeletion
+		want     bool
+	}{
+		{"in grace period", UserDeletion{Status: deletionScheduled, PurgeAt: now.Add(time.Hour)}, true},
+		{"grace period over", UserDeletion{Status: deletionScheduled, PurgeAt: now}, false},
+		{"announced", UserDeletion{Status: deletionScheduled, PurgeAt: now.Add(time.Hour), Announced: true}, false},
+		{"purging", UserDeletion{Status: deletionPurging, PurgeAt: now.Add(time.Hour)}, false},
+		{"restored", UserDeletion{Status: deletionRestored, PurgeAt: now.Add(time.Hour)}, false},
+	}
+
+	for _, tt := range tests {
+		if got := restorable(tt.deletion, now); got != tt.want {
+			t.Errorf("%s: Want %v, Got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestPurgeDue(t *testing.T) {
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	claimedRecently := now.Add(-time.Minute)
+	claimedLongAgo := now.Add(-purgeLease)
+	userServiceDone := []ServiceReport{{Service: "user-service"}}
+	othersDone := []ServiceReport{{Service: "task-service"}, {Service: "billing-service"}}
+
+	tests := []struct {
+		name     string
+		deletion UserDeletion
+		want     bool
+	}{
+		{"in grace period", UserDeletion{Status: deletionScheduled, PurgeAt: now.Add(time.Hour)}, false},
+		{"grace period over", UserDeletion{Status: deletionScheduled, PurgeAt: now}, true},
+		{"retried announcement", UserDeletion{Status: deletionScheduled, PurgeAt: now.Add(-time.Hour), Announced: true}, true},
+		{"purge in progress", UserDeletion{Status: deletionPurging, ClaimedAt: &claimedRecently}, false},
+		{"purge stuck", UserDeletion{Status: deletionPurging, ClaimedAt: &claimedLongAgo, Reports: othersDone}, true},
+		{"purge done here", UserDeletion{Status: deletionPurging, ClaimedAt: &claimedLongAgo, Reports: userServiceDone}, false},
+		{"purge claimed before leases", UserDeletion{Status: deletionPurging}, true},
+		{"restored", UserDeletion{Status: deletionRestored, PurgeAt: now.Add(-time.Hour)}, false},
+		{"completed", UserDeletion{Status: deletionCompleted, PurgeAt: now.Add(-time.Hour)}, false},
+	}
+
+	for _, tt := range tests {
+		if got := purgeDue(tt.deletion, now); got != tt.want {
+			t.Errorf("%s: Want %v, Got %v", tt.name, tt.want, got)
+		}
+	}
+}
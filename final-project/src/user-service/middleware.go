@@ -101,7 +101,20 @@ func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
     }
 }
 
+// internalServiceMiddleware only lets other services through, e.g. for lookups
+// that would otherwise let anyone probe which user IDs exist.
+func internalServiceMiddleware(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        internalToken := req.Header.Get("X-Internal-Service")
+        expectedToken := "your-internal-service-secret" // You should store and retrieve this securely
 
+        if internalToken != expectedToken {
+            http.Error(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+        next(w, req)
+    }
+}
 
 func isAdmin(req *http.Request) bool {
     role := req.Context().Value("role")
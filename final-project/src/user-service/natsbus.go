@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// All services share one JetStream stream; each event type is its own subject.
+const (
+	eventStream        = "EVENTS"
+	eventSubjectPrefix = "events."
+	eventRetryDelay    = 5 * time.Second
+)
+
+// NATSBus publishes events to a NATS JetStream stream, which keeps them until
+// every subscribing service has processed them. Each service subscribes through
+// a durable consumer per event type shared by all its instances, so an event is
+// handled once per service even across restarts.
+type NATSBus struct {
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+	service string
+}
+
+func NewNATSBus(url, service string) (*NATSBus, error) {
+	conn, err := nats.Connect(url, nats.Name(service), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true))
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_, err = js.StreamInfo(eventStream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     eventStream,
+			Subjects: []string{eventSubjectPrefix + ">"},
+			Storage:  nats.FileStorage,
+			MaxAge:   7 * 24 * time.Hour,
+		})
+	}
+	if err != nil && !errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		conn.Close()
+		return nil, err
+	}
+	return &NATSBus{conn: conn, js: js, service: service}, nil
+}
+
+// Publish stores the event in the stream. JetStream drops an event whose ID it
+// has seen in the last two minutes, so republishing after a lost reply is safe.
+func (b *NATSBus) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = b.js.Publish(eventSubjectPrefix+event.Type, data, nats.MsgId(event.ID), nats.Context(ctx))
+	return err
+}
+
+// Subscribe delivers every event of the type, including ones published before
+// this service first subscribed. Events the handler fails on are redelivered.
+func (b *NATSBus) Subscribe(eventType string, handler EventHandler) error {
+	durable := b.service + "-" + eventType
+	_, err := b.js.QueueSubscribe(eventSubjectPrefix+eventType, durable, func(msg *nats.Msg) {
+		var event Event
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			log.Printf("Dropping malformed %s event: %v", eventType, err)
+			msg.Term()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := handler(ctx, event); err != nil {
+			log.Printf("Failed to handle %s event %s, will retry: %v", event.Type, event.ID, err)
+			msg.NakWithDelay(eventRetryDelay)
+			return
+		}
+		msg.Ack()
+	}, nats.Durable(durable), nats.ManualAck(), nats.DeliverAll(), nats.AckWait(time.Minute))
+	return err
+}
+
+func (b *NATSBus) Close() error {
+	return b.conn.Drain()
+}
@@ -38,6 +38,19 @@ func main() {
 		log.Fatal(err)
 	}
 
+	bus, err = newEventBus("user-service")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer bus.Close()
+	err = bus.Subscribe(eventUserDataPurged, handleUserDataPurged)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Purge users whose deletion grace period is over
+	go runDeletionPurger()
+
 	// Create a new HTTP server
 	mux := http.NewServeMux()
 
@@ -47,6 +60,9 @@ func main() {
 mux.Handle("/users/get/", authMiddleware(adminMiddleware(http.HandlerFunc(getUser))))
 mux.Handle("/users/update/", authMiddleware(adminMiddleware(http.HandlerFunc(updateUser))))
 mux.Handle("/users/remove/", authMiddleware(adminMiddleware(http.HandlerFunc(removeUser))))
+mux.Handle("/users/restore/", authMiddleware(adminMiddleware(http.HandlerFunc(restoreUser))))
+mux.Handle("/users/deletions", authMiddleware(adminMiddleware(http.HandlerFunc(listDeletions))))
+mux.Handle("/users/lookup/", internalServiceMiddleware(http.HandlerFunc(lookupUser)))
 mux.Handle("/users/delete-all", http.HandlerFunc(deleteAllUsers))
 mux.Handle("/users/login", http.HandlerFunc(loginUser))
 
@@ -114,6 +130,7 @@ type User struct {
 	Email    string             `bson:"email" json:"email"`
 	Password string             `bson:"password" json:"password"`
         Role     string             `bson:"role" json:"role"`
+	DeletedAt *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
 }
 
 func createUser(w http.ResponseWriter, req *http.Request) {
@@ -195,7 +212,7 @@ func loginUser(w http.ResponseWriter, req *http.Request) {
     log.Printf("Login attempt for username: %s", credentials.Username)
 
     collection := client.Database("user").Collection("users")
-    filter := bson.M{"username": credentials.Username, "password": credentials.Password}
+    filter := bson.M{"username": credentials.Username, "password": credentials.Password, "deleted_at": bson.M{"$exists": false}}
 
     var user User
     err = collection.FindOne(context.TODO(), filter).Decode(&user)
@@ -254,8 +271,12 @@ func getUser(w http.ResponseWriter, req *http.Request) {
 
 	log.Printf("Getting user with ID: %s", userID)
 
+	// Like listUsers, users waiting to be purged are only returned on request
 	collection := client.Database("user").Collection("users")
-	filter := bson.M{"_id": objectID}
+	filter := bson.M{"_id": objectID, "deleted_at": bson.M{"$exists": false}}
+	if req.URL.Query().Get("include_deleted") == "true" {
+		filter = bson.M{"_id": objectID}
+	}
 
 	var user User
 	err = collection.FindOne(context.TODO(), filter).Decode(&user)
@@ -271,6 +292,49 @@ func getUser(w http.ResponseWriter, req *http.Request) {
         json.NewEncoder(w).Encode(user)
 }
 
+// lookupUser lets other services check that a user they refer to exists, by ID
+// or, with /users/lookup/?username=, by username. Users waiting out their deletion
+// grace period count as missing.
+func lookupUser(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := bson.M{"deleted_at": bson.M{"$exists": false}}
+	if userID := req.URL.Path[len("/users/lookup/"):]; userID != "" {
+		objectID, err := primitive.ObjectIDFromHex(userID)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		filter["_id"] = objectID
+	} else if username := req.URL.Query().Get("username"); username != "" {
+		filter["username"] = username
+	} else {
+		http.Error(w, "Missing user ID or username", http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	err := client.Database("user").Collection("users").FindOne(context.TODO(), filter).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID       primitive.ObjectID `json:"id"`
+		Username string             `json:"username"`
+		Role     string             `json:"role"`
+	}{user.ID, user.Username, user.Role})
+}
+
 func updateUser(w http.ResponseWriter, req *http.Request) {
 	log.Println("Received request to update user")
 
@@ -317,39 +381,6 @@ func updateUser(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func removeUser(w http.ResponseWriter, req *http.Request) {
-	log.Println("Received request to remove user")
-
-	if req.Method != http.MethodDelete {
-		log.Println("Invalid request method")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	userID := req.URL.Path[len("/users/remove/"):]
-	objectID, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		log.Printf("Invalid user ID: %v", err)
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
-
-	log.Printf("Removing user with ID: %s", userID)
-
-	collection := client.Database("user").Collection("users")
-	filter := bson.M{"_id": objectID}
-
-	_, err = collection.DeleteOne(context.TODO(), filter)
-	if err != nil {
-		log.Printf("Failed to remove user: %v", err)
-		http.Error(w, "Failed to remove user", http.StatusInternalServerError)
-		return
-	}
-
-	log.Printf("User removed successfully: %s", userID)
-	w.WriteHeader(http.StatusNoContent)
-}
-
 func listUsers(w http.ResponseWriter, req *http.Request) {
 	log.Println("Received request to list users")
 
@@ -359,8 +390,14 @@ func listUsers(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Users waiting to be purged are only listed on request
+	filter := bson.M{"deleted_at": bson.M{"$exists": false}}
+	if req.URL.Query().Get("include_deleted") == "true" {
+		filter = bson.M{}
+	}
+
 	collection := client.Database("user").Collection("users")
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	cursor, err := collection.Find(context.TODO(), filter)
 	if err != nil {
 		log.Printf("Failed to list users: %v", err)
 		http.Error(w, "Failed to list users", http.StatusInternalServerError)